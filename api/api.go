@@ -0,0 +1,221 @@
+// Package api serves a local HTTP API to inspect and control a running gg session.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// Controller is the session to control, which is implemented by tracer.Tracer.
+type Controller interface {
+	Proxy() *proxy.Proxy
+	Dialer() *dialer.Dialer
+	SetDialer(d *dialer.Dialer)
+	UDPEnabled() bool
+	SetUDPEnabled(enabled bool)
+}
+
+// DialerCreator creates the dialer from a share-link to switch to.
+type DialerCreator func(link string) (*dialer.Dialer, error)
+
+type Node struct {
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"`
+	SupportUDP bool   `json:"support_udp"`
+}
+
+type SwitchNodeRequest struct {
+	Link string `json:"link"`
+}
+
+type UDP struct {
+	Enabled bool `json:"enabled"`
+}
+
+type Error struct {
+	Error string `json:"error"`
+}
+
+type Server struct {
+	controller Controller
+	newDialer  DialerCreator
+	log        *logrus.Logger
+	server     *http.Server
+}
+
+func New(controller Controller, newDialer DialerCreator, log *logrus.Logger) *Server {
+	s := &Server{
+		controller: controller,
+		newDialer:  newDialer,
+		log:        log,
+	}
+	s.server = &http.Server{Handler: s.Handler()}
+	return s
+}
+
+// Handler returns the handler of the API.
+//
+//	GET    /node                current node
+//	PUT    /node                switch the node by {"link": "..."}
+//	GET    /connections         live connections
+//	DELETE /connections/{id}    close a connection
+//	GET    /traffic             traffic counters
+//	GET    /dns                 fake-IP table
+//	GET    /mappers             sizes of the mappers
+//	GET    /udp                 whether UDP is redirected
+//	PUT    /udp                 toggle UDP by {"enabled": true}
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /node", s.getNode)
+	mux.HandleFunc("PUT /node", s.putNode)
+	mux.HandleFunc("GET /connections", s.getConnections)
+	mux.HandleFunc("DELETE /connections/{id}", s.deleteConnection)
+	mux.HandleFunc("GET /traffic", s.getTraffic)
+	mux.HandleFunc("GET /dns", s.getDNS)
+	mux.HandleFunc("GET /mappers", s.getMappers)
+	mux.HandleFunc("GET /udp", s.getUDP)
+	mux.HandleFunc("PUT /udp", s.putUDP)
+	return mux
+}
+
+// ListenAndServe serves the API on the unix socket path, which is only accessible to the current user.
+func (s *Server) ListenAndServe(path string) error {
+	// remove the socket left by a previous session
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	if err := s.server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Tracef("api: write response: %v", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, code int, err error) {
+	s.writeJSON(w, code, Error{Error: err.Error()})
+}
+
+func (s *Server) getNode(w http.ResponseWriter, r *http.Request) {
+	d := s.controller.Dialer()
+	s.writeJSON(w, http.StatusOK, Node{
+		Name:       d.Name(),
+		Protocol:   d.Protocol(),
+		SupportUDP: d.SupportUDP(),
+	})
+}
+
+func (s *Server) putNode(w http.ResponseWriter, r *http.Request) {
+	var req SwitchNodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Link == "" {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("link is required"))
+		return
+	}
+	d, err := s.newDialer(req.Link)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.controller.SetDialer(d)
+	s.log.Infof("api: switched to the node: %v", d.Name())
+	s.getNode(w, r)
+}
+
+func (s *Server) stats(w http.ResponseWriter) *proxy.Stats {
+	stats := s.controller.Proxy().Stats()
+	if stats == nil {
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("connections are not tracked"))
+	}
+	return stats
+}
+
+func (s *Server) getConnections(w http.ResponseWriter, r *http.Request) {
+	if stats := s.stats(w); stats != nil {
+		s.writeJSON(w, http.StatusOK, stats.Live())
+	}
+}
+
+func (s *Server) deleteConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	stats := s.stats(w)
+	if stats == nil {
+		return
+	}
+	if err = stats.CloseConn(id); err != nil {
+		if errors.Is(err, proxy.ErrConnNotFound) {
+			s.writeError(w, http.StatusNotFound, err)
+		} else {
+			s.writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getTraffic(w http.ResponseWriter, r *http.Request) {
+	if stats := s.stats(w); stats != nil {
+		s.writeJSON(w, http.StatusOK, stats.Traffic())
+	}
+}
+
+func (s *Server) getDNS(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.controller.Proxy().FakeIPs())
+}
+
+func (s *Server) getMappers(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.controller.Proxy().MapperSizes())
+}
+
+func (s *Server) getUDP(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, UDP{Enabled: s.controller.UDPEnabled()})
+}
+
+func (s *Server) putUDP(w http.ResponseWriter, r *http.Request) {
+	var req UDP
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.controller.SetUDPEnabled(req.Enabled)
+	s.log.Infof("api: UDP redirection enabled: %v", req.Enabled)
+	s.getUDP(w, r)
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+type controller struct {
+	proxy     *proxy.Proxy
+	ignoreUDP atomic.Bool
+}
+
+func (c *controller) Proxy() *proxy.Proxy {
+	return c.proxy
+}
+
+func (c *controller) Dialer() *dialer.Dialer {
+	return c.proxy.Dialer().(*dialer.Dialer)
+}
+
+func (c *controller) SetDialer(d *dialer.Dialer) {
+	c.proxy.SetDialer(d)
+}
+
+func (c *controller) UDPEnabled() bool {
+	return !c.ignoreUDP.Load()
+}
+
+func (c *controller) SetUDPEnabled(enabled bool) {
+	c.ignoreUDP.Store(!enabled)
+}
+
+// serve starts a proxy with a direct node and the API on a unix socket, and returns the client of the API.
+func serve(t *testing.T) (*controller, *http.Client) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p := proxy.New(log, dialer.NewDialer(dialer.SymmetricDirect, true, "direct", "direct", ""))
+	p.SetStats(proxy.NewStats(0))
+	go p.ListenTCP("127.0.0.1:0")
+	select {
+	case <-p.Listened():
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy does not listen")
+	}
+	t.Cleanup(func() { p.Close() })
+	c := &controller{proxy: p}
+
+	s := New(c, func(link string) (*dialer.Dialer, error) {
+		if link != "direct://other" {
+			return nil, fmt.Errorf("unexpected link: %v", link)
+		}
+		return dialer.NewDialer(dialer.SymmetricDirect, false, "other", "direct", link), nil
+	}, log)
+	path := filepath.Join(t.TempDir(), "gg.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return c, &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+func do(t *testing.T, client *http.Client, method string, path string, body interface{}, resp interface{}) int {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://gg"+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if resp != nil && res.StatusCode < 300 {
+		if err = json.NewDecoder(res.Body).Decode(resp); err != nil {
+			t.Fatalf("%v %v: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+// echo starts a TCP echo server.
+func echo(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNode(t *testing.T) {
+	_, client := serve(t)
+	var node Node
+	if code := do(t, client, "GET", "/node", nil, &node); code != http.StatusOK || node.Name != "direct" || !node.SupportUDP {
+		t.Fatalf("unexpected node: %v %+v", code, node)
+	}
+	if code := do(t, client, "PUT", "/node", SwitchNodeRequest{Link: "direct://bad"}, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %v", code)
+	}
+	if code := do(t, client, "PUT", "/node", SwitchNodeRequest{Link: "direct://other"}, &node); code != http.StatusOK || node.Name != "other" || node.SupportUDP {
+		t.Fatalf("unexpected node after switching: %v %+v", code, node)
+	}
+	if code := do(t, client, "GET", "/node", nil, &node); code != http.StatusOK || node.Name != "other" {
+		t.Fatalf("the node is not switched: %+v", node)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	c, client := serve(t)
+	target := echo(t)
+	loopback, err := c.proxy.AllocProjection(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(loopback.String(), strconv.Itoa(c.proxy.TCPPort())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []proxy.ConnRecord
+	if code := do(t, client, "GET", "/connections", nil, &conns); code != http.StatusOK || len(conns) != 1 {
+		t.Fatalf("unexpected connections: %v %+v", code, conns)
+	}
+	if conns[0].Target != target || conns[0].Network != "tcp" || conns[0].Node != "direct" || conns[0].Upload != int64(len(msg)) {
+		t.Fatalf("unexpected connection: %+v", conns[0])
+	}
+	var traffic proxy.Traffic
+	if code := do(t, client, "GET", "/traffic", nil, &traffic); code != http.StatusOK || traffic.Live != 1 || traffic.Download != int64(len(msg)) {
+		t.Fatalf("unexpected traffic: %v %+v", code, traffic)
+	}
+
+	if code := do(t, client, "DELETE", "/connections/"+strconv.FormatUint(conns[0].ID+1, 10), nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected not found, got %v", code)
+	}
+	if code := do(t, client, "DELETE", "/connections/"+strconv.FormatUint(conns[0].ID, 10), nil, nil); code != http.StatusNoContent {
+		t.Fatalf("expected no content, got %v", code)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the connection is not closed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if code := do(t, client, "GET", "/traffic", nil, &traffic); code != http.StatusOK {
+			t.Fatalf("unexpected code: %v", code)
+		}
+		if traffic.Live == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the connection is still alive: %+v", traffic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if traffic.Connections != 1 || traffic.Upload != int64(len(msg)) {
+		t.Fatalf("unexpected traffic: %+v", traffic)
+	}
+}
+
+func TestDNSAndMappers(t *testing.T) {
+	c, client := serve(t)
+	fakeIP, _ := c.proxy.AllocProjection("example.com")
+	if _, err := c.proxy.AllocProjection("93.184.215.14:443"); err != nil {
+		t.Fatal(err)
+	}
+	var table []proxy.FakeIP
+	if code := do(t, client, "GET", "/dns", nil, &table); code != http.StatusOK || len(table) != 1 {
+		t.Fatalf("unexpected table: %v %+v", code, table)
+	}
+	if table[0].IP != fakeIP || table[0].Domain != "example.com" || table[0].RealIP.IsValid() {
+		t.Fatalf("unexpected fake IP: %+v", table[0])
+	}
+	var sizes proxy.MapperSizes
+	if code := do(t, client, "GET", "/mappers", nil, &sizes); code != http.StatusOK {
+		t.Fatalf("unexpected code: %v", code)
+	}
+	if sizes != (proxy.MapperSizes{Loopback: 1, Reserved: 1}) {
+		t.Fatalf("unexpected sizes: %+v", sizes)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	c, client := serve(t)
+	var udp UDP
+	if code := do(t, client, "GET", "/udp", nil, &udp); code != http.StatusOK || !udp.Enabled {
+		t.Fatalf("unexpected udp: %v %+v", code, udp)
+	}
+	if code := do(t, client, "PUT", "/udp", UDP{Enabled: false}, &udp); code != http.StatusOK || udp.Enabled {
+		t.Fatalf("unexpected udp: %v %+v", code, udp)
+	}
+	if c.UDPEnabled() {
+		t.Fatal("UDP is not disabled")
+	}
+}
@@ -0,0 +1,47 @@
+// Package backend defines the common interface of the ways to intercept the traffic of a program.
+package backend
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
+	"github.com/sirupsen/logrus"
+)
+
+// Backend runs a program and redirects its traffic to the proxy.
+type Backend interface {
+	// Proxy returns the proxy that the traffic is redirected to.
+	Proxy() *proxy.Proxy
+	// Dialer returns the dialer to the current node.
+	Dialer() *dialer.Dialer
+	// SetDialer switches the node for new connections.
+	SetDialer(d *dialer.Dialer)
+	// UDPEnabled reports whether UDP traffic is redirected.
+	UDPEnabled() bool
+	// SetUDPEnabled sets whether new UDP traffic is redirected.
+	SetUDPEnabled(enabled bool)
+	// Signal forwards sig to the program.
+	Signal(sig os.Signal) error
+	// Wait waits for the program to exit, and returns how it exited.
+	Wait() (status syscall.WaitStatus, err error)
+}
+
+// Options are shared by the backends.
+type Options struct {
+	Dialer            *dialer.Dialer
+	IgnoreUDP         bool
+	IgnorePrivateAddr bool
+	Logger            *logrus.Logger
+	// The connections are recorded to Stats, logged to ConnLog and captured to Capture if they are not nil.
+	Stats   *proxy.Stats
+	ConnLog *proxy.ConnLog
+	Capture *proxy.Capture
+	// If Allowlist is not nil, the connections to other destinations are refused.
+	Allowlist sandbox.Allowlist
+	// The traffic of processes is proxied, bypassed or blocked according to Policy.
+	Policy policy.Policy
+}
@@ -0,0 +1,32 @@
+package backend
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// Suspend stops gg like the program pid stopped by a signal, so that the shell sees the job stopped. The program is
+// continued once gg is continued, in case only gg is.
+func Suspend(pid int) {
+	runtime.LockOSThread()
+	// a signal to the thread itself is delivered before the syscall returns
+	_ = syscall.Tgkill(syscall.Getpid(), syscall.Gettid(), syscall.SIGSTOP)
+	runtime.UnlockOSThread()
+	_ = syscall.Kill(pid, syscall.SIGCONT)
+}
+
+// WaitProgram waits for the child pid to exit like Backend.Wait, and suspends gg whenever the child stops.
+func WaitProgram(pid int) (status syscall.WaitStatus, err error) {
+	for {
+		if _, err = syscall.Wait4(pid, &status, syscall.WUNTRACED, nil); err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return 0, err
+		}
+		if !status.Stopped() {
+			return status, nil
+		}
+		Suspend(pid)
+	}
+}
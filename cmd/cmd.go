@@ -10,8 +10,19 @@ import (
 	"path/filepath"
 	"runtime"
 	"syscall"
+	"time"
 
+	"github.com/mzz2017/gg/api"
+	"github.com/mzz2017/gg/backend"
 	"github.com/mzz2017/gg/cmd/infra"
+	"github.com/mzz2017/gg/config"
+	dialer2 "github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/metrics"
+	"github.com/mzz2017/gg/netns"
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/preload"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
 	"github.com/mzz2017/gg/tracer"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -53,18 +64,29 @@ $ gg git clone https://github.com/mzz2017/gg.git`)
 			v, _ = getConfig(log, true, viper.New, cmd)
 
 			// check ptrace_scope and capability
-			if err := infra.CheckPtraceCapability(); err != nil {
-				switch err {
-				case infra.ErrBadCapability:
-					path, err := filepath.Abs(os.Args[0])
-					if err != nil {
-						path = filepath.Clean(os.Args[0])
+			backendName, _ := cmd.Flags().GetString("backend")
+			switch backendName {
+			case backendAuto, backendPtrace, backendPreload, backendNetns:
+			default:
+				log.Fatalf("unexpected backend: %v", backendName)
+			}
+			if backendName == backendAuto || backendName == backendPtrace {
+				if err := infra.CheckPtraceCapability(); err != nil {
+					switch {
+					case backendName == backendAuto && (err == infra.ErrBadCapability || err == infra.ErrBadPtraceScope):
+						log.Infof("%v, so we will use the preload backend", err)
+						backendName = backendPreload
+					case err == infra.ErrBadCapability:
+						path, err := filepath.Abs(os.Args[0])
+						if err != nil {
+							path = filepath.Clean(os.Args[0])
+						}
+						log.Fatalf("Your ptrace_scope is 2 and you should give the correct capability to %v:\nsudo setcap cap_net_raw,cap_sys_ptrace+ep %v", program, path)
+					case err == infra.ErrBadPtraceScope:
+						log.Fatalln("Your kernel does not allow ptrace permission, please use following command and reboot:\necho kernel.yama.ptrace_scope = 1 | sudo tee -a /etc/sysctl.d/10-ptrace.conf")
+					default:
+						log.Infoln(err)
 					}
-					log.Fatalf("Your ptrace_scope is 2 and you should give the correct capability to %v:\nsudo setcap cap_net_raw,cap_sys_ptrace+ep %v", program, path)
-				case infra.ErrBadPtraceScope:
-					log.Fatalln("Your kernel does not allow ptrace permission, please use following command and reboot:\necho kernel.yama.ptrace_scope = 1 | sudo tee -a /etc/sysctl.d/10-ptrace.conf")
-				default:
-					log.Infoln(err)
 				}
 			}
 
@@ -80,9 +102,19 @@ $ gg git clone https://github.com/mzz2017/gg.git`)
 				}
 			}
 			// get dialer
-			dialer, err := GetDialer(log)
-			if err != nil {
-				logrus.Fatal("GetDialer:", err)
+			dryRun, _ := cmd.Flags().GetString("dry-run")
+			var dialer *dialer2.Dialer
+			switch dryRun {
+			case "":
+				if dialer, err = GetDialer(log); err != nil {
+					logrus.Fatal("GetDialer:", err)
+				}
+			case dryRunDirect:
+				dialer = dialer2.NewDialer(dialer2.SymmetricDirect, true, "direct", "direct", "")
+			case dryRunBlock:
+				dialer = dialer2.NewDialer(dialer2.Block, true, "block", "block", "")
+			default:
+				logrus.Fatalf("unexpected dry-run mode: %v", dryRun)
 			}
 
 			if len(args) == 0 {
@@ -112,39 +144,196 @@ $ gg git clone https://github.com/mzz2017/gg.git`)
 			} else {
 				proxyPrivate = v.GetBool("proxy_private")
 			}
+			if dryRun != "" {
+				// audit all destinations
+				proxyPrivate = true
+			}
+			var stats *proxy.Stats
+			statsTable, _ := cmd.Flags().GetBool("stats")
+			statsJSON, _ := cmd.Flags().GetString("stats-json")
+			apiPath, _ := cmd.Flags().GetString("api")
+			if statsTable || statsJSON != "" || dryRun != "" {
+				stats = proxy.NewStats(0)
+			} else if apiPath != "" {
+				// the API shows live connections and counters, so the history can be limited.
+				stats = proxy.NewStats(apiMaxFinished)
+			}
+			var connLog *proxy.ConnLog
+			if connLogPath, _ := cmd.Flags().GetString("conn-log"); connLogPath != "" {
+				w := os.Stderr
+				if connLogPath != "-" {
+					if w, err = os.OpenFile(connLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+						logrus.Fatal("open conn-log:", err)
+					}
+					defer w.Close()
+				}
+				connLog = proxy.NewConnLog(w)
+			}
+			var capture *proxy.Capture
+			if capturePath, _ := cmd.Flags().GetString("capture"); capturePath != "" {
+				f, err := os.Create(capturePath)
+				if err != nil {
+					logrus.Fatal("create capture:", err)
+				}
+				defer f.Close()
+				if capture, err = proxy.NewCapture(f); err != nil {
+					logrus.Fatal("NewCapture:", err)
+				}
+			}
+			var allowlist sandbox.Allowlist
+			if sandboxed, _ := cmd.Flags().GetBool("sandbox"); sandboxed {
+				rules, _ := cmd.Flags().GetStringSlice("allow")
+				if allowlist, err = sandbox.Parse(rules); err != nil {
+					logrus.Fatal("sandbox:", err)
+				}
+			}
+			policyRules, _ := cmd.Flags().GetStringArray("policy")
+			rules, err := policy.Parse(policyRules)
+			if err != nil {
+				logrus.Fatal("policy:", err)
+			}
+			if metricsAddr, _ := cmd.Flags().GetString("metrics"); metricsAddr != "" {
+				go func() {
+					if err := metrics.ListenAndServe(metricsAddr); err != nil {
+						log.Warnf("metrics: %v", err)
+					}
+				}()
+			}
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			t, err := tracer.New(
-				ctx,
-				fullPath,
-				args,
-				&os.ProcAttr{Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}, Env: os.Environ()},
-				dialer,
-				noUDP,
-				!proxyPrivate,
-				log,
-			)
-			if err != nil {
-				logrus.Fatal("tracer.New:", err)
+			opt := backend.Options{
+				Dialer:            dialer,
+				IgnoreUDP:         noUDP,
+				IgnorePrivateAddr: !proxyPrivate,
+				Logger:            log,
+				Stats:             stats,
+				ConnLog:           connLog,
+				Capture:           capture,
+				Allowlist:         allowlist,
+				Policy:            rules,
+			}
+			attr := &os.ProcAttr{Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}, Env: os.Environ()}
+			var t backend.Backend
+			if backendName == backendAuto || backendName == backendPtrace {
+				t, err = tracer.New(ctx, fullPath, args, attr, opt)
+				if err != nil {
+					if backendName == backendAuto && errors.Is(err, syscall.EPERM) {
+						// the program has not started if ptrace is not permitted
+						log.Infof("tracer.New: %v, so we will use the preload backend", err)
+						backendName = backendPreload
+						attr.Sys = nil
+					} else {
+						logrus.Fatal("tracer.New:", err)
+					}
+				}
+			}
+			if backendName == backendPreload {
+				libPath, _ := cmd.Flags().GetString("preload-lib")
+				lib, err := preload.Library(libPath)
+				if err != nil {
+					logrus.Fatal("preload.Library:", err)
+				}
+				if t, err = preload.New(ctx, fullPath, args, attr, lib, opt); err != nil {
+					logrus.Fatal("preload.New:", err)
+				}
+			}
+			if backendName == backendNetns {
+				if t, err = netns.New(ctx, fullPath, args, attr, opt); err != nil {
+					logrus.Fatal("netns.New:", err)
+				}
+			}
+			var server *api.Server
+			if apiPath != "" {
+				opt, err := GetGlobalOption()
+				if err != nil {
+					logrus.Fatal("GetGlobalOption:", err)
+				}
+				opt.Logger = log
+				server = api.New(t, func(link string) (*dialer2.Dialer, error) {
+					return GetDialerFromLink(link, opt, config.ParamsObj.TestNode, config.ParamsObj.TestURL)
+				}, log)
+				go func() {
+					if err := server.ListenAndServe(apiPath); err != nil {
+						log.Warnf("api: %v", err)
+					}
+				}()
 			}
 			go func() {
-				// listen signal
+				// forward the signals to the program, and stop intercepting it
 				sigs := make(chan os.Signal, 1)
-				signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGILL)
-				<-sigs
-				cancel()
+				signal.Notify(sigs, append(termSignals, jobSignals...)...)
+				for sig := range sigs {
+					if !fromTerminal(sig) {
+						if err := t.Signal(sig); err != nil {
+							log.Warnf("forward %v: %v", sig, err)
+						}
+					}
+					if isTermSignal(sig) {
+						cancel()
+					}
+				}
 			}()
-			code, err := t.Wait()
+			status, err := t.Wait()
 			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					logrus.Fatal("tracer.Wait:", err)
+				logrus.Fatal("Wait:", err)
+			}
+			if ctx.Err() != nil {
+				// let the connections of the programs left finish
+				drainTimeout, _ := cmd.Flags().GetDuration("drain-timeout")
+				t.Proxy().Drain(drainTimeout)
+			}
+			if server != nil {
+				_ = server.Close()
+				_ = os.Remove(apiPath)
+			}
+			if capture != nil {
+				if err := capture.Flush(); err != nil {
+					log.Warnf("write capture: %v", err)
 				}
 			}
-			os.Exit(code)
+			if statsTable {
+				_ = stats.WriteTable(os.Stderr)
+			}
+			if dryRun != "" {
+				_ = stats.WriteAudit(os.Stderr)
+			}
+			if statsJSON != "" {
+				if err := writeStatsJSON(stats, statsJSON); err != nil {
+					log.Warnf("write stats: %v", err)
+				}
+			}
+			exit(status)
 		},
 	}
 )
 
+func writeStatsJSON(stats *proxy.Stats, path string) error {
+	if path == "-" {
+		return stats.WriteJSON(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return stats.WriteJSON(f)
+}
+
+const (
+	backendAuto    = "auto"
+	backendPtrace  = "ptrace"
+	backendPreload = "preload"
+	backendNetns   = "netns"
+)
+
+const (
+	dryRunDirect = "direct"
+	dryRunBlock  = "block"
+)
+
+// apiMaxFinished is the number of finished connections kept for the API.
+const apiMaxFinished = 1000
+
 // Execute executes the root command.
 func Execute() error {
 	return rootCmd.Execute()
@@ -157,6 +346,21 @@ func init() {
 	rootCmd.PersistentFlags().StringP("subscription", "s", "", "subscription-link of your modern proxy")
 	rootCmd.PersistentFlags().Bool("noudp", false, "do not redirect UDP traffic, even though the proxy server supports")
 	rootCmd.PersistentFlags().Bool("proxyprivate", false, "redirect traffic to private address")
+	rootCmd.PersistentFlags().Bool("stats", false, "print the summary of connections by destination on exit")
+	rootCmd.PersistentFlags().String("stats-json", "", "write the records of connections as JSON to the file on exit (- for stdout)")
+	rootCmd.PersistentFlags().String("conn-log", "", "log the events of connections as JSON lines to the file (- for stderr)")
+	rootCmd.PersistentFlags().String("capture", "", "write the payload of proxied flows to the pcapng file")
+	rootCmd.PersistentFlags().String("api", "", "serve the control API on the unix socket path")
+	rootCmd.PersistentFlags().String("metrics", "", "serve Prometheus metrics on /metrics of the address, e.g. 127.0.0.1:9100")
+	rootCmd.PersistentFlags().String("dry-run", "", "do not use the node, but connect directly or block, and print the destinations on exit: direct or block")
+	rootCmd.PersistentFlags().Lookup("dry-run").NoOptDefVal = dryRunDirect
+	rootCmd.PersistentFlags().Bool("sandbox", false, "refuse the connections to destinations not allowed by --allow")
+	rootCmd.PersistentFlags().StringSlice("allow", nil, "destinations allowed in the sandbox: domains, IPs, CIDRs and ports, e.g. example.com,10.0.0.0/8,:443,[::1]:8000-8999")
+	rootCmd.PersistentFlags().StringArray("policy", nil, "proxy, bypass or block the processes by executable name, path or argv=pattern, e.g. bypass:ssh (repeatable, first match wins)")
+	rootCmd.PersistentFlags().String("backend", backendAuto, "the way to intercept the traffic: ptrace, preload (LD_PRELOAD, for programs that cannot be traced), netns (a network namespace with a tun device) or auto (ptrace if permitted, otherwise preload)")
+	rootCmd.PersistentFlags().Duration("drain-timeout", 5*time.Second, "on signals, how long to wait for the connections left to finish after the program exits")
+	rootCmd.PersistentFlags().String("preload-lib", "", "the path of the preload shim library, which is built with cc if not given")
+	rootCmd.PersistentFlags().String("mux", "", "multiplex TCP over connections to the node: smux, yamux, mux.cool or none")
 	rootCmd.PersistentFlags().String("testnode", "true", "test the connectivity before connecting to the node")
 	rootCmd.PersistentFlags().Bool("select", false, "manually select the node to connect from the subscription")
 	rootCmd.AddCommand(configCmd)
@@ -186,6 +186,9 @@ func getConfig(log *logrus.Logger, bindToConfig bool, newViper func() *viper.Vip
 		v.BindPFlag("no_udp", flagCmd.PersistentFlags().Lookup("noudp"))
 		v.BindPFlag("proxy_private", flagCmd.PersistentFlags().Lookup("proxyprivate"))
 		v.BindPFlag("test_node_before_use", flagCmd.PersistentFlags().Lookup("testnode"))
+		if muxProtocol, _ := flagCmd.PersistentFlags().GetString("mux"); muxProtocol != "" {
+			v.BindPFlag("mux.protocol", flagCmd.PersistentFlags().Lookup("mux"))
+		}
 		if node, _ := flagCmd.PersistentFlags().GetString("node"); node != "" {
 			//log.Warn("Please use --node only on trusted computers, because it may leave a record in command history.")
 			v.BindPFlag("node", flagCmd.PersistentFlags().Lookup("node"))
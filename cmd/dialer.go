@@ -9,6 +9,7 @@ import (
 	"github.com/mzz2017/gg/common"
 	"github.com/mzz2017/gg/config"
 	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/dialer/transport/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/tools/container/intsets"
@@ -26,11 +27,30 @@ type DialerWithLatency struct {
 	Latency int
 }
 
-func GetDialer(log *logrus.Logger) (d *dialer.Dialer, err error) {
-	nodeLink := config.ParamsObj.Node
+// GetGlobalOption returns the dialer option from the config.
+func GetGlobalOption() (*dialer.GlobalOption, error) {
 	opt := &dialer.GlobalOption{
 		AllowInsecure: config.ParamsObj.AllowInsecure,
+		Mux: mux.Option{
+			Protocol:       config.ParamsObj.Mux.Protocol,
+			MaxConnections: config.ParamsObj.Mux.MaxConnections,
+			MaxStreams:     config.ParamsObj.Mux.MaxStreams,
+			IdleTimeout:    time.Duration(config.ParamsObj.Mux.IdleTimeout) * time.Second,
+		},
+	}
+	if err := opt.Mux.Validate(); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+func GetDialer(log *logrus.Logger) (d *dialer.Dialer, err error) {
+	nodeLink := config.ParamsObj.Node
+	opt, err := GetGlobalOption()
+	if err != nil {
+		return nil, err
 	}
+	opt.Logger = log
 	if len(nodeLink) > 0 {
 		d, err = GetDialerFromLink(nodeLink, opt, config.ParamsObj.TestNode, config.ParamsObj.TestURL)
 		if err != nil {
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// termSignals stop intercepting the program after forwarded.
+	termSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGILL}
+	// jobSignals are only forwarded.
+	jobSignals = []os.Signal{syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU, syscall.SIGCONT, syscall.SIGWINCH}
+)
+
+func isTermSignal(sig os.Signal) bool {
+	for _, s := range termSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTerminal reports whether sig is likely sent by the terminal to its foreground process group, which the
+// program has received as well.
+func fromTerminal(sig os.Signal) bool {
+	switch sig {
+	case syscall.SIGTTIN, syscall.SIGTTOU:
+		// only sent by the terminal, to the process reading or writing it in background
+		return true
+	case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP, syscall.SIGCONT, syscall.SIGWINCH:
+	default:
+		return false
+	}
+	pgrp, err := unix.IoctlGetInt(int(os.Stdin.Fd()), unix.TIOCGPGRP)
+	return err == nil && pgrp == syscall.Getpgrp()
+}
+
+// exit exits like the program with the given status, so that the shell sees the same exit code or signal.
+func exit(status syscall.WaitStatus) {
+	if !status.Signaled() {
+		os.Exit(status.ExitStatus())
+	}
+	sig := status.Signal()
+	// the Go runtime handles the signal otherwise, e.g. SIGQUIT dumps the goroutines
+	var act [64]byte // struct sigaction with SIG_DFL
+	sigsetSize := uintptr(8)
+	if runtime.GOARCH == "mips64le" {
+		sigsetSize = 16
+	}
+	_, _, _ = syscall.RawSyscall6(syscall.SYS_RT_SIGACTION, uintptr(sig), uintptr(unsafe.Pointer(&act)), 0, sigsetSize, 0, 0)
+	// the program has dumped its core if any
+	_ = unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{})
+	runtime.LockOSThread()
+	_ = syscall.Tgkill(syscall.Getpid(), syscall.Gettid(), sig)
+	os.Exit(128 + int(sig))
+}
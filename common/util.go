@@ -109,6 +109,21 @@ func SetValue(values *url.Values, key string, value string) {
 	values.Set(key, value)
 }
 
+// ParseHeaders parses headers in the form of "Name: Value".
+func ParseHeaders(values []string) (headers map[string]string, err error) {
+	for _, h := range values {
+		fields := strings.SplitN(h, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("header: %v", h)
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+	}
+	return headers, nil
+}
+
 func Max(a, b int) int {
 	if a > b {
 		return a
@@ -124,3 +139,17 @@ func MustGetMapKeys(m interface{}) (keys []string) {
 	}
 	return keys
 }
+
+// FormatBytes formats n in binary units, e.g. 1.5 KiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
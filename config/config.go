@@ -11,6 +11,12 @@ type Cache struct {
 type CacheSubscription struct {
 	LastNode string `mapstructure:"last_node"`
 }
+type Mux struct {
+	Protocol       string `mapstructure:"protocol" default:"none"`
+	MaxConnections int    `mapstructure:"max_connections" default:"4"`
+	MaxStreams     int    `mapstructure:"max_streams" default:"0"`
+	IdleTimeout    int    `mapstructure:"idle_timeout" default:"60"` // seconds
+}
 type Params struct {
 	Node         string       `mapstructure:"node"`
 	Subscription Subscription `mapstructure:"subscription"`
@@ -21,6 +27,8 @@ type Params struct {
 	ProxyPrivate  bool `mapstructure:"proxy_private"`
 	AllowInsecure bool `mapstructure:"allow_insecure"`
 
+	Mux Mux `mapstructure:"mux"`
+
 	TestNode bool   `mapstructure:"test_node_before_use" default:"true"`
 	TestURL  string `mapstructure:"test_url" default:"https://connectivitycheck.gstatic.com/generate_204"`
 }
@@ -4,10 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/mzz2017/gg/dialer/transport/mux"
+	"github.com/mzz2017/gg/metrics"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/net/proxy"
 	"gopkg.in/yaml.v3"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
@@ -54,6 +58,15 @@ func (d *Dialer) Link() string {
 	return d.link
 }
 
+// Dial dials the address via the node, and counts the failures.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	c, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		metrics.DialErrors.With(d.name, network).Inc()
+	}
+	return c, err
+}
+
 func (d *Dialer) Test(ctx context.Context, url string) (bool, error) {
 	cd := ContextDialer{d.Dialer}
 	cli := http.Client{
@@ -90,11 +103,22 @@ func FromLinkRegister(name string, creator FromLinkCreator) {
 }
 
 func NewFromLink(name string, link string, opt *GlobalOption) (dialer *Dialer, err error) {
-	if creator, ok := fromLinkCreators[name]; ok {
-		return creator(link, opt)
-	} else {
+	creator, ok := fromLinkCreators[name]
+	if !ok {
 		return nil, fmt.Errorf("unexpected link type: %v", name)
 	}
+	if dialer, err = creator(link, opt); err != nil {
+		return nil, err
+	}
+	muxOpt := opt.Mux
+	var explicit bool
+	if u, err := url.Parse(link); err == nil {
+		if muxOpt, err = mux.OptionFromQuery(u.Query(), muxOpt); err != nil {
+			return nil, fmt.Errorf("%w: %v", InvalidParameterErr, err)
+		}
+		explicit = u.Query().Get("mux") != ""
+	}
+	return dialer.withMux(muxOpt, explicit)
 }
 
 type FromClashCreator func(clashObj *yaml.Node, opt *GlobalOption) (dialer *Dialer, err error)
@@ -111,11 +135,76 @@ func NewFromClash(clashObj *yaml.Node, opt *GlobalOption) (dialer *Dialer, err e
 		return nil, err
 	}
 	name, _ := preUnload["type"].(string)
-	if creator, ok := fromClashCreators[name]; ok {
-		return creator(clashObj, opt)
-	} else {
+	creator, ok := fromClashCreators[name]
+	if !ok {
 		return nil, fmt.Errorf("unexpected link type: %v", name)
 	}
+	if dialer, err = creator(clashObj, opt); err != nil {
+		return nil, err
+	}
+	muxOpt := opt.Mux
+	var clashMux struct {
+		Smux struct {
+			Enabled        bool   `yaml:"enabled"`
+			Protocol       string `yaml:"protocol"`
+			MaxConnections *int   `yaml:"max-connections"`
+			MaxStreams     *int   `yaml:"max-streams"`
+		} `yaml:"smux"`
+	}
+	if err = clashObj.Decode(&clashMux); err != nil {
+		return nil, err
+	}
+	if clashMux.Smux.Enabled {
+		// The sing-mux server detects the protocol, so smux is a fine default.
+		muxOpt.Protocol = mux.ProtocolSmux
+		if clashMux.Smux.Protocol != "" {
+			muxOpt.Protocol = clashMux.Smux.Protocol
+		}
+		// The absent fields keep the global options.
+		if clashMux.Smux.MaxConnections != nil {
+			muxOpt.MaxConnections = *clashMux.Smux.MaxConnections
+		}
+		if clashMux.Smux.MaxStreams != nil {
+			muxOpt.MaxStreams = *clashMux.Smux.MaxStreams
+		}
+		if err = muxOpt.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", InvalidParameterErr, err)
+		}
+	}
+	return dialer.withMux(muxOpt, clashMux.Smux.Enabled)
+}
+
+// muxProtocols are the protocols whose servers may serve the multiplexing, and whether they serve mux.cool, which
+// only v2ray and Xray do.
+var muxProtocols = map[string]bool{
+	"shadowsocks": false,
+	"vmess":       true,
+	"vless":       true,
+	"trojan":      false,
+}
+
+// withMux makes the TCP of the dialer multiplexed if opt is enabled and the protocol supports. If explicit, opt is
+// given by the node, and mux.cool for a server not serving it is an error instead of being ignored.
+func (d *Dialer) withMux(opt mux.Option, explicit bool) (*Dialer, error) {
+	if !opt.Enabled() {
+		return d, nil
+	}
+	muxCool, ok := muxProtocols[d.protocol]
+	if !ok {
+		return d, nil
+	}
+	if opt.Protocol == mux.ProtocolMuxCool && !muxCool {
+		if explicit {
+			return nil, fmt.Errorf("%w: mux %v is not supported by %v", UnexpectedFieldErr, opt.Protocol, d.protocol)
+		}
+		return d, nil
+	}
+	m, err := mux.NewMux(d.Dialer, opt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidParameterErr, err)
+	}
+	d.Dialer = m
+	return d, nil
 }
 
 type ContextDialer struct {
@@ -147,4 +236,8 @@ func (d *ContextDialer) DialContext(ctx context.Context, network, addr string) (
 
 type GlobalOption struct {
 	AllowInsecure bool
+	// Mux is the default multiplexing, which can be overridden by a node.
+	Mux mux.Option
+	// Logger logs the problems that do not fail the nodes. The standard logger is used if nil.
+	Logger *logrus.Logger
 }
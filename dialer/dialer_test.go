@@ -0,0 +1,76 @@
+package dialer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mzz2017/gg/dialer/transport/mux"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	for _, protocol := range []string{"trojan", "vmess"} {
+		protocol := protocol
+		FromLinkRegister(protocol, func(link string, opt *GlobalOption) (*Dialer, error) {
+			return NewDialer(SymmetricDirect, true, "", protocol, link), nil
+		})
+		FromClashRegister(protocol, func(clashObj *yaml.Node, opt *GlobalOption) (*Dialer, error) {
+			return NewDialer(SymmetricDirect, true, "", protocol, ""), nil
+		})
+	}
+}
+
+func TestMuxOption(t *testing.T) {
+	global := &GlobalOption{Mux: mux.Option{Protocol: mux.ProtocolSmux, MaxConnections: 4, MaxStreams: 8}}
+	for _, c := range []struct {
+		name  string
+		link  string
+		clash string
+		opt   *mux.Option // opt is nil if not multiplexed
+		err   error
+	}{
+		{"global", "trojan://p@example.com:443", "", &global.Mux, nil},
+		{"link", "vmess://example.com:443?mux=yamux&muxStreams=2", "",
+			&mux.Option{Protocol: mux.ProtocolYamux, MaxConnections: 4, MaxStreams: 2}, nil},
+		{"link mux.cool", "vmess://example.com:443?mux=mux.cool", "",
+			&mux.Option{Protocol: mux.ProtocolMuxCool, MaxConnections: 4, MaxStreams: 8}, nil},
+		{"link mux.cool unsupported", "trojan://p@example.com:443?mux=mux.cool", "", nil, UnexpectedFieldErr},
+		{"clash absent fields", "", "{type: trojan, smux: {enabled: true, max-streams: 0}}",
+			&mux.Option{Protocol: mux.ProtocolSmux, MaxConnections: 4}, nil},
+		{"clash", "", "{type: trojan, smux: {enabled: true, protocol: yamux, max-connections: 1}}",
+			&mux.Option{Protocol: mux.ProtocolYamux, MaxConnections: 1, MaxStreams: 8}, nil},
+		{"clash mux.cool unsupported", "", "{type: trojan, smux: {enabled: true, protocol: mux.cool}}", nil, UnexpectedFieldErr},
+	} {
+		var (
+			d   *Dialer
+			err error
+		)
+		if c.link != "" {
+			scheme, _, _ := strings.Cut(c.link, "://")
+			d, err = NewFromLink(scheme, c.link, global)
+		} else {
+			var node yaml.Node
+			if err = yaml.Unmarshal([]byte(c.clash), &node); err != nil {
+				t.Fatal(err)
+			}
+			d, err = NewFromClash(node.Content[0], global)
+		}
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Errorf("%v: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		m, ok := d.Dialer.(*mux.Mux)
+		if !ok {
+			t.Fatalf("%v: not multiplexed", c.name)
+		}
+		if m.Option() != *c.opt {
+			t.Errorf("%v: option %+v, want %+v", c.name, m.Option(), *c.opt)
+		}
+	}
+}
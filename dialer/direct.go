@@ -1,6 +1,7 @@
 package dialer
 
 import (
+	"fmt"
 	"golang.org/x/net/proxy"
 	"net"
 )
@@ -8,6 +9,17 @@ import (
 var SymmetricDirect = NewDirect(false)
 var FullconeDirect = NewDirect(true)
 
+var BlockedErr = fmt.Errorf("blocked")
+
+// Block refuses all connections.
+var Block proxy.Dialer = block{}
+
+type block struct{}
+
+func (block) Dial(network, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("%w: %v %v", BlockedErr, network, addr)
+}
+
 type direct struct {
 	proxy.Dialer
 	netDialer net.Dialer
@@ -0,0 +1,90 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/mzz2017/gg/dialer/transport/tls"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// connectDialer is an HTTP/HTTPS proxy client which tunnels every connection by CONNECT.
+type connectDialer struct {
+	dialer    proxy.Dialer
+	addr      string
+	tlsConfig *tls.Config
+	header    http.Header
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	c, err := d.dialer.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("[http]: dial to %s: %w", d.addr, err)
+	}
+	if d.tlsConfig != nil {
+		tlsConn, err := d.tlsConfig.Client(context.Background(), c, "http/1.1")
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("[http]: tls handshake with %s: %w", d.addr, err)
+		}
+		c = tlsConn
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: d.header.Clone(),
+	}
+	_ = c.SetDeadline(time.Now().Add(15 * time.Second))
+	if err = req.Write(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("[http]: write CONNECT: %w", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("[http]: read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("[http]: connect to %v through %v: %v", addr, d.addr, resp.Status)
+	}
+	_ = c.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// bufferedConn reads the data which was read ahead with the CONNECT response first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
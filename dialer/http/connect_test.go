@@ -0,0 +1,164 @@
+package http
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/gg/dialer"
+)
+
+// newCert returns a self-signed certificate for 127.0.0.1 in PEM.
+func newCert(t *testing.T, name string) (certPEM, keyPEM string, cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bKey}))
+	if cert, err = tls.X509KeyPair([]byte(certPEM), []byte(keyPEM)); err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM, cert
+}
+
+type connectRequest struct {
+	target     string
+	header     http.Header
+	clientCert string // clientCert is the common name of the client certificate
+}
+
+// serveConnect starts an HTTPS proxy which requests a client certificate, records the CONNECT requests and
+// echoes the tunneled data.
+func serveConnect(t *testing.T, cert tls.Certificate) (addr string, requests chan connectRequest) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	requests = make(chan connectRequest, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				r := connectRequest{target: req.Host, header: req.Header}
+				if certs := c.(*tls.Conn).ConnectionState().PeerCertificates; len(certs) > 0 {
+					r.clientCert = certs[0].Subject.CommonName
+				}
+				requests <- r
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(c, br)
+			}()
+		}
+	}()
+	return l.Addr().String(), requests
+}
+
+func TestConnect(t *testing.T) {
+	serverPEM, _, serverCert := newCert(t, "proxy")
+	clientPEM, clientKey, _ := newCert(t, "gg")
+	addr, requests := serveConnect(t, serverCert)
+	_, strPort, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(strPort)
+	s := &HTTP{
+		Server:   "127.0.0.1",
+		Port:     port,
+		Username: "user",
+		Password: "pass",
+		Protocol: "https",
+		Cert:     clientPEM,
+		Key:      clientKey,
+		CA:       serverPEM,
+		Headers:  map[string]string{"X-Gg": "1"},
+	}
+	d, err := s.Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := <-requests
+	if r.target != "example.com:443" || r.header.Get("X-Gg") != "1" ||
+		r.header.Get("Proxy-Authorization") != basicAuth("user", "pass") {
+		t.Fatalf("unexpected CONNECT request: %+v", r)
+	}
+	if r.clientCert != "gg" {
+		t.Fatalf("the client certificate is not presented: %q", r.clientCert)
+	}
+	msg := []byte("hello")
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("unexpected echo: %q %v", buf, err)
+	}
+
+	// the proxy is not trusted without the CA
+	s.CA = ""
+	if d, err = s.Dialer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Dial("tcp", "example.com:443"); err == nil {
+		t.Fatal("expect an error because the certificate of the proxy is not trusted")
+	}
+}
+
+func TestParseHTTPURL(t *testing.T) {
+	s, err := ParseHTTPURL("https://u:p@example.com?header=X-A%3A%201&header=X-B%3A2&sni=proxy#node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Port != 443 || s.SNI != "proxy" || s.Headers["X-A"] != "1" || s.Headers["X-B"] != "2" {
+		t.Fatalf("unexpected result: %+v", s)
+	}
+	if _, err = dialer.NewFromLink("https", s.ExportToURL(), &dialer.GlobalOption{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,13 +1,16 @@
 package http
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/mzz2017/gg/common"
 	"github.com/mzz2017/gg/dialer"
-	"github.com/mzz2017/softwind/protocol/http"
+	tls2 "github.com/mzz2017/gg/dialer/transport/tls"
 	"gopkg.in/yaml.v3"
 	"net"
+	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 )
 
@@ -18,14 +21,20 @@ func init() {
 }
 
 type HTTP struct {
-	Name          string `json:"name"`
-	Server        string `json:"server"`
-	Port          int    `json:"port"`
-	Username      string `json:"username"`
-	Password      string `json:"password"`
-	SNI           string `json:"sni"`
-	Protocol      string `json:"protocol"`
-	AllowInsecure bool   `json:"allowInsecure"`
+	Name          string            `json:"name"`
+	Server        string            `json:"server"`
+	Port          int               `json:"port"`
+	Username      string            `json:"username"`
+	Password      string            `json:"password"`
+	SNI           string            `json:"sni"`
+	Protocol      string            `json:"protocol"`
+	AllowInsecure bool              `json:"allowInsecure"`
+	Cert          string            `json:"cert"`
+	Key           string            `json:"key"`
+	CA            string            `json:"ca"`
+	Fingerprint   string            `json:"fp"`
+	PinSHA256     string            `json:"pinSHA256"`
+	Headers       map[string]string `json:"headers"`
 }
 
 func NewHTTP(link string, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
@@ -68,6 +77,11 @@ func ParseHTTPURL(link string) (data *HTTP, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("error when parsing port: %w", err)
 	}
+	// header=Name:Value can be given multiple times.
+	headers, err := common.ParseHeaders(u.Query()["header"])
+	if err != nil {
+		return nil, err
+	}
 	return &HTTP{
 		Name:     u.Fragment,
 		Server:   u.Hostname(),
@@ -78,19 +92,31 @@ func ParseHTTPURL(link string) (data *HTTP, err error) {
 		Protocol: u.Scheme,
 		AllowInsecure: common.StringToBool(u.Query().Get("allowInsecure")) ||
 			common.StringToBool(u.Query().Get("skipVerify")),
+		Cert:        u.Query().Get("cert"),
+		Key:         u.Query().Get("key"),
+		CA:          u.Query().Get("ca"),
+		Fingerprint: u.Query().Get("fp"),
+		PinSHA256:   u.Query().Get("pinSHA256"),
+		Headers:     headers,
 	}, nil
 }
 
 func ParseClash(o *yaml.Node) (data *HTTP, err error) {
 	type HttpOption struct {
-		Name           string `yaml:"name"`
-		Server         string `yaml:"server"`
-		Port           int    `yaml:"port"`
-		UserName       string `yaml:"username,omitempty"`
-		Password       string `yaml:"password,omitempty"`
-		TLS            bool   `yaml:"tls,omitempty"`
-		SNI            string `yaml:"sni,omitempty"`
-		SkipCertVerify bool   `yaml:"skip-cert-verify,omitempty"`
+		Name           string            `yaml:"name"`
+		Server         string            `yaml:"server"`
+		Port           int               `yaml:"port"`
+		UserName       string            `yaml:"username,omitempty"`
+		Password       string            `yaml:"password,omitempty"`
+		TLS            bool              `yaml:"tls,omitempty"`
+		SNI            string            `yaml:"sni,omitempty"`
+		SkipCertVerify bool              `yaml:"skip-cert-verify,omitempty"`
+		Certificate    string            `yaml:"certificate,omitempty"`
+		PrivateKey     string            `yaml:"private-key,omitempty"`
+		CA             string            `yaml:"ca,omitempty"`
+		Fingerprint    string            `yaml:"fingerprint,omitempty"`
+		ClientFP       string            `yaml:"client-fingerprint,omitempty"`
+		Headers        map[string]string `yaml:"headers,omitempty"`
 	}
 	var option HttpOption
 	if err = o.Decode(&option); err != nil {
@@ -109,14 +135,42 @@ func ParseClash(o *yaml.Node) (data *HTTP, err error) {
 		SNI:           option.SNI,
 		AllowInsecure: option.SkipCertVerify,
 		Protocol:      scheme,
+		Cert:          option.Certificate,
+		Key:           option.PrivateKey,
+		CA:            option.CA,
+		Fingerprint:   option.ClientFP,
+		PinSHA256:     option.Fingerprint,
+		Headers:       option.Headers,
 	}, nil
 }
 
 func (s *HTTP) Dialer() (*dialer.Dialer, error) {
 	u := s.URL()
-	d, err := http.NewHTTPProxy(&u, dialer.SymmetricDirect)
-	if err != nil {
-		return nil, err
+	d := &connectDialer{
+		dialer: dialer.SymmetricDirect,
+		addr:   u.Host,
+		header: make(http.Header),
+	}
+	if s.Username != "" {
+		d.header.Set("Proxy-Authorization", basicAuth(s.Username, s.Password))
+	}
+	// Custom headers are able to override the Proxy-Authorization above with another scheme.
+	for k, v := range s.Headers {
+		d.header.Set(k, v)
+	}
+	if s.Protocol == "https" {
+		var err error
+		// sni, allowInsecure, ca, fp and pinSHA256 are in the query.
+		if d.tlsConfig, err = tls2.ConfigFromQuery(u.Query(), s.Server); err != nil {
+			return nil, fmt.Errorf("%w: %v", dialer.InvalidParameterErr, err)
+		}
+		if s.Cert != "" {
+			cert, err := tls2.LoadCertificate(s.Cert, s.Key)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", dialer.InvalidParameterErr, err)
+			}
+			d.tlsConfig.Certificates = []tls.Certificate{cert}
+		}
 	}
 	return dialer.NewDialer(d, false, s.Name, s.Protocol, u.String()), nil
 }
@@ -127,12 +181,23 @@ func (s *HTTP) URL() url.URL {
 		Host:     net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
 		Fragment: s.Name,
 	}
-	if s.SNI != "" {
-		u.RawQuery = url.Values{
-			"sni":           []string{s.SNI},
-			"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
-		}.Encode()
+	q := u.Query()
+	common.SetValue(&q, "sni", s.SNI)
+	if s.AllowInsecure {
+		q.Set("allowInsecure", common.BoolToString(s.AllowInsecure))
+	}
+	common.SetValue(&q, "cert", s.Cert)
+	common.SetValue(&q, "key", s.Key)
+	tls2.SetQuery(&q, "", s.Fingerprint, s.PinSHA256, s.CA)
+	keys := make([]string, 0, len(s.Headers))
+	for k := range s.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		q.Add("header", k+": "+s.Headers[k])
 	}
+	u.RawQuery = q.Encode()
 	if s.Username != "" {
 		if s.Password != "" {
 			u.User = url.UserPassword(s.Username, s.Password)
@@ -2,10 +2,13 @@ package socks
 
 import (
 	"fmt"
+	"github.com/mzz2017/gg/common"
 	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/dialer/transport/tls"
+	"github.com/mzz2017/softwind/protocol/socks5"
 	"github.com/nadoo/glider/proxy"
 	"github.com/nadoo/glider/proxy/socks4"
-	"github.com/nadoo/glider/proxy/socks5"
+	proxy2 "golang.org/x/net/proxy"
 	"gopkg.in/yaml.v3"
 	"net"
 	"net/url"
@@ -28,6 +31,14 @@ type Socks struct {
 	Password string `json:"password"`
 	Protocol string `json:"protocol"`
 	UDP      bool   `json:"udp"`
+
+	// TLS wraps the TCP connection to the SOCKS5 server. The UDP relay is not affected.
+	TLS           bool   `json:"tls"`
+	SNI           string `json:"sni"`
+	AllowInsecure bool   `json:"allowInsecure"`
+	Fingerprint   string `json:"fp"`
+	PinSHA256     string `json:"pinSHA256"`
+	CA            string `json:"ca"`
 }
 
 func NewSocks(link string, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
@@ -35,6 +46,9 @@ func NewSocks(link string, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
 	if err != nil {
 		return nil, dialer.InvalidParameterErr
 	}
+	if opt.AllowInsecure {
+		s.AllowInsecure = true
+	}
 	return s.Dialer()
 }
 
@@ -43,6 +57,9 @@ func NewSocks5FromClashObj(o *yaml.Node, opt *dialer.GlobalOption) (*dialer.Dial
 	if err != nil {
 		return nil, err
 	}
+	if opt.AllowInsecure {
+		s.AllowInsecure = true
+	}
 	return s.Dialer()
 }
 
@@ -50,12 +67,38 @@ func (s *Socks) Dialer() (*dialer.Dialer, error) {
 	link := s.ExportToURL()
 	switch s.Protocol {
 	case "", "socks", "socks5":
-		d, err := socks5.NewSocks5Dialer(link, &proxy.Direct{})
+		var forward proxy2.Dialer = dialer.SymmetricDirect
+		if s.TLS {
+			sni := s.SNI
+			if sni == "" {
+				sni = s.Server
+			}
+			query := url.Values{
+				"sni":           []string{sni},
+				"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
+			}
+			tls.SetQuery(&query, "", s.Fingerprint, s.PinSHA256, s.CA)
+			u := url.URL{
+				Scheme:   "tls",
+				Host:     net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
+				RawQuery: query.Encode(),
+			}
+			t, err := tls.NewTls(u.String(), forward)
+			if err != nil {
+				return nil, err
+			}
+			forward = &tlsTCPDialer{tls: t, udp: forward}
+		}
+		// UDP is relayed by UDP ASSOCIATE.
+		d, err := socks5.NewSocks5Dialer(link, forward)
 		if err != nil {
 			return nil, err
 		}
 		return dialer.NewDialer(d, s.UDP, s.Name, s.Protocol, link), nil
 	case "socks4", "socks4a":
+		if s.TLS {
+			return nil, fmt.Errorf("%w: tls is not supported by %v", dialer.UnexpectedFieldErr, s.Protocol)
+		}
 		d, err := socks4.NewSocks4Dialer(link, &proxy.Direct{})
 		if err != nil {
 			return nil, err
@@ -74,27 +117,29 @@ func ParseClashSocks5(o *yaml.Node) (data *Socks, err error) {
 		UserName       string `yaml:"username,omitempty"`
 		Password       string `yaml:"password,omitempty"`
 		TLS            bool   `yaml:"tls,omitempty"`
+		SNI            string `yaml:"sni,omitempty"`
 		UDP            bool   `yaml:"udp,omitempty"`
 		SkipCertVerify bool   `yaml:"skip-cert-verify,omitempty"`
+		Fingerprint    string `yaml:"fingerprint,omitempty"`
+		ClientFP       string `yaml:"client-fingerprint,omitempty"`
 	}
 	var option Socks5Option
 	if err = o.Decode(&option); err != nil {
 		return nil, err
 	}
-	if option.TLS {
-		return nil, fmt.Errorf("%w: tls=true", dialer.UnexpectedFieldErr)
-	}
-	if option.SkipCertVerify {
-		return nil, fmt.Errorf("%w: skip-cert-verify=true", dialer.UnexpectedFieldErr)
-	}
 	return &Socks{
-		Name:     option.Name,
-		Server:   option.Server,
-		Port:     option.Port,
-		Username: option.UserName,
-		Password: option.Password,
-		Protocol: "socks5",
-		UDP:      option.UDP,
+		Name:          option.Name,
+		Server:        option.Server,
+		Port:          option.Port,
+		Username:      option.UserName,
+		Password:      option.Password,
+		Protocol:      "socks5",
+		UDP:           option.UDP,
+		TLS:           option.TLS,
+		SNI:           option.SNI,
+		AllowInsecure: option.SkipCertVerify,
+		Fingerprint:   option.ClientFP,
+		PinSHA256:     option.Fingerprint,
 	}, nil
 }
 
@@ -118,13 +163,19 @@ func ParseSocksURL(link string) (data *Socks, err error) {
 		udp = false
 	}
 	return &Socks{
-		Name:     u.Fragment,
-		Server:   u.Hostname(),
-		Port:     port,
-		Username: u.User.Username(),
-		Password: pwd,
-		Protocol: u.Scheme,
-		UDP:      udp,
+		Name:          u.Fragment,
+		Server:        u.Hostname(),
+		Port:          port,
+		Username:      u.User.Username(),
+		Password:      pwd,
+		Protocol:      u.Scheme,
+		UDP:           udp,
+		TLS:           common.StringToBool(u.Query().Get("tls")),
+		SNI:           u.Query().Get("sni"),
+		AllowInsecure: common.StringToBool(u.Query().Get("allowInsecure")),
+		Fingerprint:   u.Query().Get("fp"),
+		PinSHA256:     u.Query().Get("pinSHA256"),
+		CA:            u.Query().Get("ca"),
 	}, nil
 }
 
@@ -141,5 +192,33 @@ func (s *Socks) ExportToURL() string {
 		Host:     net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
 		Fragment: s.Name,
 	}
+	q := u.Query()
+	if s.Protocol == "socks5" && !s.UDP {
+		q.Set("udp", "false")
+	}
+	if s.TLS {
+		q.Set("tls", "1")
+		common.SetValue(&q, "sni", s.SNI)
+		if s.AllowInsecure {
+			q.Set("allowInsecure", "1")
+		}
+		tls.SetQuery(&q, "", s.Fingerprint, s.PinSHA256, s.CA)
+	}
+	u.RawQuery = q.Encode()
 	return u.String()
 }
+
+// tlsTCPDialer dials TCP through TLS and UDP through the plain dialer.
+type tlsTCPDialer struct {
+	tls proxy2.Dialer
+	udp proxy2.Dialer
+}
+
+func (d *tlsTCPDialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "udp":
+		return d.udp.Dial(network, addr)
+	default:
+		return d.tls.Dial(network, addr)
+	}
+}
@@ -0,0 +1,125 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/softwind/protocol/infra/socks"
+)
+
+// serveSocks5 starts a SOCKS5 server without authentication which only supports UDP ASSOCIATE, and relays each
+// datagram to its target and the response back.
+func serveSocks5(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveAssociate(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveAssociate(c net.Conn) {
+	defer c.Close()
+	buf := make([]byte, 2048)
+	// VER NMETHODS METHODS
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+	// VER CMD RSV DST.ADDR DST.PORT
+	if _, err := io.ReadFull(c, buf[:3]); err != nil || buf[1] != socks.CmdUDPAssociate {
+		return
+	}
+	if _, err := socks.ReadAddr(c); err != nil {
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	c.Write(append([]byte{5, 0, 0}, socks.ParseAddr(relay.LocalAddr().String())...))
+	go func() {
+		for {
+			// RSV FRAG ATYP DST.ADDR DST.PORT DATA
+			n, client, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			tgt := socks.SplitAddr(buf[3:n])
+			data := buf[3+len(tgt) : n]
+			conn, err := net.Dial("udp", tgt.String())
+			if err != nil {
+				continue
+			}
+			conn.Write(data)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp := make([]byte, 2048)
+			m, err := conn.Read(resp)
+			conn.Close()
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(append(append([]byte{0, 0, 0}, tgt...), resp[:m]...), client)
+		}
+	}()
+	// the association ends with the TCP connection
+	io.Copy(io.Discard, c)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+	host, strPort, _ := net.SplitHostPort(serveSocks5(t))
+	port, _ := strconv.Atoi(strPort)
+	d, err := (&Socks{Server: host, Port: port, Protocol: "socks5", UDP: true}).Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.SupportUDP() {
+		t.Fatal("UDP is not supported")
+	}
+	c, err := d.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	msg := []byte("hello")
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != string(msg) {
+		t.Fatalf("unexpected response: %q %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,83 @@
+package grpc
+
+import (
+	"fmt"
+	"github.com/mzz2017/gg/common"
+	"github.com/mzz2017/gg/dialer/transport/reality"
+	"github.com/mzz2017/gg/dialer/transport/tls"
+	"github.com/mzz2017/softwind/protocol"
+	"github.com/mzz2017/softwind/transport/grpc"
+	"golang.org/x/net/proxy"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// NewGrpc returns a gun dialer. The TLS is included, which is REALITY if security=reality.
+func NewGrpc(s string, d proxy.Dialer) (proxy.Dialer, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("NewGrpc: %w", err)
+	}
+	query := u.Query()
+	serviceName := query.Get("serviceName")
+	if serviceName == "" {
+		serviceName = "GunService"
+	}
+	sni := query.Get("sni")
+	if sni == "" {
+		sni = u.Hostname()
+	}
+	if query.Get("security") == "reality" {
+		// REALITY takes the place of TLS.
+		query.Set("sni", sni)
+		realityURL := url.URL{
+			Scheme:   "reality",
+			Host:     u.Host,
+			RawQuery: query.Encode(),
+		}
+		r, err := reality.NewReality(realityURL.String(), d)
+		if err != nil {
+			return nil, err
+		}
+		return &grpc.Dialer{
+			NextDialer:    &protocol.DialerConverter{Dialer: r},
+			ServiceName:   serviceName,
+			ServerName:    sni,
+			AllowInsecure: true, // it means no TLS in grpc
+		}, nil
+	}
+	alpn := query.Get("alpn")
+	if alpn != "" && !slices.Contains(strings.Split(alpn, ","), "h2") {
+		return nil, fmt.Errorf("NewGrpc: alpn %v: gRPC requires h2", alpn)
+	}
+	if query.Get("fp") == "" && query.Get("pinSHA256") == "" && query.Get("ca") == "" && (alpn == "" || alpn == "h2") {
+		// Let grpc do TLS, which also sets the authority to the sni.
+		return &grpc.Dialer{
+			NextDialer:    &protocol.DialerConverter{Dialer: d},
+			ServiceName:   serviceName,
+			ServerName:    sni,
+			AllowInsecure: common.StringToBool(query.Get("allowInsecure")),
+		}, nil
+	}
+	// Do TLS by ourselves and let grpc speak h2 over it.
+	if alpn == "" {
+		query.Set("alpn", "h2")
+	}
+	query.Set("sni", sni)
+	tlsURL := url.URL{
+		Scheme:   "tls",
+		Host:     u.Host,
+		RawQuery: query.Encode(),
+	}
+	t, err := tls.NewTls(tlsURL.String(), d)
+	if err != nil {
+		return nil, err
+	}
+	return &grpc.Dialer{
+		NextDialer:    &protocol.DialerConverter{Dialer: t},
+		ServiceName:   serviceName,
+		ServerName:    sni,
+		AllowInsecure: true, // it means no TLS in grpc
+	}, nil
+}
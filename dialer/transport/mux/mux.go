@@ -0,0 +1,275 @@
+// Package mux multiplexes streams over a small pool of connections to the node.
+// smux and yamux follow the sing-mux protocol of sing-box, and mux.cool follows Xray and v2ray.
+package mux
+
+import (
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolNone    = "none"
+	ProtocolSmux    = "smux"
+	ProtocolYamux   = "yamux"
+	ProtocolMuxCool = "mux.cool"
+)
+
+const (
+	DefaultMaxConnections = 4
+	DefaultIdleTimeout    = 60 * time.Second
+)
+
+type Option struct {
+	// Protocol is one of smux, yamux and mux.cool. Multiplexing is disabled if it is empty or none.
+	Protocol string
+	// MaxConnections is the max number of physical connections. 0 means unlimited.
+	MaxConnections int
+	// MaxStreams is the max number of streams in a physical connection before a new one is made. 0 means unlimited.
+	MaxStreams int
+	// IdleTimeout is how long a physical connection without any stream is kept. 0 means forever.
+	IdleTimeout time.Duration
+}
+
+// Enabled reports whether the multiplexing should be applied.
+func (o Option) Enabled() bool {
+	return o.Protocol != "" && o.Protocol != ProtocolNone
+}
+
+// Validate checks the protocol.
+func (o Option) Validate() error {
+	switch o.Protocol {
+	case "", ProtocolNone, ProtocolSmux, ProtocolYamux, ProtocolMuxCool:
+		return nil
+	default:
+		return fmt.Errorf("unsupported mux protocol: %v", o.Protocol)
+	}
+}
+
+// OptionFromQuery overrides opt by mux, muxConnections and muxStreams in the query.
+func OptionFromQuery(query url.Values, opt Option) (Option, error) {
+	var err error
+	if protocol := query.Get("mux"); protocol != "" {
+		opt.Protocol = strings.ToLower(protocol)
+	}
+	if v := query.Get("muxConnections"); v != "" {
+		if opt.MaxConnections, err = strconv.Atoi(v); err != nil {
+			return opt, fmt.Errorf("muxConnections: %w", err)
+		}
+	}
+	if v := query.Get("muxStreams"); v != "" {
+		if opt.MaxStreams, err = strconv.Atoi(v); err != nil {
+			return opt, fmt.Errorf("muxStreams: %w", err)
+		}
+	}
+	return opt, opt.Validate()
+}
+
+type session interface {
+	Open(addr string) (net.Conn, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+type pooledSession struct {
+	session
+	idleSince time.Time
+}
+
+// Mux is a dialer that carries TCP streams over multiplexed connections.
+// Other networks are passed to the next dialer unchanged.
+type Mux struct {
+	dialer     proxy.Dialer
+	opt        Option
+	newSession func(conn net.Conn) (session, error)
+	dest       string
+
+	mu       sync.Mutex
+	sessions []*pooledSession
+	// pending is the number of sessions being dialed.
+	pending int
+	janitor bool
+}
+
+// NewMux returns a Mux dialer over d.
+func NewMux(d proxy.Dialer, opt Option) (*Mux, error) {
+	m := &Mux{
+		dialer: d,
+		opt:    opt,
+	}
+	switch opt.Protocol {
+	case ProtocolSmux:
+		m.dest = singMuxDestination
+		m.newSession = newSmuxSession
+	case ProtocolYamux:
+		m.dest = singMuxDestination
+		m.newSession = newYamuxSession
+	case ProtocolMuxCool:
+		m.dest = muxCoolDestination
+		m.newSession = newMuxCoolSession
+	default:
+		return nil, fmt.Errorf("unsupported mux protocol: %v", opt.Protocol)
+	}
+	return m, nil
+}
+
+// Option returns the option of the multiplexing.
+func (m *Mux) Option() Option {
+	return m.opt
+}
+
+func (m *Mux) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return m.dialer.Dial(network, addr)
+	}
+	for {
+		s, fresh, err := m.offer()
+		if err != nil {
+			return nil, fmt.Errorf("[Mux]: %w", err)
+		}
+		c, err := s.Open(addr)
+		if err == nil {
+			return c, nil
+		}
+		// The connection may be closed by the server, so try again with a new one.
+		_ = s.Close()
+		m.remove(s)
+		if fresh {
+			return nil, fmt.Errorf("[Mux]: open stream: %w", err)
+		}
+	}
+}
+
+// offer returns the session to open a stream in, which is new if fresh is true.
+func (m *Mux) offer() (s *pooledSession, fresh bool, err error) {
+	m.mu.Lock()
+	m.prune()
+	for _, ps := range m.sessions {
+		if s == nil || ps.NumStreams() < s.NumStreams() {
+			s = ps
+		}
+	}
+	if s != nil && m.reusable(s.NumStreams()) {
+		s.idleSince = time.Time{}
+		m.mu.Unlock()
+		return s, false, nil
+	}
+	// Reserve the slot of the new session, which is dialed without the lock.
+	m.pending++
+	m.mu.Unlock()
+
+	ss, err := m.dialSession()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending--
+	if err != nil {
+		return nil, false, err
+	}
+	s = &pooledSession{session: ss}
+	m.sessions = append(m.sessions, s)
+	if m.opt.IdleTimeout > 0 && !m.janitor {
+		m.janitor = true
+		go m.cleanIdle()
+	}
+	return s, true, nil
+}
+
+// dialSession dials the node and makes a session over the connection.
+func (m *Mux) dialSession() (session, error) {
+	conn, err := m.dialer.Dial("tcp", m.dest)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := m.newSession(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (m *Mux) reusable(numStreams int) bool {
+	if numStreams == 0 {
+		return true
+	}
+	if m.opt.MaxConnections > 0 && len(m.sessions)+m.pending >= m.opt.MaxConnections {
+		return true
+	}
+	if m.opt.MaxStreams > 0 {
+		return numStreams < m.opt.MaxStreams
+	}
+	return m.opt.MaxConnections == 0
+}
+
+// prune removes closed sessions. m.mu must be held.
+func (m *Mux) prune() {
+	sessions := m.sessions[:0]
+	for _, s := range m.sessions {
+		if !s.IsClosed() {
+			sessions = append(sessions, s)
+		}
+	}
+	for i := len(sessions); i < len(m.sessions); i++ {
+		m.sessions[i] = nil
+	}
+	m.sessions = sessions
+}
+
+func (m *Mux) remove(s *pooledSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i] == s {
+			m.sessions = append(m.sessions[:i], m.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// cleanIdle closes sessions without any stream for IdleTimeout, and exits when the pool is empty.
+func (m *Mux) cleanIdle() {
+	interval := m.opt.IdleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		m.mu.Lock()
+		for _, s := range m.sessions {
+			if s.NumStreams() > 0 {
+				s.idleSince = time.Time{}
+			} else if s.idleSince.IsZero() {
+				s.idleSince = now
+			} else if now.Sub(s.idleSince) >= m.opt.IdleTimeout {
+				_ = s.Close()
+			}
+		}
+		m.prune()
+		if len(m.sessions) == 0 {
+			m.janitor = false
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Close closes all physical connections.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		_ = s.Close()
+	}
+	m.sessions = nil
+	return nil
+}
@@ -0,0 +1,421 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// muxCoolDestination is the destination that makes a v2ray or Xray inbound serve mux.cool.
+const muxCoolDestination = "v1.mux.cool:9527"
+
+const (
+	muxCoolStatusNew       = 1
+	muxCoolStatusKeep      = 2
+	muxCoolStatusEnd       = 3
+	muxCoolStatusKeepAlive = 4
+
+	muxCoolOptionData  = 1
+	muxCoolOptionError = 2
+
+	muxCoolNetworkTCP = 1
+
+	// muxCoolMaxChunk is the max size of the data in a frame.
+	muxCoolMaxChunk = 8192
+)
+
+var errMuxCoolRemoteError = fmt.Errorf("closed by the remote with an error")
+
+type muxCoolSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	streams   map[uint16]*muxCoolConn
+	lastID    uint16
+	exhausted bool
+	closed    bool
+}
+
+func newMuxCoolSession(conn net.Conn) (session, error) {
+	s := &muxCoolSession{
+		conn:    conn,
+		streams: make(map[uint16]*muxCoolConn),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *muxCoolSession) Open(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port: %v", port)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if s.exhausted {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("session ids are exhausted")
+	}
+	s.lastID++
+	id := s.lastID
+	if id == 0xffff {
+		// Session ids are never reused, so that late frames of old streams cannot be misdelivered.
+		s.exhausted = true
+	}
+	c := newMuxCoolConn(s, id)
+	s.streams[id] = c
+	s.mu.Unlock()
+
+	// The meta of a new stream: network, port and address.
+	meta := []byte{muxCoolNetworkTCP}
+	meta = binary.BigEndian.AppendUint16(meta, uint16(p))
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			meta = append(meta, 0x01)
+		} else {
+			meta = append(meta, 0x03)
+		}
+		meta = append(meta, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			s.removeStream(id)
+			return nil, fmt.Errorf("domain is too long: %v", host)
+		}
+		meta = append(meta, 0x02, byte(len(host)))
+		meta = append(meta, host...)
+	}
+	if err = s.writeFrame(id, muxCoolStatusNew, 0, meta, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *muxCoolSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports true also if no more stream can be opened, and the session closes itself after the streams end.
+func (s *muxCoolSession) IsClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed || s.exhausted
+}
+
+func (s *muxCoolSession) Close() error {
+	s.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (s *muxCoolSession) closeWithError(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	streams := s.streams
+	s.streams = make(map[uint16]*muxCoolConn)
+	s.mu.Unlock()
+	_ = s.conn.Close()
+	for _, c := range streams {
+		c.remoteClose(err)
+	}
+}
+
+func (s *muxCoolSession) removeStream(id uint16) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	done := s.exhausted && len(s.streams) == 0
+	s.mu.Unlock()
+	if done {
+		s.closeWithError(net.ErrClosed)
+	}
+}
+
+func (s *muxCoolSession) writeFrame(id uint16, status byte, option byte, extraMeta []byte, data []byte) error {
+	if len(data) > 0 {
+		option |= muxCoolOptionData
+	}
+	metaLen := 4 + len(extraMeta)
+	frame := make([]byte, 0, 2+metaLen+2+len(data))
+	frame = binary.BigEndian.AppendUint16(frame, uint16(metaLen))
+	frame = binary.BigEndian.AppendUint16(frame, id)
+	frame = append(frame, status, option)
+	frame = append(frame, extraMeta...)
+	if option&muxCoolOptionData != 0 {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+		frame = append(frame, data...)
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(frame)
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+func (s *muxCoolSession) readLoop() {
+	r := bufio.NewReader(s.conn)
+	var header [2]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		meta := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(r, meta); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if len(meta) < 4 {
+			s.closeWithError(fmt.Errorf("mux.cool: meta is too short"))
+			return
+		}
+		id := binary.BigEndian.Uint16(meta)
+		status, option := meta[2], meta[3]
+		var data []byte
+		if option&muxCoolOptionData != 0 {
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				s.closeWithError(err)
+				return
+			}
+			data = make([]byte, binary.BigEndian.Uint16(header[:]))
+			if _, err := io.ReadFull(r, data); err != nil {
+				s.closeWithError(err)
+				return
+			}
+		}
+		s.mu.Lock()
+		c := s.streams[id]
+		s.mu.Unlock()
+		switch status {
+		case muxCoolStatusKeep:
+			if c == nil {
+				// Tell the server that the stream has gone.
+				_ = s.writeFrame(id, muxCoolStatusEnd, 0, nil, nil)
+			} else if len(data) > 0 {
+				c.deliver(data)
+			}
+		case muxCoolStatusEnd:
+			if c != nil {
+				var err error = io.EOF
+				if option&muxCoolOptionError != 0 {
+					err = errMuxCoolRemoteError
+				}
+				c.remoteClose(err)
+				s.removeStream(id)
+			}
+		case muxCoolStatusNew, muxCoolStatusKeepAlive:
+			// Reverse proxy is not supported, and keep-alive needs no reply.
+		default:
+			s.closeWithError(fmt.Errorf("mux.cool: unexpected status: %v", status))
+			return
+		}
+	}
+}
+
+// muxCoolConn is a stream of muxCoolSession.
+type muxCoolConn struct {
+	s  *muxCoolSession
+	id uint16
+
+	chunks     chan []byte
+	buf        []byte
+	remoteDone chan struct{}
+	remoteErr  error
+	remoteOnce sync.Once
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newMuxCoolConn(s *muxCoolSession, id uint16) *muxCoolConn {
+	return &muxCoolConn{
+		s:             s,
+		id:            id,
+		chunks:        make(chan []byte, 16),
+		remoteDone:    make(chan struct{}),
+		done:          make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// deliver blocks the session until the data is accepted, which is how mux.cool does flow control.
+func (c *muxCoolConn) deliver(data []byte) {
+	select {
+	case c.chunks <- data:
+	case <-c.done:
+	}
+}
+
+func (c *muxCoolConn) remoteClose(err error) {
+	c.remoteOnce.Do(func() {
+		c.remoteErr = err
+		close(c.remoteDone)
+	})
+}
+
+func (c *muxCoolConn) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		select {
+		case c.buf = <-c.chunks:
+		case <-c.remoteDone:
+			// Chunks are always delivered before the remote closes.
+			select {
+			case c.buf = <-c.chunks:
+			default:
+				return 0, c.remoteErr
+			}
+		case <-c.done:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *muxCoolConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		select {
+		case <-c.done:
+			return n, net.ErrClosed
+		case <-c.remoteDone:
+			return n, c.remoteErr
+		case <-c.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		default:
+		}
+		chunk := b
+		if len(chunk) > muxCoolMaxChunk {
+			chunk = chunk[:muxCoolMaxChunk]
+		}
+		if err = c.s.writeFrame(c.id, muxCoolStatusKeep, 0, nil, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *muxCoolConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		select {
+		case <-c.remoteDone:
+		default:
+			_ = c.s.writeFrame(c.id, muxCoolStatusEnd, 0, nil, nil)
+		}
+		c.s.removeStream(c.id)
+	})
+	return nil
+}
+
+func (c *muxCoolConn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+func (c *muxCoolConn) RemoteAddr() net.Addr {
+	return c.s.conn.RemoteAddr()
+}
+
+func (c *muxCoolConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *muxCoolConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *muxCoolConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a resettable deadline in the way of net.Pipe.
+type deadline struct {
+	mu     *sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{
+		mu:     new(sync.Mutex),
+		cancel: make(chan struct{}),
+	}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer has fired.
+		<-d.cancel
+	}
+	d.timer = nil
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
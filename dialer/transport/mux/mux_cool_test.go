@@ -0,0 +1,145 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveMuxCool serves mux.cool over conn, which echoes the data of each stream, and ends a stream after echoing
+// "end". The destinations of the new streams are sent to dests.
+func serveMuxCool(conn net.Conn, dests chan<- string) {
+	defer conn.Close()
+	var writeMu sync.Mutex
+	writeFrame := func(id uint16, status byte, data []byte) {
+		var option byte
+		if len(data) > 0 {
+			option = muxCoolOptionData
+		}
+		frame := binary.BigEndian.AppendUint16(nil, 4)
+		frame = binary.BigEndian.AppendUint16(frame, id)
+		frame = append(frame, status, option)
+		if len(data) > 0 {
+			frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+			frame = append(frame, data...)
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.Write(frame)
+	}
+	r := bufio.NewReader(conn)
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		meta := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(r, meta); err != nil {
+			return
+		}
+		id, status, option := binary.BigEndian.Uint16(meta), meta[2], meta[3]
+		var data []byte
+		if option&muxCoolOptionData != 0 {
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				return
+			}
+			data = make([]byte, binary.BigEndian.Uint16(header[:]))
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+		}
+		switch status {
+		case muxCoolStatusNew:
+			// network, port, address type and address
+			port := binary.BigEndian.Uint16(meta[5:])
+			var host string
+			switch meta[7] {
+			case 0x01, 0x03:
+				host = net.IP(meta[8:]).String()
+			case 0x02:
+				host = string(meta[9:])
+			}
+			dests <- net.JoinHostPort(host, strconv.Itoa(int(port)))
+		case muxCoolStatusKeep:
+			writeFrame(id, muxCoolStatusKeep, data)
+			if string(data) == "end" {
+				writeFrame(id, muxCoolStatusEnd, nil)
+			}
+		case muxCoolStatusEnd:
+			dests <- "closed"
+		}
+	}
+}
+
+func TestMuxCool(t *testing.T) {
+	client, server := net.Pipe()
+	dests := make(chan string, 8)
+	go serveMuxCool(server, dests)
+	s, err := newMuxCoolSession(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, addr := range []string{"1.1.1.1:80", "[::1]:443", "example.com:8080"} {
+		c, err := s.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest := <-dests; dest != addr {
+			t.Fatalf("opened %v, want %v", dest, addr)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		msg := []byte("hello " + addr)
+		if _, err = c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+			t.Fatalf("unexpected echo: %q %v", buf, err)
+		}
+		if s.NumStreams() != 1 {
+			t.Fatalf("unexpected number of streams: %v", s.NumStreams())
+		}
+		// the local close ends the stream at the server
+		c.Close()
+		if dest := <-dests; dest != "closed" {
+			t.Fatalf("the stream is not closed: %v", dest)
+		}
+		if s.NumStreams() != 0 {
+			t.Fatalf("unexpected number of streams: %v", s.NumStreams())
+		}
+	}
+
+	// the remote close
+	c, err := s.Open("1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-dests
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write([]byte("end")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(c); err != nil || string(b) != "end" {
+		t.Fatalf("unexpected data before EOF: %q %v", b, err)
+	}
+
+	// the streams end with the session
+	c, err = s.Open("1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect an error after the session is closed")
+	}
+	if !s.IsClosed() {
+		t.Fatal("the session is not closed")
+	}
+}
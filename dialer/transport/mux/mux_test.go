@@ -0,0 +1,150 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serverDialer makes a connection to an in-process server of the protocol for each Dial, and blocks the Dial while
+// block is not nil.
+type serverDialer struct {
+	protocol string
+	dials    atomic.Int32
+	block    chan struct{}
+}
+
+func (d *serverDialer) Dial(network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	if d.block != nil {
+		<-d.block
+	}
+	client, server := net.Pipe()
+	dests := make(chan string, 64)
+	if d.protocol == ProtocolMuxCool {
+		go serveMuxCool(server, dests)
+	} else {
+		go serveSingMux(server, dests)
+	}
+	return client, nil
+}
+
+func echo(t *testing.T, c net.Conn) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("unexpected echo: %q %v", buf, err)
+	}
+}
+
+func TestMux_MaxStreams(t *testing.T) {
+	for _, protocol := range []string{ProtocolSmux, ProtocolYamux, ProtocolMuxCool} {
+		t.Run(protocol, func(t *testing.T) {
+			d := &serverDialer{protocol: protocol}
+			m, err := NewMux(d, Option{Protocol: protocol, MaxConnections: 2, MaxStreams: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			var conns []net.Conn
+			for i, dials := range []int32{1, 1, 2, 2, 2} {
+				c, err := m.Dial("tcp", "1.1.1.1:80")
+				if err != nil {
+					t.Fatal(err)
+				}
+				echo(t, c)
+				conns = append(conns, c)
+				// the fifth stream exceeds max streams because of max connections
+				if got := d.dials.Load(); got != dials {
+					t.Fatalf("stream %v: %v connections, want %v", i, got, dials)
+				}
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+		})
+	}
+}
+
+func TestMux_IdleTimeout(t *testing.T) {
+	d := &serverDialer{protocol: ProtocolSmux}
+	m, err := NewMux(d, Option{Protocol: ProtocolSmux, IdleTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c, err := m.Dial("tcp", "1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c)
+	c.Close()
+	// the idle session is closed within two ticks of the janitor
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		m.mu.Lock()
+		n := len(m.sessions)
+		m.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the idle session is not closed")
+		}
+	}
+	if c, err = m.Dial("tcp", "1.1.1.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c)
+	c.Close()
+	if got := d.dials.Load(); got != 2 {
+		t.Fatalf("%v connections, want 2", got)
+	}
+}
+
+func TestMux_DialWithoutLock(t *testing.T) {
+	d := &serverDialer{protocol: ProtocolSmux}
+	m, err := NewMux(d, Option{Protocol: ProtocolSmux, MaxConnections: 2, MaxStreams: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c, err := m.Dial("tcp", "1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the second connection is being dialed
+	d.block = make(chan struct{})
+	dialed := make(chan error, 1)
+	go func() {
+		c, err := m.Dial("tcp", "1.1.1.1:80")
+		if err == nil {
+			c.Close()
+		}
+		dialed <- err
+	}()
+	for d.dials.Load() != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the pending one counts against max connections, so the first session is used without waiting
+	c2, err := m.Dial("tcp", "1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c2)
+	c2.Close()
+	close(d.block)
+	if err = <-dialed; err != nil {
+		t.Fatal(err)
+	}
+	if got := d.dials.Load(); got != 2 {
+		t.Fatalf("%v connections, want 2", got)
+	}
+}
@@ -0,0 +1,175 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/xtaci/smux"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// singMuxDestination is the destination that makes a sing-box inbound serve sing-mux.
+const singMuxDestination = "sp.mux.sing-box.arpa:444"
+
+const (
+	singMuxVersion0      = 0
+	singMuxProtocolSmux  = 0
+	singMuxProtocolYamux = 1
+
+	singMuxStatusSuccess = 0
+	singMuxStatusError   = 1
+)
+
+// protocolConn writes the [version][protocol] header with the first payload.
+type protocolConn struct {
+	net.Conn
+	header  [2]byte
+	written bool
+}
+
+func (c *protocolConn) Write(b []byte) (int, error) {
+	if c.written {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, 0, len(c.header)+len(b))
+	buf = append(buf, c.header[:]...)
+	buf = append(buf, b...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	c.written = true
+	return len(b), nil
+}
+
+type smuxSession struct {
+	*smux.Session
+}
+
+func newSmuxSession(conn net.Conn) (session, error) {
+	config := smux.DefaultConfig()
+	config.KeepAliveDisabled = true
+	s, err := smux.Client(&protocolConn{Conn: conn, header: [2]byte{singMuxVersion0, singMuxProtocolSmux}}, config)
+	if err != nil {
+		return nil, err
+	}
+	return &smuxSession{Session: s}, nil
+}
+
+func (s *smuxSession) Open(addr string) (net.Conn, error) {
+	stream, err := s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return newSingMuxConn(stream, addr)
+}
+
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func newYamuxSession(conn net.Conn) (session, error) {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	config.StreamCloseTimeout = 5 * time.Second
+	config.StreamOpenTimeout = 5 * time.Second
+	s, err := yamux.Client(&protocolConn{Conn: conn, header: [2]byte{singMuxVersion0, singMuxProtocolYamux}}, config)
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxSession{Session: s}, nil
+}
+
+func (s *yamuxSession) Open(addr string) (net.Conn, error) {
+	stream, err := s.Session.Open()
+	if err != nil {
+		return nil, err
+	}
+	return newSingMuxConn(stream, addr)
+}
+
+// singMuxConn is a TCP stream, which sends the request at once and reads the response with the first Read.
+type singMuxConn struct {
+	net.Conn
+	reader       *bufio.Reader
+	responseOnce sync.Once
+	responseErr  error
+}
+
+func newSingMuxConn(stream net.Conn, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port: %v", port)
+	}
+	// flags (0 for TCP) and the destination in socks address format.
+	req := []byte{0, 0}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			req = append(req, 0x01)
+		} else {
+			req = append(req, 0x04)
+		}
+		req = append(req, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain is too long: %v", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(p))
+	if _, err = stream.Write(req); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	return &singMuxConn{
+		Conn:   stream,
+		reader: bufio.NewReaderSize(stream, 1),
+	}, nil
+}
+
+func (c *singMuxConn) readResponse() error {
+	status, err := c.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case singMuxStatusSuccess:
+		return nil
+	case singMuxStatusError:
+		l, err := binary.ReadUvarint(c.reader)
+		if err != nil {
+			return err
+		}
+		msg := make([]byte, l)
+		if _, err = io.ReadFull(c.reader, msg); err != nil {
+			return err
+		}
+		return fmt.Errorf("remote error: %v", string(msg))
+	default:
+		return fmt.Errorf("unexpected response status: %v", status)
+	}
+}
+
+func (c *singMuxConn) Read(b []byte) (int, error) {
+	c.responseOnce.Do(func() {
+		c.responseErr = c.readResponse()
+	})
+	if c.responseErr != nil {
+		return 0, c.responseErr
+	}
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,171 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/xtaci/smux"
+)
+
+// bufferedConn reads the bytes buffered before.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// serveSingMux serves sing-mux over conn, which echoes the data of each stream. The destinations of the new streams
+// are sent to dests, and a stream to the port 0 is refused.
+func serveSingMux(conn net.Conn, dests chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil || header[0] != singMuxVersion0 {
+		return
+	}
+	var accept func() (net.Conn, error)
+	switch header[1] {
+	case singMuxProtocolSmux:
+		s, err := smux.Server(&bufferedConn{Conn: conn, r: r}, smux.DefaultConfig())
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		accept = func() (net.Conn, error) { return s.AcceptStream() }
+	case singMuxProtocolYamux:
+		config := yamux.DefaultConfig()
+		config.LogOutput = io.Discard
+		s, err := yamux.Server(&bufferedConn{Conn: conn, r: r}, config)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		accept = s.Accept
+	default:
+		return
+	}
+	for {
+		stream, err := accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			// flags and the destination in socks address format
+			req := bufio.NewReader(stream)
+			b := make([]byte, 3)
+			if _, err := io.ReadFull(req, b); err != nil {
+				return
+			}
+			var host string
+			switch b[2] {
+			case 0x01, 0x04:
+				ip := make([]byte, 4)
+				if b[2] == 0x04 {
+					ip = make([]byte, 16)
+				}
+				if _, err := io.ReadFull(req, ip); err != nil {
+					return
+				}
+				host = net.IP(ip).String()
+			case 0x03:
+				l, err := req.ReadByte()
+				if err != nil {
+					return
+				}
+				domain := make([]byte, l)
+				if _, err := io.ReadFull(req, domain); err != nil {
+					return
+				}
+				host = string(domain)
+			}
+			port := make([]byte, 2)
+			if _, err := io.ReadFull(req, port); err != nil {
+				return
+			}
+			p := binary.BigEndian.Uint16(port)
+			dests <- net.JoinHostPort(host, strconv.Itoa(int(p)))
+			if p == 0 {
+				msg := "refused"
+				stream.Write(append(binary.AppendUvarint([]byte{singMuxStatusError}, uint64(len(msg))), msg...))
+				return
+			}
+			stream.Write([]byte{singMuxStatusSuccess})
+			io.Copy(stream, req)
+		}()
+	}
+}
+
+func TestSingMux(t *testing.T) {
+	for _, c := range []struct {
+		protocol   string
+		newSession func(conn net.Conn) (session, error)
+	}{
+		{ProtocolSmux, newSmuxSession},
+		{ProtocolYamux, newYamuxSession},
+	} {
+		t.Run(c.protocol, func(t *testing.T) {
+			client, server := net.Pipe()
+			dests := make(chan string, 8)
+			go serveSingMux(server, dests)
+			s, err := c.newSession(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for _, addr := range []string{"1.1.1.1:80", "[::1]:443", "example.com:8080"} {
+				conn, err := s.Open(addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				msg := []byte("hello " + addr)
+				if _, err = conn.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, len(msg))
+				if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != string(msg) {
+					t.Fatalf("unexpected echo: %q %v", buf, err)
+				}
+				if dest := <-dests; dest != addr {
+					t.Fatalf("opened %v, want %v", dest, addr)
+				}
+				if n := s.NumStreams(); n != 1 {
+					t.Fatalf("unexpected number of streams: %v", n)
+				}
+				conn.Close()
+				// the stream is removed once the server closes it too
+				for deadline := time.Now().Add(5 * time.Second); s.NumStreams() != 0; time.Sleep(10 * time.Millisecond) {
+					if time.Now().After(deadline) {
+						t.Fatalf("unexpected number of streams: %v", s.NumStreams())
+					}
+				}
+			}
+
+			// the error response of the server
+			conn, err := s.Open("1.1.1.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = conn.Read(make([]byte, 1)); err == nil || err.Error() != "remote error: refused" {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			conn.Close()
+
+			s.Close()
+			if !s.IsClosed() {
+				t.Fatal("the session is not closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// Package reality implements the client side of the REALITY handshake.
+// https://github.com/XTLS/REALITY
+package reality
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/mzz2017/gg/dialer/transport/tls"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// version is the client version reported in the session id, which could be limited by the server.
+var version = [3]byte{1, 8, 0}
+
+// Reality is a base Reality struct
+type Reality struct {
+	dialer      proxy.Dialer
+	addr        string
+	serverName  string
+	fingerprint utls.ClientHelloID
+	// spec overrides the fingerprint if given.
+	spec      *utls.ClientHelloSpec
+	publicKey *ecdh.PublicKey
+	shortID   [8]byte
+	spiderX   string
+}
+
+// NewReality returns a Reality infra.
+// The query accepts sni, fp (chrome by default), pbk (the public key of the server), sid (the short id) and spx (spiderX).
+func NewReality(s string, d proxy.Dialer) (*Reality, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("NewReality: %w", err)
+	}
+	query := u.Query()
+	t := &Reality{
+		dialer:     d,
+		addr:       u.Host,
+		serverName: query.Get("sni"),
+		spiderX:    query.Get("spx"),
+	}
+	if t.serverName == "" {
+		t.serverName = u.Hostname()
+	}
+	fp := strings.ToLower(query.Get("fp"))
+	if fp == "" || fp == "none" {
+		// REALITY does not work with the Go default ClientHello.
+		fp = "chrome"
+	}
+	if t.fingerprint, err = tls.ClientHelloID(fp); err != nil {
+		return nil, fmt.Errorf("NewReality: %w", err)
+	}
+	pbk, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(query.Get("pbk"), "="))
+	if err != nil {
+		return nil, fmt.Errorf("NewReality: pbk: %w", err)
+	}
+	if t.publicKey, err = ecdh.X25519().NewPublicKey(pbk); err != nil {
+		return nil, fmt.Errorf("NewReality: pbk: %w", err)
+	}
+	sid := query.Get("sid")
+	if len(sid) > 2*len(t.shortID) {
+		return nil, fmt.Errorf("NewReality: sid is too long: %v", sid)
+	}
+	if len(sid)%2 == 1 {
+		sid += "0"
+	}
+	if _, err = hex.Decode(t.shortID[:], []byte(sid)); err != nil {
+		return nil, fmt.Errorf("NewReality: sid: %w", err)
+	}
+	if t.spiderX == "" || t.spiderX[0] != '/' {
+		t.spiderX = "/" + t.spiderX
+	}
+	return t, nil
+}
+
+func (s *Reality) Dial(network, addr string) (conn net.Conn, err error) {
+	rc, err := s.dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("[Reality]: dial to %s: %w", s.addr, err)
+	}
+	c, err := s.Client(context.Background(), rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("[Reality]: %w", err)
+	}
+	return c, nil
+}
+
+// Client makes a REALITY client connection over conn and completes the handshake.
+func (s *Reality) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	var (
+		authKey  []byte
+		verified bool
+	)
+	uConn := utls.UClient(conn, &utls.Config{
+		ServerName: s.serverName,
+		// The certificate is verified by the auth key, or as a normal certificate in VerifyPeerCertificate.
+		InsecureSkipVerify:     true,
+		SessionTicketsDisabled: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no certificate")
+			}
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			if verifyAuth(certs[0], authKey) {
+				verified = true
+				return nil
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       s.serverName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		},
+	}, s.fingerprint)
+	if s.spec != nil {
+		uConn.ClientHelloID = utls.HelloCustom
+		if err := uConn.ApplyPreset(s.spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := uConn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	hello := uConn.HandshakeState.Hello
+	ecdhe := uConn.HandshakeState.State13.EcdheKey
+	if ecdhe == nil {
+		return nil, fmt.Errorf("the fingerprint does not support TLS 1.3")
+	}
+	shared, err := ecdhe.ECDH(s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if authKey, err = deriveAuthKey(shared, hello.Random); err != nil {
+		return nil, err
+	}
+	hello.SessionId = sessionID(s.shortID, time.Now())
+	if err = sealSessionID(hello.SessionId, authKey, hello.Random, hello.Raw); err != nil {
+		return nil, err
+	}
+	if err = uConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	if !verified {
+		// We are talking to the real website. Behave like a browser before leaving.
+		s.spider(uConn)
+		return nil, fmt.Errorf("the server is not verified as a REALITY server")
+	}
+	return uConn, nil
+}
+
+// deriveAuthKey derives the key shared with the server from the ECDHE secret and the client random.
+func deriveAuthKey(shared []byte, random []byte) ([]byte, error) {
+	authKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, random[:20], []byte("REALITY")), authKey); err != nil {
+		return nil, err
+	}
+	return authKey, nil
+}
+
+// sessionID returns the plaintext session id: version, reserved, timestamp and short id.
+func sessionID(shortID [8]byte, now time.Time) []byte {
+	id := make([]byte, 32)
+	copy(id, version[:])
+	binary.BigEndian.PutUint32(id[4:], uint32(now.Unix()))
+	copy(id[8:], shortID[:])
+	return id
+}
+
+// sealSessionID seals the first 16 bytes of the session id in place by the auth key, and writes it into raw, the
+// ClientHello message, which is the additional data with the session id cleared.
+func sealSessionID(sessionID []byte, authKey []byte, random []byte, raw []byte) error {
+	block, err := aes.NewCipher(authKey)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	// type (1), length (3), version (2), random (32) and session id length (1)
+	copy(raw[39:], make([]byte, 32))
+	aead.Seal(sessionID[:0], random[20:], sessionID[:16], raw)
+	copy(raw[39:], sessionID)
+	return nil
+}
+
+// verifyAuth reports whether the certificate is signed by the auth key, which only a REALITY server can do.
+func verifyAuth(cert *x509.Certificate, authKey []byte) bool {
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return false
+	}
+	h := hmac.New(sha512.New, authKey)
+	h.Write(pub)
+	return bytes.Equal(h.Sum(nil), cert.Signature)
+}
+
+// spider requests spiderX from the website like a browser.
+func (s *Reality) spider(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		return
+	}
+	defer cc.Close()
+	req, err := http.NewRequest("GET", "https://"+s.serverName+s.spiderX, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
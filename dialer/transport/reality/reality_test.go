@@ -0,0 +1,270 @@
+package reality
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+func seq(from, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(from + i)
+	}
+	return b
+}
+
+func TestDeriveAuthKey(t *testing.T) {
+	key, err := deriveAuthKey(seq(0, 32), seq(32, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(key); got != "7b5a66114b135a545cd6a012c439ae29697a0c1e7f1d65576c6cf70f2fd5493c" {
+		t.Fatalf("unexpected auth key: %v", got)
+	}
+	// the signature of the certificate is the HMAC of the public key
+	sig, _ := hex.DecodeString("38e9e76f32503ae8f53a243ccbc1a3d0385c5189c893019bbacfc0907bfff514aa1f9f307bcd2892bbb944855a7a038f7eedc10ea52f8ac5bede2f1ab5126731")
+	cert := &x509.Certificate{PublicKey: ed25519.PublicKey(seq(100, 32)), Signature: sig}
+	if !verifyAuth(cert, key) {
+		t.Fatal("the certificate signed by the auth key is not verified")
+	}
+	cert.Signature = seq(0, 64)
+	if verifyAuth(cert, key) {
+		t.Fatal("the certificate not signed by the auth key is verified")
+	}
+}
+
+func TestSealSessionID(t *testing.T) {
+	key, random := seq(0, 32), seq(32, 32)
+	id := sessionID([8]byte{0xab, 0xcd}, time.Unix(0x01020304, 0))
+	if got := hex.EncodeToString(id[:16]); got != "0108000001020304abcd000000000000" {
+		t.Fatalf("unexpected session id: %v", got)
+	}
+	raw := append(seq(0, 39), seq(200, 32)...)
+	if err := sealSessionID(id, key, random, raw); err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(id); got != "b577d6a65fe7d6f4f6c1370adf891e3764785120461f90615d2f22b7f3208c80" {
+		t.Fatalf("unexpected sealed session id: %v", got)
+	}
+	if !bytes.Equal(raw[39:], id) {
+		t.Fatal("the sealed session id is not written into the ClientHello")
+	}
+	plain, err := openSessionID(key, random, raw)
+	if err != nil || !bytes.Equal(plain[8:10], []byte{0xab, 0xcd}) {
+		t.Fatalf("unexpected opened session id: %x %v", plain, err)
+	}
+}
+
+// openSessionID opens the session id in the ClientHello message raw, as a REALITY server does.
+func openSessionID(authKey []byte, random []byte, raw []byte) ([]byte, error) {
+	block, err := aes.NewCipher(authKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	ad := bytes.Clone(raw)
+	copy(ad[39:], make([]byte, 32))
+	return aead.Open(nil, random[20:], raw[39:39+32], ad)
+}
+
+// clientHello parses the random and the X25519 key share of the ClientHello message.
+func clientHello(msg []byte) (random []byte, keyShare []byte, ok bool) {
+	if len(msg) < 39+32 || msg[0] != 1 {
+		return nil, nil, false
+	}
+	random = msg[6:38]
+	b := msg[39+int(msg[38]):]
+	next := func(lenSize int) []byte {
+		if len(b) < lenSize {
+			b = nil
+			return nil
+		}
+		n := 0
+		for _, v := range b[:lenSize] {
+			n = n<<8 | int(v)
+		}
+		if len(b) < lenSize+n {
+			b = nil
+			return nil
+		}
+		v := b[lenSize : lenSize+n]
+		b = b[lenSize+n:]
+		return v
+	}
+	next(2) // cipher suites
+	next(1) // compression methods
+	exts := next(2)
+	for len(exts) >= 4 {
+		typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			break
+		}
+		if typ == 0x0033 {
+			// key_share
+			shares := exts[4+2 : 4+n]
+			for len(shares) >= 4 {
+				group, m := binary.BigEndian.Uint16(shares), int(binary.BigEndian.Uint16(shares[2:]))
+				if len(shares) < 4+m {
+					break
+				}
+				if group == 0x001d {
+					return random, shares[4 : 4+m], true
+				}
+				shares = shares[4+m:]
+			}
+		}
+		exts = exts[4+n:]
+	}
+	return random, nil, false
+}
+
+// prefixConn reads the bytes peeked before.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// serveReality starts a REALITY server of the private key and the short id, which echoes the data. The certificate
+// is signed by the auth key if the client is authenticated, and is an ordinary self-signed one otherwise.
+func serveReality(t *testing.T, private *ecdh.PrivateKey, shortID [8]byte) string {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				hdr, err := r.Peek(5)
+				if err != nil {
+					return
+				}
+				record, err := r.Peek(5 + int(binary.BigEndian.Uint16(hdr[3:])))
+				if err != nil {
+					return
+				}
+				cert := bytes.Clone(der)
+				if random, share, ok := clientHello(record[5:]); ok {
+					if clientPub, err := ecdh.X25519().NewPublicKey(share); err == nil {
+						shared, _ := private.ECDH(clientPub)
+						authKey, _ := deriveAuthKey(shared, random)
+						if id, err := openSessionID(authKey, random, record[5:]); err == nil && bytes.Equal(id[8:16], shortID[:]) {
+							// the ed25519 signature is the last 64 bytes
+							h := hmac.New(sha512.New, authKey)
+							h.Write(pub)
+							copy(cert[len(cert)-64:], h.Sum(nil))
+						}
+					}
+				}
+				tc := tls.Server(&prefixConn{Conn: c, r: r}, &tls.Config{
+					Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: priv}},
+					MinVersion:   tls.VersionTLS13,
+					NextProtos:   []string{"h2", "http/1.1"},
+				})
+				io.Copy(tc, tc)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestHandshake(t *testing.T) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortID := [8]byte{0x12, 0x34}
+	addr := serveReality(t, private, shortID)
+	pbk := base64.RawURLEncoding.EncodeToString(private.PublicKey().Bytes())
+	for _, c := range []struct {
+		sid string
+		ok  bool
+	}{
+		{"1234", true},
+		{"5678", false},
+	} {
+		r, err := NewReality("reality://"+addr+"?sni=example.com&pbk="+pbk+"&sid="+c.sid, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the Go server signs by the ed25519 key only if the client offers it, which no browser does
+		spec, err := utls.UTLSIdToSpec(utls.HelloChrome_Auto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ext := range spec.Extensions {
+			if ext, ok := ext.(*utls.SignatureAlgorithmsExtension); ok {
+				ext.SupportedSignatureAlgorithms = append(ext.SupportedSignatureAlgorithms, utls.Ed25519)
+			}
+		}
+		r.spec = &spec
+		conn, err := r.Dial("tcp", addr)
+		if !c.ok {
+			if err == nil {
+				conn.Close()
+				t.Fatalf("sid %v: the server is verified with a wrong short id", c.sid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("sid %v: %v", c.sid, err)
+		}
+		msg := []byte("hello")
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+			t.Fatalf("unexpected echo: %q %v", buf, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readPEM accepts either the path of a PEM file or the PEM content itself.
+func readPEM(s string) ([]byte, error) {
+	if strings.Contains(s, "-----BEGIN") {
+		return []byte(s), nil
+	}
+	return os.ReadFile(s)
+}
+
+// LoadCertificate loads a client certificate and its private key. Both of them can be a path or PEM content.
+func LoadCertificate(cert string, key string) (tls.Certificate, error) {
+	bCert, err := readPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read certificate: %w", err)
+	}
+	if key == "" {
+		// the private key may be in the same file
+		key = cert
+	}
+	bKey, err := readPEM(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read private key: %w", err)
+	}
+	return tls.X509KeyPair(bCert, bKey)
+}
+
+// LoadCertPool loads a CA bundle. It can be a path or PEM content.
+func LoadCertPool(ca string) (*x509.CertPool, error) {
+	b, err := readPEM(ca)
+	if err != nil {
+		return nil, fmt.Errorf("read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in CA")
+	}
+	return pool, nil
+}
@@ -0,0 +1,212 @@
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/mzz2017/gg/common"
+	utls "github.com/refraction-networking/utls"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var fingerprints = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"safari":     utls.HelloSafari_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"edge":       utls.HelloEdge_Auto,
+	"android":    utls.HelloAndroid_11_OkHttp,
+	"360":        utls.Hello360_Auto,
+	"qq":         utls.HelloQQ_Auto,
+	"random":     utls.HelloRandomized,
+	"randomized": utls.HelloRandomized,
+}
+
+// ClientHelloID returns the uTLS ClientHello of the fingerprint name.
+func ClientHelloID(fingerprint string) (utls.ClientHelloID, error) {
+	id, ok := fingerprints[fingerprint]
+	if !ok {
+		return utls.ClientHelloID{}, fmt.Errorf("unsupported fingerprint: %v", fingerprint)
+	}
+	return id, nil
+}
+
+// Config is the TLS options shared by tls, ws and grpc transports.
+type Config struct {
+	ServerName string
+	SkipVerify bool
+	// Alpn is the ALPN to offer. It overrides the one of the fingerprint if given.
+	Alpn []string
+	// Fingerprint is the name of a browser ClientHello to mimic, such as chrome and firefox.
+	// An empty Fingerprint means the Go default ClientHello.
+	Fingerprint string
+	// PinnedSHA256 is the SHA-256 of certificates. If it is given, the connection is trusted only if any certificate
+	// in the chain matches, and the CA verification is skipped, so that self-signed certificates can be pinned.
+	PinnedSHA256 [][]byte
+	RootCAs      *x509.CertPool
+	// Certificates are the client certificates.
+	Certificates []tls.Certificate
+}
+
+// ConfigFromQuery parses sni, allowInsecure (skipVerify), alpn, fp, pinSHA256 and ca from the query.
+func ConfigFromQuery(query url.Values, defaultServerName string) (*Config, error) {
+	c := &Config{
+		ServerName: query.Get("sni"),
+		SkipVerify: common.StringToBool(query.Get("allowInsecure")) ||
+			common.StringToBool(query.Get("skipVerify")),
+		Fingerprint: strings.ToLower(query.Get("fp")),
+	}
+	if c.ServerName == "" {
+		c.ServerName = defaultServerName
+	}
+	if alpn := query.Get("alpn"); alpn != "" {
+		c.Alpn = strings.Split(alpn, ",")
+	}
+	if c.Fingerprint == "none" {
+		c.Fingerprint = ""
+	}
+	if c.Fingerprint != "" {
+		if _, err := ClientHelloID(c.Fingerprint); err != nil {
+			return nil, err
+		}
+	}
+	if pins := query.Get("pinSHA256"); pins != "" {
+		for _, pin := range strings.Split(pins, ",") {
+			b, err := decodeSHA256(pin)
+			if err != nil {
+				return nil, fmt.Errorf("pinSHA256: %v: %w", pin, err)
+			}
+			c.PinnedSHA256 = append(c.PinnedSHA256, b)
+		}
+	}
+	if ca := query.Get("ca"); ca != "" {
+		pool, err := LoadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
+
+// SetQuery is the reverse of ConfigFromQuery for the fields given as strings.
+func SetQuery(query *url.Values, alpn, fingerprint, pinSHA256, ca string) {
+	common.SetValue(query, "alpn", alpn)
+	common.SetValue(query, "fp", fingerprint)
+	common.SetValue(query, "pinSHA256", pinSHA256)
+	common.SetValue(query, "ca", ca)
+}
+
+func decodeSHA256(s string) ([]byte, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ":", "")
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		if b, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("neither hex nor base64")
+		}
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("unexpected length: %v", len(b))
+	}
+	return b, nil
+}
+
+func (c *Config) verifyPinned(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	for _, raw := range rawCerts {
+		sum := sha256.Sum256(raw)
+		for _, pin := range c.PinnedSHA256 {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("tls: no certificate matches the pinned SHA-256")
+}
+
+// StdConfig returns the crypto/tls config. The fingerprint is not considered.
+func (c *Config) StdConfig() *tls.Config {
+	conf := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.SkipVerify,
+		NextProtos:         c.Alpn,
+		RootCAs:            c.RootCAs,
+		Certificates:       c.Certificates,
+	}
+	if len(c.PinnedSHA256) > 0 {
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = c.verifyPinned
+	}
+	return conf
+}
+
+func (c *Config) uConfig() *utls.Config {
+	conf := &utls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.SkipVerify,
+		NextProtos:         c.Alpn,
+		RootCAs:            c.RootCAs,
+	}
+	for _, cert := range c.Certificates {
+		conf.Certificates = append(conf.Certificates, utls.Certificate{
+			Certificate:                 cert.Certificate,
+			PrivateKey:                  cert.PrivateKey,
+			OCSPStaple:                  cert.OCSPStaple,
+			SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+			Leaf:                        cert.Leaf,
+		})
+	}
+	if len(c.PinnedSHA256) > 0 {
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = c.verifyPinned
+	}
+	return conf
+}
+
+// Client makes a TLS client connection over conn and completes the handshake.
+// alpn overrides c.Alpn if given, which is used by transports requiring a specific ALPN, such as ws and grpc.
+func (c *Config) Client(ctx context.Context, conn net.Conn, alpn ...string) (net.Conn, error) {
+	if len(alpn) == 0 {
+		alpn = c.Alpn
+	}
+	if c.Fingerprint == "" {
+		conf := c.StdConfig()
+		conf.NextProtos = alpn
+		tlsConn := tls.Client(conn, conf)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	uConn := utls.UClient(conn, c.uConfig(), fingerprints[c.Fingerprint])
+	if len(alpn) > 0 {
+		// The ALPN of the fingerprint should be replaced.
+		if err := uConn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, ext := range uConn.Extensions {
+			if ext, ok := ext.(*utls.ALPNExtension); ok {
+				ext.AlpnProtocols = alpn
+				found = true
+				break
+			}
+		}
+		if !found {
+			uConn.Extensions = append(uConn.Extensions, &utls.ALPNExtension{AlpnProtocols: alpn})
+		}
+		if err := uConn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+	}
+	if err := uConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return uConn, nil
+}
@@ -1,9 +1,8 @@
 package tls
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
-	"github.com/mzz2017/gg/common"
 	"golang.org/x/net/proxy"
 	"net"
 	"net/url"
@@ -11,11 +10,9 @@ import (
 
 // Tls is a base Tls struct
 type Tls struct {
-	dialer     proxy.Dialer
-	addr       string
-	serverName string
-	skipVerify bool
-	tlsConfig  *tls.Config
+	dialer proxy.Dialer
+	addr   string
+	config *Config
 }
 
 // NewTls returns a Tls infra.
@@ -30,20 +27,8 @@ func NewTls(s string, d proxy.Dialer) (*Tls, error) {
 		addr:   u.Host,
 	}
 
-	query := u.Query()
-	t.serverName = query.Get("sni")
-
-	// skipVerify
-	if common.StringToBool(query.Get("allowInsecure")) ||
-		common.StringToBool(query.Get("skipVerify")) {
-		t.skipVerify = true
-	}
-	if t.serverName == "" {
-		t.serverName = u.Hostname()
-	}
-	t.tlsConfig = &tls.Config{
-		ServerName:         t.serverName,
-		InsecureSkipVerify: t.skipVerify,
+	if t.config, err = ConfigFromQuery(u.Query(), u.Hostname()); err != nil {
+		return nil, fmt.Errorf("NewTls: %w", err)
 	}
 
 	return t, nil
@@ -55,8 +40,9 @@ func (s *Tls) Dial(network, addr string) (conn net.Conn, err error) {
 		return nil, fmt.Errorf("[Tls]: dial to %s: %w", s.addr, err)
 	}
 
-	tlsConn := tls.Client(rc, s.tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
+	tlsConn, err := s.config.Client(context.Background(), rc)
+	if err != nil {
+		rc.Close()
 		return nil, err
 	}
 	return tlsConn, err
@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// earlyDataConn performs the WebSocket handshake at the first Write, sending up to maxEarlyData bytes in the header.
+type earlyDataConn struct {
+	ws *Ws
+
+	once   sync.Once
+	dialed chan struct{}
+	err    error
+
+	mu            sync.Mutex
+	conn          *conn
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newEarlyDataConn(ws *Ws) *earlyDataConn {
+	return &earlyDataConn{
+		ws:     ws,
+		dialed: make(chan struct{}),
+	}
+}
+
+// dial does the handshake with b as the early data if it is the first call, and returns the length of early data.
+func (c *earlyDataConn) dial(b []byte) (n int) {
+	c.once.Do(func() {
+		defer close(c.dialed)
+		if len(b) > c.ws.maxEarlyData {
+			b = b[:c.ws.maxEarlyData]
+		}
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			c.err = net.ErrClosed
+			return
+		}
+		conn, err := c.ws.dial(b)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			conn.Close()
+			c.err = net.ErrClosed
+			return
+		}
+		if !c.readDeadline.IsZero() {
+			_ = conn.SetReadDeadline(c.readDeadline)
+		}
+		if !c.writeDeadline.IsZero() {
+			_ = conn.SetWriteDeadline(c.writeDeadline)
+		}
+		c.conn = conn
+		n = len(b)
+	})
+	return n
+}
+
+func (c *earlyDataConn) getConn() *conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *earlyDataConn) Write(b []byte) (int, error) {
+	n := c.dial(b)
+	<-c.dialed
+	if c.err != nil {
+		return 0, c.err
+	}
+	if n == len(b) {
+		return n, nil
+	}
+	m, err := c.conn.Write(b[n:])
+	return n + m, err
+}
+
+func (c *earlyDataConn) Read(b []byte) (int, error) {
+	<-c.dialed
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Read(b)
+}
+
+func (c *earlyDataConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	// Unblock the readers waiting for the handshake if it has not started.
+	go c.dial(nil)
+	return nil
+}
+
+func (c *earlyDataConn) LocalAddr() net.Addr {
+	if conn := c.getConn(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return &net.TCPAddr{}
+}
+
+func (c *earlyDataConn) RemoteAddr() net.Addr {
+	if conn := c.getConn(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return &net.TCPAddr{}
+}
+
+func (c *earlyDataConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *earlyDataConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *earlyDataConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
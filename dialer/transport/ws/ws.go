@@ -1,25 +1,41 @@
 package ws
 
 import (
-	"crypto/tls"
+	"context"
+	"encoding/base64"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/mzz2017/gg/common"
+	"github.com/mzz2017/gg/dialer/transport/tls"
 	"golang.org/x/net/proxy"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// DefaultEarlyDataHeader carries the early data if the header name is not given.
+const DefaultEarlyDataHeader = "Sec-WebSocket-Protocol"
+
 // Ws is a base Ws struct
 type Ws struct {
 	dialer   proxy.Dialer
 	wsAddr   string
 	header   http.Header
 	wsDialer *websocket.Dialer
+
+	maxEarlyData    int
+	earlyDataHeader string
 }
 
 // NewWs returns a Ws infra.
+// The path may contain a query, where ed is the max early data as Xray does.
+// The query of s accepts host, header (Name: Value, repeatable), ed and eh (max early data and its header name),
+// and TLS options if the scheme is wss. Only http/1.1 is offered by ALPN, which WebSocket requires, so the alpn
+// must contain it.
 func NewWs(s string, d proxy.Dialer) (*Ws, error) {
 	u, err := url.Parse(s)
 	if err != nil {
@@ -31,28 +47,83 @@ func NewWs(s string, d proxy.Dialer) (*Ws, error) {
 	}
 
 	query := u.Query()
+	headers, err := common.ParseHeaders(query["header"])
+	if err != nil {
+		return nil, fmt.Errorf("NewWs: %w", err)
+	}
+	t.header = http.Header{}
+	for k, v := range headers {
+		t.header.Set(k, v)
+	}
 	host := query.Get("host")
+	if host == "" {
+		host = t.header.Get("Host")
+	}
 	if host == "" {
 		host = u.Hostname()
 	}
-	t.header = http.Header{}
 	t.header.Set("Host", host)
 
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		pathQuery, err := url.ParseQuery(path[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("NewWs: path: %w", err)
+		}
+		path = path[:i]
+		if ed := pathQuery.Get("ed"); ed != "" {
+			if t.maxEarlyData, err = strconv.Atoi(ed); err != nil {
+				return nil, fmt.Errorf("NewWs: ed: %w", err)
+			}
+			pathQuery.Del("ed")
+		}
+		if len(pathQuery) > 0 {
+			path += "?" + pathQuery.Encode()
+		}
+	}
+	if ed := query.Get("ed"); ed != "" {
+		if t.maxEarlyData, err = strconv.Atoi(ed); err != nil {
+			return nil, fmt.Errorf("NewWs: ed: %w", err)
+		}
+	}
+	t.earlyDataHeader = query.Get("eh")
+	if t.earlyDataHeader == "" {
+		t.earlyDataHeader = DefaultEarlyDataHeader
+	}
+
+	// TLS is done by ourselves in NetDial, so that the fingerprint can be customized.
 	wsUrl := url.URL{
-		Scheme: u.Scheme,
+		Scheme: "ws",
 		Host:   u.Host,
 	}
-	t.wsAddr = wsUrl.String() + u.Path
+	t.wsAddr = wsUrl.String() + path
 	t.wsDialer = &websocket.Dialer{
 		NetDial: d.Dial,
 		//Subprotocols: []string{"binary"},
 	}
 	if u.Scheme == "wss" {
-		skipVerify := common.StringToBool(query.Get("allowInsecure")) ||
-			common.StringToBool(query.Get("skipVerify"))
-		t.wsDialer.TLSClientConfig = &tls.Config{
-			ServerName:         u.Query().Get("sni"),
-			InsecureSkipVerify: skipVerify,
+		config, err := tls.ConfigFromQuery(query, u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("NewWs: %w", err)
+		}
+		if len(config.Alpn) > 0 && !slices.Contains(config.Alpn, "http/1.1") {
+			return nil, fmt.Errorf("NewWs: alpn %v: WebSocket requires http/1.1", strings.Join(config.Alpn, ","))
+		}
+		t.wsDialer.NetDial = func(network, addr string) (net.Conn, error) {
+			rc, err := d.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// WebSocket requires HTTP/1.1.
+			tlsConn, err := config.Client(context.Background(), rc, "http/1.1")
+			if err != nil {
+				rc.Close()
+				return nil, err
+			}
+			return tlsConn, nil
 		}
 	}
 	return t, nil
@@ -60,9 +131,47 @@ func NewWs(s string, d proxy.Dialer) (*Ws, error) {
 
 // Dial connects to the address addr on the network net via the infra.
 func (s *Ws) Dial(network, addr string) (net.Conn, error) {
-	rc, _, err := s.wsDialer.Dial(s.wsAddr, s.header)
+	if s.maxEarlyData > 0 {
+		// The handshake is delayed to the first Write to carry the early data.
+		return newEarlyDataConn(s), nil
+	}
+	return s.dial(nil)
+}
+
+func (s *Ws) dial(earlyData []byte) (*conn, error) {
+	header := s.header
+	if len(earlyData) > 0 {
+		header = s.header.Clone()
+		header.Set(s.earlyDataHeader, base64.RawURLEncoding.EncodeToString(earlyData))
+	}
+	rc, _, err := s.wsDialer.Dial(s.wsAddr, header)
 	if err != nil {
 		return nil, fmt.Errorf("[Ws]: dial to %s: %w", s.wsAddr, err)
 	}
-	return newConn(rc), err
+	return newConn(rc), nil
+}
+
+// SetQuery sets the header and eh in the query for NewWs. The headers are sorted to be deterministic.
+func SetQuery(query *url.Values, headers map[string]string, earlyDataHeader string) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		query.Add("header", k+": "+headers[k])
+	}
+	common.SetValue(query, "eh", earlyDataHeader)
+}
+
+// PathWithEarlyData appends ed to the query of path in the way of Xray.
+func PathWithEarlyData(path string, maxEarlyData int) string {
+	if maxEarlyData <= 0 {
+		return path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "ed=" + strconv.Itoa(maxEarlyData)
 }
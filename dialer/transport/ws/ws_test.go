@@ -0,0 +1,233 @@
+package ws
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+)
+
+// request is what the server receives in the handshake.
+type request struct {
+	host      string
+	path      string
+	rawQuery  string
+	header    http.Header
+	earlyData []byte
+}
+
+// echoServer is a WebSocket server which echoes the early data in the header earlyDataHeader and the messages.
+func echoServer(t *testing.T, earlyDataHeader string) (*httptest.Server, chan request) {
+	requests := make(chan request, 8)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{host: r.Host, path: r.URL.Path, rawQuery: r.URL.RawQuery, header: r.Header}
+		var respHeader http.Header
+		if ed := r.Header.Get(earlyDataHeader); ed != "" {
+			b, err := base64.RawURLEncoding.DecodeString(ed)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.earlyData = b
+			if earlyDataHeader == DefaultEarlyDataHeader {
+				// the subprotocol is echoed as Xray does
+				respHeader = http.Header{DefaultEarlyDataHeader: []string{ed}}
+			}
+		}
+		requests <- req
+		c, err := upgrader.Upgrade(w, r, respHeader)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if len(req.earlyData) > 0 {
+			if err = c.WriteMessage(websocket.BinaryMessage, req.earlyData); err != nil {
+				return
+			}
+		}
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = c.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func TestWs_EarlyData(t *testing.T) {
+	cases := []struct {
+		name            string
+		path            string
+		query           url.Values
+		earlyDataHeader string
+		wantPath        string
+		wantRawQuery    string
+		wantEarlyData   string
+	}{
+		{
+			name:            "none",
+			path:            "/ws",
+			earlyDataHeader: DefaultEarlyDataHeader,
+			wantPath:        "/ws",
+		},
+		{
+			name:            "ed in path",
+			path:            PathWithEarlyData("/ws", 8),
+			earlyDataHeader: DefaultEarlyDataHeader,
+			wantPath:        "/ws",
+			wantEarlyData:   "hello wo",
+		},
+		{
+			name:            "ed in path with query",
+			path:            PathWithEarlyData("/ws?key=value", 8),
+			earlyDataHeader: DefaultEarlyDataHeader,
+			wantPath:        "/ws",
+			wantRawQuery:    "key=value",
+			wantEarlyData:   "hello wo",
+		},
+		{
+			name:            "ed in query",
+			path:            "/ws",
+			query:           url.Values{"ed": []string{"64"}},
+			earlyDataHeader: DefaultEarlyDataHeader,
+			wantPath:        "/ws",
+			wantEarlyData:   "hello world",
+		},
+		{
+			name:            "eh",
+			path:            PathWithEarlyData("/ws", 8),
+			query:           url.Values{"eh": []string{"X-Early-Data"}},
+			earlyDataHeader: "X-Early-Data",
+			wantPath:        "/ws",
+			wantEarlyData:   "hello wo",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, requests := echoServer(t, c.earlyDataHeader)
+			u := url.URL{
+				Scheme:   "ws",
+				Host:     srv.Listener.Addr().String(),
+				Path:     c.path,
+				RawQuery: c.query.Encode(),
+			}
+			w, err := NewWs(u.String(), proxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := w.Dial("tcp", "example.com:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if c.wantEarlyData != "" {
+				if _, ok := conn.(*earlyDataConn); !ok {
+					t.Fatalf("dialed %T, want the early data conn", conn)
+				}
+				// nothing is sent before the first write
+				select {
+				case <-requests:
+					t.Fatal("the handshake is done before the first write")
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			msg := "hello world"
+			if n, err := conn.Write([]byte(msg)); err != nil || n != len(msg) {
+				t.Fatalf("Write() = %v, %v", n, err)
+			}
+			req := <-requests
+			if req.path != c.wantPath || req.rawQuery != c.wantRawQuery {
+				t.Errorf("requested %v?%v, want %v?%v", req.path, req.rawQuery, c.wantPath, c.wantRawQuery)
+			}
+			if string(req.earlyData) != c.wantEarlyData {
+				t.Errorf("early data %q, want %q", req.earlyData, c.wantEarlyData)
+			}
+			// the early data and the rest are echoed in order
+			b := make([]byte, len(msg))
+			if _, err = io.ReadFull(conn, b); err != nil || string(b) != msg {
+				t.Fatalf("read %q: %v", b, err)
+			}
+		})
+	}
+}
+
+func TestWs_Headers(t *testing.T) {
+	srv, requests := echoServer(t, DefaultEarlyDataHeader)
+	query := url.Values{"host": []string{"example.com"}}
+	SetQuery(&query, map[string]string{"User-Agent": "gg", "X-Token": "secret"}, "")
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     srv.Listener.Addr().String(),
+		Path:     "/",
+		RawQuery: query.Encode(),
+	}
+	w, err := NewWs(u.String(), proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := w.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := <-requests
+	if req.host != "example.com" {
+		t.Errorf("host %q, want example.com", req.host)
+	}
+	for k, v := range map[string]string{"User-Agent": "gg", "X-Token": "secret"} {
+		if got := req.header.Get(k); got != v {
+			t.Errorf("header %v: %q, want %q", k, got, v)
+		}
+	}
+	if req.header.Get(DefaultEarlyDataHeader) != "" {
+		t.Errorf("unexpected early data header without ed")
+	}
+}
+
+func TestEarlyDataConn_CloseBeforeWrite(t *testing.T) {
+	srv, requests := echoServer(t, DefaultEarlyDataHeader)
+	w, err := NewWs("ws://"+srv.Listener.Addr().String()+"/?ed=8", proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := w.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+	conn.Close()
+	select {
+	case err := <-read:
+		if err != net.ErrClosed {
+			t.Fatalf("Read() = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reader is blocked after closed")
+	}
+	if _, err = conn.Write([]byte("hello")); err != net.ErrClosed {
+		t.Fatalf("Write() = %v, want %v", err, net.ErrClosed)
+	}
+	select {
+	case <-requests:
+		t.Fatal("the handshake is done after closed")
+	default:
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"github.com/mzz2017/gg/common"
 	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/dialer/transport/grpc"
 	"github.com/mzz2017/gg/dialer/transport/tls"
 	"github.com/mzz2017/gg/dialer/transport/ws"
 	"github.com/mzz2017/softwind/protocol"
-	"github.com/mzz2017/softwind/transport/grpc"
 	"gopkg.in/yaml.v3"
 	"net"
 	"net/url"
@@ -22,18 +22,25 @@ func init() {
 }
 
 type Trojan struct {
-	Name          string `json:"name"`
-	Server        string `json:"server"`
-	Port          int    `json:"port"`
-	Password      string `json:"password"`
-	Sni           string `json:"sni"`
-	Type          string `json:"type"`
-	Encryption    string `json:"encryption"`
-	Host          string `json:"host"`
-	Path          string `json:"path"`
-	ServiceName   string `json:"serviceName"`
-	AllowInsecure bool   `json:"allowInsecure"`
-	Protocol      string `json:"protocol"`
+	Name       string `json:"name"`
+	Server     string `json:"server"`
+	Port       int    `json:"port"`
+	Password   string `json:"password"`
+	Sni        string `json:"sni"`
+	Type       string `json:"type"`
+	Encryption string `json:"encryption"`
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	// Headers and EarlyDataHeader are for ws. The max early data is in the query of Path as Xray does.
+	Headers         map[string]string `json:"headers,omitempty"`
+	EarlyDataHeader string            `json:"eh,omitempty"`
+	ServiceName     string            `json:"serviceName"`
+	AllowInsecure   bool              `json:"allowInsecure"`
+	Alpn            string            `json:"alpn"`
+	Fingerprint     string            `json:"fp"`
+	PinSHA256       string            `json:"pinSHA256"`
+	CA              string            `json:"ca"`
+	Protocol        string            `json:"protocol"`
 }
 
 func NewTrojan(link string, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
@@ -60,13 +67,20 @@ func NewTrojanFromClashObj(o *yaml.Node, opt *dialer.GlobalOption) (*dialer.Dial
 
 func (s *Trojan) Dialer() (*dialer.Dialer, error) {
 	d := dialer.SymmetricDirect
+	query := url.Values{
+		"sni":           []string{s.Sni},
+		"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
+	}
+	alpn := s.Alpn
+	if s.Type == "ws" {
+		// WebSocket requires HTTP/1.1.
+		alpn = "http/1.1"
+	}
+	tls.SetQuery(&query, alpn, s.Fingerprint, s.PinSHA256, s.CA)
 	u := url.URL{
-		Scheme: "tls",
-		Host:   net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
-		RawQuery: url.Values{
-			"sni":           []string{s.Sni},
-			"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
-		}.Encode(),
+		Scheme:   "tls",
+		Host:     net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
+		RawQuery: query.Encode(),
 	}
 	var err error
 	if s.Type != "grpc" {
@@ -78,28 +92,33 @@ func (s *Trojan) Dialer() (*dialer.Dialer, error) {
 	// "tls,ws,ss,trojanc"
 	switch s.Type {
 	case "ws":
+		query := url.Values{
+			"host": []string{s.Host},
+		}
+		ws.SetQuery(&query, s.Headers, s.EarlyDataHeader)
 		u = url.URL{
-			Scheme: "ws",
-			Host:   net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
-			RawQuery: url.Values{
-				"host":          []string{s.Host},
-				"path":          []string{s.Path},
-				"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
-			}.Encode(),
+			Scheme:   "ws",
+			Host:     net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
+			Path:     s.Path,
+			RawQuery: query.Encode(),
 		}
 		if d, err = ws.NewWs(u.String(), d); err != nil {
 			return nil, err
 		}
 	case "grpc":
-		serviceName := s.ServiceName
-		if serviceName == "" {
-			serviceName = "GunService"
+		query := url.Values{
+			"serviceName":   []string{s.ServiceName},
+			"sni":           []string{s.Sni},
+			"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
 		}
-		d = &grpc.Dialer{
-			NextDialer:    &protocol.DialerConverter{Dialer: d},
-			ServiceName:   serviceName,
-			ServerName:    s.Sni,
-			AllowInsecure: s.AllowInsecure,
+		tls.SetQuery(&query, "", s.Fingerprint, s.PinSHA256, s.CA)
+		u = url.URL{
+			Scheme:   "grpc",
+			Host:     net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
+			RawQuery: query.Encode(),
+		}
+		if d, err = grpc.NewGrpc(u.String(), d); err != nil {
+			return nil, err
 		}
 	}
 	if strings.HasPrefix(s.Encryption, "ss;") {
@@ -149,6 +168,10 @@ func ParseTrojanURL(u string) (data *Trojan, err error) {
 		Password:      t.User.Username(),
 		Sni:           sni,
 		AllowInsecure: common.StringToBool(allowInsecure),
+		Alpn:          t.Query().Get("alpn"),
+		Fingerprint:   t.Query().Get("fp"),
+		PinSHA256:     t.Query().Get("pinSHA256"),
+		CA:            t.Query().Get("ca"),
 		Protocol:      "trojan",
 	}
 	if t.Query().Get("type") != "" {
@@ -161,6 +184,10 @@ func ParseTrojanURL(u string) (data *Trojan, err error) {
 		data.Path = t.Query().Get("path")
 		data.Type = t.Query().Get("type")
 		data.ServiceName = t.Query().Get("serviceName")
+		if data.Headers, err = common.ParseHeaders(t.Query()["header"]); err != nil {
+			return nil, fmt.Errorf("%w: %v", dialer.InvalidParameterErr, err)
+		}
+		data.EarlyDataHeader = t.Query().Get("eh")
 		if data.Type == "grpc" && data.ServiceName == "" {
 			data.ServiceName = data.Path
 		}
@@ -177,7 +204,7 @@ func ParseClash(o *yaml.Node) (data *Trojan, err error) {
 		EarlyDataHeaderName string            `yaml:"early-data-header-name,omitempty"`
 	}
 	type GrpcOptions struct {
-		GrpcServiceName string `proxy:"grpc-service-name,omitempty"`
+		GrpcServiceName string `yaml:"grpc-service-name,omitempty"`
 	}
 	type TrojanOption struct {
 		Name           string      `yaml:"name"`
@@ -186,6 +213,8 @@ func ParseClash(o *yaml.Node) (data *Trojan, err error) {
 		Password       string      `yaml:"password"`
 		ALPN           []string    `yaml:"alpn,omitempty"`
 		SNI            string      `yaml:"sni,omitempty"`
+		Fingerprint    string      `yaml:"fingerprint,omitempty"`
+		ClientFP       string      `yaml:"client-fingerprint,omitempty"`
 		SkipCertVerify bool        `yaml:"skip-cert-verify,omitempty"`
 		UDP            bool        `yaml:"udp,omitempty"`
 		Network        string      `yaml:"network,omitempty"`
@@ -200,19 +229,38 @@ func ParseClash(o *yaml.Node) (data *Trojan, err error) {
 	if option.Network != "" && option.Network != "origin" {
 		proto = "trojan-go"
 	}
+	var (
+		host    string
+		headers map[string]string
+	)
+	for k, v := range option.WSOpts.Headers {
+		if strings.EqualFold(k, "Host") {
+			host = v
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[k] = v
+	}
 	return &Trojan{
-		Name:          option.Name,
-		Server:        option.Server,
-		Port:          option.Port,
-		Password:      option.Password,
-		Sni:           option.SNI,
-		Type:          option.Network,
-		Encryption:    "",
-		Host:          option.WSOpts.Headers["Host"],
-		Path:          option.WSOpts.Path,
-		AllowInsecure: option.SkipCertVerify,
-		ServiceName:   option.GrpcOpts.GrpcServiceName,
-		Protocol:      proto,
+		Name:            option.Name,
+		Server:          option.Server,
+		Port:            option.Port,
+		Password:        option.Password,
+		Sni:             option.SNI,
+		Type:            option.Network,
+		Encryption:      "",
+		Host:            host,
+		Path:            ws.PathWithEarlyData(option.WSOpts.Path, option.WSOpts.MaxEarlyData),
+		Headers:         headers,
+		EarlyDataHeader: option.WSOpts.EarlyDataHeaderName,
+		AllowInsecure:   option.SkipCertVerify,
+		ServiceName:     option.GrpcOpts.GrpcServiceName,
+		Alpn:            strings.Join(option.ALPN, ","),
+		Fingerprint:     option.ClientFP,
+		PinSHA256:       option.Fingerprint,
+		Protocol:        proto,
 	}, nil
 }
 
@@ -228,6 +276,7 @@ func (t *Trojan) ExportToURL() string {
 		q.Set("allowInsecure", "1")
 	}
 	common.SetValue(&q, "sni", t.Sni)
+	tls.SetQuery(&q, t.Alpn, t.Fingerprint, t.PinSHA256, t.CA)
 
 	if t.Protocol == "trojan-go" {
 		u.Scheme = "trojan-go"
@@ -235,6 +284,7 @@ func (t *Trojan) ExportToURL() string {
 		common.SetValue(&q, "encryption", t.Encryption)
 		common.SetValue(&q, "type", t.Type)
 		common.SetValue(&q, "path", t.Path)
+		ws.SetQuery(&q, t.Headers, t.EarlyDataHeader)
 	}
 	u.RawQuery = q.Encode()
 	return u.String()
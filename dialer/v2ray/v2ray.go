@@ -6,10 +6,13 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/mzz2017/gg/common"
 	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/dialer/transport/grpc"
+	"github.com/mzz2017/gg/dialer/transport/reality"
 	"github.com/mzz2017/gg/dialer/transport/tls"
 	"github.com/mzz2017/gg/dialer/transport/ws"
 	"github.com/mzz2017/softwind/protocol"
-	"github.com/mzz2017/softwind/transport/grpc"
+	vless "github.com/mzz2017/softwind/protocol/vless"
+	"golang.org/x/net/proxy"
 	"gopkg.in/yaml.v3"
 	"net"
 	"net/url"
@@ -22,25 +25,35 @@ func init() {
 	dialer.FromLinkRegister("vmess", NewV2Ray)
 	dialer.FromLinkRegister("vless", NewV2Ray)
 	dialer.FromClashRegister("vmess", NewVMessFromClashObj)
+	dialer.FromClashRegister("vless", NewVLessFromClashObj)
 }
 
 type V2Ray struct {
-	Ps            string `json:"ps"`
-	Add           string `json:"add"`
-	Port          string `json:"port"`
-	ID            string `json:"id"`
-	Aid           string `json:"aid"`
-	Net           string `json:"net"`
-	Type          string `json:"type"`
-	Host          string `json:"host"`
-	SNI           string `json:"sni"`
-	Path          string `json:"path"`
-	TLS           string `json:"tls"`
-	Flow          string `json:"flow,omitempty"`
-	Alpn          string `json:"alpn,omitempty"`
-	AllowInsecure bool   `json:"allowInsecure"`
-	V             string `json:"v"`
-	Protocol      string `json:"protocol"`
+	Ps   string `json:"ps"`
+	Add  string `json:"add"`
+	Port string `json:"port"`
+	ID   string `json:"id"`
+	Aid  string `json:"aid"`
+	Net  string `json:"net"`
+	Type string `json:"type"`
+	Host string `json:"host"`
+	SNI  string `json:"sni"`
+	Path string `json:"path"`
+	TLS  string `json:"tls"`
+	// Headers and EarlyDataHeader are for ws. The max early data is in the query of Path as Xray does.
+	Headers         map[string]string `json:"headers,omitempty"`
+	EarlyDataHeader string            `json:"eh,omitempty"`
+	Flow            string            `json:"flow,omitempty"`
+	Alpn            string            `json:"alpn,omitempty"`
+	Fingerprint     string            `json:"fp,omitempty"`
+	PinSHA256       string            `json:"pinSHA256,omitempty"`
+	CA              string            `json:"ca,omitempty"`
+	PublicKey       string            `json:"pbk,omitempty"`
+	ShortID         string            `json:"sid,omitempty"`
+	SpiderX         string            `json:"spx,omitempty"`
+	AllowInsecure   bool              `json:"allowInsecure"`
+	V               string            `json:"v"`
+	Protocol        string            `json:"protocol"`
 }
 
 func NewV2Ray(link string, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
@@ -82,13 +95,40 @@ func NewVMessFromClashObj(o *yaml.Node, opt *dialer.GlobalOption) (*dialer.Diale
 	return s.Dialer()
 }
 
+func NewVLessFromClashObj(o *yaml.Node, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
+	s, err := ParseClashVLess(o)
+	if err != nil {
+		return nil, err
+	}
+	if opt.AllowInsecure {
+		s.AllowInsecure = true
+	}
+	return s.Dialer()
+}
+
 func (s *V2Ray) Dialer() (data *dialer.Dialer, err error) {
 	var (
-		d = dialer.SymmetricDirect
+		d proxy.Dialer = dialer.SymmetricDirect
 	)
 
+	switch s.Flow {
+	case "":
+	case FlowVision:
+		if s.Protocol != "vless" || strings.ToLower(s.Net) != "tcp" ||
+			(s.TLS != "tls" && s.TLS != "xtls" && s.TLS != "reality") {
+			return nil, fmt.Errorf("%w: flow %v requires vless over tcp with tls or reality", dialer.UnexpectedFieldErr, s.Flow)
+		}
+		// Vision needs to take over the raw connection under TLS.
+		d = &recordDialer{Dialer: d}
+	default:
+		return nil, fmt.Errorf("%w: flow: %v", dialer.UnexpectedFieldErr, s.Flow)
+	}
+
 	switch strings.ToLower(s.Net) {
 	case "ws":
+		if s.TLS == "reality" {
+			return nil, fmt.Errorf("%w: reality is not supported by ws", dialer.UnexpectedFieldErr)
+		}
 		scheme := "ws"
 		if s.TLS == "tls" || s.TLS == "xtls" {
 			scheme = "wss"
@@ -97,14 +137,18 @@ func (s *V2Ray) Dialer() (data *dialer.Dialer, err error) {
 		if sni == "" {
 			sni = s.Host
 		}
+		query := url.Values{
+			"host":          []string{s.Host},
+			"sni":           []string{sni},
+			"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
+		}
+		tls.SetQuery(&query, s.Alpn, s.Fingerprint, s.PinSHA256, s.CA)
+		ws.SetQuery(&query, s.Headers, s.EarlyDataHeader)
 		u := url.URL{
-			Scheme: scheme,
-			Host:   net.JoinHostPort(s.Add, s.Port),
-			Path:   s.Path,
-			RawQuery: url.Values{
-				"host": []string{s.Host},
-				"sni":  []string{sni},
-			}.Encode(),
+			Scheme:   scheme,
+			Host:     net.JoinHostPort(s.Add, s.Port),
+			Path:     s.Path,
+			RawQuery: query.Encode(),
 		}
 		d, err = ws.NewWs(u.String(), d)
 		if err != nil {
@@ -116,18 +160,24 @@ func (s *V2Ray) Dialer() (data *dialer.Dialer, err error) {
 			if sni == "" {
 				sni = s.Host
 			}
+			query := url.Values{
+				"sni":           []string{sni},
+				"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
+			}
+			tls.SetQuery(&query, s.Alpn, s.Fingerprint, s.PinSHA256, s.CA)
 			u := url.URL{
-				Scheme: "tls",
-				Host:   net.JoinHostPort(s.Add, s.Port),
-				RawQuery: url.Values{
-					"sni":           []string{sni},
-					"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
-				}.Encode(),
+				Scheme:   "tls",
+				Host:     net.JoinHostPort(s.Add, s.Port),
+				RawQuery: query.Encode(),
 			}
 			d, err = tls.NewTls(u.String(), d)
 			if err != nil {
 				return nil, err
 			}
+		} else if s.TLS == "reality" {
+			if d, err = s.realityDialer(d); err != nil {
+				return nil, err
+			}
 		}
 		if s.Type != "none" && s.Type != "" {
 			return nil, fmt.Errorf("%w: type: %v", dialer.UnexpectedFieldErr, s.Type)
@@ -141,63 +191,154 @@ func (s *V2Ray) Dialer() (data *dialer.Dialer, err error) {
 		if serviceName == "" {
 			serviceName = "GunService"
 		}
-		d = &grpc.Dialer{
-			NextDialer:    &protocol.DialerConverter{Dialer: d},
-			ServiceName:   serviceName,
-			ServerName:    sni,
-			AllowInsecure: s.AllowInsecure,
+		query := url.Values{
+			"serviceName":   []string{serviceName},
+			"sni":           []string{sni},
+			"allowInsecure": []string{common.BoolToString(s.AllowInsecure)},
+		}
+		tls.SetQuery(&query, s.Alpn, s.Fingerprint, s.PinSHA256, s.CA)
+		if s.TLS == "reality" {
+			query.Set("security", "reality")
+			common.SetValue(&query, "pbk", s.PublicKey)
+			common.SetValue(&query, "sid", s.ShortID)
+			common.SetValue(&query, "spx", s.SpiderX)
+		}
+		u := url.URL{
+			Scheme:   "grpc",
+			Host:     net.JoinHostPort(s.Add, s.Port),
+			RawQuery: query.Encode(),
+		}
+		if d, err = grpc.NewGrpc(u.String(), d); err != nil {
+			return nil, err
 		}
 	default:
 		return nil, fmt.Errorf("%w: network: %v", dialer.UnexpectedFieldErr, s.Net)
 	}
 
-	if d, err = protocol.NewDialer(s.Protocol, d, protocol.Header{
+	header := protocol.Header{
 		ProxyAddress: net.JoinHostPort(s.Add, s.Port),
 		Cipher:       "aes-128-gcm",
 		Password:     s.ID,
 		IsClient:     true,
-	}); err != nil {
+	}
+	next := d
+	if d, err = protocol.NewDialer(s.Protocol, next, header); err != nil {
 		return nil, err
 	}
+	if s.Flow == FlowVision {
+		key, err := vless.Password2Key(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		// UDP goes without the flow.
+		d = &visionDialer{
+			nextDialer:   next,
+			udpDialer:    d,
+			proxyAddress: header.ProxyAddress,
+			key:          key,
+		}
+	}
 	return dialer.NewDialer(d, true, s.Ps, s.Protocol, s.ExportToURL()), nil
 }
 
+func (s *V2Ray) realityDialer(d proxy.Dialer) (proxy.Dialer, error) {
+	sni := s.SNI
+	if sni == "" {
+		sni = s.Host
+	}
+	query := url.Values{}
+	common.SetValue(&query, "sni", sni)
+	common.SetValue(&query, "fp", s.Fingerprint)
+	common.SetValue(&query, "pbk", s.PublicKey)
+	common.SetValue(&query, "sid", s.ShortID)
+	common.SetValue(&query, "spx", s.SpiderX)
+	u := url.URL{
+		Scheme:   "reality",
+		Host:     net.JoinHostPort(s.Add, s.Port),
+		RawQuery: query.Encode(),
+	}
+	return reality.NewReality(u.String(), d)
+}
+
+type clashWSOptions struct {
+	Path                string            `yaml:"path,omitempty"`
+	Headers             map[string]string `yaml:"headers,omitempty"`
+	MaxEarlyData        int               `yaml:"max-early-data,omitempty"`
+	EarlyDataHeaderName string            `yaml:"early-data-header-name,omitempty"`
+}
+
+type clashGrpcOptions struct {
+	GrpcServiceName string `yaml:"grpc-service-name,omitempty"`
+}
+
+type clashHTTP2Options struct {
+	Host []string `yaml:"host,omitempty"`
+	Path string   `yaml:"path,omitempty"`
+}
+
+type clashRealityOptions struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id,omitempty"`
+	SpiderX   string `yaml:"spider-x,omitempty"`
+}
+
+// clashOption is the union of vmess and vless options of Clash.
+type clashOption struct {
+	Name           string              `yaml:"name"`
+	Server         string              `yaml:"server"`
+	Port           int                 `yaml:"port"`
+	UUID           string              `yaml:"uuid"`
+	AlterID        int                 `yaml:"alterId"`
+	Cipher         string              `yaml:"cipher"`
+	Flow           string              `yaml:"flow,omitempty"`
+	UDP            bool                `yaml:"udp,omitempty"`
+	Network        string              `yaml:"network,omitempty"`
+	TLS            bool                `yaml:"tls,omitempty"`
+	SkipCertVerify bool                `yaml:"skip-cert-verify,omitempty"`
+	ServerName     string              `yaml:"servername,omitempty"`
+	ALPN           []string            `yaml:"alpn,omitempty"`
+	Fingerprint    string              `yaml:"fingerprint,omitempty"`
+	ClientFP       string              `yaml:"client-fingerprint,omitempty"`
+	RealityOpts    clashRealityOptions `yaml:"reality-opts,omitempty"`
+	HTTPOpts       interface{}         `yaml:"http-opts,omitempty"`
+	HTTP2Opts      clashHTTP2Options   `yaml:"h2-opts,omitempty"`
+	GrpcOpts       clashGrpcOptions    `yaml:"grpc-opts,omitempty"`
+	WSOpts         clashWSOptions      `yaml:"ws-opts,omitempty"`
+}
+
 func ParseClashVMess(o *yaml.Node) (data *V2Ray, err error) {
-	type WSOptions struct {
-		Path                string            `yaml:"path,omitempty"`
-		Headers             map[string]string `yaml:"headers,omitempty"`
-		MaxEarlyData        int               `yaml:"max-early-data,omitempty"`
-		EarlyDataHeaderName string            `yaml:"early-data-header-name,omitempty"`
-	}
-	type GrpcOptions struct {
-		GrpcServiceName string `proxy:"grpc-service-name,omitempty"`
-	}
-	type HTTP2Options struct {
-		Host []string `proxy:"host,omitempty"`
-		Path string   `proxy:"path,omitempty"`
-	}
-	type VmessOption struct {
-		Name           string       `yaml:"name"`
-		Server         string       `yaml:"server"`
-		Port           int          `yaml:"port"`
-		UUID           string       `yaml:"uuid"`
-		AlterID        int          `yaml:"alterId"`
-		Cipher         string       `yaml:"cipher"`
-		UDP            bool         `yaml:"udp,omitempty"`
-		Network        string       `yaml:"network,omitempty"`
-		TLS            bool         `yaml:"tls,omitempty"`
-		SkipCertVerify bool         `yaml:"skip-cert-verify,omitempty"`
-		ServerName     string       `yaml:"servername,omitempty"`
-		HTTPOpts       interface{}  `yaml:"http-opts,omitempty"`
-		HTTP2Opts      HTTP2Options `yaml:"h2-opts,omitempty"`
-		GrpcOpts       GrpcOptions  `yaml:"grpc-opts,omitempty"`
-		WSOpts         WSOptions    `yaml:"ws-opts,omitempty"`
-	}
-	var option VmessOption
+	var option clashOption
 	if err = o.Decode(&option); err != nil {
 		return nil, err
 	}
+	s := option.toV2Ray()
+	s.Aid = strconv.Itoa(option.AlterID)
+	s.V = "2"
+	s.Protocol = "vmess"
+	return s, nil
+}
 
+func ParseClashVLess(o *yaml.Node) (data *V2Ray, err error) {
+	var option clashOption
+	if err = o.Decode(&option); err != nil {
+		return nil, err
+	}
+	s := option.toV2Ray()
+	s.Flow = option.Flow
+	s.Protocol = "vless"
+	if s.TLS == "" {
+		s.TLS = "none"
+	}
+	if option.RealityOpts.PublicKey != "" {
+		s.TLS = "reality"
+		s.PublicKey = option.RealityOpts.PublicKey
+		s.ShortID = option.RealityOpts.ShortID
+		s.SpiderX = option.RealityOpts.SpiderX
+	}
+	return s, nil
+}
+
+func (option *clashOption) toV2Ray() *V2Ray {
 	if option.Network == "" {
 		option.Network = "tcp"
 	}
@@ -206,10 +347,24 @@ func ParseClashVMess(o *yaml.Node) (data *V2Ray, err error) {
 		host string
 		alpn string
 	)
+	var (
+		headers         map[string]string
+		earlyDataHeader string
+	)
 	switch option.Network {
 	case "ws":
-		path = option.WSOpts.Path
-		host = option.WSOpts.Headers["Host"]
+		path = ws.PathWithEarlyData(option.WSOpts.Path, option.WSOpts.MaxEarlyData)
+		for k, v := range option.WSOpts.Headers {
+			if strings.EqualFold(k, "Host") {
+				host = v
+				continue
+			}
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[k] = v
+		}
+		earlyDataHeader = option.WSOpts.EarlyDataHeaderName
 		alpn = "http/1.1"
 	case "grpc":
 		path = option.GrpcOpts.GrpcServiceName
@@ -220,27 +375,32 @@ func ParseClashVMess(o *yaml.Node) (data *V2Ray, err error) {
 	case "http":
 		// TODO
 	}
+	if len(option.ALPN) > 0 {
+		alpn = strings.Join(option.ALPN, ",")
+	}
 	s := &V2Ray{
-		Ps:            option.Name,
-		Add:           option.Server,
-		Port:          strconv.Itoa(option.Port),
-		ID:            option.UUID,
-		Aid:           strconv.Itoa(option.AlterID),
-		Net:           option.Network,
-		Type:          "none", // FIXME
-		Host:          host,
-		SNI:           option.ServerName,
-		Path:          path,
-		AllowInsecure: option.SkipCertVerify,
-		Alpn:          alpn,
-		V:             "2",
-		Protocol:      "vmess",
+		Ps:              option.Name,
+		Add:             option.Server,
+		Port:            strconv.Itoa(option.Port),
+		ID:              option.UUID,
+		Net:             option.Network,
+		Type:            "none", // FIXME
+		Host:            host,
+		SNI:             option.ServerName,
+		Path:            path,
+		Headers:         headers,
+		EarlyDataHeader: earlyDataHeader,
+		AllowInsecure:   option.SkipCertVerify,
+		Alpn:            alpn,
+		Fingerprint:     option.ClientFP,
+		PinSHA256:       option.Fingerprint,
 	}
 	if option.TLS {
 		s.TLS = "tls"
 	}
-	return s, nil
+	return s
 }
+
 func ParseVlessURL(vless string) (data *V2Ray, err error) {
 	u, err := url.Parse(vless)
 	if err != nil {
@@ -259,9 +419,19 @@ func ParseVlessURL(vless string) (data *V2Ray, err error) {
 		TLS:           u.Query().Get("security"),
 		Flow:          u.Query().Get("flow"),
 		Alpn:          u.Query().Get("alpn"),
+		Fingerprint:   u.Query().Get("fp"),
+		PinSHA256:     u.Query().Get("pinSHA256"),
+		CA:            u.Query().Get("ca"),
+		PublicKey:     u.Query().Get("pbk"),
+		ShortID:       u.Query().Get("sid"),
+		SpiderX:       u.Query().Get("spx"),
 		AllowInsecure: common.StringToBool(u.Query().Get("allowInsecure")),
 		Protocol:      "vless",
 	}
+	if data.Headers, err = common.ParseHeaders(u.Query()["header"]); err != nil {
+		return nil, fmt.Errorf("%w: %v", dialer.InvalidParameterErr, err)
+	}
+	data.EarlyDataHeader = u.Query().Get("eh")
 	if data.Net == "" {
 		data.Net = "tcp"
 	}
@@ -274,9 +444,6 @@ func ParseVlessURL(vless string) (data *V2Ray, err error) {
 	if data.TLS == "" {
 		data.TLS = "none"
 	}
-	if data.Flow == "" {
-		data.Flow = "xtls-rprx-direct"
-	}
 	if data.Type == "mkcp" || data.Type == "kcp" {
 		data.Path = u.Query().Get("seed")
 	}
@@ -368,7 +535,11 @@ func (s *V2Ray) ExportToURL() string {
 		common.SetValue(&query, "type", s.Net)
 		common.SetValue(&query, "security", s.TLS)
 		switch s.Net {
-		case "websocket", "ws", "http", "h2":
+		case "websocket", "ws":
+			common.SetValue(&query, "path", s.Path)
+			common.SetValue(&query, "host", s.Host)
+			ws.SetQuery(&query, s.Headers, s.EarlyDataHeader)
+		case "http", "h2":
 			common.SetValue(&query, "path", s.Path)
 			common.SetValue(&query, "host", s.Host)
 		case "mkcp", "kcp":
@@ -382,14 +553,24 @@ func (s *V2Ray) ExportToURL() string {
 			common.SetValue(&query, "serviceName", s.Path)
 		}
 		//TODO: QUIC
-		if s.TLS != "none" {
-			common.SetValue(&query, "sni", s.Host) // FIXME: it may be different from ws's host
-			common.SetValue(&query, "alpn", s.Alpn)
-			common.SetValue(&query, "allowInsecure", common.BoolToString(s.AllowInsecure))
+		sni := s.SNI
+		if sni == "" {
+			sni = s.Host
 		}
-		if s.TLS == "xtls" {
-			common.SetValue(&query, "flow", s.Flow)
+		switch s.TLS {
+		case "none":
+		case "reality":
+			common.SetValue(&query, "sni", sni)
+			common.SetValue(&query, "fp", s.Fingerprint)
+			common.SetValue(&query, "pbk", s.PublicKey)
+			common.SetValue(&query, "sid", s.ShortID)
+			common.SetValue(&query, "spx", s.SpiderX)
+		default:
+			common.SetValue(&query, "sni", sni)
+			tls.SetQuery(&query, s.Alpn, s.Fingerprint, s.PinSHA256, s.CA)
+			common.SetValue(&query, "allowInsecure", common.BoolToString(s.AllowInsecure))
 		}
+		common.SetValue(&query, "flow", s.Flow)
 
 		U := url.URL{
 			Scheme:   "vless",
@@ -0,0 +1,90 @@
+package v2ray
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// serveALPN starts a TLS server which records the ALPN offered by the clients and closes the connections.
+func serveALPN(t *testing.T) (port string, offered chan []string) {
+	offered = make(chan []string, 1)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			offered <- hello.SupportedProtos
+			return nil, net.ErrClosed
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+	_, port, _ = net.SplitHostPort(l.Addr().String())
+	return port, offered
+}
+
+func TestAlpn(t *testing.T) {
+	for _, c := range []struct {
+		net     string
+		alpn    string
+		offered []string // offered is nil if the node is invalid
+	}{
+		{"ws", "", []string{"http/1.1"}},
+		{"ws", "h2,http/1.1", []string{"http/1.1"}},
+		{"ws", "h2", nil},
+		{"grpc", "h2,http/1.1", []string{"h2", "http/1.1"}},
+		{"grpc", "http/1.1", nil},
+	} {
+		port, offered := serveALPN(t)
+		s := &V2Ray{
+			Add:           "127.0.0.1",
+			Port:          port,
+			ID:            "b831381d-6324-4d53-ad4f-8cda48b30811",
+			Net:           c.net,
+			TLS:           "tls",
+			Alpn:          c.alpn,
+			AllowInsecure: true,
+			Protocol:      "vless",
+		}
+		d, err := s.Dialer()
+		if c.offered == nil {
+			if err == nil {
+				t.Errorf("%v %v: expect an error", c.net, c.alpn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v %v: %v", c.net, c.alpn, err)
+		}
+		// the dial fails after the handshake, which may take a while
+		go func() {
+			if conn, err := d.Dial("tcp", "example.com:80"); err == nil {
+				// the handshake may be lazy
+				conn.Write([]byte("hello"))
+				conn.Close()
+			}
+		}()
+		select {
+		case protos := <-offered:
+			if !slices.Equal(protos, c.offered) {
+				t.Errorf("%v %v: offered %v, want %v", c.net, c.alpn, protos, c.offered)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v %v: no handshake", c.net, c.alpn)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package v2ray
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/mzz2017/softwind/protocol"
+	"github.com/mzz2017/softwind/protocol/vmess"
+	"golang.org/x/net/proxy"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FlowVision is the only supported VLESS flow.
+// https://github.com/XTLS/Xray-core/discussions/1295
+const FlowVision = "xtls-rprx-vision"
+
+const (
+	visionCommandContinue byte = iota
+	visionCommandEnd
+	visionCommandDirect
+)
+
+const (
+	// visionMaxContent keeps a padded block within the 8192-byte buffer of Xray.
+	visionMaxContent = 8192 - 16 - 5
+	// visionReadSize is larger than any TLS record, so that a Read of the TLS conn drains the plaintext of a record.
+	visionReadSize = 1<<14 + 1024
+)
+
+var (
+	tlsApplicationDataStart = []byte{0x17, 0x03, 0x03}
+	tls13SupportedVersions  = []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}
+)
+
+// recordDialer returns connections never read ahead of TLS records, which allows vision to take over the raw
+// connection right after a TLS record.
+type recordDialer struct {
+	proxy.Dialer
+}
+
+func (d *recordDialer) Dial(network, addr string) (net.Conn, error) {
+	c, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &recordConn{Conn: c, r: bufio.NewReaderSize(c, visionReadSize)}, nil
+}
+
+type recordConn struct {
+	net.Conn
+	r *bufio.Reader
+	// remaining is the number of bytes left in the current TLS record.
+	remaining int
+}
+
+// Read is used by TLS and returns no more than the current TLS record.
+func (c *recordConn) Read(b []byte) (int, error) {
+	if c.remaining == 0 {
+		hdr, err := c.r.Peek(5)
+		if err != nil {
+			if len(hdr) > 0 {
+				// Let TLS report the malformed record.
+				n, _ := c.r.Read(b)
+				return n, nil
+			}
+			return 0, err
+		}
+		c.remaining = 5 + int(binary.BigEndian.Uint16(hdr[3:]))
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.remaining -= n
+	return n, err
+}
+
+// ReadDirect reads the raw connection after vision switches to direct copy.
+func (c *recordConn) ReadDirect(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// visionState is the traffic state of a vision connection shared by the reading and writing.
+type visionState struct {
+	mu sync.Mutex
+
+	numberOfPacketToFilter int
+	isTLS                  bool
+	isTLS12orAbove         bool
+	enableXtls             bool
+	remainingServerHello   int
+	cipher                 uint16
+}
+
+// filterTLS detects whether the inner traffic is TLS 1.3, which is the condition of direct copy.
+func (s *visionState) filterTLS(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.numberOfPacketToFilter <= 0 || len(b) == 0 {
+		return
+	}
+	s.numberOfPacketToFilter--
+	if len(b) >= 6 {
+		if bytes.Equal(b[:3], []byte{0x16, 0x03, 0x03}) && b[5] == 0x02 {
+			// ServerHello
+			s.remainingServerHello = int(binary.BigEndian.Uint16(b[3:])) + 5
+			s.isTLS12orAbove = true
+			s.isTLS = true
+			if len(b) >= 79 && s.remainingServerHello >= 79 {
+				sessionIdLen := int(b[43])
+				if len(b) >= 43+sessionIdLen+3 {
+					s.cipher = binary.BigEndian.Uint16(b[43+sessionIdLen+1:])
+				}
+			}
+		} else if bytes.Equal(b[:2], []byte{0x16, 0x03}) && b[5] == 0x01 {
+			// ClientHello
+			s.isTLS = true
+		}
+	}
+	if s.remainingServerHello > 0 {
+		end := s.remainingServerHello
+		if end > len(b) {
+			end = len(b)
+		}
+		s.remainingServerHello -= len(b)
+		if bytes.Contains(b[:end], tls13SupportedVersions) {
+			// TLS_AES_128_CCM_8_SHA256 is not spliced by Xray.
+			s.enableXtls = s.cipher >= 0x1301 && s.cipher <= 0x1304
+			s.numberOfPacketToFilter = 0
+		} else if s.remainingServerHello <= 0 {
+			s.numberOfPacketToFilter = 0
+		}
+	}
+}
+
+// visionDialer is a VLESS client with the xtls-rprx-vision flow. It requires a TLS or REALITY dialer over a
+// recordDialer. UDP is dialed by udpDialer because vision only works for TCP.
+type visionDialer struct {
+	nextDialer   proxy.Dialer
+	udpDialer    proxy.Dialer
+	proxyAddress string
+	key          []byte
+}
+
+func (d *visionDialer) Dial(network string, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp":
+	case "udp":
+		return d.udpDialer.Dial(network, addr)
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	mdata, err := protocol.ParseMetadata(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.nextDialer.Dial("tcp", d.proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	nc, ok := conn.(interface{ NetConn() net.Conn })
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%v requires TLS", FlowVision)
+	}
+	raw, ok := nc.NetConn().(*recordConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%v: unexpected underlying connection", FlowVision)
+	}
+	c := &visionConn{
+		Conn:       conn,
+		raw:        raw,
+		metadata:   vmess.Metadata{Metadata: mdata, Network: network},
+		key:        d.key,
+		writeUUID:  true,
+		readUUID:   true,
+		writePad:   true,
+		readPad:    true,
+		readBuf:    make([]byte, visionReadSize),
+		remainCmd:  -1,
+		remainCont: -1,
+		remainPad:  -1,
+		state:      &visionState{numberOfPacketToFilter: 8},
+	}
+	time.AfterFunc(100*time.Millisecond, func() {
+		// Avoid the situation where the server sends messages first.
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		if !c.headerSent {
+			_ = c.write(nil)
+		}
+	})
+	return c, nil
+}
+
+type visionConn struct {
+	net.Conn
+	raw      *recordConn
+	metadata vmess.Metadata
+	key      []byte
+	state    *visionState
+
+	writeMu     sync.Mutex
+	headerSent  bool
+	writeUUID   bool
+	writePad    bool
+	writeDirect bool
+
+	readMu     sync.Mutex
+	headerRead bool
+	readUUID   bool
+	readPad    bool
+	readDirect atomic.Bool
+	readBuf    []byte
+	pending    []byte
+	curCmd     byte
+	remainCmd  int
+	remainCont int
+	remainPad  int
+}
+
+func (c *visionConn) reqHeader() []byte {
+	addrLen := c.metadata.AddrLen()
+	buf := make([]byte, 0, 1+16+1+2+len(FlowVision)+1+2+1+addrLen)
+	buf = append(buf, 0) // version
+	buf = append(buf, c.key...)
+	// Addons is a protobuf message whose field 1 is the flow.
+	buf = append(buf, byte(2+len(FlowVision)), 0x0a, byte(len(FlowVision)))
+	buf = append(buf, FlowVision...)
+	buf = append(buf, vmess.NetworkToByte(c.metadata.Network))
+	buf = binary.BigEndian.AppendUint16(buf, c.metadata.Port)
+	buf = append(buf, vmess.MetadataTypeToByte(c.metadata.Type))
+	addr := make([]byte, addrLen)
+	c.metadata.PutAddr(addr)
+	return append(buf, addr...)
+}
+
+// pad appends a padded block of content to dst.
+func (c *visionConn) pad(dst []byte, content []byte, command byte, longPadding bool) []byte {
+	var paddingLen int
+	if len(content) < 900 && longPadding {
+		paddingLen = rand.Intn(500) + 900 - len(content)
+	} else {
+		paddingLen = rand.Intn(256)
+	}
+	if max := visionMaxContent - len(content); paddingLen > max {
+		paddingLen = max
+	}
+	if c.writeUUID {
+		dst = append(dst, c.key...)
+		c.writeUUID = false
+	}
+	dst = append(dst, command)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(content)))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(paddingLen))
+	dst = append(dst, content...)
+	return append(dst, make([]byte, paddingLen)...)
+}
+
+func (c *visionConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.write(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *visionConn) write(b []byte) error {
+	if c.writeDirect {
+		_, err := c.raw.Conn.Write(b)
+		return err
+	}
+	var out []byte
+	if !c.headerSent {
+		out = c.reqHeader()
+		c.headerSent = true
+	}
+	if !c.writePad {
+		if _, err := c.Conn.Write(append(out, b...)); err != nil {
+			return err
+		}
+		return nil
+	}
+	if len(b) == 0 {
+		out = c.pad(out, nil, visionCommandContinue, true)
+		_, err := c.Conn.Write(out)
+		return err
+	}
+	c.state.filterTLS(b)
+	c.state.mu.Lock()
+	isTLS, isTLS12orAbove, enableXtls, toFilter := c.state.isTLS, c.state.isTLS12orAbove, c.state.enableXtls, c.state.numberOfPacketToFilter
+	c.state.mu.Unlock()
+	longPadding := isTLS
+	var direct bool
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > visionMaxContent {
+			chunk = chunk[:visionMaxContent]
+		}
+		b = b[len(chunk):]
+		command := visionCommandContinue
+		if isTLS && len(chunk) >= 6 && bytes.Equal(chunk[:3], tlsApplicationDataStart) {
+			// The inner TLS handshake is finished. Padding ends here.
+			c.writePad = false
+			longPadding = false
+		} else if !isTLS12orAbove && toFilter <= 1 {
+			// Not TLS or not recognized in time.
+			c.writePad = false
+		}
+		if !c.writePad {
+			command = visionCommandEnd
+			if enableXtls {
+				command = visionCommandDirect
+				direct = true
+			}
+			out = c.pad(out, chunk, command, longPadding)
+			if _, err := c.Conn.Write(out); err != nil {
+				return err
+			}
+			// The rest is written without padding.
+			if direct {
+				c.writeDirect = true
+				if len(b) > 0 {
+					_, err := c.raw.Conn.Write(b)
+					return err
+				}
+				return nil
+			}
+			if len(b) > 0 {
+				_, err := c.Conn.Write(b)
+				return err
+			}
+			return nil
+		}
+		out = c.pad(out, chunk, command, longPadding)
+		if _, err := c.Conn.Write(out); err != nil {
+			return err
+		}
+		out = out[:0]
+	}
+	return nil
+}
+
+func (c *visionConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		if c.readDirect.Load() {
+			return c.raw.ReadDirect(b)
+		}
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readRecord reads the plaintext of a TLS record and processes it into pending.
+func (c *visionConn) readRecord() error {
+	n, err := c.Conn.Read(c.readBuf)
+	if n == 0 {
+		if err == nil {
+			return nil
+		}
+		return err
+	}
+	data := c.readBuf[:n]
+	if !c.headerRead {
+		// The response header: version and addons.
+		for len(data) < 2 || len(data) < 2+int(data[1]) {
+			m, err := c.Conn.Read(c.readBuf[len(data):])
+			if m == 0 && err != nil {
+				return err
+			}
+			data = c.readBuf[:len(data)+m]
+		}
+		if data[0] != 0 {
+			return fmt.Errorf("version %v is not supported", data[0])
+		}
+		data = data[2+int(data[1]):]
+		c.headerRead = true
+	}
+	c.state.mu.Lock()
+	toFilter := c.state.numberOfPacketToFilter
+	c.state.mu.Unlock()
+	if c.readPad || toFilter > 0 {
+		data = c.unpad(data)
+		if c.remainCont > 0 || c.remainPad > 0 || c.curCmd == visionCommandContinue {
+			c.readPad = true
+		} else if c.curCmd == visionCommandEnd {
+			c.readPad = false
+		} else if c.curCmd == visionCommandDirect {
+			c.readPad = false
+			c.readDirect.Store(true)
+		}
+	}
+	c.state.filterTLS(data)
+	c.pending = data
+	return nil
+}
+
+// unpad removes the padding in place.
+func (c *visionConn) unpad(b []byte) []byte {
+	if c.remainCmd == -1 && c.remainCont == -1 && c.remainPad == -1 {
+		if !c.readUUID || len(b) < 21 || !bytes.Equal(b[:16], c.key) {
+			return b
+		}
+		c.readUUID = false
+		b = b[16:]
+		c.remainCmd = 5
+	}
+	out := b[:0]
+	for len(b) > 0 {
+		switch {
+		case c.remainCmd > 0:
+			switch c.remainCmd {
+			case 5:
+				c.curCmd = b[0]
+			case 4:
+				c.remainCont = int(b[0]) << 8
+			case 3:
+				c.remainCont |= int(b[0])
+			case 2:
+				c.remainPad = int(b[0]) << 8
+			case 1:
+				c.remainPad |= int(b[0])
+			}
+			b = b[1:]
+			c.remainCmd--
+		case c.remainCont > 0:
+			n := c.remainCont
+			if n > len(b) {
+				n = len(b)
+			}
+			// out never overtakes b, so that it is safe to copy in place.
+			out = append(out, b[:n]...)
+			b = b[n:]
+			c.remainCont -= n
+		default:
+			n := c.remainPad
+			if n > len(b) {
+				n = len(b)
+			}
+			b = b[n:]
+			c.remainPad -= n
+		}
+		if c.remainCmd <= 0 && c.remainCont <= 0 && c.remainPad <= 0 {
+			if c.curCmd == visionCommandContinue {
+				c.remainCmd = 5
+			} else {
+				c.remainCmd, c.remainCont, c.remainPad = -1, -1, -1
+				out = append(out, b...)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (c *visionConn) Close() error {
+	c.writeMu.Lock()
+	direct := c.writeDirect
+	c.writeMu.Unlock()
+	if direct || c.readDirect.Load() {
+		// The TLS conn is not able to send close_notify any more.
+		return c.raw.Close()
+	}
+	return c.Conn.Close()
+}
+
+func (c *visionConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeDirect {
+		if cw, ok := c.raw.Conn.(interface{ CloseWrite() error }); ok {
+			return cw.CloseWrite()
+		}
+		return nil
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
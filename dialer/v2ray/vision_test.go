@@ -0,0 +1,225 @@
+package v2ray
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+var visionKey = bytes.Repeat([]byte{0xb8}, 16)
+
+func newVisionConn() *visionConn {
+	return &visionConn{
+		key:        visionKey,
+		writeUUID:  true,
+		readUUID:   true,
+		remainCmd:  -1,
+		remainCont: -1,
+		remainPad:  -1,
+	}
+}
+
+func TestVisionPad(t *testing.T) {
+	c := newVisionConn()
+	for _, content := range [][]byte{[]byte("abc"), bytes.Repeat([]byte{1}, visionMaxContent)} {
+		for _, longPadding := range []bool{false, true} {
+			writeUUID := c.writeUUID
+			b := c.pad(nil, content, visionCommandEnd, longPadding)
+			if writeUUID {
+				if !bytes.Equal(b[:16], visionKey) {
+					t.Fatal("the first block does not start with the UUID")
+				}
+				b = b[16:]
+			}
+			contentLen, paddingLen := int(binary.BigEndian.Uint16(b[1:])), int(binary.BigEndian.Uint16(b[3:]))
+			if b[0] != visionCommandEnd || contentLen != len(content) || !bytes.Equal(b[5:5+contentLen], content) {
+				t.Fatalf("unexpected block header: %x", b[:5])
+			}
+			if len(b) != 5+contentLen+paddingLen || contentLen+paddingLen > visionMaxContent {
+				t.Fatalf("unexpected padding length: %v", paddingLen)
+			}
+			if longPadding && len(content) < 900 && contentLen+paddingLen < 900 {
+				t.Fatalf("the long padding is too short: %v", paddingLen)
+			}
+		}
+	}
+}
+
+func TestVisionUnpad(t *testing.T) {
+	// UUID, a block of "abc" to continue, a block of "de" to end and the rest "fg" without padding
+	b := append(bytes.Clone(visionKey),
+		0x00, 0x00, 0x03, 0x00, 0x02, 'a', 'b', 'c', 0, 0,
+		0x01, 0x00, 0x02, 0x00, 0x00, 'd', 'e',
+		'f', 'g')
+	for _, size := range []int{len(b), 7, 1} {
+		c := newVisionConn()
+		// the UUID is detected in the first record, which holds the first block header at least
+		out := c.unpad(bytes.Clone(b[:21]))
+		for i := 21; i < len(b); i += size {
+			out = append(out, c.unpad(bytes.Clone(b[i:min(i+size, len(b))]))...)
+		}
+		if string(out) != "abcdefg" || c.curCmd != visionCommandEnd {
+			t.Fatalf("size %v: unexpected unpadded data: %q, command %v", size, out, c.curCmd)
+		}
+	}
+
+	// the data not starting with the UUID is not padded
+	c := newVisionConn()
+	if out := c.unpad(bytes.Repeat([]byte("x"), 32)); len(out) != 32 {
+		t.Fatalf("unexpected unpadded data: %q", out)
+	}
+
+	// pad and unpad
+	w, r := newVisionConn(), newVisionConn()
+	var stream []byte
+	stream = w.pad(stream, []byte("hello "), visionCommandContinue, true)
+	stream = w.pad(stream, []byte("world"), visionCommandEnd, false)
+	if out := r.unpad(stream); string(out) != "hello world" {
+		t.Fatalf("unexpected unpadded data: %q", out)
+	}
+}
+
+// serverHello returns a ServerHello record of the cipher with the extensions.
+func serverHello(cipher uint16, exts []byte) []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 32)
+	body = append(body, make([]byte, 32)...) // session id
+	body = binary.BigEndian.AppendUint16(body, cipher)
+	body = append(body, 0) // compression method
+	body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+	msg := append([]byte{0x02, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{0x16, 0x03, 0x03, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestFilterTLS(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		packets        [][]byte
+		isTLS          bool
+		isTLS12orAbove bool
+		enableXtls     bool
+		toFilter       int
+	}{
+		{"not tls", [][]byte{[]byte("GET / HTTP/1.1\r\n")}, false, false, false, 7},
+		{"client hello", [][]byte{{0x16, 0x03, 0x01, 0x00, 0xc8, 0x01}}, true, false, false, 7},
+		{"tls 1.3", [][]byte{serverHello(0x1301, tls13SupportedVersions)}, true, true, true, 0},
+		{"tls 1.3 ccm 8", [][]byte{serverHello(0x1305, tls13SupportedVersions)}, true, true, false, 0},
+		{"tls 1.2", [][]byte{serverHello(0xc02f, []byte{0xff, 0x01, 0x00, 0x01, 0x00})}, true, true, false, 0},
+		{"tls 1.3 fragmented", [][]byte{
+			serverHello(0x1302, tls13SupportedVersions)[:80],
+			serverHello(0x1302, tls13SupportedVersions)[80:],
+		}, true, true, true, 0},
+	} {
+		s := &visionState{numberOfPacketToFilter: 8}
+		for _, p := range c.packets {
+			s.filterTLS(p)
+		}
+		if s.isTLS != c.isTLS || s.isTLS12orAbove != c.isTLS12orAbove || s.enableXtls != c.enableXtls ||
+			s.numberOfPacketToFilter != c.toFilter {
+			t.Errorf("%v: unexpected state: %+v", c.name, s)
+		}
+	}
+}
+
+// serveVision starts a VLESS server of the vision flow over TLS, which echoes the first message in a padded block
+// and the rest without padding.
+func serveVision(t *testing.T, cert tls.Certificate) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				// version, UUID, addons, command, port, address type and IPv4
+				hdr := make([]byte, 1+16+1)
+				if _, err := io.ReadFull(c, hdr); err != nil || !bytes.Equal(hdr[1:17], visionKey) {
+					return
+				}
+				rest := make([]byte, int(hdr[17])+1+2+1+4)
+				if _, err := io.ReadFull(c, rest); err != nil || !bytes.Contains(rest, []byte(FlowVision)) {
+					return
+				}
+				v := newVisionConn()
+				buf := make([]byte, visionReadSize)
+				for first := true; ; {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					data := v.unpad(buf[:n])
+					if len(data) == 0 {
+						continue
+					}
+					if first {
+						data = v.pad([]byte{0, 0}, data, visionCommandEnd, false)
+						first = false
+					}
+					if _, err = c.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestVision(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(serveVision(t, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}))
+	s := &V2Ray{
+		Add:           host,
+		Port:          port,
+		ID:            "b8b8b8b8-b8b8-b8b8-b8b8-b8b8b8b8b8b8",
+		Net:           "tcp",
+		TLS:           "tls",
+		Flow:          FlowVision,
+		AllowInsecure: true,
+		Protocol:      "vless",
+	}
+	d, err := s.Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", "1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"hello", "world"} {
+		if _, err = c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != msg {
+			t.Fatalf("unexpected echo: %q %v", buf, err)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package wireguard
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/mzz2017/gg/common"
+	"github.com/mzz2017/gg/dialer"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultMTU = 1420
+
+func init() {
+	dialer.FromLinkRegister("wireguard", NewWireGuard)
+	dialer.FromLinkRegister("wg", NewWireGuard)
+	dialer.FromClashRegister("wireguard", NewWireGuardFromClashObj)
+}
+
+type WireGuard struct {
+	Name         string   `json:"name"`
+	Server       string   `json:"server"`
+	Port         int      `json:"port"`
+	PrivateKey   string   `json:"privateKey"`
+	PublicKey    string   `json:"publicKey"`
+	PresharedKey string   `json:"presharedKey"`
+	Address      []string `json:"address"`
+	DNS          []string `json:"dns"`
+	MTU          int      `json:"mtu"`
+	KeepAlive    int      `json:"keepAlive"`
+	Reserved     []byte   `json:"reserved"` // Reserved is the 3 reserved bytes of the message header, used by WARP
+	Protocol     string   `json:"protocol"`
+}
+
+func NewWireGuard(link string, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
+	s, err := ParseWireGuardURL(link)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", dialer.InvalidParameterErr, err)
+	}
+	return s.Dialer()
+}
+
+func NewWireGuardFromClashObj(o *yaml.Node, opt *dialer.GlobalOption) (*dialer.Dialer, error) {
+	s, err := ParseClash(o)
+	if err != nil {
+		return nil, err
+	}
+	return s.Dialer()
+}
+
+func (s *WireGuard) Dialer() (*dialer.Dialer, error) {
+	if s.MTU == 0 {
+		s.MTU = DefaultMTU
+	}
+	d := &wgDialer{wg: s}
+	// Check the parameters in advance, so that an invalid node will not be brought up lazily.
+	if _, err := d.ipcConfig(netip.AddrPortFrom(netip.IPv4Unspecified(), uint16(s.Port))); err != nil {
+		return nil, err
+	}
+	if _, err := s.localAddresses(); err != nil {
+		return nil, err
+	}
+	if _, err := s.dnsServers(); err != nil {
+		return nil, err
+	}
+	if len(s.Reserved) != 0 && len(s.Reserved) != 3 {
+		return nil, fmt.Errorf("%w: reserved: %v", dialer.InvalidParameterErr, s.Reserved)
+	}
+	return dialer.NewDialer(d, true, s.Name, s.Protocol, s.ExportToURL()), nil
+}
+
+func ParseWireGuardURL(link string) (data *WireGuard, err error) {
+	// wireguard://privateKey@server:port?publickey=...&address=10.0.0.2/32,fd00::2/128&mtu=1420#name
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing port: %w", err)
+	}
+	q := u.Query()
+	privateKey := u.User.Username()
+	if privateKey == "" {
+		privateKey = q.Get("privatekey")
+	}
+	data = &WireGuard{
+		Name:         u.Fragment,
+		Server:       u.Hostname(),
+		Port:         port,
+		PrivateKey:   privateKey,
+		PublicKey:    q.Get("publickey"),
+		PresharedKey: q.Get("presharedkey"),
+		Address:      splitList(q.Get("address")),
+		DNS:          splitList(q.Get("dns")),
+		Protocol:     "wireguard",
+	}
+	if mtu := q.Get("mtu"); mtu != "" {
+		if data.MTU, err = strconv.Atoi(mtu); err != nil {
+			return nil, fmt.Errorf("error when parsing mtu: %w", err)
+		}
+	}
+	if keepAlive := q.Get("keepalive"); keepAlive != "" {
+		if data.KeepAlive, err = strconv.Atoi(keepAlive); err != nil {
+			return nil, fmt.Errorf("error when parsing keepalive: %w", err)
+		}
+	}
+	if reserved := q.Get("reserved"); reserved != "" {
+		if data.Reserved, err = parseReserved(reserved); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func ParseClash(o *yaml.Node) (data *WireGuard, err error) {
+	type WireGuardOption struct {
+		Name                string   `yaml:"name"`
+		Server              string   `yaml:"server"`
+		Port                int      `yaml:"port"`
+		IP                  string   `yaml:"ip,omitempty"`
+		IPv6                string   `yaml:"ipv6,omitempty"`
+		PrivateKey          string   `yaml:"private-key"`
+		PublicKey           string   `yaml:"public-key"`
+		PresharedKey        string   `yaml:"preshared-key,omitempty"`
+		PreSharedKey        string   `yaml:"pre-shared-key,omitempty"`
+		DNS                 []string `yaml:"dns,omitempty"`
+		MTU                 int      `yaml:"mtu,omitempty"`
+		UDP                 bool     `yaml:"udp,omitempty"`
+		PersistentKeepalive int      `yaml:"persistent-keepalive,omitempty"`
+		Reserved            any      `yaml:"reserved,omitempty"`
+	}
+	var option WireGuardOption
+	if err = o.Decode(&option); err != nil {
+		return nil, err
+	}
+	// reserved is like [209, 98, 59] or "0WI7"
+	var reserved []byte
+	switch r := option.Reserved.(type) {
+	case nil:
+	case string:
+		if reserved, err = parseReserved(r); err != nil {
+			return nil, err
+		}
+	case []any:
+		for _, v := range r {
+			b, ok := v.(int)
+			if !ok || b < 0 || b > 255 {
+				return nil, fmt.Errorf("%w: reserved: %v", dialer.InvalidParameterErr, r)
+			}
+			reserved = append(reserved, byte(b))
+		}
+	default:
+		return nil, fmt.Errorf("%w: reserved: %v", dialer.InvalidParameterErr, r)
+	}
+	var address []string
+	if option.IP != "" {
+		address = append(address, option.IP)
+	}
+	if option.IPv6 != "" {
+		address = append(address, option.IPv6)
+	}
+	psk := option.PresharedKey
+	if psk == "" {
+		psk = option.PreSharedKey
+	}
+	return &WireGuard{
+		Name:         option.Name,
+		Server:       option.Server,
+		Port:         option.Port,
+		PrivateKey:   option.PrivateKey,
+		PublicKey:    option.PublicKey,
+		PresharedKey: psk,
+		Address:      address,
+		DNS:          option.DNS,
+		MTU:          option.MTU,
+		KeepAlive:    option.PersistentKeepalive,
+		Reserved:     reserved,
+		Protocol:     "wireguard",
+	}, nil
+}
+
+func (s *WireGuard) ExportToURL() string {
+	u := url.URL{
+		Scheme:   "wireguard",
+		User:     url.User(s.PrivateKey),
+		Host:     net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
+		Fragment: s.Name,
+	}
+	q := u.Query()
+	common.SetValue(&q, "publickey", s.PublicKey)
+	common.SetValue(&q, "presharedkey", s.PresharedKey)
+	common.SetValue(&q, "address", strings.Join(s.Address, ","))
+	common.SetValue(&q, "dns", strings.Join(s.DNS, ","))
+	if s.MTU != 0 {
+		q.Set("mtu", strconv.Itoa(s.MTU))
+	}
+	if s.KeepAlive != 0 {
+		q.Set("keepalive", strconv.Itoa(s.KeepAlive))
+	}
+	if len(s.Reserved) != 0 {
+		reserved := make([]string, len(s.Reserved))
+		for i, b := range s.Reserved {
+			reserved[i] = strconv.Itoa(int(b))
+		}
+		q.Set("reserved", strings.Join(reserved, ","))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// parseReserved parses the reserved bytes like "209,98,59" or the base64 "0WI7".
+func parseReserved(s string) ([]byte, error) {
+	if !strings.Contains(s, ",") {
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 3 {
+			return b, nil
+		}
+	}
+	var reserved []byte
+	for _, v := range splitList(s) {
+		b, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reserved: %v", dialer.InvalidParameterErr, s)
+		}
+		reserved = append(reserved, byte(b))
+	}
+	if len(reserved) != 3 {
+		return nil, fmt.Errorf("%w: reserved: %v", dialer.InvalidParameterErr, s)
+	}
+	return reserved, nil
+}
+
+func (s *WireGuard) localAddresses() (addrs []netip.Addr, err error) {
+	if len(s.Address) == 0 {
+		return nil, fmt.Errorf("%w: address is required", dialer.InvalidParameterErr)
+	}
+	for _, a := range s.Address {
+		// Both "10.0.0.2" and "10.0.0.2/32" are acceptable.
+		if prefix, err := netip.ParsePrefix(a); err == nil {
+			addrs = append(addrs, prefix.Addr())
+			continue
+		}
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("%w: address: %v", dialer.InvalidParameterErr, a)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (s *WireGuard) dnsServers() (servers []netip.Addr, err error) {
+	if len(s.DNS) == 0 {
+		return []netip.Addr{netip.MustParseAddr("1.1.1.1")}, nil
+	}
+	for _, a := range s.DNS {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("%w: dns: %v", dialer.InvalidParameterErr, a)
+		}
+		servers = append(servers, addr)
+	}
+	return servers, nil
+}
+
+// wgDialer brings up a userspace WireGuard device with a netstack on the first Dial,
+// because a subscription may contain a lot of nodes and most of them will never be used.
+type wgDialer struct {
+	wg *WireGuard
+
+	mu          sync.Mutex // mu protects the initialization, which is retried on the next Dial if failed
+	initialized bool
+	tnet        *netstack.Net
+	device      *device.Device
+}
+
+func (d *wgDialer) ipcConfig(endpoint netip.AddrPort) (string, error) {
+	privateKey, err := keyToHex(d.wg.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: private key: %v", dialer.InvalidParameterErr, err)
+	}
+	publicKey, err := keyToHex(d.wg.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: public key: %v", dialer.InvalidParameterErr, err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%v\n", privateKey)
+	fmt.Fprintf(&b, "public_key=%v\n", publicKey)
+	if d.wg.PresharedKey != "" {
+		psk, err := keyToHex(d.wg.PresharedKey)
+		if err != nil {
+			return "", fmt.Errorf("%w: preshared key: %v", dialer.InvalidParameterErr, err)
+		}
+		fmt.Fprintf(&b, "preshared_key=%v\n", psk)
+	}
+	fmt.Fprintf(&b, "endpoint=%v\n", endpoint.String())
+	if d.wg.KeepAlive != 0 {
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%v\n", d.wg.KeepAlive)
+	}
+	b.WriteString("allowed_ip=0.0.0.0/0\n")
+	b.WriteString("allowed_ip=::/0\n")
+	return b.String(), nil
+}
+
+func (d *wgDialer) init() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.initialized {
+		return nil
+	}
+	if err := d.up(); err != nil {
+		return err
+	}
+	d.initialized = true
+	return nil
+}
+
+func (d *wgDialer) up() error {
+	ips, err := net.LookupIP(d.wg.Server)
+	if err != nil {
+		return fmt.Errorf("[WireGuard]: resolve %v: %w", d.wg.Server, err)
+	}
+	// prefer IPv4, which is available on more hosts
+	ip, _ := netip.AddrFromSlice(ips[0])
+	for _, v := range ips {
+		if v.To4() != nil {
+			ip, _ = netip.AddrFromSlice(v)
+			break
+		}
+	}
+	cfg, err := d.ipcConfig(netip.AddrPortFrom(ip.Unmap(), uint16(d.wg.Port)))
+	if err != nil {
+		return err
+	}
+	localAddrs, _ := d.wg.localAddresses()
+	dnsServers, _ := d.wg.dnsServers()
+	tun, tnet, err := netstack.CreateNetTUN(localAddrs, dnsServers, d.wg.MTU)
+	if err != nil {
+		return fmt.Errorf("[WireGuard]: CreateNetTUN: %w", err)
+	}
+	var bind conn.Bind = conn.NewDefaultBind()
+	if len(d.wg.Reserved) == 3 {
+		bind = &reservedBind{Bind: bind, reserved: [3]byte(d.wg.Reserved)}
+	}
+	dev := device.NewDevice(tun, bind, device.NewLogger(device.LogLevelSilent, ""))
+	if err = dev.IpcSet(cfg); err != nil {
+		dev.Close()
+		return fmt.Errorf("[WireGuard]: IpcSet: %w", err)
+	}
+	if err = dev.Up(); err != nil {
+		dev.Close()
+		return fmt.Errorf("[WireGuard]: Up: %w", err)
+	}
+	d.tnet = tnet
+	d.device = dev
+	return nil
+}
+
+func (d *wgDialer) Dial(network, addr string) (c net.Conn, err error) {
+	switch network {
+	case "tcp", "udp":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if err = d.init(); err != nil {
+		return nil, err
+	}
+	// Domains are resolved by the DNS servers inside the tunnel.
+	return d.tnet.DialContext(context.Background(), network, addr)
+}
+
+// reservedBind writes the reserved bytes into the header of the messages to send, and clears them in the received
+// ones, which are rejected by the device otherwise.
+type reservedBind struct {
+	conn.Bind
+	reserved [3]byte
+}
+
+func (b *reservedBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
+	fns, actualPort, err = b.Bind.Open(port)
+	for i, fn := range fns {
+		fns[i] = func(packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+			n, err = fn(packets, sizes, eps)
+			for j := 0; j < n; j++ {
+				if sizes[j] >= 4 {
+					copy(packets[j][1:4], []byte{0, 0, 0})
+				}
+			}
+			return n, err
+		}
+	}
+	return fns, actualPort, err
+}
+
+func (b *reservedBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	for _, buf := range bufs {
+		if len(buf) >= 4 {
+			copy(buf[1:4], b.reserved[:])
+		}
+	}
+	return b.Bind.Send(bufs, ep)
+}
+
+func keyToHex(key string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != device.NoisePublicKeySize {
+		return "", fmt.Errorf("unexpected key length: %v", len(b))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
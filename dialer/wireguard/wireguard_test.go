@@ -0,0 +1,251 @@
+package wireguard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/gg/dialer"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gopkg.in/yaml.v3"
+)
+
+func newKey(t *testing.T) (private, public string) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		t.Fatal(err)
+	}
+	priv[0] &= 248
+	priv[31] = priv[31]&127 | 64
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(priv), base64.StdEncoding.EncodeToString(pub)
+}
+
+// peerBind records the reserved bytes of the received messages and clears them.
+type peerBind struct {
+	conn.Bind
+	reserved atomic.Value
+}
+
+func (b *peerBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
+	fns, actualPort, err = b.Bind.Open(port)
+	for i, fn := range fns {
+		fns[i] = func(packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+			n, err = fn(packets, sizes, eps)
+			for j := 0; j < n; j++ {
+				if sizes[j] >= 4 {
+					b.reserved.Store(string(packets[j][1:4]))
+					copy(packets[j][1:4], []byte{0, 0, 0})
+				}
+			}
+			return n, err
+		}
+	}
+	return fns, actualPort, err
+}
+
+// servePeer starts an in-process WireGuard peer at 10.0.0.1 whose netstack echoes the TCP connections to port 80 and
+// the UDP datagrams to port 53.
+func servePeer(t *testing.T, clientPublicKey string) (port int, publicKey string, bind *peerBind) {
+	private, public := newKey(t)
+	tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, DefaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind = &peerBind{Bind: conn.NewDefaultBind()}
+	dev := device.NewDevice(tun, bind, device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+	privateHex, _ := keyToHex(private)
+	clientHex, _ := keyToHex(clientPublicKey)
+	if err = dev.IpcSet(fmt.Sprintf("private_key=%v\nlisten_port=0\npublic_key=%v\nallowed_ip=10.0.0.2/32\n", privateHex, clientHex)); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(cfg, "\n") {
+		if v, ok := strings.CutPrefix(line, "listen_port="); ok {
+			port, _ = strconv.Atoi(v)
+		}
+	}
+	l, err := tnet.ListenTCPAddrPort(netip.MustParseAddrPort("10.0.0.1:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	pc, err := tnet.ListenUDPAddrPort(netip.MustParseAddrPort("10.0.0.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return port, public, bind
+}
+
+// echo writes to c and checks that the data is echoed.
+func echo(t *testing.T, c net.Conn) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("unexpected echo: %q %v", buf, err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, reserved := range [][]byte{nil, {209, 98, 59}} {
+		t.Run(hex.EncodeToString(reserved), func(t *testing.T) {
+			private, public := newKey(t)
+			port, peerPublic, bind := servePeer(t, public)
+			wg := &WireGuard{
+				Server:     "127.0.0.1",
+				Port:       port,
+				PrivateKey: private,
+				PublicKey:  peerPublic,
+				Address:    []string{"10.0.0.2/32"},
+				Reserved:   reserved,
+				Protocol:   "wireguard",
+			}
+			d, err := wg.Dialer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := d.Dial("tcp", "10.0.0.1:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			echo(t, c)
+			uc, err := d.Dial("udp", "10.0.0.1:53")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer uc.Close()
+			echo(t, uc)
+			want := string([]byte{0, 0, 0})
+			if reserved != nil {
+				want = string(reserved)
+			}
+			if got := bind.reserved.Load(); got != want {
+				t.Fatalf("received reserved %v, want %v", []byte(got.(string)), []byte(want))
+			}
+		})
+	}
+}
+
+func TestInitRetry(t *testing.T) {
+	private, public := newKey(t)
+	port, peerPublic, _ := servePeer(t, public)
+	wg := &WireGuard{
+		Server:     "",
+		Port:       port,
+		PrivateKey: private,
+		PublicKey:  peerPublic,
+		Address:    []string{"10.0.0.2/32"},
+		Protocol:   "wireguard",
+	}
+	d, err := wg.Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server cannot be resolved
+	if _, err = d.Dial("tcp", "10.0.0.1:80"); err == nil {
+		t.Fatal("brought up without the server")
+	}
+	wg.Server = "127.0.0.1"
+	c, err := d.Dial("tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatalf("the failed initialization is not retried: %v", err)
+	}
+	defer c.Close()
+	echo(t, c)
+}
+
+func TestParseReserved(t *testing.T) {
+	for _, c := range []struct {
+		link     string
+		reserved []byte
+		ok       bool
+	}{
+		{"wireguard://k@1.1.1.1:2408?reserved=209,98,59", []byte{209, 98, 59}, true},
+		{"wireguard://k@1.1.1.1:2408?reserved=0WI7", []byte{209, 98, 59}, true},
+		{"wireguard://k@1.1.1.1:2408?reserved=1,2", nil, false},
+		{"wireguard://k@1.1.1.1:2408?reserved=1,2,256", nil, false},
+	} {
+		s, err := ParseWireGuardURL(c.link)
+		if (err == nil) != c.ok || (c.ok && !bytes.Equal(s.Reserved, c.reserved)) {
+			t.Fatalf("%v: unexpected reserved: %v %v", c.link, s, err)
+		}
+		if c.ok {
+			if s2, err := ParseWireGuardURL(s.ExportToURL()); err != nil || !reflect.DeepEqual(s, s2) {
+				t.Fatalf("%v: not exported the same: %v %v", c.link, s2, err)
+			}
+		}
+	}
+	for _, c := range []struct {
+		reserved string
+		ok       bool
+	}{
+		{"[209, 98, 59]", true},
+		{`"0WI7"`, true},
+		{"[209, 98, 600]", false},
+	} {
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte("{name: n, server: 1.1.1.1, port: 2408, reserved: "+c.reserved+"}"), &node); err != nil {
+			t.Fatal(err)
+		}
+		s, err := ParseClash(node.Content[0])
+		if (err == nil) != c.ok || (c.ok && !bytes.Equal(s.Reserved, []byte{209, 98, 59})) {
+			t.Fatalf("%v: unexpected reserved: %v %v", c.reserved, s, err)
+		}
+		if !c.ok && !errors.Is(err, dialer.InvalidParameterErr) {
+			t.Fatalf("%v: unexpected error: %v", c.reserved, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package pcapng writes packets in the pcapng format, which can be opened by Wireshark.
+//
+// See https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	LinkTypeRaw = 101 // raw IPv4 or IPv6 packets
+
+	blockTypeSectionHeader        = 0x0A0D0D0A
+	blockTypeInterface            = 0x00000001
+	blockTypeEnhancedPacket       = 0x00000006
+	byteOrderMagic                = 0x1A2B3C4D
+	optionEndOfOpt                = 0
+	optionComment                 = 1
+	optionInterfaceName           = 2
+	optionInterfaceTsResol        = 9
+	tsResolMicroseconds     uint8 = 6
+)
+
+// Writer writes a section with a single interface. It is not thread-safe.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the section header and the interface description of linkType named name.
+func NewWriter(w io.Writer, linkType uint16, name string) (*Writer, error) {
+	pw := &Writer{w: w}
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	if err := pw.writeBlock(blockTypeSectionHeader, shb, nil); err != nil {
+		return nil, err
+	}
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkType)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+	var opts []byte
+	if name != "" {
+		opts = appendOption(opts, optionInterfaceName, []byte(name))
+	}
+	opts = appendOption(opts, optionInterfaceTsResol, []byte{tsResolMicroseconds})
+	if err := pw.writeBlock(blockTypeInterface, idb, opts); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WritePacket writes the packet captured at t. The comment is omitted if empty.
+func (pw *Writer) WritePacket(t time.Time, packet []byte, comment string) error {
+	ts := uint64(t.UnixMicro())
+	var epb []byte
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // interface ID
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = append(epb, packet...)
+	epb = pad(epb)
+	var opts []byte
+	if comment != "" {
+		opts = appendOption(opts, optionComment, []byte(comment))
+	}
+	return pw.writeBlock(blockTypeEnhancedPacket, epb, opts)
+}
+
+func (pw *Writer) writeBlock(typ uint32, body []byte, opts []byte) error {
+	if len(opts) > 0 {
+		opts = appendOption(opts, optionEndOfOpt, nil)
+	}
+	length := uint32(12 + len(body) + len(opts))
+	b := make([]byte, 0, length)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	b = append(b, opts...)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	_, err := pw.w.Write(b)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return pad(b)
+}
+
+// pad pads b to 32 bits.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,41 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeRaw, "gg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WritePacket(time.UnixMicro(1<<32|2), []byte("hello"), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WritePacket(time.UnixMicro(3), []byte("abcd"), ""); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		// section header: type, length, byte-order magic, version 1.0, unknown section length, length
+		"0a0d0d0a", "1c000000", "4d3c2b1a", "01000000", "ffffffffffffffff", "1c000000",
+		// interface description: type, length, link type, reserved, snap length,
+		// if_name "gg", if_tsresol 6, end of options, length
+		"01000000", "28000000", "6500", "0000", "00000000",
+		"02000200" + hex.EncodeToString([]byte("gg")) + "0000", "09000100" + "06000000", "00000000", "28000000",
+		// enhanced packet: type, length, interface, timestamp high and low, captured and original length,
+		// the padded packet, comment "hi", end of options, length
+		"06000000", "34000000", "00000000", "01000000", "02000000", "05000000", "05000000",
+		hex.EncodeToString([]byte("hello")) + "000000", "01000200" + hex.EncodeToString([]byte("hi")) + "0000", "00000000", "34000000",
+		// enhanced packet without options
+		"06000000", "24000000", "00000000", "00000000", "03000000", "04000000", "04000000",
+		hex.EncodeToString([]byte("abcd")), "24000000",
+	}, "")
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Fatalf("unexpected pcapng:\n%v\nwant\n%v", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/json-iterator/go/extra"
 	"github.com/mzz2017/gg/cmd"
+	"github.com/mzz2017/gg/netns"
 	"net/http"
 	"os"
 	"time"
@@ -11,8 +12,10 @@ import (
 	_ "github.com/mzz2017/gg/dialer/shadowsocks"
 	_ "github.com/mzz2017/gg/dialer/shadowsocksr"
 	_ "github.com/mzz2017/gg/dialer/socks"
+	_ "github.com/mzz2017/gg/dialer/ssh"
 	_ "github.com/mzz2017/gg/dialer/trojan"
 	_ "github.com/mzz2017/gg/dialer/v2ray"
+	_ "github.com/mzz2017/gg/dialer/wireguard"
 	_ "github.com/mzz2017/softwind/protocol/shadowsocks"
 	_ "github.com/mzz2017/softwind/protocol/trojanc"
 	_ "github.com/mzz2017/softwind/protocol/vless"
@@ -20,6 +23,9 @@ import (
 )
 
 func main() {
+	if netns.IsChild() {
+		netns.RunChild()
+	}
 	extra.RegisterFuzzyDecoders()
 
 	http.DefaultClient.Timeout = 30 * time.Second
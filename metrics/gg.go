@@ -0,0 +1,31 @@
+package metrics
+
+import "net/http"
+
+// Default is the registry of the metrics of gg.
+var Default = &Registry{}
+
+var (
+	TCPSessions       = Default.Counter("gg_tcp_sessions_total", "TCP sessions accepted by the proxy.")
+	TCPSessionsActive = Default.Gauge("gg_tcp_sessions_active", "TCP sessions being relayed.")
+	UDPSessions       = Default.Counter("gg_udp_sessions_total", "UDP NAT mappings created by the proxy.")
+	UDPSessionsActive = Default.Gauge("gg_udp_sessions_active", "UDP NAT mappings being relayed.")
+	DialErrors        = Default.CounterVec("gg_dial_errors_total", "Failed dials to the target via the node.", "node", "network")
+	RelayedBytes      = Default.CounterVec("gg_relayed_bytes_total", "Bytes of the payload relayed between the program and the node.", "network", "direction")
+	DNSHijacks        = Default.Counter("gg_dns_hijacks_total", "DNS queries answered with fake IPs.")
+	SyscallStops      = Default.Counter("gg_tracer_syscall_stops_total", "Syscall stops of the tracees handled by the tracer.")
+	HandlerSeconds    = Default.Histogram("gg_tracer_handler_seconds", "Time spent in the handlers of syscall stops.",
+		0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05)
+
+	TCPUpload   = RelayedBytes.With("tcp", "upload")
+	TCPDownload = RelayedBytes.With("tcp", "download")
+	UDPUpload   = RelayedBytes.With("udp", "upload")
+	UDPDownload = RelayedBytes.With("udp", "download")
+)
+
+// ListenAndServe serves the default registry on /metrics of addr.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Default.Handler())
+	return http.ListenAndServe(addr, mux)
+}
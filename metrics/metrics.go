@@ -0,0 +1,216 @@
+// Package metrics collects the counters of gg and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n int) {
+	if n > 0 {
+		c.v.Add(uint64(n))
+	}
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+// CounterVec is a set of counters partitioned by the values of labels.
+type CounterVec struct {
+	labels   []string
+	mu       sync.Mutex
+	counters map[string]*Counter
+	values   map[string][]string
+}
+
+func NewCounterVec(labels ...string) *CounterVec {
+	return &CounterVec{
+		labels:   labels,
+		counters: make(map[string]*Counter),
+		values:   make(map[string][]string),
+	}
+}
+
+// With returns the counter of the label values, which are in the same order as the labels.
+func (v *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: expected %v label values, got %v", len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{}
+		v.counters[key] = c
+		v.values[key] = values
+	}
+	return c
+}
+
+// Histogram counts the observed durations in cumulative buckets of seconds.
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64 // the last one is +Inf
+	sum     atomic.Int64    // nanoseconds
+}
+
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	s := d.Seconds()
+	i := sort.SearchFloat64s(h.buckets, s)
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+type metric struct {
+	name  string
+	help  string
+	typ   string
+	value interface{}
+}
+
+// Registry is a set of metrics to expose. It is thread-safe.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *Registry) register(name, help, typ string, value interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, metric{name: name, help: help, typ: typ, value: value})
+}
+
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+func (r *Registry) Gauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, help, "gauge", g)
+	return g
+}
+
+func (r *Registry) CounterVec(name, help string, labels ...string) *CounterVec {
+	v := NewCounterVec(labels...)
+	r.register(name, help, "counter", v)
+	return v
+}
+
+func (r *Registry) Histogram(name, help string, buckets ...float64) *Histogram {
+	h := NewHistogram(buckets...)
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name, m.typ)
+		switch v := m.value.(type) {
+		case *Counter:
+			fmt.Fprintf(&b, "%v %v\n", m.name, v.Value())
+		case *Gauge:
+			fmt.Fprintf(&b, "%v %v\n", m.name, v.Value())
+		case *CounterVec:
+			v.mu.Lock()
+			keys := make([]string, 0, len(v.counters))
+			for k := range v.counters {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(&b, "%v%v %v\n", m.name, labels(v.labels, v.values[k]), v.counters[k].Value())
+			}
+			v.mu.Unlock()
+		case *Histogram:
+			var count uint64
+			for i := range v.counts {
+				count += v.counts[i].Load()
+				le := math.Inf(1)
+				if i < len(v.buckets) {
+					le = v.buckets[i]
+				}
+				fmt.Fprintf(&b, "%v_bucket%v %v\n", m.name, labels([]string{"le"}, []string{formatFloat(le)}), count)
+			}
+			fmt.Fprintf(&b, "%v_sum %v\n", m.name, formatFloat(time.Duration(v.sum.Load()).Seconds()))
+			fmt.Fprintf(&b, "%v_count %v\n", m.name, count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler returns the handler to be scraped.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+func labels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + `="` + escaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
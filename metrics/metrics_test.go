@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := &Registry{}
+	r.Counter("a_total", "A.").Add(3)
+	g := r.Gauge("b", "B.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	v := r.CounterVec("c_total", "C.", "node", "network")
+	v.With("n\"1", "tcp").Inc()
+	v.With("n2", "udp").Add(2)
+	h := r.Histogram("d_seconds", "D.", 0.001, 0.01)
+	h.Observe(500 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP a_total A.
+# TYPE a_total counter
+a_total 3
+# HELP b B.
+# TYPE b gauge
+b 1
+# HELP c_total C.
+# TYPE c_total counter
+c_total{node="n\"1",network="tcp"} 1
+c_total{node="n2",network="udp"} 2
+# HELP d_seconds D.
+# TYPE d_seconds histogram
+d_seconds_bucket{le="0.001"} 1
+d_seconds_bucket{le="0.01"} 2
+d_seconds_bucket{le="+Inf"} 3
+d_seconds_sum 1.0055
+d_seconds_count 3
+`
+	if b.String() != expected {
+		t.Fatalf("unexpected output:\n%v", b.String())
+	}
+}
@@ -0,0 +1,222 @@
+package netns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// IsChild reports whether gg is running as the child in the namespaces.
+func IsChild() bool {
+	return os.Getenv(envChild) != ""
+}
+
+// RunChild sets up the network in the namespaces, sends the tun device to the parent over fd 3, and executes the
+// program in os.Args[1:] once the parent is ready. It does not return.
+func RunChild() {
+	err := runChild()
+	fmt.Fprintf(os.Stderr, "gg: netns: %v\n", err)
+	os.Exit(1)
+}
+
+func runChild() error {
+	ctrl := os.NewFile(3, "netns")
+	if len(os.Args) < 3 {
+		return fmt.Errorf("no program is given")
+	}
+	if err := setUp("lo"); err != nil {
+		return fmt.Errorf("set up lo: %w", err)
+	}
+	fd, err := openTun(tunName)
+	if err != nil {
+		return fmt.Errorf("open tun: %w", err)
+	}
+	if err = setUp(tunName); err != nil {
+		return fmt.Errorf("set up %v: %w", tunName, err)
+	}
+	ifi, err := net.InterfaceByName(tunName)
+	if err != nil {
+		return err
+	}
+	if err = addAddr(ifi.Index, tunAddr4); err != nil {
+		return fmt.Errorf("add address: %w", err)
+	}
+	if err = addDefaultRoute(ifi.Index, unix.AF_INET); err != nil {
+		return fmt.Errorf("add route: %w", err)
+	}
+	// IPv6 may be disabled
+	if addAddr(ifi.Index, tunAddr6) == nil {
+		_ = addDefaultRoute(ifi.Index, unix.AF_INET6)
+	}
+	if err = replaceLoopbackNameservers(); err != nil {
+		return fmt.Errorf("resolv.conf: %w", err)
+	}
+	if err = unix.Sendmsg(int(ctrl.Fd()), []byte{0}, unix.UnixRights(fd), nil, 0); err != nil {
+		return fmt.Errorf("send tun: %w", err)
+	}
+	_ = unix.Close(fd)
+	// wait for the parent to serve the tun device
+	var b [1]byte
+	if _, err = ctrl.Read(b[:]); err != nil {
+		return fmt.Errorf("wait for the parent: %w", err)
+	}
+	ctrl.Close()
+	if err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envChild+"=") {
+			env = append(env, kv)
+		}
+	}
+	return syscall.Exec(os.Args[1], os.Args[2:], env)
+}
+
+func openTun(name string) (fd int, err error) {
+	if fd, err = unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0); err != nil {
+		return -1, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func setUp(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+func family(ip netip.Addr) uint8 {
+	if ip.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func addAddr(index int, prefix netip.Prefix) error {
+	ip := prefix.Addr()
+	// struct ifaddrmsg
+	msg := []byte{family(ip), uint8(prefix.Bits()), unix.IFA_F_NODAD, unix.RT_SCOPE_UNIVERSE, 0, 0, 0, 0}
+	binary.NativeEndian.PutUint32(msg[4:], uint32(index))
+	return netlink(unix.RTM_NEWADDR, msg, rtAttr(unix.IFA_LOCAL, ip.AsSlice()), rtAttr(unix.IFA_ADDRESS, ip.AsSlice()))
+}
+
+func addDefaultRoute(index int, family uint8) error {
+	// struct rtmsg
+	msg := []byte{family, 0, 0, 0, unix.RT_TABLE_MAIN, unix.RTPROT_BOOT, unix.RT_SCOPE_LINK, unix.RTN_UNICAST, 0, 0, 0, 0}
+	oif := binary.NativeEndian.AppendUint32(nil, uint32(index))
+	return netlink(unix.RTM_NEWROUTE, msg, rtAttr(unix.RTA_OIF, oif))
+}
+
+func rtAttr(typ uint16, value []byte) []byte {
+	length := unix.SizeofRtAttr + len(value)
+	b := make([]byte, (length+unix.NLMSG_ALIGNTO-1)&^(unix.NLMSG_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(b, uint16(length))
+	binary.NativeEndian.PutUint16(b[2:], typ)
+	copy(b[unix.SizeofRtAttr:], value)
+	return b
+}
+
+// netlink sends the rtnetlink request and waits for the acknowledgement.
+func netlink(typ uint16, msg []byte, attrs ...[]byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	b := make([]byte, unix.SizeofNlMsghdr, 64)
+	b = append(b, msg...)
+	for _, attr := range attrs {
+		b = append(b, attr...)
+	}
+	binary.NativeEndian.PutUint32(b, uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:], typ)
+	binary.NativeEndian.PutUint16(b[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK|unix.NLM_F_CREATE|unix.NLM_F_EXCL)
+	binary.NativeEndian.PutUint32(b[8:], 1) // sequence
+	if err = unix.Sendto(fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	resp := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(fd, resp, 0)
+	if err != nil {
+		return err
+	}
+	if n < unix.SizeofNlMsghdr+4 || binary.NativeEndian.Uint16(resp[4:]) != unix.NLMSG_ERROR {
+		return fmt.Errorf("unexpected netlink response")
+	}
+	if errno := -int32(binary.NativeEndian.Uint32(resp[unix.SizeofNlMsghdr:])); errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
+
+// replaceLoopbackNameservers replaces the loopback nameservers, which are unreachable in the namespace, by
+// dnsAddr. The parent sends the queries to dnsAddr to the nameserver of the host.
+func replaceLoopbackNameservers() error {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	replaced := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip, err := netip.ParseAddr(fields[1]); err == nil && ip.IsLoopback() {
+				line = "nameserver " + dnsAddr.String()
+				replaced = true
+			}
+		}
+		lines = append(lines, line)
+	}
+	if !replaced {
+		return nil
+	}
+	tmp, err := os.CreateTemp("", "gg-resolv-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0644); err == nil {
+		_, err = tmp.WriteString(strings.Join(lines, "\n") + "\n")
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	// do not propagate the mount to the host
+	if err = unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	return unix.Mount(tmp.Name(), resolvConf, "", unix.MS_BIND, "")
+}
@@ -0,0 +1,215 @@
+// Package netns runs a program in new user, network and mount namespaces, where the only route is a tun device
+// served by a userspace TCP/IP stack in gg. The flows are relayed by the proxy, so the traffic of any program,
+// including statically linked ones, is captured without stopping at its syscalls.
+package netns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mzz2017/gg/backend"
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	envChild   = "GG_NETNS_CHILD"
+	tunName    = "tun0"
+	tunMTU     = 1500
+	resolvConf = "/etc/resolv.conf"
+)
+
+var (
+	// The addresses of the tun device are in the documentation ranges, which are never real destinations.
+	tunAddr4 = netip.MustParsePrefix("198.51.100.1/32")
+	tunAddr6 = netip.MustParsePrefix("2001:db8::1/128")
+	// dnsAddr replaces the loopback nameservers in the namespace.
+	dnsAddr = netip.MustParseAddr("198.51.100.53")
+)
+
+type Netns struct {
+	ignoreUDP         atomic.Bool
+	ignorePrivateAddr bool
+	log               *logrus.Logger
+	proxy             *proxy.Proxy
+	allowlist         sandbox.Allowlist
+	policy            policy.Policy
+	stack             *stack.Stack
+	pid               int
+	proc              *os.Process
+	nameserver        string // the nameserver of the host, to which the queries to dnsAddr are sent
+	closed            chan struct{}
+	status            syscall.WaitStatus
+	exitErr           error
+}
+
+// New starts the program in the namespaces.
+func New(ctx context.Context, name string, argv []string, attr *os.ProcAttr, opt backend.Options) (*Netns, error) {
+	n := &Netns{
+		ignorePrivateAddr: opt.IgnorePrivateAddr,
+		log:               opt.Logger,
+		proxy:             proxy.New(opt.Logger, opt.Dialer),
+		allowlist:         opt.Allowlist,
+		policy:            opt.Policy,
+		nameserver:        hostNameserver(),
+		closed:            make(chan struct{}),
+	}
+	n.ignoreUDP.Store(opt.IgnoreUDP)
+	n.proxy.SetStats(opt.Stats)
+	n.proxy.SetConnLog(opt.ConnLog)
+	n.proxy.SetCapture(opt.Capture)
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ctrl := os.NewFile(uintptr(fds[0]), "netns")
+	defer ctrl.Close()
+	childCtrl := os.NewFile(uintptr(fds[1]), "netns")
+
+	if attr == nil {
+		attr = &os.ProcAttr{}
+	}
+	files := make([]*os.File, 3, 4)
+	copy(files, attr.Files)
+	env := attr.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	proc, err := os.StartProcess(self, append([]string{self, name}, argv...), &os.ProcAttr{
+		Dir:   attr.Dir,
+		Env:   append(env[:len(env):len(env)], envChild+"=1"),
+		Files: append(files, childCtrl),
+		Sys: &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}},
+			AmbientCaps: []uintptr{unix.CAP_NET_ADMIN, unix.CAP_SYS_ADMIN},
+		},
+	})
+	childCtrl.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w (are unprivileged user namespaces allowed?)", err)
+	}
+	n.pid = proc.Pid
+	n.proc = proc
+
+	// receive the tun device
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := unix.Recvmsg(fds[0], make([]byte, 1), oob, 0)
+	if err == nil && oobn == 0 {
+		err = fmt.Errorf("failed to set up the network in the namespaces")
+	}
+	var tunFd int
+	if err == nil {
+		tunFd, err = parseRights(oob[:oobn])
+	}
+	if err == nil {
+		n.stack, err = n.newStack(tunFd)
+	}
+	if err == nil {
+		_, err = ctrl.Write([]byte{0})
+	}
+	if err != nil {
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+		return nil, err
+	}
+	go func() {
+		n.status, n.exitErr = backend.WaitProgram(proc.Pid)
+		n.stack.Close()
+		close(n.closed)
+	}()
+	return n, nil
+}
+
+func parseRights(oob []byte) (fd int, err error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1, err
+	}
+	if len(msgs) == 0 {
+		return -1, fmt.Errorf("no tun device is received")
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return -1, err
+	}
+	if len(fds) == 0 {
+		return -1, fmt.Errorf("no tun device is received")
+	}
+	return fds[0], nil
+}
+
+// hostNameserver returns the first nameserver of the host.
+func hostNameserver() string {
+	if f, err := os.Open(resolvConf); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+				if ip, err := netip.ParseAddr(fields[1]); err == nil {
+					return net.JoinHostPort(ip.String(), "53")
+				}
+			}
+		}
+	}
+	return "1.1.1.1:53"
+}
+
+// Proxy returns the proxy that the traffic is redirected to.
+func (n *Netns) Proxy() *proxy.Proxy {
+	return n.proxy
+}
+
+// Dialer returns the dialer to the current node.
+func (n *Netns) Dialer() *dialer.Dialer {
+	return n.proxy.Dialer().(*dialer.Dialer)
+}
+
+// SetDialer switches the node for new connections.
+func (n *Netns) SetDialer(d *dialer.Dialer) {
+	n.proxy.SetDialer(d)
+}
+
+// UDPEnabled reports whether UDP traffic is redirected.
+func (n *Netns) UDPEnabled() bool {
+	return !n.ignoreUDP.Load()
+}
+
+// SetUDPEnabled sets whether new UDP traffic is redirected.
+func (n *Netns) SetUDPEnabled(enabled bool) {
+	n.ignoreUDP.Store(!enabled)
+}
+
+// Signal forwards sig to the program.
+func (n *Netns) Signal(sig os.Signal) error {
+	if err := n.proc.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+// Wait waits for the program to exit.
+func (n *Netns) Wait() (status syscall.WaitStatus, err error) {
+	<-n.closed
+	return n.status, n.exitErr
+}
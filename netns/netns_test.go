@@ -0,0 +1,159 @@
+package netns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/gg/backend"
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// envTestClient makes the test binary run testClient, as the program in the namespaces.
+const envTestClient = "GG_NETNS_TEST_CLIENT"
+
+func TestMain(m *testing.M) {
+	switch {
+	case IsChild():
+		RunChild()
+	case os.Getenv(envTestClient) != "":
+		if err := testClient(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testClient resolves gg.test by the nameserver on the tun device, and checks that the data to the resolved IP is
+// echoed.
+func testClient() error {
+	name := dnsmessage.MustNewName("gg.test.")
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return err
+	}
+	dns, err := net.Dial("udp", net.JoinHostPort(dnsAddr.String(), "53"))
+	if err != nil {
+		return err
+	}
+	defer dns.Close()
+	dns.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = dns.Write(query); err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	n, err := dns.Read(buf)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	var resp dnsmessage.Message
+	if err = resp.Unpack(buf[:n]); err != nil {
+		return err
+	}
+	if len(resp.Answers) == 0 {
+		return fmt.Errorf("dns: no answer")
+	}
+	aaaa, ok := resp.Answers[0].Body.(*dnsmessage.AAAAResource)
+	if !ok {
+		return fmt.Errorf("dns: unexpected answer: %v", resp.Answers[0].Body)
+	}
+	ip := netip.AddrFrom16(aaaa.AAAA).Unmap()
+	if !proxy.ReservedPrefix.Contains(ip) {
+		return fmt.Errorf("dns: %v is not a fake IP", ip)
+	}
+
+	c, err := net.Dial("tcp", netip.AddrPortFrom(ip, 80).String())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write([]byte("hello")); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(c, buf[:5]); err != nil || string(buf[:5]) != "hello" {
+		return fmt.Errorf("tcp: unexpected echo: %q %v", buf[:5], err)
+	}
+	return nil
+}
+
+// echoDialer connects to the echo server whatever the target is, and records the targets.
+type echoDialer struct {
+	addr    string
+	targets chan string
+}
+
+func (d *echoDialer) Dial(network, addr string) (net.Conn, error) {
+	d.targets <- addr
+	return net.Dial("tcp", d.addr)
+}
+
+func TestNetns(t *testing.T) {
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	d := &echoDialer{addr: ln.Addr().String(), targets: make(chan string, 8)}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := New(context.Background(), self, []string{self}, &os.ProcAttr{
+		Env:   append(os.Environ(), envTestClient+"=1"),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	}, backend.Options{
+		Dialer: dialer.NewDialer(d, false, "echo", "echo", ""),
+		Logger: log,
+	})
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		t.Skipf("no user namespaces: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Proxy().Close()
+	status, err := n.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ExitStatus() != 0 {
+		t.Fatalf("the client exits with %v", status.ExitStatus())
+	}
+	// the connection to the fake IP goes to the node with the domain
+	if target := <-d.targets; target != "gg.test:80" {
+		t.Errorf("dialed %v, want gg.test:80", target)
+	}
+}
@@ -0,0 +1,211 @@
+package netns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/softwind/pool"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	nicID = 1
+	// maxInFlight is the maximum number of TCP connections being established.
+	maxInFlight = 1024
+)
+
+// newStack serves the tun device fd by a userspace TCP/IP stack accepting all flows.
+func (n *Netns) newStack(fd int) (*stack.Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	// the handlers are installed before the NIC starts to dispatch the packets
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, maxInFlight, n.handleTCP).HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udp.NewForwarder(s, n.handleUDP).HandlePacket)
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: tunMTU})
+	if err != nil {
+		return nil, err
+	}
+	if e := s.CreateNIC(nicID, ep); e != nil {
+		return nil, fmt.Errorf("CreateNIC: %v", e)
+	}
+	// accept the packets to any address, and reply from it
+	if e := s.SetPromiscuousMode(nicID, true); e != nil {
+		return nil, fmt.Errorf("SetPromiscuousMode: %v", e)
+	}
+	if e := s.SetSpoofing(nicID, true); e != nil {
+		return nil, fmt.Errorf("SetSpoofing: %v", e)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+	return s, nil
+}
+
+func addrPort(addr tcpip.Address, port uint16) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return netip.AddrPortFrom(ip.Unmap(), port)
+}
+
+// route decides where the flow from process to dst should go, in the same way as the tracer. target is the
+// address to dial, which is the domain instead of its fake IP.
+func (n *Netns) route(network string, dst netip.AddrPort, process *proxy.Process) (target string, direct bool, refused bool) {
+	ip, port := dst.Addr(), dst.Port()
+	isDNS := network == "udp" && port == 53
+	target = dst.String()
+	host := ip.String()
+	switch {
+	case ip == dnsAddr && port == 53:
+		target = n.nameserver
+		host, _, _ = net.SplitHostPort(target)
+	case proxy.ReservedPrefix.Contains(ip):
+		if domain := n.proxy.GetProjection(ip); domain != "" {
+			host = domain
+			target = net.JoinHostPort(domain, strconv.Itoa(int(port)))
+		}
+	}
+	var exe string
+	var argv []string
+	pid := 0
+	if process != nil {
+		exe, argv, pid = process.Exe, process.Cmdline, process.Pid
+	}
+	action := n.policy.Action(exe, argv)
+	direct = action == policy.ActionBypass ||
+		(network == "udp" && (n.ignoreUDP.Load() || (!n.Dialer().SupportUDP() && !isDNS))) ||
+		(n.ignorePrivateAddr && ip.IsPrivate() && !isDNS)
+	// DNS queries are exempt from the sandbox only if the proxy answers them.
+	if n.allowlist != nil && !(isDNS && !direct) && port != 0 {
+		if !n.allowlist.Allow(host, port) {
+			n.log.Warnf("sandbox: refuse %v %v from %v (%v)", network, target, pid, exe)
+			return target, false, true
+		}
+		n.log.Infof("sandbox: allow %v %v from %v (%v)", network, target, pid, exe)
+	}
+	if action == policy.ActionBlock {
+		n.log.Infof("policy: block %v %v from %v (%v)", network, target, pid, exe)
+		return target, false, true
+	}
+	return target, direct, false
+}
+
+func (n *Netns) handleTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	dst := addrPort(id.LocalAddress, id.LocalPort)
+	process := proxy.SocketOwner(n.pid, "tcp", addrPort(id.RemoteAddress, id.RemotePort))
+	target, direct, refused := n.route("tcp", dst, process)
+	if refused {
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, e := r.CreateEndpoint(&wq)
+	if e != nil {
+		r.Complete(true)
+		n.log.Infof("netns: CreateEndpoint: %v", e)
+		return
+	}
+	r.Complete(false)
+	conn := gonet.NewTCPConn(&wq, ep)
+	var err error
+	if direct {
+		err = relayDirectTCP(conn, target)
+	} else {
+		err = n.proxy.HandleTCP(conn, target, process)
+	}
+	if err != nil {
+		n.log.Warnf("netns: tcp %v: %v", target, err)
+	}
+}
+
+func relayDirectTCP(conn net.Conn, target string) error {
+	defer conn.Close()
+	c, err := net.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return proxy.RelayTCP(conn, c)
+}
+
+func (n *Netns) handleUDP(r *udp.ForwarderRequest) {
+	var wq waiter.Queue
+	ep, e := r.CreateEndpoint(&wq)
+	if e != nil {
+		n.log.Infof("netns: CreateEndpoint: %v", e)
+		return
+	}
+	id := r.ID()
+	go n.relayUDP(gonet.NewUDPConn(&wq, ep), addrPort(id.RemoteAddress, id.RemotePort), addrPort(id.LocalAddress, id.LocalPort))
+}
+
+// relayUDP relays the datagrams from client to dst received by conn until it is idle for the NAT timeout.
+func (n *Netns) relayUDP(conn *gonet.UDPConn, client netip.AddrPort, dst netip.AddrPort) {
+	defer conn.Close()
+	process := proxy.SocketOwner(n.pid, "udp", client)
+	target, direct, refused := n.route("udp", dst, process)
+	if refused {
+		return
+	}
+	lAddr := net.UDPAddrFromAddrPort(client)
+	var directConn net.Conn
+	buf := pool.Get(tunMTU)
+	defer pool.Put(buf)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(proxy.DefaultNatTimeout))
+		length, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if direct {
+			if directConn == nil {
+				if directConn, err = net.Dial("udp", target); err != nil {
+					n.log.Infof("netns: udp %v: %v", target, err)
+					return
+				}
+				defer directConn.Close()
+				go relayDirectUDP(conn, directConn)
+			}
+			_, _ = directConn.Write(buf[:length])
+			continue
+		}
+		data := pool.Get(length)
+		copy(data, buf[:length])
+		if err = n.proxy.HandleUDP(conn, lAddr, target, data, process); err != nil {
+			n.log.Infof("netns: udp %v: %v", target, err)
+		}
+		pool.Put(data)
+	}
+}
+
+// relayDirectUDP relays the responses from directConn back to conn.
+func relayDirectUDP(conn *gonet.UDPConn, directConn net.Conn) {
+	buf := pool.Get(tunMTU)
+	defer pool.Put(buf)
+	for {
+		_ = directConn.SetReadDeadline(time.Now().Add(proxy.DefaultNatTimeout))
+		n, err := directConn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
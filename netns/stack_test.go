@@ -0,0 +1,60 @@
+package netns
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRoute(t *testing.T) {
+	allowlist, err := sandbox.Parse([]string{":443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bypass, err := policy.Parse([]string{"bypass:curl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	curl := &proxy.Process{Pid: 42, Exe: "/usr/bin/curl"}
+	for _, c := range []struct {
+		name       string
+		network    string
+		dst        string
+		process    *proxy.Process
+		ignoreUDP  bool
+		supportUDP bool
+		direct     bool
+		refused    bool
+	}{
+		{"allowed", "tcp", "8.8.8.8:443", nil, false, true, false, false},
+		{"not allowed", "tcp", "8.8.8.8:80", nil, false, true, false, true},
+		{"udp not allowed", "udp", "8.8.8.8:123", nil, false, true, false, true},
+		{"bypassing", "tcp", "8.8.8.8:443", curl, false, true, true, false},
+		// DNS queries are allowed only if they are answered by the proxy
+		{"dns", "udp", "8.8.8.8:53", nil, false, true, false, false},
+		{"dns without udp support", "udp", "8.8.8.8:53", nil, false, false, false, false},
+		{"dns with udp ignored", "udp", "8.8.8.8:53", nil, true, true, false, true},
+		{"dns bypassing", "udp", "8.8.8.8:53", curl, false, true, false, true},
+		{"tcp dns", "tcp", "8.8.8.8:53", nil, false, true, false, true},
+	} {
+		n := &Netns{
+			log:       log,
+			proxy:     proxy.New(log, dialer.NewDialer(dialer.SymmetricDirect, c.supportUDP, "", "", "")),
+			allowlist: allowlist,
+			policy:    bypass,
+		}
+		n.ignoreUDP.Store(c.ignoreUDP)
+		_, direct, refused := n.route(c.network, netip.MustParseAddrPort(c.dst), c.process)
+		if direct != c.direct || refused != c.refused {
+			t.Errorf("%v: direct %v refused %v, want %v %v", c.name, direct, refused, c.direct, c.refused)
+		}
+	}
+}
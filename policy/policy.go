@@ -0,0 +1,107 @@
+// Package policy decides how to handle the traffic of a process by its executable or arguments.
+package policy
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type Action string
+
+const (
+	ActionProxy  Action = "proxy"  // redirect to the proxy
+	ActionBypass Action = "bypass" // connect directly
+	ActionBlock  Action = "block"  // refuse the connection
+)
+
+// Rule is a pattern of processes and the action to take.
+//
+//	proxy:git              the name of the executable
+//	bypass:/usr/bin/ssh    the path of the executable, if the pattern contains a slash
+//	block:argv=*telemetry* the arguments joined by spaces
+//
+// Patterns are globs, where * and ? match any characters, including slashes.
+type Rule struct {
+	Action  Action
+	Argv    bool
+	Pattern string
+	re      *regexp.Regexp
+}
+
+func ParseRule(s string) (r Rule, err error) {
+	action, pattern, ok := strings.Cut(s, ":")
+	if !ok || pattern == "" {
+		return Rule{}, fmt.Errorf("expected action:pattern")
+	}
+	r.Action = Action(action)
+	switch r.Action {
+	case ActionProxy, ActionBypass, ActionBlock:
+	default:
+		return Rule{}, fmt.Errorf("unexpected action: %v", action)
+	}
+	if argv, ok := strings.CutPrefix(pattern, "argv="); ok {
+		r.Argv = true
+		pattern = argv
+	}
+	r.Pattern = pattern
+	if r.re, err = compileGlob(pattern); err != nil {
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// Match reports whether the rule matches the process.
+func (r Rule) Match(exe string, argv []string) bool {
+	switch {
+	case r.Argv:
+		return r.re.MatchString(strings.Join(argv, " "))
+	case strings.Contains(r.Pattern, "/"):
+		return r.re.MatchString(exe)
+	default:
+		return r.re.MatchString(filepath.Base(exe))
+	}
+}
+
+// Policy is the ordered rules, and the first matched one wins.
+type Policy []Rule
+
+func Parse(rules []string) (Policy, error) {
+	var p Policy
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad policy %q: %w", s, err)
+		}
+		p = append(p, r)
+	}
+	return p, nil
+}
+
+// Action returns the action of the first rule matching the process, or ActionProxy if none matches.
+func (p Policy) Action(exe string, argv []string) Action {
+	for _, r := range p {
+		if r.Match(exe, argv) {
+			return r.Action
+		}
+	}
+	return ActionProxy
+}
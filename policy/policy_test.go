@@ -0,0 +1,36 @@
+package policy
+
+import "testing"
+
+func TestPolicy(t *testing.T) {
+	p, err := Parse([]string{"block:argv=*--telemetry*", "bypass:ssh", "bypass:/opt/*", "proxy:python3*", "block:telemetry-agent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		exe    string
+		argv   []string
+		action Action
+	}{
+		{"/usr/bin/ssh", []string{"ssh", "host"}, ActionBypass},
+		{"/usr/bin/ssh", []string{"ssh", "--telemetry=on"}, ActionBlock},
+		{"/opt/tools/bin/agent", nil, ActionBypass},
+		{"/usr/bin/python3.11", []string{"python3", "x.py"}, ActionProxy},
+		{"/usr/local/bin/telemetry-agent", nil, ActionBlock},
+		{"/usr/bin/curl", []string{"curl", "example.com"}, ActionProxy},
+		{"/usr/bin/sshd", nil, ActionProxy},
+	}
+	for _, c := range cases {
+		if action := p.Action(c.exe, c.argv); action != c.action {
+			t.Errorf("Action(%v, %v) = %v, expected %v", c.exe, c.argv, action, c.action)
+		}
+	}
+}
+
+func TestParseRuleError(t *testing.T) {
+	for _, s := range []string{"ssh", "allow:ssh", "bypass:"} {
+		if _, err := ParseRule(s); err == nil {
+			t.Errorf("ParseRule(%q) should fail", s)
+		}
+	}
+}
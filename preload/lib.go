@@ -0,0 +1,68 @@
+package preload
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+//go:embed shim/gg_preload.c
+var shimSource []byte
+
+var NoCompilerErr = fmt.Errorf("no C compiler to build the preload shim")
+
+// Library returns the path of the shim library. If path is empty, the shim is compiled with $CC or cc once and cached
+// in the user cache directory.
+func Library(path string) (string, error) {
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return filepath.Abs(path)
+	}
+	sum := sha256.Sum256(shimSource)
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "gg")
+	lib := filepath.Join(dir, fmt.Sprintf("libgg_preload-%v-%v.so", runtime.GOARCH, hex.EncodeToString(sum[:6])))
+	if _, err := os.Stat(lib); err == nil {
+		return lib, nil
+	}
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	if cc, err = exec.LookPath(cc); err != nil {
+		return "", fmt.Errorf("%w: %v; please build %v and give its path by --preload-lib", NoCompilerErr, err, "preload/shim/gg_preload.c")
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	src, err := os.CreateTemp(dir, "gg_preload-*.c")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(src.Name())
+	_, err = src.Write(shimSource)
+	src.Close()
+	if err != nil {
+		return "", err
+	}
+	// build to a temporary file and rename it, so that concurrent builds do not see a partial library
+	tmp := src.Name() + ".so"
+	defer os.Remove(tmp)
+	if out, err := exec.Command(cc, "-shared", "-fPIC", "-O2", "-o", tmp, src.Name(), "-ldl").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("build the preload shim: %v: %s", err, out)
+	}
+	if err = os.Rename(tmp, lib); err != nil {
+		return "", err
+	}
+	return lib, nil
+}
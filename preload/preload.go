@@ -0,0 +1,168 @@
+// Package preload intercepts the traffic of a program by a shim injected with LD_PRELOAD, for the programs that cannot
+// be traced. The shim asks the backend where to connect over a unix socket, so the decisions are the same as the
+// tracer's. It does not work for statically linked programs, or setuid programs for which LD_PRELOAD is ignored.
+package preload
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mzz2017/gg/backend"
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envPreload = "LD_PRELOAD"
+	envSocket  = "GG_PRELOAD_SOCK"
+)
+
+type Preload struct {
+	ignoreUDP         atomic.Bool
+	ignorePrivateAddr bool
+	log               *logrus.Logger
+	proxy             *proxy.Proxy
+	allowlist         sandbox.Allowlist
+	policy            policy.Policy
+	dir               string
+	proc              *os.Process
+	listener          *net.UnixListener
+	clientsMu         sync.Mutex
+	clients           map[int]struct{} // the processes that have asked the control socket
+	closed            chan struct{}
+	status            syscall.WaitStatus
+	exitErr           error
+}
+
+// New starts the program with the shim library lib preloaded.
+func New(ctx context.Context, name string, argv []string, attr *os.ProcAttr, lib string, opt backend.Options) (*Preload, error) {
+	p := &Preload{
+		ignorePrivateAddr: opt.IgnorePrivateAddr,
+		log:               opt.Logger,
+		proxy:             proxy.New(opt.Logger, opt.Dialer),
+		allowlist:         opt.Allowlist,
+		policy:            opt.Policy,
+		clients:           make(map[int]struct{}),
+		closed:            make(chan struct{}),
+	}
+	p.ignoreUDP.Store(opt.IgnoreUDP)
+	p.proxy.SetStats(opt.Stats)
+	p.proxy.SetConnLog(opt.ConnLog)
+	p.proxy.SetCapture(opt.Capture)
+	p.proxy.SetAuthenticator(p.clientPids)
+	listenErr := make(chan error, 1)
+	go func() {
+		if err := p.proxy.ListenAndServe(0); err != nil {
+			listenErr <- err
+		}
+	}()
+	select {
+	case <-p.proxy.Listened():
+	case err := <-listenErr:
+		return nil, err
+	}
+
+	var err error
+	if p.dir, err = os.MkdirTemp("", "gg-preload-"); err != nil {
+		return nil, err
+	}
+	sock := filepath.Join(p.dir, "control.sock")
+	if p.listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"}); err != nil {
+		os.RemoveAll(p.dir)
+		return nil, err
+	}
+	go p.serve()
+
+	if attr == nil {
+		attr = &os.ProcAttr{}
+	}
+	env := attr.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	attr.Env = withPreload(env, lib, sock)
+	proc, err := os.StartProcess(name, argv, attr)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	p.proc = proc
+	go func() {
+		p.status, p.exitErr = backend.WaitProgram(proc.Pid)
+		p.close()
+		close(p.closed)
+	}()
+	return p, nil
+}
+
+// withPreload returns env with lib prepended to LD_PRELOAD and the path of the control socket.
+func withPreload(env []string, lib string, sock string) []string {
+	preload := lib
+	var result []string
+	for _, kv := range env {
+		switch {
+		case strings.HasPrefix(kv, envPreload+"="):
+			if v := strings.TrimPrefix(kv, envPreload+"="); v != "" {
+				preload += ":" + v
+			}
+		case strings.HasPrefix(kv, envSocket+"="):
+		default:
+			result = append(result, kv)
+		}
+	}
+	return append(result, envPreload+"="+preload, envSocket+"="+sock)
+}
+
+func (p *Preload) close() {
+	_ = p.listener.Close()
+	_ = os.RemoveAll(p.dir)
+}
+
+// Proxy returns the proxy that the traffic is redirected to.
+func (p *Preload) Proxy() *proxy.Proxy {
+	return p.proxy
+}
+
+// Dialer returns the dialer to the current node.
+func (p *Preload) Dialer() *dialer.Dialer {
+	return p.proxy.Dialer().(*dialer.Dialer)
+}
+
+// SetDialer switches the node for new connections.
+func (p *Preload) SetDialer(d *dialer.Dialer) {
+	p.proxy.SetDialer(d)
+}
+
+// UDPEnabled reports whether UDP traffic is redirected.
+func (p *Preload) UDPEnabled() bool {
+	return !p.ignoreUDP.Load()
+}
+
+// SetUDPEnabled sets whether new UDP traffic is redirected.
+func (p *Preload) SetUDPEnabled(enabled bool) {
+	p.ignoreUDP.Store(!enabled)
+}
+
+// Signal forwards sig to the program.
+func (p *Preload) Signal(sig os.Signal) error {
+	if err := p.proc.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+// Wait waits for the program to exit.
+func (p *Preload) Wait() (status syscall.WaitStatus, err error) {
+	<-p.closed
+	return p.status, p.exitErr
+}
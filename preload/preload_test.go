@@ -0,0 +1,132 @@
+package preload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mzz2017/gg/backend"
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// client resolves the host, connects to it, and prints the resolved IP if the data is echoed.
+const client = `#include <netdb.h>
+#include <stdio.h>
+#include <string.h>
+#include <unistd.h>
+#include <arpa/inet.h>
+
+int main(int argc, char **argv) {
+	struct addrinfo hints = {0}, *res;
+	hints.ai_family = AF_INET;
+	hints.ai_socktype = SOCK_STREAM;
+	if (getaddrinfo(argv[1], argv[2], &hints, &res) != 0)
+		return 2;
+	int fd = socket(res->ai_family, res->ai_socktype, 0);
+	if (fd < 0 || connect(fd, res->ai_addr, res->ai_addrlen) != 0)
+		return 3;
+	char buf[8] = {0};
+	if (write(fd, "hello", 5) != 5 || read(fd, buf, sizeof(buf) - 1) != 5 || strcmp(buf, "hello") != 0)
+		return 4;
+	char ip[INET_ADDRSTRLEN];
+	inet_ntop(AF_INET, &((struct sockaddr_in *)res->ai_addr)->sin_addr, ip, sizeof(ip));
+	printf("%s\n", ip);
+	return 0;
+}
+`
+
+// echoDialer connects to the echo server whatever the target is, and records the targets.
+type echoDialer struct {
+	addr    string
+	targets chan string
+}
+
+func (d *echoDialer) Dial(network, addr string) (net.Conn, error) {
+	d.targets <- addr
+	return net.Dial("tcp", d.addr)
+}
+
+func TestPreload(t *testing.T) {
+	// build the shim afresh instead of using the cached one
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	lib, err := Library("")
+	if errors.Is(err, NoCompilerErr) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	src, prog := filepath.Join(dir, "client.c"), filepath.Join(dir, "client")
+	if err = os.WriteFile(src, []byte(client), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("cc", "-o", prog, src).CombinedOutput(); err != nil {
+		t.Fatalf("build the client: %v: %s", err, out)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	d := &echoDialer{addr: ln.Addr().String(), targets: make(chan string, 8)}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	p, err := New(context.Background(), prog, []string{prog, "gg.test", "80"}, &os.ProcAttr{
+		Files: []*os.File{os.Stdin, w, os.Stderr},
+	}, lib, backend.Options{
+		Dialer: dialer.NewDialer(d, false, "echo", "echo", ""),
+		Logger: log,
+	})
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Proxy().Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := p.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ExitStatus() != 0 {
+		t.Fatalf("the client exits with %v", status.ExitStatus())
+	}
+	// the domain is resolved to a fake IP, and the connection to it goes to the node with the domain
+	ip, err := netip.ParseAddr(strings.TrimSpace(string(out)))
+	if err != nil || !proxy.ReservedPrefix.Contains(ip) {
+		t.Errorf("resolved to %q, want a fake IP", out)
+	}
+	if target := <-d.targets; target != "gg.test:80" {
+		t.Errorf("dialed %v, want gg.test:80", target)
+	}
+}
@@ -0,0 +1,197 @@
+package preload
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	replyPass   = "PASS"
+	replyAddr   = "ADDR"
+	replyRefuse = "REFUSE"
+)
+
+func (p *Preload) serve() {
+	for {
+		conn, err := p.listener.AcceptUnix()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.log.Warnf("preload: accept: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := p.handle(conn); err != nil {
+				p.log.Infof("preload: %v", err)
+			}
+		}()
+	}
+}
+
+func (p *Preload) handle(conn *net.UnixConn) error {
+	pid, err := peerPid(conn)
+	if err != nil {
+		return err
+	}
+	p.clientsMu.Lock()
+	p.clients[pid] = struct{}{}
+	p.clientsMu.Unlock()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var reply string
+	switch fields := strings.Fields(line); {
+	case len(fields) == 3 && fields[0] == "CONNECT":
+		reply = p.connect(pid, fields[1], fields[2])
+	case len(fields) == 2 && fields[0] == "RESOLVE":
+		reply = p.resolve(pid, fields[1])
+	default:
+		reply = replyPass
+		p.log.Infof("preload: unexpected request from %v: %q", pid, line)
+	}
+	_, err = conn.Write([]byte(reply + "\n"))
+	return err
+}
+
+// clientPids returns the processes that have asked the control socket, which authenticates the connections to the
+// proxy. The shim asks before each connection.
+func (p *Preload) clientPids() []int {
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	pids := make([]int, 0, len(p.clients))
+	for pid := range p.clients {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// peerPid returns the pid of the process on the other side of the unix socket.
+func peerPid(conn *net.UnixConn) (pid int, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *unix.Ucred
+	if e := rawConn.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); e != nil {
+		return 0, e
+	}
+	if err != nil {
+		return 0, fmt.Errorf("SO_PEERCRED: %w", err)
+	}
+	return int(cred.Pid), nil
+}
+
+func refuse(network string) string {
+	errno := syscall.ECONNREFUSED
+	if network == "udp" {
+		errno = syscall.EPERM
+	}
+	return fmt.Sprintf("%v %d", replyRefuse, errno)
+}
+
+// connect decides where the connection or datagram to addr should go, in the same way as the tracer.
+func (p *Preload) connect(pid int, network string, addr string) string {
+	if network != "tcp" && network != "udp" {
+		return replyPass
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return replyPass
+	}
+	ip, port := ap.Addr().Unmap(), ap.Port()
+	isDNS := network == "udp" && port == 53
+	if ip.IsLoopback() && !isDNS {
+		return replyPass
+	}
+	host := ip.String()
+	if proxy.ReservedPrefix.Contains(ip) {
+		if domain := p.proxy.GetProjection(ip); domain != "" {
+			host = domain
+		}
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	process := proxy.ReadProcess(pid)
+	action := p.policy.Action(process.Exe, process.Cmdline)
+	// DNS queries are exempt from the sandbox only if the proxy answers them.
+	hijacksDNS := isDNS && !p.ignoreUDP.Load() && action != policy.ActionBypass
+	if p.allowlist != nil && !ip.IsLoopback() && !hijacksDNS && port != 0 {
+		if !p.allowlist.Allow(host, port) {
+			p.log.Warnf("sandbox: refuse %v %v from %v (%v)", network, target, process.Pid, process.Exe)
+			return refuse(network)
+		}
+		p.log.Infof("sandbox: allow %v %v from %v (%v)", network, target, process.Pid, process.Exe)
+	}
+	switch action {
+	case policy.ActionBlock:
+		if ip.IsLoopback() {
+			return replyPass
+		}
+		p.log.Infof("policy: block %v %v from %v (%v)", network, target, process.Pid, process.Exe)
+		return refuse(network)
+	case policy.ActionBypass:
+		return p.bypass(ip, port)
+	}
+	if network == "udp" && (p.ignoreUDP.Load() || port == 0 || (!p.Dialer().SupportUDP() && !isDNS)) {
+		return replyPass
+	}
+	if p.ignorePrivateAddr && ip.IsPrivate() && !isDNS {
+		return replyPass
+	}
+	loopback, err := p.proxy.AllocProjection(target)
+	if err != nil {
+		// not to bypass the proxy
+		p.log.Warnf("preload: refuse %v %v from %v (%v): %v", network, target, process.Pid, process.Exe, err)
+		return fmt.Sprintf("%v %d", replyRefuse, syscall.EADDRNOTAVAIL)
+	}
+	p.proxy.SetProjectionOwner(loopback, process)
+	proxyPort := p.proxy.TCPPort()
+	if network == "udp" {
+		proxyPort = p.proxy.UDPPort()
+	}
+	p.log.Tracef("preload: %v %v -> %v:%v from %v", network, target, loopback, proxyPort, process.Pid)
+	return fmt.Sprintf("%v %v %v", replyAddr, loopback, proxyPort)
+}
+
+// bypass connects directly, replacing the fake IP of a domain by its real IP if known.
+func (p *Preload) bypass(ip netip.Addr, port uint16) string {
+	if !proxy.ReservedPrefix.Contains(ip) {
+		return replyPass
+	}
+	realIP, ok := p.proxy.GetRealIP(ip)
+	if !ok {
+		p.log.Infof("policy: bypass: unknown real IP of the fake IP %v", ip)
+		return replyPass
+	}
+	return fmt.Sprintf("%v %v %v", replyAddr, realIP, port)
+}
+
+// resolve resolves the domain to a fake IP, so that the proxy resolves it on the node.
+func (p *Preload) resolve(pid int, domain string) string {
+	process := proxy.ReadProcess(pid)
+	switch p.policy.Action(process.Exe, process.Cmdline) {
+	case policy.ActionBlock:
+		p.log.Infof("policy: block resolving %v from %v (%v)", domain, process.Pid, process.Exe)
+		return refuse("udp")
+	case policy.ActionBypass:
+		return replyPass
+	}
+	fakeIP, err := p.proxy.AllocProjection(domain)
+	if err != nil {
+		return replyPass
+	}
+	return fmt.Sprintf("%v %v 0", replyAddr, fakeIP)
+}
@@ -0,0 +1,58 @@
+package preload
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConnect_Sandbox(t *testing.T) {
+	allowlist, err := sandbox.Parse([]string{":443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bypass, err := policy.Parse([]string{"bypass:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	prx := proxy.New(log, dialer.NewDialer(dialer.SymmetricDirect, true, "", "", ""))
+	go prx.ListenAndServe(0)
+	<-prx.Listened()
+	defer prx.Close()
+	for _, c := range []struct {
+		name      string
+		network   string
+		addr      string
+		ignoreUDP bool
+		policy    policy.Policy
+		reply     string
+	}{
+		{"allowed", "tcp", "8.8.8.8:443", false, nil, replyAddr},
+		{"not allowed", "tcp", "8.8.8.8:80", false, nil, replyRefuse},
+		{"udp not allowed", "udp", "8.8.8.8:123", false, nil, replyRefuse},
+		// DNS queries are allowed only if they are answered by the proxy
+		{"dns", "udp", "8.8.8.8:53", false, nil, replyAddr},
+		{"dns with udp ignored", "udp", "8.8.8.8:53", true, nil, replyRefuse},
+		{"dns bypassing", "udp", "8.8.8.8:53", false, bypass, replyRefuse},
+	} {
+		p := &Preload{
+			log:       log,
+			proxy:     prx,
+			allowlist: allowlist,
+			policy:    c.policy,
+		}
+		p.ignoreUDP.Store(c.ignoreUDP)
+		if reply := p.connect(os.Getpid(), c.network, c.addr); !strings.HasPrefix(reply, c.reply+" ") {
+			t.Errorf("%v: reply %q, want %v", c.name, reply, c.reply)
+		}
+	}
+}
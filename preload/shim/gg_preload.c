@@ -0,0 +1,223 @@
+// The preload shim of gg. It hooks connect, sendto, sendmsg and getaddrinfo, and asks gg over the unix socket in
+// $GG_PRELOAD_SOCK where to send the traffic. Each request is a line, and so is the reply:
+//
+//	CONNECT tcp 1.2.3.4:443      ADDR 127.0.0.2 40000   send to the address instead
+//	RESOLVE example.com          ADDR 198.18.0.1 0      resolve to the IP
+//	                             PASS                   leave it alone
+//	                             REFUSE 111             fail with the errno
+//
+// Build: cc -shared -fPIC -O2 -o libgg_preload.so gg_preload.c -ldl
+#define _GNU_SOURCE
+#include <arpa/inet.h>
+#include <dlfcn.h>
+#include <errno.h>
+#include <netdb.h>
+#include <netinet/in.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/socket.h>
+#include <sys/un.h>
+#include <unistd.h>
+
+#define LINE_SIZE 512
+
+static int (*real_connect)(int, const struct sockaddr *, socklen_t);
+static ssize_t (*real_sendto)(int, const void *, size_t, int, const struct sockaddr *, socklen_t);
+static ssize_t (*real_sendmsg)(int, const struct msghdr *, int);
+static int (*real_getaddrinfo)(const char *, const char *, const struct addrinfo *, struct addrinfo **);
+
+#define LOAD(sym)                                   \
+	do {                                            \
+		if (!real_##sym)                            \
+			real_##sym = dlsym(RTLD_NEXT, #sym);    \
+	} while (0)
+
+// ask sends the request to gg and reads the reply. It returns -1 if gg is not reachable.
+static int ask(const char *request, char *reply, size_t size) {
+	const char *path = getenv("GG_PRELOAD_SOCK");
+	if (!path || !*path)
+		return -1;
+	LOAD(connect);
+	int saved = errno;
+	int fd = socket(AF_UNIX, SOCK_STREAM | SOCK_CLOEXEC, 0);
+	if (fd < 0)
+		goto fail;
+	struct sockaddr_un sun = {.sun_family = AF_UNIX};
+	strncpy(sun.sun_path, path, sizeof(sun.sun_path) - 1);
+	if (real_connect(fd, (struct sockaddr *)&sun, sizeof(sun)) < 0)
+		goto fail;
+	size_t len = strlen(request), off = 0;
+	while (off < len) {
+		ssize_t n = write(fd, request + off, len - off);
+		if (n < 0 && errno == EINTR)
+			continue;
+		if (n <= 0)
+			goto fail;
+		off += n;
+	}
+	off = 0;
+	while (off < size - 1) {
+		ssize_t n = read(fd, reply + off, size - 1 - off);
+		if (n < 0 && errno == EINTR)
+			continue;
+		if (n <= 0)
+			break;
+		off += n;
+		if (memchr(reply + off - n, '\n', n))
+			break;
+	}
+	reply[off] = '\0';
+	close(fd);
+	errno = saved;
+	return off > 0 ? 0 : -1;
+fail:
+	if (fd >= 0)
+		close(fd);
+	errno = saved;
+	return -1;
+}
+
+static const char *network(int fd) {
+	int type;
+	socklen_t len = sizeof(type);
+	if (getsockopt(fd, SOL_SOCKET, SO_TYPE, &type, &len) < 0)
+		return NULL;
+	switch (type) {
+	case SOCK_STREAM:
+		return "tcp";
+	case SOCK_DGRAM:
+		return "udp";
+	}
+	return NULL;
+}
+
+// redirect asks gg about the destination addr of fd. It returns 1 and fills out if the address is changed,
+// 0 if not, or -1 with errno set if the syscall should fail.
+static int redirect(int fd, const struct sockaddr *addr, socklen_t addrlen, struct sockaddr_storage *out, socklen_t *outlen) {
+	if (!addr)
+		return 0;
+	char ip[INET6_ADDRSTRLEN], request[LINE_SIZE], reply[LINE_SIZE];
+	const char *net;
+	unsigned port;
+	switch (addr->sa_family) {
+	case AF_INET:
+		if (addrlen < sizeof(struct sockaddr_in))
+			return 0;
+		inet_ntop(AF_INET, &((const struct sockaddr_in *)addr)->sin_addr, ip, sizeof(ip));
+		port = ntohs(((const struct sockaddr_in *)addr)->sin_port);
+		break;
+	case AF_INET6:
+		if (addrlen < sizeof(struct sockaddr_in6))
+			return 0;
+		inet_ntop(AF_INET6, &((const struct sockaddr_in6 *)addr)->sin6_addr, ip, sizeof(ip));
+		port = ntohs(((const struct sockaddr_in6 *)addr)->sin6_port);
+		break;
+	default:
+		return 0;
+	}
+	if (!(net = network(fd)))
+		return 0;
+	if (addr->sa_family == AF_INET6)
+		snprintf(request, sizeof(request), "CONNECT %s [%s]:%u\n", net, ip, port);
+	else
+		snprintf(request, sizeof(request), "CONNECT %s %s:%u\n", net, ip, port);
+	if (ask(request, reply, sizeof(reply)) < 0)
+		return 0;
+	int code;
+	if (sscanf(reply, "REFUSE %d", &code) == 1) {
+		errno = code;
+		return -1;
+	}
+	if (sscanf(reply, "ADDR %45s %u", ip, &port) != 2)
+		return 0;
+	memset(out, 0, sizeof(*out));
+	if (addr->sa_family == AF_INET) {
+		struct sockaddr_in *in = (struct sockaddr_in *)out;
+		in->sin_family = AF_INET;
+		in->sin_port = htons(port);
+		if (inet_pton(AF_INET, ip, &in->sin_addr) != 1)
+			return 0;
+		*outlen = sizeof(*in);
+	} else {
+		struct sockaddr_in6 *in6 = (struct sockaddr_in6 *)out;
+		char mapped[INET6_ADDRSTRLEN + 8];
+		in6->sin6_family = AF_INET6;
+		in6->sin6_port = htons(port);
+		snprintf(mapped, sizeof(mapped), strchr(ip, ':') ? "%s" : "::ffff:%s", ip);
+		if (inet_pton(AF_INET6, mapped, &in6->sin6_addr) != 1)
+			return 0;
+		*outlen = sizeof(*in6);
+	}
+	return 1;
+}
+
+int connect(int fd, const struct sockaddr *addr, socklen_t addrlen) {
+	LOAD(connect);
+	struct sockaddr_storage out;
+	socklen_t outlen;
+	switch (redirect(fd, addr, addrlen, &out, &outlen)) {
+	case -1:
+		return -1;
+	case 1:
+		return real_connect(fd, (struct sockaddr *)&out, outlen);
+	}
+	return real_connect(fd, addr, addrlen);
+}
+
+ssize_t sendto(int fd, const void *buf, size_t len, int flags, const struct sockaddr *addr, socklen_t addrlen) {
+	LOAD(sendto);
+	struct sockaddr_storage out;
+	socklen_t outlen;
+	switch (redirect(fd, addr, addrlen, &out, &outlen)) {
+	case -1:
+		return -1;
+	case 1:
+		return real_sendto(fd, buf, len, flags, (struct sockaddr *)&out, outlen);
+	}
+	return real_sendto(fd, buf, len, flags, addr, addrlen);
+}
+
+ssize_t sendmsg(int fd, const struct msghdr *msg, int flags) {
+	LOAD(sendmsg);
+	struct sockaddr_storage out;
+	socklen_t outlen;
+	struct msghdr m;
+	switch (redirect(fd, msg->msg_name, msg->msg_namelen, &out, &outlen)) {
+	case -1:
+		return -1;
+	case 1:
+		m = *msg;
+		m.msg_name = &out;
+		m.msg_namelen = outlen;
+		return real_sendmsg(fd, &m, flags);
+	}
+	return real_sendmsg(fd, msg, flags);
+}
+
+int getaddrinfo(const char *node, const char *service, const struct addrinfo *hints, struct addrinfo **res) {
+	LOAD(getaddrinfo);
+	struct in6_addr ip6;
+	if (!node || strlen(node) > 253 || strcmp(node, "localhost") == 0 || inet_pton(AF_INET, node, &ip6) == 1 ||
+		inet_pton(AF_INET6, node, &ip6) == 1 || (hints && (hints->ai_flags & AI_NUMERICHOST)))
+		return real_getaddrinfo(node, service, hints, res);
+	char request[LINE_SIZE], reply[LINE_SIZE], ip[INET6_ADDRSTRLEN], mapped[INET6_ADDRSTRLEN + 8];
+	unsigned port;
+	int code;
+	snprintf(request, sizeof(request), "RESOLVE %s\n", node);
+	if (ask(request, reply, sizeof(reply)) < 0)
+		return real_getaddrinfo(node, service, hints, res);
+	if (sscanf(reply, "REFUSE %d", &code) == 1)
+		return EAI_FAIL;
+	if (sscanf(reply, "ADDR %45s %u", ip, &port) != 2)
+		return real_getaddrinfo(node, service, hints, res);
+	struct addrinfo h = {0};
+	if (hints)
+		h = *hints;
+	h.ai_flags = (h.ai_flags & ~(AI_CANONNAME | AI_ADDRCONFIG)) | AI_NUMERICHOST;
+	if (h.ai_family == AF_INET6 && !strchr(ip, ':')) {
+		snprintf(mapped, sizeof(mapped), "::ffff:%s", ip);
+		return real_getaddrinfo(mapped, service, &h, res);
+	}
+	return real_getaddrinfo(ip, service, &h, res);
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// AuditEntry is a destination that the programs tried to connect to.
+type AuditEntry struct {
+	Network     string   `json:"network"`
+	Host        string   `json:"host"`
+	Port        int      `json:"port"`
+	Connections int      `json:"connections"`
+	Errors      int      `json:"errors"`
+	Processes   []string `json:"processes"` // executables, or pids if unknown
+}
+
+// Audit lists the destinations of the records, sorted by host, port and network.
+func (s *Stats) Audit() []AuditEntry {
+	type key struct {
+		network string
+		target  string
+	}
+	m := make(map[key]*AuditEntry)
+	processes := make(map[key]map[string]struct{})
+	for _, r := range s.Records() {
+		k := key{network: r.Network, target: r.Target}
+		e, ok := m[k]
+		if !ok {
+			host, strPort, _ := net.SplitHostPort(r.Target)
+			port, _ := strconv.Atoi(strPort)
+			e = &AuditEntry{Network: r.Network, Host: host, Port: port}
+			m[k] = e
+			processes[k] = make(map[string]struct{})
+		}
+		e.Connections++
+		if r.Error != "" {
+			e.Errors++
+		}
+		switch {
+		case r.Exe != "":
+			processes[k][r.Exe] = struct{}{}
+		case r.Pid != 0:
+			processes[k]["pid "+strconv.Itoa(r.Pid)] = struct{}{}
+		}
+	}
+	entries := make([]AuditEntry, 0, len(m))
+	for k, e := range m {
+		for p := range processes[k] {
+			e.Processes = append(e.Processes, p)
+		}
+		sort.Strings(e.Processes)
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Host != entries[j].Host {
+			return entries[i].Host < entries[j].Host
+		}
+		if entries[i].Port != entries[j].Port {
+			return entries[i].Port < entries[j].Port
+		}
+		return entries[i].Network < entries[j].Network
+	})
+	return entries
+}
+
+// WriteAudit writes the destinations as a table.
+func (s *Stats) WriteAudit(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tHOST\tPORT\tCONNS\tERRORS\tPROCESSES")
+	for _, e := range s.Audit() {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			e.Network,
+			e.Host,
+			e.Port,
+			e.Connections,
+			e.Errors,
+			strings.Join(e.Processes, ","),
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	s := NewStats(0)
+	trackAll([]testConn{
+		{network: "tcp", target: "example.com:443", exe: "/usr/bin/curl"},
+		{network: "udp", target: "1.1.1.1:53", pid: 42},
+		{network: "tcp", target: "example.com:80", exe: "/usr/bin/wget", err: errors.New("blocked")},
+		{network: "tcp", target: "example.com:443", exe: "/usr/bin/wget"},
+		{network: "tcp", target: "example.com:443", exe: "/usr/bin/curl", err: errors.New("blocked")},
+		{network: "tcp", target: "1.1.1.1:53"},
+		{network: "tcp", target: "[::1]:8080", pid: 7, live: true},
+	}, s.add)
+	want := []AuditEntry{
+		{Network: "tcp", Host: "1.1.1.1", Port: 53, Connections: 1},
+		{Network: "udp", Host: "1.1.1.1", Port: 53, Connections: 1, Processes: []string{"pid 42"}},
+		{Network: "tcp", Host: "::1", Port: 8080, Connections: 1, Processes: []string{"pid 7"}},
+		{Network: "tcp", Host: "example.com", Port: 80, Connections: 1, Errors: 1, Processes: []string{"/usr/bin/wget"}},
+		{Network: "tcp", Host: "example.com", Port: 443, Connections: 3, Errors: 1, Processes: []string{"/usr/bin/curl", "/usr/bin/wget"}},
+	}
+	if got := s.Audit(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("audit %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mzz2017/gg/infra/pcapng"
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	protoTCP = 6
+	protoUDP = 17
+
+	// captureSegmentSize keeps the synthesized packets within the 16-bit length fields of IP.
+	captureSegmentSize = 65000
+)
+
+// Capture writes the application-side payload of proxied flows as a pcapng file. The IP and TCP/UDP headers
+// are synthesized: the program is the client and the original destination is the server. It is thread-safe.
+type Capture struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	pw  *pcapng.Writer
+	err error
+}
+
+func NewCapture(w io.Writer) (*Capture, error) {
+	bw := bufio.NewWriter(w)
+	pw, err := pcapng.NewWriter(bw, pcapng.LinkTypeRaw, "gg")
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{w: bw, pw: pw}, nil
+}
+
+// Flush writes the buffered packets and returns the first error of writing.
+func (c *Capture) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+	return c.err
+}
+
+func (c *Capture) write(packet []byte, comment string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = c.pw.WritePacket(time.Now(), packet, comment)
+}
+
+// SetCapture makes the proxy write the payload of flows to c. It should be called before serving.
+func (p *Proxy) SetCapture(c *Capture) {
+	p.capture = c
+}
+
+// captureServer returns the address the program sees as the target.
+func (p *Proxy) captureServer(target string) netip.AddrPort {
+	if addr, err := netip.ParseAddrPort(target); err == nil {
+		return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	}
+	host, strPort, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(strPort)
+	// the program connected to the fake IP of the domain
+	p.mutex.Lock()
+	ip, ok := p.domainMapper.Lookup(host)
+	p.mutex.Unlock()
+	if !ok {
+		ip = netip.IPv4Unspecified()
+	}
+	return netip.AddrPortFrom(ip, uint16(port))
+}
+
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ap := addr.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	case *net.UDPAddr:
+		ap := addr.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
+
+// captureComment describes the flow, which is noted on its first packet.
+func captureComment(network string, target string, node string, process *Process) string {
+	comment := network + " " + target
+	if node != "" {
+		comment += " via " + node
+	}
+	if process != nil {
+		comment += fmt.Sprintf(" by %v (%v)", process.Pid, process.Exe)
+	}
+	return comment
+}
+
+// captureTCP starts to capture a TCP flow. It returns nil if the capture is not set.
+func (p *Proxy) captureTCP(client net.Addr, target string, node string, process *Process) *tcpFlow {
+	if p.capture == nil {
+		return nil
+	}
+	f := &tcpFlow{
+		c:      p.capture,
+		client: addrPortOf(client),
+		server: p.captureServer(target),
+	}
+	// three-way handshake
+	f.c.write(f.packet(true, tcpFlagSYN, nil), captureComment("tcp", target, node, process))
+	f.clientSeq++
+	f.c.write(f.packet(false, tcpFlagSYN|tcpFlagACK, nil), "")
+	f.serverSeq++
+	f.c.write(f.packet(true, tcpFlagACK, nil), "")
+	return f
+}
+
+type tcpFlow struct {
+	c         *Capture
+	mu        sync.Mutex
+	client    netip.AddrPort
+	server    netip.AddrPort
+	clientSeq uint32
+	serverSeq uint32
+	closed    bool
+}
+
+func (f *tcpFlow) packet(fromClient bool, flags uint8, payload []byte) []byte {
+	src, dst, seq, ack := f.client, f.server, f.clientSeq, f.serverSeq
+	if !fromClient {
+		src, dst, seq, ack = f.server, f.client, f.serverSeq, f.clientSeq
+	}
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	if flags&tcpFlagACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	tcp = append(tcp, payload...)
+	return ipPacket(src.Addr(), dst.Addr(), protoTCP, tcp, 16)
+}
+
+// Payload captures the data sent by the client if fromClient, otherwise by the server.
+func (f *tcpFlow) Payload(fromClient bool, b []byte) {
+	if f == nil || len(b) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	for len(b) > 0 {
+		n := min(len(b), captureSegmentSize)
+		f.c.write(f.packet(fromClient, tcpFlagPSH|tcpFlagACK, b[:n]), "")
+		if fromClient {
+			f.clientSeq += uint32(n)
+		} else {
+			f.serverSeq += uint32(n)
+		}
+		b = b[n:]
+	}
+}
+
+// Close captures the four-way handshake. It is idempotent.
+func (f *tcpFlow) Close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.c.write(f.packet(true, tcpFlagFIN|tcpFlagACK, nil), "")
+	f.clientSeq++
+	f.c.write(f.packet(false, tcpFlagFIN|tcpFlagACK, nil), "")
+	f.serverSeq++
+	f.c.write(f.packet(true, tcpFlagACK, nil), "")
+}
+
+// captureUDP captures a datagram between the client and the target. The target is noted if it is a domain.
+func (p *Proxy) captureUDP(client net.Addr, target string, fromClient bool, payload []byte) {
+	if p.capture == nil {
+		return
+	}
+	src, dst := addrPortOf(client), p.captureServer(target)
+	var comment string
+	if _, err := netip.ParseAddrPort(target); err != nil {
+		comment = "udp " + target
+	}
+	if !fromClient {
+		src, dst = dst, src
+	}
+	for len(payload) > 0 {
+		n := min(len(payload), captureSegmentSize)
+		udp := make([]byte, 8, 8+n)
+		binary.BigEndian.PutUint16(udp[0:], src.Port())
+		binary.BigEndian.PutUint16(udp[2:], dst.Port())
+		binary.BigEndian.PutUint16(udp[4:], uint16(8+n))
+		udp = append(udp, payload[:n]...)
+		p.capture.write(ipPacket(src.Addr(), dst.Addr(), protoUDP, udp, 6), comment)
+		payload = payload[n:]
+	}
+}
+
+// ipPacket wraps the transport segment with an IP header and fills the checksum of the segment at csumOffset.
+// IPv4 addresses are mapped to IPv6 if the other one is IPv6.
+func ipPacket(src, dst netip.Addr, proto uint8, segment []byte, csumOffset int) []byte {
+	var pseudo []byte
+	var header []byte
+	if src.Is4() && dst.Is4() {
+		header = make([]byte, 20)
+		header[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment)))
+		header[6] = 0x40 // don't fragment
+		header[8] = 64   // TTL
+		header[9] = proto
+		s, d := src.As4(), dst.As4()
+		copy(header[12:], s[:])
+		copy(header[16:], d[:])
+		binary.BigEndian.PutUint16(header[10:], checksum(0, header))
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = append(pseudo, 0, proto)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		header = make([]byte, 40)
+		header[0] = 6 << 4
+		binary.BigEndian.PutUint16(header[4:], uint16(len(segment)))
+		header[6] = proto
+		header[7] = 64 // hop limit
+		s, d := src.As16(), dst.As16()
+		copy(header[8:], s[:])
+		copy(header[24:], d[:])
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, proto)
+	}
+	csum := checksum(sum(0, pseudo), segment)
+	if csum == 0 && proto == protoUDP {
+		csum = 0xffff // zero means no checksum in UDP
+	}
+	binary.BigEndian.PutUint16(segment[csumOffset:], csum)
+	return append(header, segment...)
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b with the initial sum s.
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// readPackets returns the packets and comments of the enhanced packet blocks in the pcapng file.
+func readPackets(t *testing.T, b []byte) (packets [][]byte, comments []string) {
+	for len(b) > 0 {
+		typ, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if length%4 != 0 || int(length) > len(b) || binary.LittleEndian.Uint32(b[length-4:]) != length {
+			t.Fatalf("malformed block of type %x", typ)
+		}
+		if typ == 6 {
+			body := b[8 : length-4]
+			n := binary.LittleEndian.Uint32(body[12:])
+			packets = append(packets, body[20:20+n])
+			var comment string
+			if opts := body[20+(n+3)/4*4:]; len(opts) > 0 && binary.LittleEndian.Uint16(opts) == 1 {
+				comment = string(opts[4 : 4+binary.LittleEndian.Uint16(opts[2:])])
+			}
+			comments = append(comments, comment)
+		}
+		b = b[length:]
+	}
+	return packets, comments
+}
+
+// onesSum returns the one's complement sum, which is 0xffff for the data with a valid checksum.
+func onesSum(bs ...[]byte) uint16 {
+	var s uint32
+	for _, b := range bs {
+		for i := 0; i+1 < len(b); i += 2 {
+			s += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			s += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+// segmentOf checks the IP header and the checksum of the transport segment, and returns the segment.
+func segmentOf(t *testing.T, packet []byte, proto uint8) (src, dst netip.Addr, segment []byte) {
+	var pseudo []byte
+	switch packet[0] >> 4 {
+	case 4:
+		header := packet[:20]
+		if onesSum(header) != 0xffff || int(binary.BigEndian.Uint16(header[2:])) != len(packet) || header[9] != proto {
+			t.Fatalf("bad IPv4 header: %x", header)
+		}
+		src, dst = netip.AddrFrom4([4]byte(header[12:16])), netip.AddrFrom4([4]byte(header[16:20]))
+		segment = packet[20:]
+		pseudo = append(append(pseudo, header[12:20]...), 0, proto)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	case 6:
+		header := packet[:40]
+		if int(binary.BigEndian.Uint16(header[4:])) != len(packet)-40 || header[6] != proto {
+			t.Fatalf("bad IPv6 header: %x", header)
+		}
+		src, dst = netip.AddrFrom16([16]byte(header[8:24])), netip.AddrFrom16([16]byte(header[24:40]))
+		segment = packet[40:]
+		pseudo = append(pseudo, header[8:40]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, proto)
+	default:
+		t.Fatalf("bad IP version: %x", packet[0])
+	}
+	if onesSum(pseudo, segment) != 0xffff {
+		t.Fatalf("bad checksum of the segment: %x", segment)
+	}
+	return src, dst, segment
+}
+
+func TestChecksum(t *testing.T) {
+	// https://en.wikipedia.org/wiki/Internet_checksum
+	header, _ := hex.DecodeString("450000730000400040110000c0a80001c0a800c7")
+	if got := checksum(0, header); got != 0xb861 {
+		t.Fatalf("checksum %x, want b861", got)
+	}
+}
+
+func TestCaptureTCP(t *testing.T) {
+	for _, c := range []struct {
+		target string
+		server netip.Addr
+		client netip.Addr
+	}{
+		{"93.184.216.34:443", netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("127.0.0.1")},
+		// the IPv4 client is mapped to IPv6
+		{"[2001:db8::1]:443", netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("::ffff:127.0.0.1")},
+	} {
+		var buf bytes.Buffer
+		capture, err := NewCapture(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Proxy{capture: capture}
+		f := p.captureTCP(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, c.target, "node", &Process{Pid: 42, Exe: "/usr/bin/curl"})
+		f.Payload(true, []byte("GET"))
+		f.Payload(false, []byte("HTTP/1.1"))
+		f.Close()
+		f.Close()
+		f.Payload(true, []byte("late"))
+		if err = capture.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		packets, comments := readPackets(t, buf.Bytes())
+		want := []struct {
+			fromClient bool
+			flags      uint8
+			seq, ack   uint32
+			payload    string
+		}{
+			{true, tcpFlagSYN, 0, 0, ""},
+			{false, tcpFlagSYN | tcpFlagACK, 0, 1, ""},
+			{true, tcpFlagACK, 1, 1, ""},
+			{true, tcpFlagPSH | tcpFlagACK, 1, 1, "GET"},
+			{false, tcpFlagPSH | tcpFlagACK, 1, 4, "HTTP/1.1"},
+			{true, tcpFlagFIN | tcpFlagACK, 4, 9, ""},
+			{false, tcpFlagFIN | tcpFlagACK, 9, 5, ""},
+			{true, tcpFlagACK, 5, 10, ""},
+		}
+		if len(packets) != len(want) {
+			t.Fatalf("%v: %v packets, want %v", c.target, len(packets), len(want))
+		}
+		if comments[0] != "tcp "+c.target+" via node by 42 (/usr/bin/curl)" {
+			t.Errorf("%v: unexpected comment: %q", c.target, comments[0])
+		}
+		for i, w := range want {
+			src, dst, tcp := segmentOf(t, packets[i], protoTCP)
+			srcPort, dstPort := uint16(40000), uint16(443)
+			if !w.fromClient {
+				src, dst, srcPort, dstPort = dst, src, dstPort, srcPort
+			}
+			if src != c.client || dst != c.server || binary.BigEndian.Uint16(tcp) != srcPort || binary.BigEndian.Uint16(tcp[2:]) != dstPort {
+				t.Errorf("%v: packet %v: unexpected addresses: %v %v %x", c.target, i, src, dst, tcp[:4])
+			}
+			seq, ack, flags := binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:]), tcp[13]
+			if seq != w.seq || ack != w.ack || flags != w.flags || string(tcp[20:]) != w.payload {
+				t.Errorf("%v: packet %v: seq %v ack %v flags %x payload %q, want %+v", c.target, i, seq, ack, flags, tcp[20:], w)
+			}
+		}
+	}
+}
+
+func TestCaptureUDP(t *testing.T) {
+	var buf bytes.Buffer
+	capture, err := NewCapture(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{capture: capture}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	p.captureUDP(client, "1.1.1.1:53", true, []byte("query"))
+	p.captureUDP(client, "1.1.1.1:53", false, []byte("answer!"))
+	if err = capture.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	packets, _ := readPackets(t, buf.Bytes())
+	if len(packets) != 2 {
+		t.Fatalf("%v packets, want 2", len(packets))
+	}
+	for i, payload := range []string{"query", "answer!"} {
+		src, _, udp := segmentOf(t, packets[i], protoUDP)
+		if int(binary.BigEndian.Uint16(udp[4:])) != len(udp) || string(udp[8:]) != payload {
+			t.Errorf("packet %v: unexpected UDP: %x", i, udp)
+		}
+		if wantSrc := (i == 0); (src == netip.MustParseAddr("127.0.0.1")) != wantSrc {
+			t.Errorf("packet %v: unexpected source: %v", i, src)
+		}
+	}
+}
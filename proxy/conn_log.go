@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	ConnEventOpen  = "open"
+	ConnEventClose = "close"
+)
+
+// ConnEvent is a line of ConnLog.
+type ConnEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	ConnRecord
+}
+
+// ConnLog writes the events of connections as JSON lines. It is thread-safe.
+type ConnLog struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewConnLog(w io.Writer) *ConnLog {
+	return &ConnLog{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (l *ConnLog) add(c *TrackedConn) {
+	l.write(ConnEventOpen, c.Record())
+	c.onClose = append(c.onClose, func(c *TrackedConn) {
+		l.write(ConnEventClose, c.Record())
+	})
+}
+
+func (l *ConnLog) write(event string, r ConnRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// The log is best-effort and should never break the connection.
+	_ = l.encoder.Encode(ConnEvent{
+		Time:       time.Now(),
+		Event:      event,
+		ConnRecord: r,
+	})
+}
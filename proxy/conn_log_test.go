@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestConnLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewConnLog(&buf)
+	s := NewStats(0)
+	// the log works with or without the stats
+	trackAll([]testConn{
+		{network: "tcp", target: "example.com:443", exe: "/usr/bin/curl", pid: 42, upload: 1, download: 2},
+		{network: "udp", target: "1.1.1.1:53", err: errors.New("refused")},
+		{network: "tcp", target: "[::1]:80", live: true},
+	}, s.add, l.add)
+	want := []struct {
+		event  string
+		id     uint64
+		target string
+		exe    string
+		upload int64
+		err    string
+	}{
+		{ConnEventOpen, 1, "example.com:443", "/usr/bin/curl", 0, ""},
+		{ConnEventClose, 1, "example.com:443", "/usr/bin/curl", 1, ""},
+		{ConnEventOpen, 2, "1.1.1.1:53", "", 0, ""},
+		{ConnEventClose, 2, "1.1.1.1:53", "", 0, "refused"},
+		{ConnEventOpen, 3, "[::1]:80", "", 0, ""},
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	var i int
+	for ; scanner.Scan(); i++ {
+		var e ConnEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %v is not JSON: %v", i, err)
+		}
+		if i >= len(want) {
+			t.Fatalf("unexpected line: %s", scanner.Bytes())
+		}
+		w := want[i]
+		if e.Event != w.event || e.ID != w.id || e.Target != w.target || e.Exe != w.exe || e.Upload != w.upload ||
+			e.Error != w.err || e.Time.IsZero() {
+			t.Errorf("line %v: unexpected event: %s", i, scanner.Bytes())
+		}
+		if e.Event == ConnEventClose && e.Duration <= 0 {
+			t.Errorf("line %v: no duration", i)
+		}
+	}
+	if i != len(want) {
+		t.Fatalf("%v lines, want %v", i, len(want))
+	}
+	// the fields are flattened
+	var m map[string]any
+	first, _, _ := bytes.Cut(buf.Bytes(), []byte("\n"))
+	if err := json.Unmarshal(first, &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"time", "event", "id", "pid", "exe", "network", "target"} {
+		if _, ok := m[key]; !ok {
+			t.Errorf("no field %v: %s", key, first)
+		}
+	}
+}
@@ -1,47 +1,178 @@
 package proxy
 
 import (
+	"container/list"
+	"fmt"
 	"net/netip"
+	"time"
 )
 
-type IPMapper interface {
-	Alloc(target string) (loopback netip.Addr)
-	Get(loopback netip.Addr) (target string)
+// ExhaustedErr is returned if all the projections are in use.
+var ExhaustedErr = fmt.Errorf("projections exhausted")
+
+// LoopbackPrefix is the pool of the address projections.
+var LoopbackPrefix = netip.MustParsePrefix("127.0.0.0/8")
+
+// DefaultProjectionTimeout is how long a projection not used by any connection is kept, since the program may use
+// it later. The projections that the sockets are still connected to are never reclaimed, e.g. the ones of the connected
+// UDP sockets sending nothing for a while.
+const DefaultProjectionTimeout = 10 * time.Minute
+
+type projection struct {
+	loopback netip.Addr
+	target   string
+	owner    *Process      // owner is the process that used the projection last
+	refs     int           // refs is the number of the connections using the projection
+	used     time.Time     // used is when the projection was allocated or released last
+	idle     *list.Element // idle is the element in the idle list if refs is 0
 }
 
-// LoopbackMapper projects something to a loopback IP.
-// It is not thread-safe.
+// LoopbackMapper projects something to a loopback IP. A projection is kept while connections use it, and reclaimed
+// after idle for a timeout. It is not thread-safe.
 type LoopbackMapper struct {
-	mapper    map[netip.Addr]string
-	revMapper map[string]netip.Addr
-	lastAlloc netip.Addr
+	mapper    map[netip.Addr]*projection
+	revMapper map[string]*projection
+	idle      *list.List // idle is the projections of no connections, from the least recently used
+	free      []netip.Addr
+	lastAlloc netip.Addr // lastAlloc is the last address never used before
+	prefix    netip.Prefix
+	timeout   time.Duration
+	now       func() time.Time
+	connected func() map[netip.Addr]struct{} // connected returns the loopbacks that the sockets connect to, or nil
 }
 
 func NewLoopbackMapper() *LoopbackMapper {
+	m := newLoopbackMapper(LoopbackPrefix, DefaultProjectionTimeout)
+	m.connected = connectedLoopbacks
+	return m
+}
+
+// newLoopbackMapper returns a LoopbackMapper allocating the addresses in prefix except the first and the last ones,
+// and reclaiming the projections idle for timeout.
+func newLoopbackMapper(prefix netip.Prefix, timeout time.Duration) *LoopbackMapper {
 	return &LoopbackMapper{
-		mapper:    make(map[netip.Addr]string),
-		revMapper: make(map[string]netip.Addr),
-		lastAlloc: netip.AddrFrom4([4]byte{126, 0, 0, 0}),
+		mapper:    make(map[netip.Addr]*projection),
+		revMapper: make(map[string]*projection),
+		idle:      list.New(),
+		lastAlloc: prefix.Masked().Addr(),
+		prefix:    prefix.Masked(),
+		timeout:   timeout,
+		now:       time.Now,
 	}
 }
 
-func (m *LoopbackMapper) Alloc(target string) (loopback netip.Addr) {
-	if ip, ok := m.revMapper[target]; ok {
-		return ip
+// Alloc returns the projection of target, allocating one if not exists. ExhaustedErr is returned if all the
+// addresses are in use, rather than overwriting any projection.
+func (m *LoopbackMapper) Alloc(target string) (loopback netip.Addr, err error) {
+	now := m.now()
+	m.reclaim(now)
+	if p, ok := m.revMapper[target]; ok {
+		p.used = now
+		if p.idle != nil {
+			m.idle.MoveToBack(p.idle)
+		}
+		return p.loopback, nil
 	}
+	if loopback, err = m.next(); err != nil {
+		return netip.Addr{}, err
+	}
+	p := &projection{loopback: loopback, target: target, used: now}
+	p.idle = m.idle.PushBack(p)
+	m.mapper[loopback] = p
+	m.revMapper[target] = p
+	return loopback, nil
+}
 
-	m.lastAlloc = m.lastAlloc.Next()
-	if !m.lastAlloc.IsLoopback() {
-		// The loopback address has been used up. Loop back and overwrite.
-		m.lastAlloc = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+// next returns an address not in use.
+func (m *LoopbackMapper) next() (loopback netip.Addr, err error) {
+	if next := m.lastAlloc.Next(); m.prefix.Contains(next) && m.prefix.Contains(next.Next()) {
+		m.lastAlloc = next
+		return next, nil
+	}
+	if len(m.free) == 0 {
+		return netip.Addr{}, fmt.Errorf("%w: %v in use", ExhaustedErr, len(m.mapper))
+	}
+	loopback = m.free[0]
+	m.free = m.free[1:]
+	return loopback, nil
+}
+
+// reclaim frees the projections idle for the timeout, except the ones that the sockets are still connected to, which
+// are regarded as used now.
+func (m *LoopbackMapper) reclaim(now time.Time) {
+	var connected map[netip.Addr]struct{}
+	for e := m.idle.Front(); e != nil; e = m.idle.Front() {
+		p := e.Value.(*projection)
+		if now.Sub(p.used) < m.timeout {
+			return
+		}
+		if connected == nil && m.connected != nil {
+			connected = m.connected()
+		}
+		if _, ok := connected[p.loopback]; ok {
+			p.used = now
+			m.idle.MoveToBack(e)
+			continue
+		}
+		m.idle.Remove(e)
+		delete(m.mapper, p.loopback)
+		delete(m.revMapper, p.target)
+		m.free = append(m.free, p.loopback)
+	}
+}
+
+// Retain keeps the projection from being reclaimed until released by Release. It returns false if loopback is not
+// projected.
+func (m *LoopbackMapper) Retain(loopback netip.Addr) bool {
+	p, ok := m.mapper[loopback]
+	if !ok {
+		return false
+	}
+	if p.refs == 0 {
+		m.idle.Remove(p.idle)
+		p.idle = nil
+	}
+	p.refs++
+	return true
+}
+
+// Release releases the projection retained by Retain.
+func (m *LoopbackMapper) Release(loopback netip.Addr) {
+	p, ok := m.mapper[loopback]
+	if !ok || p.refs == 0 {
+		return
+	}
+	p.refs--
+	if p.refs == 0 {
+		p.used = m.now()
+		p.idle = m.idle.PushBack(p)
 	}
-	m.mapper[m.lastAlloc] = target
-	m.revMapper[target] = m.lastAlloc
-	return m.lastAlloc
 }
 
 func (m *LoopbackMapper) Get(loopback netip.Addr) (target string) {
-	return m.mapper[loopback]
+	if p, ok := m.mapper[loopback]; ok {
+		return p.target
+	}
+	return ""
+}
+
+// SetOwner records that the projection is used by the process.
+func (m *LoopbackMapper) SetOwner(loopback netip.Addr, process *Process) {
+	if p, ok := m.mapper[loopback]; ok {
+		p.owner = process
+	}
+}
+
+// Owner returns the process that used the projection last, or nil if unknown.
+func (m *LoopbackMapper) Owner(loopback netip.Addr) (process *Process) {
+	if p, ok := m.mapper[loopback]; ok {
+		return p.owner
+	}
+	return nil
+}
+
+func (m *LoopbackMapper) Len() int {
+	return len(m.mapper)
 }
 
 var ReservedPrefix = netip.MustParsePrefix("198.18.0.0/15")
@@ -80,3 +211,22 @@ func (m *ReservedMapper) Alloc(target string) (loopback netip.Addr) {
 func (m *ReservedMapper) Get(loopback netip.Addr) (target string) {
 	return m.mapper[loopback]
 }
+
+func (m *ReservedMapper) Len() int {
+	return len(m.mapper)
+}
+
+// Lookup returns the IP projected from the target.
+func (m *ReservedMapper) Lookup(target string) (ip netip.Addr, ok bool) {
+	ip, ok = m.revMapper[target]
+	return ip, ok
+}
+
+// Range calls f for each projection until f returns false.
+func (m *ReservedMapper) Range(f func(ip netip.Addr, target string) bool) {
+	for ip, target := range m.mapper {
+		if !f(ip, target) {
+			return
+		}
+	}
+}
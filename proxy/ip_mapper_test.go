@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// clock is a fake time for the mappers.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func TestLoopbackMapper(t *testing.T) {
+	var c clock
+	m := newLoopbackMapper(netip.MustParsePrefix("127.0.0.0/29"), time.Minute)
+	m.now = c.now
+	// 127.0.0.1 to 127.0.0.6
+	var loopbacks []netip.Addr
+	for i := 0; i < 6; i++ {
+		loopback, err := m.Alloc(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := netip.AddrFrom4([4]byte{127, 0, 0, byte(i + 1)}); loopback != want {
+			t.Fatalf("allocated %v, want %v", loopback, want)
+		}
+		loopbacks = append(loopbacks, loopback)
+	}
+	if _, err := m.Alloc("6"); !errors.Is(err, ExhaustedErr) {
+		t.Fatalf("allocated from the exhausted pool: %v", err)
+	}
+	if loopback, err := m.Alloc("0"); err != nil || loopback != loopbacks[0] {
+		t.Fatalf("unexpected projection of an allocated target: %v %v", loopback, err)
+	}
+	m.Retain(loopbacks[1])
+	c.t = c.t.Add(time.Minute)
+	if _, err := m.Alloc("6"); err != nil {
+		t.Fatal(err)
+	}
+	// the idle projections have been reclaimed, except the new one
+	if m.Len() != 2 || m.Get(loopbacks[1]) != "1" {
+		t.Fatalf("unexpected projections after reclaimed: %v", m.Len())
+	}
+	m.Release(loopbacks[1])
+	c.t = c.t.Add(time.Minute - time.Second)
+	if _, err := m.Alloc("7"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get(loopbacks[1]) != "1" {
+		t.Fatal("the projection is reclaimed before the timeout since released")
+	}
+	// a socket is still connected to the idle projection
+	m.connected = func() map[netip.Addr]struct{} {
+		return map[netip.Addr]struct{}{loopbacks[1]: {}}
+	}
+	c.t = c.t.Add(time.Minute)
+	if _, err := m.Alloc("8"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get(loopbacks[1]) != "1" {
+		t.Fatal("the projection that a socket is connected to is reclaimed")
+	}
+	m.connected = nil
+	c.t = c.t.Add(time.Minute)
+	if _, err := m.Alloc("9"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get(loopbacks[1]) != "" {
+		t.Fatal("the projection is not reclaimed after the socket is closed")
+	}
+}
+
+type conn struct {
+	loopback netip.Addr
+	target   string
+	end      time.Time
+}
+
+// conns is a heap of the connections by the end.
+type conns []conn
+
+func (h conns) Len() int           { return len(h) }
+func (h conns) Less(i, j int) bool { return h[i].end.Before(h[j].end) }
+func (h conns) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *conns) Push(x any)        { *h = append(*h, x.(conn)) }
+func (h *conns) Pop() any {
+	c := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return c
+}
+
+// TestLoopbackMapperMillions simulates millions of connections of random lifetimes, and checks that no projection in
+// use is overwritten.
+func TestLoopbackMapperMillions(t *testing.T) {
+	n := 2_000_000
+	if testing.Short() {
+		n = 200_000
+	}
+	const timeout = 10 * time.Second
+	// 16382 addresses, which are exhausted sometimes
+	var c clock
+	m := newLoopbackMapper(netip.MustParsePrefix("127.0.0.0/18"), timeout)
+	m.now = c.now
+	rnd := rand.New(rand.NewSource(1))
+	var live conns
+	var exhausted int
+	for i := 0; i < n; i++ {
+		c.t = c.t.Add(time.Millisecond)
+		for len(live) > 0 && !live[0].end.After(c.t) {
+			conn := heap.Pop(&live).(conn)
+			if got := m.Get(conn.loopback); got != conn.target {
+				t.Fatalf("the projection %v in use is overwritten: %v, want %v", conn.loopback, got, conn.target)
+			}
+			m.Release(conn.loopback)
+		}
+		target := strconv.Itoa(rnd.Intn(1 << 20))
+		loopback, err := m.Alloc(target)
+		if err != nil {
+			if !errors.Is(err, ExhaustedErr) {
+				t.Fatal(err)
+			}
+			exhausted++
+			continue
+		}
+		if !m.prefix.Contains(loopback) || loopback == m.prefix.Addr() {
+			t.Fatalf("allocated %v out of the pool", loopback)
+		}
+		// most connections end soon, but the program may crowd the pool with long ones
+		lifetime := time.Duration(rnd.ExpFloat64() * float64(time.Second))
+		if i/(n/6)%2 == 1 {
+			lifetime *= 10
+		}
+		if !m.Retain(loopback) {
+			t.Fatalf("allocated %v is not projected", loopback)
+		}
+		heap.Push(&live, conn{loopback: loopback, target: target, end: c.t.Add(lifetime)})
+		if m.Len() > 1<<14-2 {
+			t.Fatalf("%v projections in the pool of %v addresses", m.Len(), 1<<14-2)
+		}
+	}
+	if exhausted == 0 || exhausted > n/2 {
+		t.Fatalf("unexpected exhaustions: %v of %v", exhausted, n)
+	}
+	for _, conn := range live {
+		m.Release(conn.loopback)
+	}
+	c.t = c.t.Add(timeout)
+	if _, err := m.Alloc("last"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 1 || m.idle.Len() != 1 {
+		t.Fatalf("idle projections are not reclaimed: %v", m.Len())
+	}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReadProcess reads the information of the process that the thread pid belongs to from /proc.
+func ReadProcess(pid int) *Process {
+	dir := "/proc/" + strconv.Itoa(pid) + "/"
+	p := &Process{Pid: pid}
+	if f, err := os.Open(dir + "status"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if tgid, ok := strings.CutPrefix(scanner.Text(), "Tgid:"); ok {
+				if tgid, err := strconv.Atoi(strings.TrimSpace(tgid)); err == nil {
+					p.Pid = tgid
+				}
+				break
+			}
+		}
+		f.Close()
+	}
+	if exe, err := os.Readlink(dir + "exe"); err == nil {
+		p.Exe = exe
+	}
+	if b, err := os.ReadFile(dir + "cmdline"); err == nil && len(b) > 0 {
+		for _, arg := range bytes.Split(bytes.TrimSuffix(b, []byte{0}), []byte{0}) {
+			p.Cmdline = append(p.Cmdline, string(arg))
+		}
+	}
+	return p
+}
+
+// SocketOwner finds the process owning the socket of network bound to local, in the network namespace of the
+// process nsPid. It returns nil if not found.
+func SocketOwner(nsPid int, network string, local netip.AddrPort) *Process {
+	dir := "/proc/" + strconv.Itoa(nsPid) + "/"
+	inode, ok := socketInode(dir+"net/"+network, local, netip.AddrPort{})
+	if !ok {
+		inode, ok = socketInode(dir+"net/"+network+"6", local, netip.AddrPort{})
+	}
+	if !ok {
+		return nil
+	}
+	netns, err := os.Readlink(dir + "ns/net")
+	if err != nil {
+		return nil
+	}
+	link := socketLink(inode)
+	pids, _ := filepath.Glob("/proc/[0-9]*")
+	for _, pidDir := range pids {
+		if ns, err := os.Readlink(pidDir + "/ns/net"); err != nil || ns != netns {
+			continue
+		}
+		if hasFd(pidDir, link) {
+			pid, _ := strconv.Atoi(filepath.Base(pidDir))
+			return ReadProcess(pid)
+		}
+	}
+	return nil
+}
+
+// SocketInode returns the inode of the socket that the file descriptor fd of the process pid refers to.
+func SocketInode(pid int, fd int) (inode uint64, ok bool) {
+	link, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/fd/" + strconv.Itoa(fd))
+	if err != nil {
+		return 0, false
+	}
+	s, ok := strings.CutPrefix(link, "socket:[")
+	if !ok {
+		return 0, false
+	}
+	inode, err = strconv.ParseUint(strings.TrimSuffix(s, "]"), 10, 64)
+	return inode, err == nil
+}
+
+// localSocketInode returns the inode of the socket of network bound to local and sending to peer, in the network
+// namespace of gg.
+func localSocketInode(network string, local netip.AddrPort, peer netip.AddrPort) (inode uint64, ok bool) {
+	if inode, ok = socketInode("/proc/self/net/"+network, local, peer); ok {
+		return inode, true
+	}
+	return socketInode("/proc/self/net/"+network+"6", local, peer)
+}
+
+// openSocketInodes returns the inodes of the IPv6 TCP and UDP sockets in the network namespace of gg.
+func openSocketInodes() map[uint64]struct{} {
+	inodes := make(map[uint64]struct{})
+	for _, table := range []string{"/proc/self/net/tcp6", "/proc/self/net/udp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			if inode, err := strconv.ParseUint(fields[9], 10, 64); err == nil {
+				inodes[inode] = struct{}{}
+			}
+		}
+		f.Close()
+	}
+	return inodes
+}
+
+// connectedLoopbacks returns the loopback IPs that the TCP and UDP sockets in the network namespace of gg are
+// connected to.
+func connectedLoopbacks() map[netip.Addr]struct{} {
+	loopbacks := make(map[netip.Addr]struct{})
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open("/proc/self/net/" + table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			if rem, ok := parseProcNetAddr(fields[2]); ok && rem.Addr().Unmap().IsLoopback() {
+				loopbacks[rem.Addr().Unmap()] = struct{}{}
+			}
+		}
+		f.Close()
+	}
+	return loopbacks
+}
+
+// socketOwnedBy reports whether the socket inode is opened by any of the processes pids. The process hint is checked
+// first if it is one of them.
+func socketOwnedBy(inode uint64, hint int, pids []int) bool {
+	link := socketLink(inode)
+	if hint != 0 && slices.Contains(pids, hint) && hasFd("/proc/"+strconv.Itoa(hint), link) {
+		return true
+	}
+	for _, pid := range pids {
+		if pid != hint && hasFd("/proc/"+strconv.Itoa(pid), link) {
+			return true
+		}
+	}
+	return false
+}
+
+func socketLink(inode uint64) string {
+	return "socket:[" + strconv.FormatUint(inode, 10) + "]"
+}
+
+// hasFd reports whether the process of the /proc directory pidDir has a file descriptor linked to link.
+func hasFd(pidDir string, link string) bool {
+	fds, err := os.ReadDir(pidDir + "/fd")
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if l, err := os.Readlink(pidDir + "/fd/" + fd.Name()); err == nil && l == link {
+			return true
+		}
+	}
+	return false
+}
+
+// socketInode returns the inode of the socket bound to local in the table like /proc/net/tcp. If peer is valid, the
+// socket must be connected to it, or be an unconnected UDP socket. An unconnected UDP socket autobound by sendto(2)
+// is bound to the unspecified address, which is found with the port of local if no socket is bound to local.
+func socketInode(table string, local netip.AddrPort, peer netip.AddrPort) (inode uint64, ok bool) {
+	f, err := os.Open(table)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	udp := strings.HasPrefix(filepath.Base(table), "udp")
+	var unspecified uint64
+	var found bool
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		addr, ok := parseProcNetAddr(fields[1])
+		if !ok || addr.Port() != local.Port() {
+			continue
+		}
+		exact := addr.Addr().Unmap() == local.Addr().Unmap()
+		if !exact && (!udp || !addr.Addr().IsUnspecified() || found) {
+			continue
+		}
+		if peer.IsValid() {
+			rem, ok := parseProcNetAddr(fields[2])
+			if !ok {
+				continue
+			}
+			if rem.Port() == 0 && rem.Addr().IsUnspecified() {
+				// not connected
+				if !udp {
+					continue
+				}
+			} else if rem.Addr().Unmap() != peer.Addr().Unmap() || rem.Port() != peer.Port() {
+				continue
+			}
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		if exact {
+			return inode, true
+		}
+		unspecified, found = inode, true
+	}
+	return unspecified, found
+}
+
+// parseProcNetAddr parses the address like "0100007F:1F90", where the IP is printed in 32-bit words of the native
+// byte order.
+func parseProcNetAddr(s string) (netip.AddrPort, bool) {
+	strIP, strPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	b, err := hex.DecodeString(strIP)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.AddrPort{}, false
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.NativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	port, err := strconv.ParseUint(strPort, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	ip, _ := netip.AddrFromSlice(b)
+	return netip.AddrPortFrom(ip, uint16(port)), true
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+func TestParseProcNetAddr(t *testing.T) {
+	// the words are printed in the native byte order
+	word := func(b [4]byte) string {
+		return fmt.Sprintf("%08X", binary.NativeEndian.Uint32(b[:]))
+	}
+	cases := []struct {
+		s    string
+		addr netip.AddrPort
+	}{
+		{word([4]byte{127, 0, 0, 1}) + ":1F90", netip.MustParseAddrPort("127.0.0.1:8080")},
+		{word([4]byte{0x20, 0x01, 0x0d, 0xb8}) + word([4]byte{}) + word([4]byte{}) + word([4]byte{0, 0, 0, 1}) + ":0035", netip.MustParseAddrPort("[2001:db8::1]:53")},
+	}
+	for _, c := range cases {
+		addr, ok := parseProcNetAddr(c.s)
+		if !ok || addr != c.addr {
+			t.Errorf("parseProcNetAddr(%q) = %v, %v, expected %v", c.s, addr, ok, c.addr)
+		}
+	}
+	if _, ok := parseProcNetAddr("0100007F"); ok {
+		t.Error("parseProcNetAddr should fail without the port")
+	}
+}
+
+// procNetAddr formats the address as in /proc/net/tcp.
+func procNetAddr(addr netip.AddrPort) string {
+	var s string
+	b := addr.Addr().AsSlice()
+	for i := 0; i < len(b); i += 4 {
+		s += fmt.Sprintf("%08X", binary.NativeEndian.Uint32(b[i:]))
+	}
+	return fmt.Sprintf("%v:%04X", s, addr.Port())
+}
+
+func TestSocketInode(t *testing.T) {
+	type row struct {
+		local, remote string
+		inode         int
+	}
+	client := netip.MustParseAddrPort("127.0.0.1:40000")
+	listener := netip.MustParseAddrPort("127.0.0.5:1080")
+	cases := []struct {
+		name  string
+		table string
+		rows  []row
+		inode uint64
+		ok    bool
+	}{
+		{"exact", "tcp", []row{{"127.0.0.1:40000", "127.0.0.5:1080", 1}}, 1, true},
+		// the ephemeral port is reused for another destination
+		{"other remote", "tcp", []row{{"127.0.0.1:40000", "1.1.1.1:443", 1}, {"127.0.0.1:40000", "127.0.0.5:1080", 2}}, 2, true},
+		{"no tcp remote", "tcp", []row{{"127.0.0.1:40000", "1.1.1.1:443", 1}}, 0, false},
+		{"tcp listener", "tcp", []row{{"127.0.0.1:40000", "0.0.0.0:0", 1}}, 0, false},
+		{"tcp unspecified", "tcp", []row{{"0.0.0.0:40000", "127.0.0.5:1080", 1}}, 0, false},
+		{"udp connected", "udp", []row{{"127.0.0.1:40000", "127.0.0.5:1080", 1}}, 1, true},
+		{"udp unconnected", "udp", []row{{"127.0.0.1:40000", "0.0.0.0:0", 1}}, 1, true},
+		// the unconnected socket autobound by sendto(2)
+		{"udp unspecified", "udp", []row{{"0.0.0.0:40001", "0.0.0.0:0", 1}, {"0.0.0.0:40000", "0.0.0.0:0", 2}}, 2, true},
+		{"udp6 unspecified", "udp6", []row{{"[::]:40000", "[::]:0", 3}}, 3, true},
+		{"udp exact first", "udp", []row{{"0.0.0.0:40000", "0.0.0.0:0", 1}, {"127.0.0.1:40000", "0.0.0.0:0", 2}}, 2, true},
+		{"udp other remote", "udp", []row{{"0.0.0.0:40000", "1.1.1.1:53", 1}}, 0, false},
+	}
+	for _, c := range cases {
+		lines := []string{"  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode"}
+		for i, r := range c.rows {
+			lines = append(lines, fmt.Sprintf("%4d: %v %v 01 00000000:00000000 00:00000000 00000000  1000        0 %v",
+				i, procNetAddr(netip.MustParseAddrPort(r.local)), procNetAddr(netip.MustParseAddrPort(r.remote)), r.inode))
+		}
+		table := filepath.Join(t.TempDir(), c.table)
+		if err := os.WriteFile(table, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if inode, ok := socketInode(table, client, listener); inode != c.inode || ok != c.ok {
+			t.Errorf("%v: socketInode() = %v, %v, expected %v, %v", c.name, inode, ok, c.inode, c.ok)
+		}
+	}
+}
+
+func TestSocketOwnedBy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	inode, ok := localSocketInode("tcp", c.LocalAddr().(*net.TCPAddr).AddrPort(), c.RemoteAddr().(*net.TCPAddr).AddrPort())
+	if !ok {
+		t.Fatal("the socket is not found")
+	}
+	f, err := c.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fdInode, ok := SocketInode(os.Getpid(), int(f.Fd())); !ok || fdInode != inode {
+		t.Errorf("SocketInode() = %v, %v, expected %v", fdInode, ok, inode)
+	}
+	if !socketOwnedBy(inode, 0, []int{1, os.Getpid()}) {
+		t.Error("the socket should be owned by the test")
+	}
+	if socketOwnedBy(inode, os.Getpid(), []int{1}) {
+		t.Error("the socket should not be owned by any allowed process")
+	}
+}
+
+func TestConnectedLoopbacks(t *testing.T) {
+	loopback := netip.MustParseAddr("127.0.0.42")
+	if _, ok := connectedLoopbacks()[loopback]; ok {
+		t.Skipf("%v is in use", loopback)
+	}
+	// a quiet connected UDP socket, which sends nothing
+	c, err := net.Dial("udp", netip.AddrPortFrom(loopback, 9).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := connectedLoopbacks()[loopback]; !ok {
+		t.Fatalf("%v is not found", loopback)
+	}
+	c.Close()
+	if _, ok := connectedLoopbacks()[loopback]; ok {
+		t.Fatalf("%v is found after the socket is closed", loopback)
+	}
+}
+
+func TestAccept_Untraced(t *testing.T) {
+	// the traced program is another process of the same user
+	traced := exec.Command("sleep", "60")
+	if err := traced.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		traced.Process.Kill()
+		traced.Wait()
+	}()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p := New(log, proxy.Direct)
+	p.SetAuthenticator(func() []int { return []int{traced.Process.Pid} })
+	loopback, err := p.AllocProjection("1.1.1.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetProjectionOwner(loopback, &Process{Pid: traced.Process.Pid})
+
+	// the listener is on the projection as the proxy's
+	ln, err := net.Listen("tcp", net.JoinHostPort(loopback.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := ln.Addr().(*net.TCPAddr).AddrPort()
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	remote := c.LocalAddr().(*net.TCPAddr).AddrPort()
+	// the test itself can read the sockets of the user, but it is not traced
+	if _, _, err = p.accept("tcp", dst, remote, true); !errors.Is(err, UnauthorizedErr) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if target, _, err := p.accept("tcp", dst, remote, false); err != nil || target != "1.1.1.1:443" {
+		t.Errorf("without authentication: %v, %v", target, err)
+	}
+	// the closed socket is in TIME_WAIT without an inode
+	c.Close()
+	if _, _, err = p.accept("tcp", dst, remote, true); !errors.Is(err, UnauthorizedErr) {
+		t.Errorf("closed: unexpected error: %v", err)
+	}
+}
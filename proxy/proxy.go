@@ -1,30 +1,72 @@
 package proxy
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/mzz2017/gg/dialer"
 	"github.com/mzz2017/gg/infra/ip_mtu_trie"
 	"github.com/mzz2017/softwind/pool"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/proxy"
+	"io"
 	"net"
 	"net/netip"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
+// IPv6Projection is the projection for the IPv6 sockets that cannot connect to IPv4-mapped addresses.
+var IPv6Projection = netip.IPv6Loopback()
+
+type socketProjection struct {
+	target  string
+	owner   *Process
+	pending int       // pending is the number of the datagrams to target not received yet
+	expiry  time.Time // expiry is when the pending datagrams are regarded as lost
+}
+
+// pendingTimeout is how long a datagram projected by ProjectSocket may take to reach the listener.
+const pendingTimeout = time.Second
+
+// SocketBusyErr is returned if a socket sends to a target while its datagrams to another are not received yet, since
+// they share IPv6Projection.
+var SocketBusyErr = fmt.Errorf("socket busy")
+
+// UnauthorizedErr is returned if a connection to the listeners is not from the program.
+var UnauthorizedErr = fmt.Errorf("unauthorized")
+
 type Proxy struct {
-	mutex        sync.Mutex      // mutex protects the mappers
-	addrMapper   *LoopbackMapper // addrMapper projects an address to a loopback IP
-	domainMapper *ReservedMapper // domainMapper projects a domain to a reserved IP
-	realIPMapper *RealIPMapper   // realIPMapper projects a fake IP to a real IP
+	mutex        sync.Mutex                  // mutex protects the mappers
+	addrMapper   *LoopbackMapper             // addrMapper projects an address to a loopback IP
+	domainMapper *ReservedMapper             // domainMapper projects a domain to a reserved IP
+	realIPMapper *RealIPMapper               // realIPMapper projects a fake IP to a real IP
+	sockets      map[uint64]socketProjection // sockets projects IPv6Projection to a target by the socket inode
 
 	log         *logrus.Logger
 	listener    net.Listener
 	udpConn     *net.UDPConn
+	listener6   net.Listener // listener6 and udpConn6 serve IPv6Projection
+	udpConn6    *net.UDPConn
+	dialerMu    sync.RWMutex
 	dialer      proxy.Dialer
+	stats       *Stats
+	connLog     *ConnLog
+	capture     *Capture
+	lastConnID  atomic.Uint64
 	closed      chan struct{}
+	closeOnce   sync.Once
 	tcpListened chan struct{}
+	relayMu     sync.Mutex
+	relays      map[*relay]struct{} // relays is the active TCP relays
+	allowed     func() []int        // allowed returns the processes that may use the listeners
 
 	nm *UDPConnMapping
 }
@@ -34,15 +76,19 @@ func New(logger *logrus.Logger, dialer proxy.Dialer) *Proxy {
 		addrMapper:   NewLoopbackMapper(),
 		domainMapper: NewReservedMapper(),
 		realIPMapper: NewRealIPMapper(),
+		sockets:      make(map[uint64]socketProjection),
 		log:          logger,
 		dialer:       dialer,
 		closed:       make(chan struct{}),
 		tcpListened:  make(chan struct{}),
+		relays:       make(map[*relay]struct{}),
 		nm:           NewUDPConnMapping(),
 	}
 }
 
-func (p *Proxy) AllocProjection(target string) (loopback netip.Addr) {
+// AllocProjection returns the IP projected from target, which is a loopback IP for an address, or a reserved IP for
+// a domain. ExhaustedErr is returned if all the loopback IPs are in use.
+func (p *Proxy) AllocProjection(target string) (ip netip.Addr, err error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	if strings.Contains(target, ":") {
@@ -50,7 +96,26 @@ func (p *Proxy) AllocProjection(target string) (loopback netip.Addr) {
 		return p.addrMapper.Alloc(target)
 	} else {
 		// domain
-		return p.domainMapper.Alloc(target)
+		return p.domainMapper.Alloc(target), nil
+	}
+}
+
+// retainProjection keeps the projection loopback from being reclaimed until the returned release is called. The
+// projections of the closed sockets are pruned on release if loopback is IPv6Projection.
+func (p *Proxy) retainProjection(loopback netip.Addr) (release func()) {
+	if loopback == IPv6Projection {
+		return p.pruneSockets
+	}
+	loopback = loopback.Unmap()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.addrMapper.Retain(loopback) {
+		return func() {}
+	}
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.addrMapper.Release(loopback)
 	}
 }
 
@@ -69,44 +134,332 @@ func (p *Proxy) GetProjection(ip netip.Addr) (target string) {
 	}
 }
 
+// ProjectSocket makes the connections and datagrams from the socket inode to IPv6Projection go to target. It is for
+// the sockets that cannot use IPv4 loopback projections, which are told by their addresses, while IPv6Projection is
+// the only IPv6 loopback. process is the owner of the socket. Each call counts a pending datagram until it is got by
+// GetSocketProjection, and SocketBusyErr is returned if target differs from the one of the pending datagrams.
+func (p *Proxy) ProjectSocket(inode uint64, target string, process *Process) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sp := p.sockets[inode]
+	if sp.pending > 0 && time.Now().Before(sp.expiry) {
+		if sp.target != target {
+			return fmt.Errorf("%w: %v datagrams to %v are pending", SocketBusyErr, sp.pending, sp.target)
+		}
+	} else {
+		sp.pending = 0
+	}
+	sp.target, sp.owner = target, process
+	sp.pending++
+	sp.expiry = time.Now().Add(pendingTimeout)
+	p.sockets[inode] = sp
+	return nil
+}
+
+// GetSocketProjection returns the target of the socket inode projected by ProjectSocket. The projection is removed
+// if once, for the TCP sockets that connect only once. Otherwise, it is kept for the connected UDP sockets that send
+// without addresses, until the socket is closed and pruned by pruneSockets.
+func (p *Proxy) GetSocketProjection(inode uint64, once bool) (target string, owner *Process) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sp, ok := p.sockets[inode]
+	if !ok {
+		return "", nil
+	}
+	if once {
+		delete(p.sockets, inode)
+	} else if sp.pending > 0 {
+		sp.pending--
+		p.sockets[inode] = sp
+	}
+	return sp.target, sp.owner
+}
+
+// pruneSockets removes the projections of the sockets that are closed and have no pending datagrams.
+func (p *Proxy) pruneSockets() {
+	open := openSocketInodes()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for inode, sp := range p.sockets {
+		if _, ok := open[inode]; !ok && (sp.pending == 0 || now.After(sp.expiry)) {
+			delete(p.sockets, inode)
+		}
+	}
+}
+
+// SetProjectionOwner records that the projection is used by the process.
+func (p *Proxy) SetProjectionOwner(loopback netip.Addr, process *Process) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.addrMapper.SetOwner(loopback.Unmap(), process)
+}
+
+// GetProjectionOwner returns the process that used the projection last, or nil if unknown.
+func (p *Proxy) GetProjectionOwner(loopback netip.Addr) (process *Process) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.addrMapper.Owner(loopback.Unmap())
+}
+
+// SetAuthenticator makes the listeners only serve the sockets opened by the processes that allowed returns. It
+// should be called before serving.
+func (p *Proxy) SetAuthenticator(allowed func() (pids []int)) {
+	p.allowed = allowed
+}
+
+// accept finds the target of the connection or datagram of network from remote to dst, which is the projection
+// loopback with the port of the listener. The socket bound to remote is authenticated if auth, and it must be opened
+// by an allowed process.
+func (p *Proxy) accept(network string, dst netip.AddrPort, remote netip.AddrPort, auth bool) (target string, owner *Process, err error) {
+	loopback := dst.Addr().Unmap()
+	dst = netip.AddrPortFrom(loopback, dst.Port())
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	if !remote.Addr().IsLoopback() {
+		return "", nil, fmt.Errorf("%w: %v from %v", UnauthorizedErr, network, remote)
+	}
+	auth = auth && p.allowed != nil
+	var inode uint64
+	var found bool
+	if loopback == IPv6Projection || auth {
+		inode, found = localSocketInode(network, remote, dst)
+		// the sockets without inodes, such as the ones in TIME_WAIT, are not opened by any process
+		found = found && inode != 0
+	}
+	if loopback == IPv6Projection {
+		if found {
+			target, owner = p.GetSocketProjection(inode, network == "tcp")
+		}
+	} else {
+		target, owner = p.GetProjection(loopback), p.GetProjectionOwner(loopback)
+	}
+	if auth {
+		hint := 0
+		if owner != nil {
+			hint = owner.Pid
+		}
+		if !found || !socketOwnedBy(inode, hint, p.allowed()) {
+			return "", nil, fmt.Errorf("%w: %v from %v: not opened by the program", UnauthorizedErr, network, remote)
+		}
+	}
+	if target == "" {
+		return "", nil, fmt.Errorf("mapped target address not found: %v", loopback)
+	}
+	return target, owner, nil
+}
+
+// SetStats makes the proxy record connections to stats. It should be called before serving.
+func (p *Proxy) SetStats(stats *Stats) {
+	p.stats = stats
+}
+
+// Stats returns the stats of the proxy, which is nil if not set.
+func (p *Proxy) Stats() *Stats {
+	return p.stats
+}
+
+// SetConnLog makes the proxy log the events of connections to l. It should be called before serving.
+func (p *Proxy) SetConnLog(l *ConnLog) {
+	p.connLog = l
+}
+
+// track starts to track a connection via d. It returns nil if neither stats nor the connection log is set.
+func (p *Proxy) track(process *Process, network string, target string, d proxy.Dialer) *TrackedConn {
+	if p.stats == nil && p.connLog == nil {
+		return nil
+	}
+	c := &TrackedConn{
+		record: ConnRecord{
+			ID:      p.lastConnID.Add(1),
+			Network: network,
+			Target:  target,
+			Node:    nodeName(d),
+			Start:   time.Now(),
+		},
+	}
+	if process != nil {
+		c.record.Pid = process.Pid
+		c.record.Exe = process.Exe
+		c.record.Cmdline = process.Cmdline
+	}
+	if p.stats != nil {
+		p.stats.add(c)
+	}
+	if p.connLog != nil {
+		p.connLog.add(c)
+	}
+	return c
+}
+
+// Dialer returns the dialer to the node.
+func (p *Proxy) Dialer() proxy.Dialer {
+	p.dialerMu.RLock()
+	defer p.dialerMu.RUnlock()
+	return p.dialer
+}
+
+// SetDialer switches the node for new connections. Existing connections are kept.
+func (p *Proxy) SetDialer(d proxy.Dialer) {
+	p.dialerMu.Lock()
+	defer p.dialerMu.Unlock()
+	p.dialer = d
+}
+
+// nodeName returns the name of the dialer.
+func nodeName(d proxy.Dialer) string {
+	if d, ok := d.(*dialer.Dialer); ok {
+		return d.Name()
+	}
+	return ""
+}
+
+// FakeIP is a reserved IP answered to a DNS query of the domain.
+type FakeIP struct {
+	IP     netip.Addr `json:"ip"`
+	Domain string     `json:"domain"`
+	RealIP netip.Addr `json:"real_ip"` // the real IP resolved by the DNS server, which may be invalid if unknown
+}
+
+// FakeIPs returns the table of fake IPs sorted by IP.
+func (p *Proxy) FakeIPs() []FakeIP {
+	p.mutex.Lock()
+	table := make([]FakeIP, 0, p.domainMapper.Len())
+	p.domainMapper.Range(func(ip netip.Addr, domain string) bool {
+		table = append(table, FakeIP{IP: ip, Domain: domain})
+		return true
+	})
+	p.mutex.Unlock()
+	for i := range table {
+		table[i].RealIP, _ = p.realIPMapper.Get(table[i].IP)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].IP.Less(table[j].IP)
+	})
+	return table
+}
+
+// MapperSizes is the number of entries in the mappers of the proxy.
+type MapperSizes struct {
+	Loopback int `json:"loopback"` // address projections
+	Reserved int `json:"reserved"` // domain projections, aka fake IPs
+	Socket   int `json:"socket"`   // IPv6 projections by the socket
+	RealIP   int `json:"real_ip"`
+	UDP      int `json:"udp"` // UDP NAT mappings
+}
+
+func (p *Proxy) MapperSizes() MapperSizes {
+	var sizes MapperSizes
+	p.mutex.Lock()
+	sizes.Loopback = p.addrMapper.Len()
+	sizes.Reserved = p.domainMapper.Len()
+	sizes.Socket = len(p.sockets)
+	p.mutex.Unlock()
+	sizes.RealIP = p.realIPMapper.Len()
+	p.nm.Lock()
+	sizes.UDP = p.nm.Len()
+	p.nm.Unlock()
+	return sizes
+}
+
+// Listened returns a channel that is closed once the TCP listener, and the UDP one if served by ListenAndServe, is
+// ready.
+func (p *Proxy) Listened() <-chan struct{} {
+	return p.tcpListened
+}
+
 func (p *Proxy) GetRealIP(fakeIP netip.Addr) (realIP netip.Addr, ok bool) {
 	return p.realIPMapper.Get(fakeIP)
 }
 
-// ListenAndServe will block the goroutine.
-func (p *Proxy) ListenAndServe(port int) error {
-	addr := net.JoinHostPort("0.0.0.0", strconv.Itoa(port))
-	eCh := make(chan error, 2)
-	go func() {
-		e := p.ListenTCP(addr)
-		eCh <- e
+// ListenAndServe listens on the loopback interface, for both 127.0.0.0/8 and ::1, and will block the goroutine.
+// The TCP and UDP listeners share the port. The IPv4 ones are bound to the unspecified address because the
+// projections take the whole 127.0.0.0/8, and the IPv6 ones are bound to ::1 unless IPv6 is disabled.
+func (p *Proxy) ListenAndServe(port int) (err error) {
+	var listeners []net.Listener
+	var udpConns []*net.UDPConn
+	defer func() {
+		if err != nil {
+			for i := range listeners {
+				listeners[i].Close()
+			}
+			for i := range udpConns {
+				udpConns[i].Close()
+			}
+		}
 	}()
-	select {
-	case e := <-eCh:
-		return e
-	case <-p.tcpListened:
-		// listen udp
-		addr = net.JoinHostPort("0.0.0.0", strconv.Itoa(p.listener.Addr().(*net.TCPAddr).Port))
+	for _, l := range []struct{ family, ip string }{{"4", "0.0.0.0"}, {"6", IPv6Projection.String()}} {
+		lt, err := p.listenConfig().Listen(context.Background(), "tcp"+l.family, net.JoinHostPort(l.ip, strconv.Itoa(port)))
+		if err != nil {
+			if l.family == "6" && (errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EAFNOSUPPORT)) {
+				p.log.Infof("listen on %v: %v", l.ip, err)
+				break
+			}
+			return err
+		}
+		listeners = append(listeners, lt)
+		port = lt.Addr().(*net.TCPAddr).Port
+		pc, err := p.listenConfig().ListenPacket(context.Background(), "udp"+l.family, net.JoinHostPort(l.ip, strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		udpConns = append(udpConns, pc.(*net.UDPConn))
+	}
+	// all are ready before the ports are used
+	p.listener, p.udpConn = listeners[0], udpConns[0]
+	if len(listeners) > 1 {
+		p.listener6, p.udpConn6 = listeners[1], udpConns[1]
+	}
+	close(p.tcpListened)
+	eCh := make(chan error, 2*len(listeners))
+	for i := range listeners {
+		lt, lu := listeners[i], udpConns[i]
+		go func() {
+			eCh <- p.serveTCP(lt)
+		}()
 		go func() {
-			e := p.ListenUDP(addr)
-			eCh <- e
+			eCh <- p.serveUDP(lu)
 		}()
 	}
 	defer p.Close()
 	return <-eCh
 }
 
+// listenConfig binds the listeners to the loopback interface, so that other hosts cannot use the node through
+// them. The addresses of the connections are checked as well, in case binding is not permitted.
+func (p *Proxy) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if e := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), "lo")
+		}); e != nil {
+			return e
+		}
+		if err != nil {
+			p.log.Infof("bind %v to the loopback interface: %v", network, err)
+		}
+		return nil
+	}}
+}
+
 func (p *Proxy) ListenTCP(addr string) (err error) {
-	lt, err := net.Listen("tcp", addr)
+	lt, err := p.listenConfig().Listen(context.Background(), "tcp", addr)
 	if err != nil {
 		return err
 	}
 	p.listener = lt
 	close(p.tcpListened)
+	return p.serveTCP(lt)
+}
+
+func (p *Proxy) serveTCP(lt net.Listener) error {
 	for {
 		conn, err := lt.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			p.log.Infof("%v", err)
+			continue
 		}
 		go func() {
 			err := p.handleTCP(conn)
@@ -118,33 +471,37 @@ func (p *Proxy) ListenTCP(addr string) (err error) {
 }
 
 func (p *Proxy) ListenUDP(addr string) (err error) {
-	_, strPort, err := net.SplitHostPort(addr)
-	if err != nil {
-		return err
-	}
-	port, err := strconv.Atoi(strPort)
+	pc, err := p.listenConfig().ListenPacket(context.Background(), "udp", addr)
 	if err != nil {
 		return err
 	}
-	lu, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
-	if err != nil {
-		return err
+	p.udpConn = pc.(*net.UDPConn)
+	return p.serveUDP(p.udpConn)
+}
+
+func (p *Proxy) serveUDP(lu *net.UDPConn) error {
+	if err := setRecvDst(lu); err != nil {
+		p.log.Warnf("receive the destinations of datagrams: %v", err)
 	}
-	p.udpConn = lu
 	var buf [ip_mtu_trie.MTU]byte
+	oob := make([]byte, 128)
 	for {
-		n, lAddr, err := lu.ReadFrom(buf[:])
+		n, oobn, _, lAddr, err := lu.ReadMsgUDP(buf[:], oob)
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return nil
 			}
-			p.log.Infof("ReadFrom: %v", err)
+			p.log.Infof("ReadMsgUDP: %v", err)
 			continue
 		}
+		loopback, ok := parseDst(oob[:oobn])
+		if !ok {
+			loopback, _ = netip.AddrFromSlice(lAddr.IP)
+		}
 		data := pool.Get(n)
 		copy(data, buf[:n])
 		go func() {
-			err := p.handleUDP(lAddr, data)
+			err := p.handleUDP(lu, lAddr, loopback, data)
 			if err != nil {
 				p.log.Infof("handleUDP: %v", err)
 			}
@@ -161,17 +518,69 @@ func (p *Proxy) UDPPort() int {
 	return p.udpConn.LocalAddr().(*net.UDPAddr).Port
 }
 
-func (p *Proxy) Close() error {
-	close(p.closed)
-	var err error
-	if p.listener != nil {
-		err = p.listener.Close()
+// relay is a TCP relay between the connection from the program and the one to the target.
+type relay struct {
+	lConn, rConn net.Conn
+}
+
+// addRelay records an active relay until the returned function is called.
+func (p *Proxy) addRelay(lConn, rConn net.Conn) (remove func()) {
+	r := &relay{lConn: lConn, rConn: rConn}
+	p.relayMu.Lock()
+	p.relays[r] = struct{}{}
+	p.relayMu.Unlock()
+	return func() {
+		p.relayMu.Lock()
+		delete(p.relays, r)
+		p.relayMu.Unlock()
 	}
-	if p.udpConn != nil {
-		err2 := p.udpConn.Close()
-		if err == nil {
-			err = err2
-		}
+}
+
+// activeRelays returns the number of the active TCP relays.
+func (p *Proxy) activeRelays() int {
+	p.relayMu.Lock()
+	defer p.relayMu.Unlock()
+	return len(p.relays)
+}
+
+// Drain closes the listeners, and waits for the active TCP relays to finish for at most timeout. The relays left
+// are closed.
+func (p *Proxy) Drain(timeout time.Duration) {
+	_ = p.Close()
+	deadline := time.Now().Add(timeout)
+	for p.activeRelays() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	p.relayMu.Lock()
+	defer p.relayMu.Unlock()
+	if len(p.relays) > 0 {
+		p.log.Infof("drain: close %v relays", len(p.relays))
 	}
+	for r := range p.relays {
+		_ = r.lConn.Close()
+		_ = r.rConn.Close()
+	}
+}
+
+// Close closes the listeners. It is idempotent.
+func (p *Proxy) Close() (err error) {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		if p.listener != nil {
+			err = p.listener.Close()
+		}
+		var closers []io.Closer
+		if p.udpConn != nil {
+			closers = append(closers, p.udpConn)
+		}
+		if p.listener6 != nil {
+			closers = append(closers, p.listener6, p.udpConn6)
+		}
+		for _, c := range closers {
+			if err2 := c.Close(); err == nil {
+				err = err2
+			}
+		}
+	})
 	return err
 }
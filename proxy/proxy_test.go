@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/gg/dialer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// echoServer listens on the loopback and echoes the data of each connection until the client closes.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// udpEchoServer starts a UDP server echoing the datagrams.
+func udpEchoServer(t *testing.T) *net.UDPConn {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, from, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			c.WriteTo(b[:n], from)
+		}
+	}()
+	return c
+}
+
+func TestAuthenticate(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+	lu := udpEchoServer(t)
+	defer lu.Close()
+	cases := []struct {
+		name    string
+		network string
+		local   string // the address to bind the UDP socket to
+		allowed bool
+	}{
+		{"allowed", "tcp", "", true},
+		{"unauthorized", "tcp", "", false},
+		{"udp allowed", "udp", "127.0.0.1:0", true},
+		// the unconnected socket is autobound to the unspecified address
+		{"udp unconnected", "udp", "", true},
+		{"udp unauthorized", "udp", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			p := New(log, dialer.NewDialer(dialer.FullconeDirect, true, "direct", "direct", ""))
+			p.SetAuthenticator(func() []int {
+				if !c.allowed {
+					return nil
+				}
+				return []int{os.Getpid()}
+			})
+			go p.ListenAndServe(0)
+			defer p.Close()
+			<-p.Listened()
+			target, port := ln.Addr().String(), p.TCPPort()
+			if c.network == "udp" {
+				target, port = lu.LocalAddr().String(), p.UDPPort()
+			}
+			loopback, err := p.AllocProjection(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := netip.AddrPortFrom(loopback, uint16(port))
+			var conn net.Conn
+			if c.network == "tcp" {
+				conn, err = net.Dial("tcp", dst.String())
+			} else {
+				var laddr *net.UDPAddr
+				if c.local != "" {
+					laddr = net.UDPAddrFromAddrPort(netip.MustParseAddrPort(c.local))
+				}
+				var uc *net.UDPConn
+				if uc, err = net.ListenUDP("udp4", laddr); err == nil {
+					conn = &unconnectedConn{UDPConn: uc, dst: net.UDPAddrFromAddrPort(dst)}
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err = conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 4)
+			_, err = io.ReadFull(conn, b)
+			if c.allowed && (err != nil || string(b) != "ping") {
+				t.Fatalf("read %q: %v", b, err)
+			}
+			if !c.allowed && err == nil {
+				t.Fatal("the connection should be refused")
+			}
+		})
+	}
+}
+
+// unconnectedConn sends the datagrams by sendto(2) with an unconnected socket.
+type unconnectedConn struct {
+	*net.UDPConn
+	dst *net.UDPAddr
+}
+
+func (c *unconnectedConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.dst)
+}
+
+func (c *unconnectedConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// serve starts the proxy with a direct dialer, which is closed when the test finishes.
+func serve(t *testing.T) *Proxy {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p := New(log, dialer.NewDialer(dialer.FullconeDirect, true, "direct", "direct", ""))
+	go p.ListenAndServe(0)
+	t.Cleanup(func() { p.Close() })
+	<-p.Listened()
+	return p
+}
+
+func TestListenAddrs(t *testing.T) {
+	p := serve(t)
+	// the IPv6 listeners are bound to ::1 instead of the dual-stack wildcard
+	addrs := []net.Addr{p.listener.Addr(), p.udpConn.LocalAddr()}
+	if p.listener6 != nil {
+		addrs = append(addrs, p.listener6.Addr(), p.udpConn6.LocalAddr())
+	}
+	for i, addr := range addrs {
+		ap := netip.MustParseAddrPort(addr.String())
+		if ip := ap.Addr(); (i < 2 && ip != netip.IPv4Unspecified()) || (i >= 2 && ip != IPv6Projection) {
+			t.Errorf("listening on %v", addr)
+		}
+		if int(ap.Port()) != p.TCPPort() {
+			t.Errorf("listening on %v, want port %v", addr, p.TCPPort())
+		}
+	}
+}
+
+func TestUDPProjection(t *testing.T) {
+	p := serve(t)
+	// each server replies with its name, and the datagrams to the second projection should reach the second one
+	var loopback netip.Addr
+	for _, name := range []string{"first", "second"} {
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		go func() {
+			b := make([]byte, 16)
+			for {
+				_, from, err := c.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				c.WriteTo([]byte(name), from)
+			}
+		}()
+		if loopback, err = p.AllocProjection(c.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := net.Dial("udp", netip.AddrPortFrom(loopback, uint16(p.UDPPort())).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, err := conn.Read(b)
+	if err != nil || string(b[:n]) != "second" {
+		t.Fatalf("read %q: %v", b[:n], err)
+	}
+}
+
+func TestIPv6Projection(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+	p := serve(t)
+	d := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		// project the socket before connecting, as the tracer does
+		return c.Control(func(fd uintptr) {
+			var st syscall.Stat_t
+			if syscall.Fstat(int(fd), &st) == nil {
+				p.ProjectSocket(st.Ino, ln.Addr().String(), nil)
+			}
+		})
+	}}
+	conn, err := d.Dial("tcp6", netip.AddrPortFrom(IPv6Projection, uint16(p.TCPPort())).String())
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("read %q: %v", b, err)
+	}
+	if sizes := p.MapperSizes(); sizes.Socket != 0 {
+		t.Fatalf("the projection of the TCP socket is left: %v", sizes.Socket)
+	}
+}
+
+func TestProjectSocket(t *testing.T) {
+	p := New(logrus.New(), proxy.Direct)
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer conn.Close()
+	var st syscall.Stat_t
+	f, err := conn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Fstat(int(f.Fd()), &st)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode := st.Ino
+	if err = p.ProjectSocket(inode, "1.1.1.1:53", nil); err != nil {
+		t.Fatal(err)
+	}
+	// the pending datagram is not misrouted
+	if err = p.ProjectSocket(inode, "8.8.8.8:53", nil); !errors.Is(err, SocketBusyErr) {
+		t.Fatalf("ProjectSocket() = %v, expected %v", err, SocketBusyErr)
+	}
+	if err = p.ProjectSocket(inode, "1.1.1.1:53", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if target, _ := p.GetSocketProjection(inode, false); target != "1.1.1.1:53" {
+			t.Fatalf("GetSocketProjection() = %v", target)
+		}
+	}
+	if err = p.ProjectSocket(inode, "8.8.8.8:53", nil); err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := p.GetSocketProjection(inode, false); target != "8.8.8.8:53" {
+		t.Fatalf("GetSocketProjection() = %v", target)
+	}
+	// the projection is kept for the open socket, which may send without addresses if connected
+	p.pruneSockets()
+	if sizes := p.MapperSizes(); sizes.Socket != 1 {
+		t.Fatalf("the projection of the open socket is pruned")
+	}
+	conn.Close()
+	p.pruneSockets()
+	if sizes := p.MapperSizes(); sizes.Socket != 0 {
+		t.Fatalf("the projection of the closed socket is left")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+	const timeout = 200 * time.Millisecond
+	cases := []struct {
+		name     string
+		finished bool // whether the client closes before draining
+	}{
+		{"finished", true},
+		{"closed", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := New(logrus.New(), proxy.Direct)
+			client, conn := net.Pipe()
+			relayed := make(chan struct{})
+			go func() {
+				p.HandleTCP(conn, ln.Addr().String(), nil)
+				close(relayed)
+			}()
+			for deadline := time.Now().Add(time.Second); p.activeRelays() == 0; {
+				if time.Now().After(deadline) {
+					t.Fatal("the relay is not active")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if c.finished {
+				client.Close()
+			}
+			start := time.Now()
+			p.Drain(timeout)
+			if elapsed := time.Since(start); c.finished == (elapsed >= timeout) {
+				t.Fatalf("drained in %v", elapsed)
+			}
+			select {
+			case <-relayed:
+			case <-time.After(time.Second):
+				t.Fatal("the relay is not closed")
+			}
+			client.Close()
+		})
+	}
+}
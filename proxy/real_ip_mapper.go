@@ -28,3 +28,9 @@ func (m *RealIPMapper) Get(fakeIP netip.Addr) (realIP netip.Addr, ok bool) {
 	realIP, ok = m.mapper[fakeIP]
 	return
 }
+
+func (m *RealIPMapper) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.mapper)
+}
@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mzz2017/gg/common"
+	"github.com/mzz2017/gg/metrics"
+)
+
+// Process is the process that makes connections.
+type Process struct {
+	Pid     int      `json:"pid"`
+	Exe     string   `json:"exe,omitempty"`
+	Cmdline []string `json:"cmdline,omitempty"`
+}
+
+// ConnRecord is the record of a connection relayed by the proxy.
+type ConnRecord struct {
+	ID       uint64        `json:"id"`
+	Pid      int           `json:"pid,omitempty"`
+	Exe      string        `json:"exe,omitempty"`
+	Cmdline  []string      `json:"cmdline,omitempty"`
+	Network  string        `json:"network"`
+	Target   string        `json:"target"`
+	Node     string        `json:"node"`
+	Upload   int64         `json:"upload"`
+	Download int64         `json:"download"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"` // nanoseconds
+	Error    string        `json:"error,omitempty"`
+}
+
+// DestinationSummary sums up the connections to a destination.
+type DestinationSummary struct {
+	Network     string
+	Target      string
+	Connections int
+	Errors      int
+	Upload      int64
+	Download    int64
+	Duration    time.Duration
+}
+
+// TrackedConn is a connection being tracked. Nil is valid and tracks nothing.
+type TrackedConn struct {
+	mu       sync.Mutex
+	record   ConnRecord
+	closed   bool
+	closer   func() error
+	upload   atomic.Int64
+	download atomic.Int64
+	onClose  []func(c *TrackedConn)
+}
+
+func (c *TrackedConn) AddUpload(n int) {
+	if c == nil {
+		return
+	}
+	c.upload.Add(int64(n))
+}
+
+func (c *TrackedConn) AddDownload(n int) {
+	if c == nil {
+		return
+	}
+	c.download.Add(int64(n))
+}
+
+// SetCloser sets the function to close the connection by Kill.
+func (c *TrackedConn) SetCloser(closer func() error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closer = closer
+}
+
+// Kill closes the connection.
+func (c *TrackedConn) Kill() error {
+	c.mu.Lock()
+	closer := c.closer
+	c.mu.Unlock()
+	if closer == nil {
+		return fmt.Errorf("the connection cannot be closed")
+	}
+	return closer()
+}
+
+// Record returns the snapshot of the record.
+func (c *TrackedConn) Record() ConnRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.record
+	r.Upload = c.upload.Load()
+	r.Download = c.download.Load()
+	if !c.closed {
+		r.Duration = time.Since(r.Start)
+	}
+	return r
+}
+
+// Close finishes the record with err. It is idempotent.
+func (c *TrackedConn) Close(err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.record.Duration = time.Since(c.record.Start)
+	if err != nil {
+		c.record.Error = err.Error()
+	}
+	c.mu.Unlock()
+	for _, f := range c.onClose {
+		f(c)
+	}
+}
+
+// Traffic is the total traffic of connections.
+type Traffic struct {
+	Connections int64 `json:"connections"`
+	Live        int   `json:"live"`
+	Errors      int64 `json:"errors"`
+	Upload      int64 `json:"upload"`
+	Download    int64 `json:"download"`
+}
+
+// Stats records the connections relayed by the proxy. It is thread-safe.
+type Stats struct {
+	mu          sync.Mutex
+	live        map[uint64]*TrackedConn
+	finished    []ConnRecord
+	maxFinished int
+	total       Traffic // total of the finished connections
+}
+
+// NewStats returns a Stats keeping at most maxFinished records of finished connections, and 0 means unlimited.
+// The oldest records are dropped first, but they are still counted in the Traffic.
+func NewStats(maxFinished int) *Stats {
+	return &Stats{
+		live:        make(map[uint64]*TrackedConn),
+		maxFinished: maxFinished,
+	}
+}
+
+func (s *Stats) add(c *TrackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live[c.record.ID] = c
+	c.onClose = append(c.onClose, s.finish)
+}
+
+func (s *Stats) finish(c *TrackedConn) {
+	r := c.Record()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.live, r.ID)
+	s.finished = append(s.finished, r)
+	if s.maxFinished > 0 && len(s.finished) > s.maxFinished {
+		n := copy(s.finished, s.finished[len(s.finished)-s.maxFinished:])
+		clear(s.finished[n:])
+		s.finished = s.finished[:n]
+	}
+	s.total.Connections++
+	if r.Error != "" {
+		s.total.Errors++
+	}
+	s.total.Upload += r.Upload
+	s.total.Download += r.Download
+}
+
+// Live returns the records of live connections sorted by ID.
+func (s *Stats) Live() []ConnRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]ConnRecord, 0, len(s.live))
+	for _, c := range s.live {
+		records = append(records, c.Record())
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
+
+// Traffic returns the total traffic of finished and live connections.
+func (s *Stats) Traffic() Traffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.total
+	t.Live = len(s.live)
+	for _, c := range s.live {
+		t.Connections++
+		t.Upload += c.upload.Load()
+		t.Download += c.download.Load()
+	}
+	return t
+}
+
+// ErrConnNotFound means that there is no such live connection.
+var ErrConnNotFound = fmt.Errorf("connection not found")
+
+// CloseConn closes the live connection with the id.
+func (s *Stats) CloseConn(id uint64) error {
+	s.mu.Lock()
+	c, ok := s.live[id]
+	s.mu.Unlock()
+	if !ok {
+		return ErrConnNotFound
+	}
+	return c.Kill()
+}
+
+// Records returns the finished and live records sorted by ID.
+func (s *Stats) Records() []ConnRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]ConnRecord, 0, len(s.finished)+len(s.live))
+	records = append(records, s.finished...)
+	for _, c := range s.live {
+		records = append(records, c.Record())
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
+
+// Summary sums up the records by destination, in descending order of the traffic.
+func (s *Stats) Summary() []DestinationSummary {
+	m := make(map[[2]string]*DestinationSummary)
+	var summaries []*DestinationSummary
+	for _, r := range s.Records() {
+		key := [2]string{r.Network, r.Target}
+		sum, ok := m[key]
+		if !ok {
+			sum = &DestinationSummary{Network: r.Network, Target: r.Target}
+			m[key] = sum
+			summaries = append(summaries, sum)
+		}
+		sum.Connections++
+		if r.Error != "" {
+			sum.Errors++
+		}
+		sum.Upload += r.Upload
+		sum.Download += r.Download
+		sum.Duration += r.Duration
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Upload+summaries[i].Download > summaries[j].Upload+summaries[j].Download
+	})
+	result := make([]DestinationSummary, 0, len(summaries))
+	for _, sum := range summaries {
+		result = append(result, *sum)
+	}
+	return result
+}
+
+// WriteTable writes the summary as a table.
+func (s *Stats) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tTARGET\tCONNS\tERRORS\tUPLOAD\tDOWNLOAD\tDURATION")
+	for _, sum := range s.Summary() {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			sum.Network,
+			sum.Target,
+			sum.Connections,
+			sum.Errors,
+			common.FormatBytes(sum.Upload),
+			common.FormatBytes(sum.Download),
+			sum.Duration.Round(time.Millisecond),
+		)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes all records as a JSON array.
+func (s *Stats) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s.Records())
+}
+
+// countedConn counts the bytes read as upload and written as download, and captures them to flow.
+// tracked and flow may be nil.
+type countedConn struct {
+	net.Conn
+	tracked *TrackedConn
+	flow    *tcpFlow
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tracked.AddUpload(n)
+	metrics.TCPUpload.Add(n)
+	c.flow.Payload(true, b[:n])
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.tracked.AddDownload(n)
+	metrics.TCPDownload.Add(n)
+	c.flow.Payload(false, b[:n])
+	return n, err
+}
+
+func (c *countedConn) CloseWrite() error {
+	if wc, ok := c.Conn.(WriteCloser); ok {
+		return wc.CloseWrite()
+	}
+	return nil
+}
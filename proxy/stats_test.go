@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	network  string
+	target   string
+	exe      string
+	pid      int
+	upload   int
+	download int
+	err      error
+	live     bool
+}
+
+// trackAll tracks the connections by the callbacks and closes the ones not live, in order.
+func trackAll(conns []testConn, adds ...func(c *TrackedConn)) []*TrackedConn {
+	var tracked []*TrackedConn
+	for i, tc := range conns {
+		c := &TrackedConn{record: ConnRecord{
+			ID:      uint64(i + 1),
+			Pid:     tc.pid,
+			Exe:     tc.exe,
+			Network: tc.network,
+			Target:  tc.target,
+			Start:   time.Now(),
+		}}
+		for _, add := range adds {
+			add(c)
+		}
+		c.AddUpload(tc.upload)
+		c.AddDownload(tc.download)
+		if !tc.live {
+			c.Close(tc.err)
+		}
+		tracked = append(tracked, c)
+	}
+	return tracked
+}
+
+func TestStats(t *testing.T) {
+	conns := []testConn{
+		{network: "tcp", target: "1.1.1.1:443", upload: 10, download: 100},
+		{network: "tcp", target: "example.com:80", upload: 1, download: 2, err: errors.New("refused")},
+		{network: "tcp", target: "1.1.1.1:443", upload: 20, download: 200, live: true},
+		{network: "udp", target: "1.1.1.1:443", upload: 5, download: 5},
+		{network: "tcp", target: "example.com:80", upload: 1000, download: 0},
+	}
+	for _, c := range []struct {
+		name        string
+		maxFinished int
+		traffic     Traffic
+		summary     []DestinationSummary
+		ids         []uint64
+	}{
+		{
+			name:    "unlimited",
+			traffic: Traffic{Connections: 5, Live: 1, Errors: 1, Upload: 1036, Download: 307},
+			summary: []DestinationSummary{
+				{Network: "tcp", Target: "example.com:80", Connections: 2, Errors: 1, Upload: 1001, Download: 2},
+				{Network: "tcp", Target: "1.1.1.1:443", Connections: 2, Upload: 30, Download: 300},
+				{Network: "udp", Target: "1.1.1.1:443", Connections: 1, Upload: 5, Download: 5},
+			},
+			ids: []uint64{1, 2, 3, 4, 5},
+		},
+		{
+			// the dropped records are still counted in the traffic
+			name:        "max finished",
+			maxFinished: 2,
+			traffic:     Traffic{Connections: 5, Live: 1, Errors: 1, Upload: 1036, Download: 307},
+			summary: []DestinationSummary{
+				{Network: "tcp", Target: "example.com:80", Connections: 1, Upload: 1000},
+				{Network: "tcp", Target: "1.1.1.1:443", Connections: 1, Upload: 20, Download: 200},
+				{Network: "udp", Target: "1.1.1.1:443", Connections: 1, Upload: 5, Download: 5},
+			},
+			ids: []uint64{3, 4, 5},
+		},
+	} {
+		s := NewStats(c.maxFinished)
+		tracked := trackAll(conns, s.add)
+		if traffic := s.Traffic(); traffic != c.traffic {
+			t.Errorf("%v: traffic %+v, want %+v", c.name, traffic, c.traffic)
+		}
+		summary := s.Summary()
+		for i := range summary {
+			summary[i].Duration = 0
+		}
+		if !reflect.DeepEqual(summary, c.summary) {
+			t.Errorf("%v: summary %+v, want %+v", c.name, summary, c.summary)
+		}
+		var ids []uint64
+		for _, r := range s.Records() {
+			ids = append(ids, r.ID)
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%v: records %v, want %v", c.name, ids, c.ids)
+		}
+		if live := s.Live(); len(live) != 1 || live[0].ID != 3 || live[0].Upload != 20 {
+			t.Errorf("%v: unexpected live records: %+v", c.name, live)
+		}
+
+		// the live one is finished by the closer
+		tracked[2].SetCloser(func() error {
+			tracked[2].Close(nil)
+			return nil
+		})
+		if err := s.CloseConn(3); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CloseConn(3); !errors.Is(err, ErrConnNotFound) {
+			t.Errorf("%v: unexpected error: %v", c.name, err)
+		}
+		if traffic := s.Traffic(); traffic.Live != 0 || traffic.Connections != 5 || traffic.Upload != 1036 {
+			t.Errorf("%v: unexpected traffic: %+v", c.name, traffic)
+		}
+		var records []ConnRecord
+		var buf bytes.Buffer
+		if err := s.WriteJSON(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(buf.Bytes(), &records); err != nil || len(records) != len(s.Records()) {
+			t.Errorf("%v: unexpected JSON: %v %v", c.name, buf.String(), err)
+		}
+	}
+}
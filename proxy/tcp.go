@@ -3,32 +3,63 @@ package proxy
 import (
 	"errors"
 	"fmt"
+	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/metrics"
 	io2 "github.com/mzz2017/softwind/pkg/zeroalloc/io"
 	"net"
-	"net/netip"
 	"time"
 )
 
 func (p *Proxy) handleTCP(conn net.Conn) error {
-	defer conn.Close()
-	loopback, _ := netip.AddrFromSlice(conn.LocalAddr().(*net.TCPAddr).IP)
-	tgt := p.GetProjection(loopback)
-	if tgt == "" {
-		return fmt.Errorf("mapped target address not found: %v", loopback)
+	dst := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	tgt, owner, err := p.accept("tcp", dst, conn.RemoteAddr().(*net.TCPAddr).AddrPort(), true)
+	if err != nil {
+		conn.Close()
+		return err
 	}
+	defer p.retainProjection(dst.Addr())()
+	return p.HandleTCP(conn, tgt, owner)
+}
+
+// HandleTCP relays the connection to tgt through the dialer. process is the owner of conn, or nil if unknown.
+func (p *Proxy) HandleTCP(conn net.Conn, tgt string, process *Process) error {
+	defer conn.Close()
 	p.log.Tracef("received tcp: %v, tgt: %v", conn.RemoteAddr().String(), tgt)
-	c, err := p.dialer.Dial("tcp", tgt)
+	metrics.TCPSessions.Inc()
+	metrics.TCPSessionsActive.Inc()
+	defer metrics.TCPSessionsActive.Dec()
+	d := p.Dialer()
+	tracked := p.track(process, "tcp", tgt, d)
+	c, err := d.Dial("tcp", tgt)
 	if err != nil {
+		tracked.Close(err)
+		if errors.Is(err, dialer.BlockedErr) {
+			p.log.Infof("handleTCP: %v", err)
+			return nil
+		}
 		return err
 	}
 	defer c.Close()
-	if err = RelayTCP(conn, c); err != nil {
+	defer p.addRelay(conn, c)()
+	flow := p.captureTCP(conn.RemoteAddr(), tgt, nodeName(d), process)
+	defer flow.Close()
+	lConn := &countedConn{Conn: conn, tracked: tracked, flow: flow}
+	if tracked != nil {
+		tracked.SetCloser(func() error {
+			c.Close()
+			return conn.Close()
+		})
+	}
+	if err = RelayTCP(lConn, c); err != nil {
 		var netErr net.Error
 		if errors.As(err, &netErr) && netErr.Timeout() {
+			tracked.Close(nil)
 			return nil // ignore i/o timeout
 		}
+		tracked.Close(err)
 		return fmt.Errorf("handleTCP relay error: %w", err)
 	}
+	tracked.Close(nil)
 	return nil
 }
 
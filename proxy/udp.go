@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mzz2017/gg/dialer"
 	"github.com/mzz2017/gg/infra/ip_mtu_trie"
+	"github.com/mzz2017/gg/metrics"
 	"github.com/mzz2017/softwind/pool"
 	"github.com/mzz2017/softwind/protocol/shadowsocks"
 	"golang.org/x/net/dns/dnsmessage"
@@ -11,6 +13,9 @@ import (
 	"net/netip"
 	"strings"
 	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -25,32 +30,84 @@ type HijackResp struct {
 	AnsIP  netip.Addr
 }
 
-func (p *Proxy) handleUDP(lAddr net.Addr, data []byte) (err error) {
-	loopback, _ := netip.AddrFromSlice(lAddr.(*net.UDPAddr).IP)
-	tgt := p.GetProjection(loopback)
-	if tgt == "" {
-		return fmt.Errorf("mapped target address not found: %v", loopback)
+// handleUDP handles the datagram data from lAddr to the projection loopback, which is received by lu.
+func (p *Proxy) handleUDP(lu *net.UDPConn, lAddr net.Addr, loopback netip.Addr, data []byte) (err error) {
+	p.nm.Lock()
+	_, mapped := p.nm.Get(lAddr.String())
+	p.nm.Unlock()
+	// the senders of the established mappings have been authenticated
+	dst := netip.AddrPortFrom(loopback, uint16(lu.LocalAddr().(*net.UDPAddr).Port))
+	tgt, owner, err := p.accept("udp", dst, lAddr.(*net.UDPAddr).AddrPort(), !mapped)
+	if err != nil {
+		return err
+	}
+	release := p.retainProjection(loopback)
+	err = p.HandleUDP(&replyConn{UDPConn: lu, src: loopback}, lAddr, tgt, data, owner)
+	// the projection is kept until the mapping is removed
+	p.nm.Lock()
+	if conn, ok := p.nm.Get(lAddr.String()); ok && conn.PacketConn != nil && conn.Release == nil {
+		conn.Release, release = release, nil
+	}
+	p.nm.Unlock()
+	if release != nil {
+		release()
 	}
+	return err
+}
+
+// replyConn writes the responses to the program from the projection src that the program sent the datagrams to, so
+// that they are accepted by the connected sockets.
+type replyConn struct {
+	*net.UDPConn
+	src netip.Addr
+}
+
+func (c *replyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, _, err := c.WriteMsgUDP(b, srcControl(c.UDPConn, c.src), addr.(*net.UDPAddr))
+	return n, err
+}
+
+// srcControl returns the control message to send the datagram from src by conn set by setRecvDst.
+func srcControl(conn *net.UDPConn, src netip.Addr) []byte {
+	var level, typ, size int
+	var data unsafe.Pointer
+	if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		// not a dual-stack socket
+		info := unix.Inet4Pktinfo{Spec_dst: src.Unmap().As4()}
+		level, typ, size, data = unix.IPPROTO_IP, unix.IP_PKTINFO, unix.SizeofInet4Pktinfo, unsafe.Pointer(&info)
+	} else {
+		info := unix.Inet6Pktinfo{Addr: src.As16()}
+		level, typ, size, data = unix.IPPROTO_IPV6, unix.IPV6_PKTINFO, unix.SizeofInet6Pktinfo, unsafe.Pointer(&info)
+	}
+	b := make([]byte, unix.CmsgSpace(size))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = int32(level), int32(typ)
+	h.SetLen(unix.CmsgLen(size))
+	copy(b[unix.CmsgLen(0):], unsafe.Slice((*byte)(data), size))
+	return b
+}
+
+// HandleUDP relays the datagram data from lAddr to tgt through the dialer, and the responses are written to lAddr
+// by conn. DNS queries are hijacked. process is the sender of data, or nil if unknown.
+func (p *Proxy) HandleUDP(conn net.PacketConn, lAddr net.Addr, tgt string, data []byte, process *Process) (err error) {
 	p.log.Tracef("received udp: %v, tgt: %v", lAddr.String(), tgt)
+	p.captureUDP(lAddr, tgt, true, data)
 	if hijackResp, isDNSQuery := p.hijackDNS(data); isDNSQuery {
 		if hijackResp != nil {
 			switch hijackResp.Type {
 			case dnsmessage.TypeAAAA:
 				// TODO: support to restore INET6 ICMP target
-				_, err = p.udpConn.WriteTo(hijackResp.Resp, lAddr)
-				return err
+				return p.reply(conn, lAddr, tgt, hijackResp.Resp)
 			case dnsmessage.TypeA:
 				respData, respMsg, e := forwardDNSMessage(tgt, data)
 				if e != nil {
 					p.log.Tracef("will not restore INET4 ICMP target: forwardDNSMessage: %v", e)
-					_, err = p.udpConn.WriteTo(hijackResp.Resp, lAddr)
-					return err
+					return p.reply(conn, lAddr, tgt, hijackResp.Resp)
 				}
 				if len(respMsg.Answers) == 0 {
 					// no answer
 					p.log.Tracef("tgt dns response with no answer")
-					_, err = p.udpConn.WriteTo(respData, lAddr)
-					return err
+					return p.reply(conn, lAddr, tgt, respData)
 				}
 				// we only pick the first A answer
 				var realAnsA *dnsmessage.AResource
@@ -69,30 +126,28 @@ func (p *Proxy) handleUDP(lAddr net.Addr, data []byte) (err error) {
 					p.realIPMapper.Set(hijackResp.AnsIP, ip)
 					p.log.Tracef("fakeIP:(%v) realIP:(%v)", hijackResp.AnsIP, ip)
 				}
-				_, err = p.udpConn.WriteTo(hijackResp.Resp, lAddr)
-				return err
+				return p.reply(conn, lAddr, tgt, hijackResp.Resp)
 			}
 			// TODO: try to send from original address if the socket uses bind.
 			// 		But to archive it, we need bind permission.
 			//		Is it worth it?
 		}
 		// is other DNS request type
-		if d, ok := p.dialer.(*dialer.Dialer); ok && !d.SupportUDP() {
+		if d, ok := p.Dialer().(*dialer.Dialer); ok && !d.SupportUDP() {
 			// bypass
 			respData, _, err := forwardDNSMessage(tgt, data)
 			if err != nil {
 				return fmt.Errorf("forwardDNSMessage: %w", err)
 			}
-			_, err = p.udpConn.WriteTo(respData, lAddr)
-			return err
+			return p.reply(conn, lAddr, tgt, respData)
 		}
 		// continue to forward DNS request but use replaced DNS server.
 		tgt = "1.1.1.1:53"
 	}
-	if d, ok := p.dialer.(*dialer.Dialer); ok && !d.SupportUDP() {
+	if d, ok := p.Dialer().(*dialer.Dialer); ok && !d.SupportUDP() {
 		return fmt.Errorf("receive an unexpected UDP request to target %v: dialer does not support UDP", tgt)
 	}
-	rc, err := p.GetOrBuildUDPConn(lAddr, tgt, data)
+	rc, err := p.GetOrBuildUDPConn(conn, lAddr, tgt, data, process)
 	if err != nil {
 		return fmt.Errorf("auth fail from: %v: %w", lAddr.String(), err)
 	}
@@ -104,9 +159,18 @@ func (p *Proxy) handleUDP(lAddr net.Addr, data []byte) (err error) {
 	if _, err = rc.WriteTo(data, targetAddr); err != nil {
 		return fmt.Errorf("write error: %w", err)
 	}
+	rc.Tracked.AddUpload(len(data))
+	metrics.UDPUpload.Add(len(data))
 	return nil
 }
 
+// reply sends the response of the target to the program.
+func (p *Proxy) reply(conn net.PacketConn, lAddr net.Addr, target string, b []byte) error {
+	p.captureUDP(lAddr, target, false, b)
+	_, err := conn.WriteTo(b, lAddr)
+	return err
+}
+
 func (p *Proxy) hijackDNS(data []byte) (resp *HijackResp, isDNSQuery bool) {
 	var dmsg dnsmessage.Message
 	if dmsg.Unpack(data) != nil {
@@ -120,10 +184,13 @@ func (p *Proxy) hijackDNS(data []byte) (resp *HijackResp, isDNSQuery bool) {
 	q := dmsg.Questions[0]
 	var domain string
 	var ans netip.Addr
+	var err error
 	switch q.Type {
 	case dnsmessage.TypeAAAA:
 		domain = strings.TrimSuffix(q.Name.String(), ".")
-		ans = p.AllocProjection(domain)
+		if ans, err = p.AllocProjection(domain); err != nil {
+			return nil, true
+		}
 		// 6in4
 		dmsg.Answers = []dnsmessage.Resource{{
 			Header: dnsmessage.ResourceHeader{
@@ -135,7 +202,9 @@ func (p *Proxy) hijackDNS(data []byte) (resp *HijackResp, isDNSQuery bool) {
 		}}
 	case dnsmessage.TypeA:
 		domain = strings.TrimSuffix(q.Name.String(), ".")
-		ans = p.AllocProjection(domain)
+		if ans, err = p.AllocProjection(domain); err != nil {
+			return nil, true
+		}
 		dmsg.Answers = []dnsmessage.Resource{{
 			Header: dnsmessage.ResourceHeader{
 				Name:  q.Name,
@@ -148,6 +217,7 @@ func (p *Proxy) hijackDNS(data []byte) (resp *HijackResp, isDNSQuery bool) {
 	switch q.Type {
 	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
 		p.log.Tracef("hijackDNS: lookup: %v to %v", q.Name.String(), ans.String())
+		metrics.DNSHijacks.Inc()
 		dmsg.RCode = dnsmessage.RCodeSuccess
 		dmsg.Response = true
 		dmsg.RecursionAvailable = true
@@ -183,8 +253,9 @@ func selectTimeout(packet []byte) time.Duration {
 	return SelectTimeout(packet)
 }
 
-// GetOrBuildUDPConn get a UDP conn from the mapping.
-func (p *Proxy) GetOrBuildUDPConn(lAddr net.Addr, target string, data []byte) (rc net.PacketConn, err error) {
+// GetOrBuildUDPConn get a UDP conn from the mapping. process is the sender of the data, or nil if unknown.
+// The responses are written to lAddr by reply.
+func (p *Proxy) GetOrBuildUDPConn(reply net.PacketConn, lAddr net.Addr, target string, data []byte, process *Process) (rc *UDPConn, err error) {
 	var conn *UDPConn
 	var ok bool
 
@@ -196,24 +267,41 @@ func (p *Proxy) GetOrBuildUDPConn(lAddr net.Addr, target string, data []byte) (r
 		p.nm.Unlock()
 
 		// dial
-		c, err := p.dialer.Dial("udp", target)
+		d := p.Dialer()
+		tracked := p.track(process, "udp", target, d)
+		c, err := d.Dial("udp", target)
 		if err != nil {
+			tracked.Close(err)
 			p.nm.Lock()
 			p.nm.Remove(connIdent) // close channel to inform that establishment ends
 			p.nm.Unlock()
 			return nil, fmt.Errorf("GetOrBuildUDPConn dial error: %w", err)
 		}
-		rc = c.(net.PacketConn)
 		p.nm.Lock()
 		p.nm.Remove(connIdent) // close channel to inform that establishment ends
-		conn = p.nm.Insert(connIdent, rc)
+		conn = p.nm.Insert(connIdent, c.(net.PacketConn))
 		conn.Timeout = selectTimeout(data)
+		conn.Tracked = tracked
+		conn.Target = target
+		conn.Reply = reply
+		tracked.SetCloser(conn.Close)
+		rc = conn
 		p.nm.Unlock()
+		metrics.UDPSessions.Inc()
+		metrics.UDPSessionsActive.Inc()
 		// relay
 		go func() {
-			if e := p.relayUDP(lAddr, rc, conn.Timeout); e != nil {
+			defer metrics.UDPSessionsActive.Dec()
+			e := p.relayUDP(lAddr, conn, conn.Timeout)
+			if e != nil {
 				p.log.Tracef("shadowsocks.udp.relay: %v", e)
 			}
+			var netErr net.Error
+			if (errors.As(e, &netErr) && netErr.Timeout()) || errors.Is(e, net.ErrClosed) {
+				// the NAT mapping expired or was removed as usual
+				e = nil
+			}
+			tracked.Close(e)
 			p.nm.Lock()
 			p.nm.Remove(connIdent)
 			p.nm.Unlock()
@@ -224,10 +312,10 @@ func (p *Proxy) GetOrBuildUDPConn(lAddr net.Addr, target string, data []byte) (r
 		<-conn.Establishing
 		if conn.PacketConn == nil {
 			// establishment ended and retrieve the result
-			return p.GetOrBuildUDPConn(lAddr, target, data)
+			return p.GetOrBuildUDPConn(reply, lAddr, target, data, process)
 		} else {
 			// establishment succeeded
-			rc = conn.PacketConn
+			rc = conn
 		}
 	}
 	// countdown
@@ -235,28 +323,77 @@ func (p *Proxy) GetOrBuildUDPConn(lAddr net.Addr, target string, data []byte) (r
 	return rc, nil
 }
 
-func (p *Proxy) relayUDP(laddr net.Addr, rConn net.PacketConn, timeout time.Duration) (err error) {
+func (p *Proxy) relayUDP(laddr net.Addr, rConn *UDPConn, timeout time.Duration) (err error) {
 	buf := pool.Get(ip_mtu_trie.MTUTrie.GetMTU(rConn.LocalAddr().(*net.UDPAddr).IP))
 	defer pool.Put(buf)
-	var n int
+	var (
+		n    int
+		from net.Addr
+	)
 	for {
 		p.log.Tracef("readfrom...")
 		_ = rConn.SetReadDeadline(time.Now().Add(timeout))
-		n, _, err = rConn.ReadFrom(buf)
+		n, from, err = rConn.ReadFrom(buf)
 		if err != nil {
-			return fmt.Errorf("rConn.ReadFrom: %v", err)
+			return fmt.Errorf("rConn.ReadFrom: %w", err)
 		}
 		p.log.Tracef("readfrom: %v", buf[:n])
 		//var dmsg dnsmessage.Message
 		//if err := dmsg.Unpack(buf[:n]); err == nil {
 		//	p.log.Traceln(dmsg)
 		//}
-		_ = p.udpConn.SetWriteDeadline(time.Now().Add(DefaultNatTimeout)) // should keep consistent
-		_, err = p.udpConn.WriteTo(buf[:n], laddr)
+		_ = rConn.Reply.SetWriteDeadline(time.Now().Add(DefaultNatTimeout)) // should keep consistent
+		if p.capture != nil {
+			target := rConn.Target
+			if addr, ok := from.(*net.UDPAddr); ok {
+				target = addr.String()
+			}
+			p.captureUDP(laddr, target, false, buf[:n])
+		}
+		_, err = rConn.Reply.WriteTo(buf[:n], laddr)
 		if err != nil {
 			return
 		}
+		rConn.Tracked.AddDownload(n)
+		metrics.UDPDownload.Add(n)
+	}
+}
+
+// setRecvDst makes conn receive the destination addresses of the datagrams, which are the projections. The source
+// addresses of the datagrams to 127.0.0.0/8 are 127.0.0.1.
+func setRecvDst(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if e := rawConn.Control(func(fd uintptr) {
+		if err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1); err != nil {
+			// not a dual-stack socket
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+		}
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// parseDst parses the destination address from the control messages received by the conn set by setRecvDst.
+func parseDst(oob []byte) (dst netip.Addr, ok bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_PKTINFO && len(msg.Data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return netip.AddrFrom16(info.Addr).Unmap(), true
+		case msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_PKTINFO && len(msg.Data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return netip.AddrFrom4(info.Addr), true
+		}
 	}
+	return netip.Addr{}, false
 }
 
 func forwardDNSMessage(tgt string, msg []byte) ([]byte, *dnsmessage.Message, error) {
@@ -9,6 +9,10 @@ import (
 type UDPConn struct {
 	Establishing chan struct{}
 	Timeout      time.Duration
+	Tracked      *TrackedConn
+	Target       string         // the target at the establishment
+	Reply        net.PacketConn // the conn to write the responses to the program
+	Release      func()         // Release releases what the mapping holds when removed, or nil
 	net.PacketConn
 }
 
@@ -58,8 +62,16 @@ func (m *UDPConnMapping) Remove(key string) {
 	select {
 	case <-v.Establishing:
 		_ = v.Close()
+		if v.Release != nil {
+			v.Release()
+		}
 	default:
 		close(v.Establishing)
 	}
 	delete(m.nm, key)
 }
+
+// Len returns the number of mappings. m must be locked.
+func (m *UDPConnMapping) Len() int {
+	return len(m.nm)
+}
@@ -0,0 +1,142 @@
+// Package sandbox decides which destinations the traced programs are allowed to connect to.
+package sandbox
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Rule matches destinations by host and port. An empty host or zero port range matches any.
+//
+//	example.com           the domain and its subdomains
+//	10.0.0.0/8            the IP prefix
+//	1.2.3.4               the IP
+//	:443                  the port on any host
+//	example.com:443       the port on the domain
+//	[2001:db8::/32]:22    the port on the IPv6 prefix
+//	:8000-8999            the port range on any host
+type Rule struct {
+	Domain  string
+	Prefix  netip.Prefix
+	MinPort uint16
+	MaxPort uint16
+}
+
+func ParseRule(s string) (r Rule, err error) {
+	host, ports := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return Rule{}, fmt.Errorf("missing ']'")
+		}
+		host = s[1:end]
+		if rest := s[end+1:]; rest != "" {
+			var ok bool
+			if ports, ok = strings.CutPrefix(rest, ":"); !ok || ports == "" {
+				return Rule{}, fmt.Errorf("bad port")
+			}
+		}
+	} else if strings.Count(s, ":") == 1 {
+		host, ports, _ = strings.Cut(s, ":")
+		if ports == "" {
+			return Rule{}, fmt.Errorf("empty port")
+		}
+	}
+	if ports != "" {
+		min, max, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			max = min
+		}
+		minPort, err := strconv.ParseUint(min, 10, 16)
+		if err != nil {
+			return Rule{}, fmt.Errorf("bad port: %v", ports)
+		}
+		maxPort, err := strconv.ParseUint(max, 10, 16)
+		if err != nil || maxPort < minPort {
+			return Rule{}, fmt.Errorf("bad port: %v", ports)
+		}
+		r.MinPort, r.MaxPort = uint16(minPort), uint16(maxPort)
+	}
+	switch {
+	case host == "":
+		if ports == "" {
+			return Rule{}, fmt.Errorf("empty rule")
+		}
+	case strings.Contains(host, "/"):
+		if r.Prefix, err = netip.ParsePrefix(host); err != nil {
+			return Rule{}, err
+		}
+		r.Prefix = r.Prefix.Masked()
+	default:
+		if ip, err := netip.ParseAddr(host); err == nil {
+			r.Prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		} else {
+			r.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "*."), "."))
+		}
+	}
+	return r, nil
+}
+
+// Match reports whether the rule matches the host, which is an IP or a domain, and the port.
+func (r Rule) Match(host string, port uint16) bool {
+	if r.MaxPort != 0 && (port < r.MinPort || port > r.MaxPort) {
+		return false
+	}
+	switch {
+	case r.Prefix.IsValid():
+		ip, err := netip.ParseAddr(host)
+		return err == nil && r.Prefix.Contains(ip.Unmap())
+	case r.Domain != "":
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		return host == r.Domain || strings.HasSuffix(host, "."+r.Domain)
+	}
+	return true
+}
+
+// Allowlist allows the destinations matching any of its rules.
+type Allowlist []Rule
+
+// Parse parses the rules, each of which can be separated by commas.
+// The result is not nil even if there is no rule.
+func Parse(rules []string) (Allowlist, error) {
+	a := Allowlist{}
+	for _, rules := range rules {
+		for _, s := range strings.Split(rules, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			r, err := ParseRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad rule %q: %w", s, err)
+			}
+			a = append(a, r)
+		}
+	}
+	return a, nil
+}
+
+// Allow reports whether the destination host:port is allowed.
+func (a Allowlist) Allow(host string, port uint16) bool {
+	for _, r := range a {
+		if r.Match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowAddr is like Allow but takes an address like "example.com:443".
+func (a Allowlist) AllowAddr(addr string) bool {
+	host, strPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.ParseUint(strPort, 10, 16)
+	if err != nil {
+		return false
+	}
+	return a.Allow(host, uint16(port))
+}
@@ -0,0 +1,43 @@
+package sandbox
+
+import "testing"
+
+func TestAllowlist(t *testing.T) {
+	a, err := Parse([]string{"example.com, 10.0.0.0/8:22", "[2001:db8::/32]:443,:8000-8999", "1.2.3.4", "[::1]", "*.test.org:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host    string
+		port    uint16
+		allowed bool
+	}{
+		{"example.com", 443, true},
+		{"api.Example.com.", 80, true},
+		{"badexample.com", 443, false},
+		{"10.1.2.3", 22, true},
+		{"10.1.2.3", 23, false},
+		{"2001:db8::1", 443, true},
+		{"2001:db9::1", 443, false},
+		{"192.168.0.1", 8080, true},
+		{"192.168.0.1", 9000, false},
+		{"1.2.3.4", 1, true},
+		{"::ffff:1.2.3.4", 1, true},
+		{"::1", 53, true},
+		{"www.test.org", 80, true},
+		{"test.org", 443, false},
+	}
+	for _, c := range cases {
+		if allowed := a.Allow(c.host, c.port); allowed != c.allowed {
+			t.Errorf("Allow(%v, %v) = %v", c.host, c.port, allowed)
+		}
+	}
+}
+
+func TestParseRuleError(t *testing.T) {
+	for _, s := range []string{"example.com:", ":", "[::1", "[::1]443", ":99999", ":20-10", "10.0.0.0/33"} {
+		if _, err := ParseRule(s); err == nil {
+			t.Errorf("ParseRule(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// processVM is whether process_vm_readv(2) and process_vm_writev(2) are available, which access the memory of the
+// tracees from any thread in one syscall, instead of PTRACE_PEEKDATA and PTRACE_POKEDATA for each word from the
+// tracer thread. The stops are handled in other goroutines only if it is true.
+var processVM = vmAvailable()
+
+func vmAvailable() bool {
+	var src, dst [1]byte
+	_, err := unix.ProcessVMReadv(syscall.Getpid(), localIovec(dst[:]), []unix.RemoteIovec{{Base: uintptr(unsafe.Pointer(&src[0])), Len: 1}}, 0)
+	return err == nil
+}
+
+// processVMReadv is unix.ProcessVMReadv for peekData, which the tests make fail.
+var processVMReadv = unix.ProcessVMReadv
+
+// offTracerThreadErr is returned by peekData if the memory can only be read by PTRACE_PEEKDATA off the tracer thread.
+var offTracerThreadErr = fmt.Errorf("PTRACE_PEEKDATA off the tracer thread")
+
+// peekData reads the memory of the tracee at addr. It falls back to PTRACE_PEEKDATA, which only works on the
+// tracer thread, so offTracerThreadErr is returned instead if not onTracer.
+func peekData(pid int, addr uintptr, b []byte, onTracer bool) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if !processVM {
+		_, err := syscall.PtracePeekData(pid, addr, b)
+		return err
+	}
+	n, err := processVMReadv(pid, localIovec(b), []unix.RemoteIovec{{Base: addr, Len: len(b)}}, 0)
+	if err == nil && n == len(b) {
+		return nil
+	}
+	if err == nil {
+		err = syscall.EFAULT
+	}
+	if !errors.Is(err, syscall.ENOSYS) && !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+	if !onTracer {
+		return fmt.Errorf("%w: process_vm_readv: %w", offTracerThreadErr, err)
+	}
+	_, err = syscall.PtracePeekData(pid, addr, b)
+	return err
+}
+
+// pokeData writes the memory of the tracee at addr. It falls back to PTRACE_POKEDATA, which only works on the
+// tracer thread, but can write to read-only pages such as a constant sockaddr.
+func pokeData(pid int, addr uintptr, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if !processVM {
+		_, err := syscall.PtracePokeData(pid, addr, b)
+		return err
+	}
+	n, err := unix.ProcessVMWritev(pid, localIovec(b), []unix.RemoteIovec{{Base: addr, Len: len(b)}}, 0)
+	if err == nil && n == len(b) {
+		return nil
+	}
+	_, err = syscall.PtracePokeData(pid, addr, b)
+	return err
+}
+
+func localIovec(b []byte) []unix.Iovec {
+	return []unix.Iovec{getIovec(&b[0], len(b))}
+}
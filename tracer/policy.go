@@ -0,0 +1,71 @@
+package tracer
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+)
+
+// action returns the action of the policy to the process that the thread pid belongs to.
+func (t *Tracer) action(pid int) policy.Action {
+	if len(t.policy) == 0 {
+		return policy.ActionProxy
+	}
+	p := t.process(pid)
+	return t.policy.Action(p.Exe, p.Cmdline)
+}
+
+// applyPolicy takes the action of the policy other than proxying. It returns the address to poke for bypassing,
+// which is nil if not changed, and whether the syscall has been handled.
+func (t *Tracer) applyPolicy(s *stop, socketInfo *SocketMetadata, bSockAddr []byte) (bSockAddrToPoke []byte, handled bool) {
+	network := t.network(socketInfo)
+	if network != "tcp" && network != "udp" {
+		return nil, false
+	}
+	switch t.action(s.pid) {
+	case policy.ActionBlock:
+		ip, port, host, ok := t.destination(bSockAddr)
+		if !ok || ip.IsLoopback() {
+			return nil, true
+		}
+		process := t.process(s.pid)
+		t.log.Infof("policy: block %v %v from %v (%v)", network, net.JoinHostPort(host, strconv.Itoa(int(port))), process.Pid, process.Exe)
+		t.refuse(s, network)
+		return nil, true
+	case policy.ActionBypass:
+		return t.bypassAddr(bSockAddr), true
+	}
+	return nil, false
+}
+
+// bypassAddr returns the address to connect directly instead of bSockAddr, or nil if there is no need to change.
+// The fake IP of a domain is replaced by its real IP if known.
+func (t *Tracer) bypassAddr(bSockAddr []byte) []byte {
+	ip, _, _, ok := t.destination(bSockAddr)
+	if !ok || !proxy.ReservedPrefix.Contains(ip) {
+		return nil
+	}
+	realIP, ok := t.proxy.GetRealIP(ip)
+	if !ok {
+		t.log.Infof("policy: bypass: unknown real IP of the fake IP %v", ip)
+		return nil
+	}
+	b := make([]byte, len(bSockAddr))
+	copy(b, bSockAddr)
+	switch (*syscall.RawSockaddr)(unsafe.Pointer(&b[0])).Family {
+	case syscall.AF_INET:
+		if !realIP.Is4() {
+			return nil
+		}
+		a := realIP.As4()
+		copy(b[4:8], a[:]) // sin_addr
+	case syscall.AF_INET6:
+		a := realIP.As16()
+		copy(b[8:24], a[:]) // sin6_addr
+	}
+	return b
+}
@@ -0,0 +1,28 @@
+package tracer
+
+import (
+	"github.com/mzz2017/gg/proxy"
+)
+
+// process returns the information of the process that the thread pid belongs to.
+// It is cached until the thread executes a new program or exits.
+func (t *Tracer) process(pid int) *proxy.Process {
+	t.mu.Lock()
+	p, ok := t.processes[pid]
+	t.mu.Unlock()
+	if ok {
+		return p
+	}
+	p = proxy.ReadProcess(pid)
+	t.mu.Lock()
+	t.processes[pid] = p
+	t.mu.Unlock()
+	return p
+}
+
+// forgetProcess drops the cached information of the process that the thread pid belongs to.
+func (t *Tracer) forgetProcess(pid int) {
+	t.mu.Lock()
+	delete(t.processes, pid)
+	t.mu.Unlock()
+}
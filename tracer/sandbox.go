@@ -0,0 +1,102 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+)
+
+// destination parses the destination in bSockAddr. host is the domain if ip is the fake IP of it.
+func (t *Tracer) destination(bSockAddr []byte) (ip netip.Addr, port uint16, host string, ok bool) {
+	if len(bSockAddr) < binary.Size(syscall.RawSockaddr{}.Family) {
+		return netip.Addr{}, 0, "", false
+	}
+	switch sockAddr := (*syscall.RawSockaddr)(unsafe.Pointer(&bSockAddr[0])); sockAddr.Family {
+	case syscall.AF_INET:
+		if len(bSockAddr) < binary.Size(RawSockaddrInet4{}) {
+			return netip.Addr{}, 0, "", false
+		}
+		addr := (*RawSockaddrInet4)(unsafe.Pointer(&bSockAddr[0]))
+		ip, port = netip.AddrFrom4(addr.Addr), binary.BigEndian.Uint16(addr.Port[:])
+	case syscall.AF_INET6:
+		if len(bSockAddr) < binary.Size(RawSockaddrInet6{}) {
+			return netip.Addr{}, 0, "", false
+		}
+		addr := (*RawSockaddrInet6)(unsafe.Pointer(&bSockAddr[0]))
+		ip, port = netip.AddrFrom16(addr.Addr).Unmap(), binary.BigEndian.Uint16(addr.Port[:])
+	default:
+		return netip.Addr{}, 0, "", false
+	}
+	host = ip.String()
+	if proxy.ReservedPrefix.Contains(ip) {
+		if domain := t.proxy.GetProjection(ip); domain != "" {
+			host = domain
+		}
+	}
+	return ip, port, host, true
+}
+
+// refuse skips the syscall at the entry stop and makes it fail. TCP connections are refused with ECONNREFUSED,
+// and UDP datagrams with EPERM.
+func (t *Tracer) refuse(s *stop, network string) {
+	s.refused = syscall.ECONNREFUSED
+	if network == "udp" {
+		s.refused = syscall.EPERM
+	}
+}
+
+// refuseIfExhausted fails the syscall if err is that no projection can be allocated, or that the socket is busy with
+// the datagrams to another target, rather than letting the connection bypass the proxy or go to a wrong target.
+func (t *Tracer) refuseIfExhausted(s *stop, socketInfo *SocketMetadata, err error) {
+	var refused syscall.Errno
+	switch {
+	case errors.Is(err, proxy.ExhaustedErr):
+		refused = syscall.EADDRNOTAVAIL
+	case errors.Is(err, proxy.SocketBusyErr):
+		// the program may retry after the pending datagrams are received
+		refused = syscall.EAGAIN
+	default:
+		return
+	}
+	process := t.process(s.pid)
+	t.log.Warnf("refuse %v from %v (%v): %v", t.network(socketInfo), process.Pid, process.Exe, err)
+	s.refused = refused
+}
+
+// hijacksDNS reports whether the proxy answers the DNS queries of the thread pid, which go direct if UDP is ignored
+// or the process bypasses the proxy.
+func (t *Tracer) hijacksDNS(pid int) bool {
+	return !t.ignoreUDP.Load() && t.action(pid) != policy.ActionBypass
+}
+
+// refuseIfNotAllowed refuses the syscall at the entry stop if the destination bSockAddr is not in the allowlist.
+// Loopback destinations are always allowed, and so are DNS queries if the proxy answers them.
+func (t *Tracer) refuseIfNotAllowed(s *stop, socketInfo *SocketMetadata, bSockAddr []byte) (refused bool) {
+	if t.allowlist == nil {
+		return false
+	}
+	network := t.network(socketInfo)
+	if network != "tcp" && network != "udp" {
+		return false
+	}
+	ip, port, host, ok := t.destination(bSockAddr)
+	if !ok || ip.IsLoopback() || (network == "udp" && (port == 0 || (port == 53 && t.hijacksDNS(s.pid)))) {
+		return false
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	process := t.process(s.pid)
+	if t.allowlist.Allow(host, port) {
+		t.log.Infof("sandbox: allow %v %v from %v (%v)", network, target, process.Pid, process.Exe)
+		return false
+	}
+	t.log.Warnf("sandbox: refuse %v %v from %v (%v)", network, target, process.Pid, process.Exe)
+	t.refuse(s, network)
+	return true
+}
@@ -0,0 +1,67 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/mzz2017/gg/policy"
+	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
+	"github.com/sirupsen/logrus"
+)
+
+func sockAddr4(ip [4]byte, port uint16) []byte {
+	addr := RawSockaddrInet4{Family: syscall.AF_INET, Addr: ip}
+	binary.BigEndian.PutUint16(addr.Port[:], port)
+	return unsafe.Slice((*byte)(unsafe.Pointer(&addr)), unsafe.Sizeof(addr))
+}
+
+func TestRefuseIfNotAllowed(t *testing.T) {
+	allowlist, err := sandbox.Parse([]string{":443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bypass, err := policy.Parse([]string{"bypass:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	tcp := &SocketMetadata{Family: syscall.AF_INET, Type: syscall.SOCK_STREAM}
+	udp := &SocketMetadata{Family: syscall.AF_INET, Type: syscall.SOCK_DGRAM}
+	for _, c := range []struct {
+		name      string
+		socket    *SocketMetadata
+		port      uint16
+		ignoreUDP bool
+		policy    policy.Policy
+		refused   syscall.Errno
+	}{
+		{"allowed", tcp, 443, false, nil, 0},
+		{"not allowed", tcp, 80, false, nil, syscall.ECONNREFUSED},
+		{"udp not allowed", udp, 123, false, nil, syscall.EPERM},
+		{"udp without port", udp, 0, false, nil, 0},
+		// DNS queries are allowed only if they are answered by the proxy
+		{"dns", udp, 53, false, nil, 0},
+		{"dns with udp ignored", udp, 53, true, nil, syscall.EPERM},
+		{"dns bypassing", udp, 53, false, bypass, syscall.EPERM},
+		{"tcp dns", tcp, 53, false, nil, syscall.ECONNREFUSED},
+	} {
+		tr := &Tracer{
+			log:       log,
+			processes: make(map[int]*proxy.Process),
+			allowlist: allowlist,
+			policy:    c.policy,
+		}
+		tr.ignoreUDP.Store(c.ignoreUDP)
+		s := &stop{pid: os.Getpid()}
+		refused := tr.refuseIfNotAllowed(s, c.socket, sockAddr4([4]byte{8, 8, 8, 8}, c.port))
+		if refused != (c.refused != 0) || s.refused != c.refused {
+			t.Errorf("%v: refused %v with %v, want %v", c.name, refused, s.refused, c.refused)
+		}
+	}
+}
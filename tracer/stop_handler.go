@@ -5,12 +5,13 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
-	"reflect"
 	"strconv"
+	"sync"
 	"syscall"
 	"unsafe"
 
 	"github.com/mzz2017/gg/proxy"
+	"golang.org/x/sys/unix"
 )
 
 func (t *Tracer) getArgsFromStorehouse(pid, inst int) ([]uint64, error) {
@@ -26,19 +27,57 @@ func (t *Tracer) saveArgsToStorehouse(pid, inst int, args []uint64) {
 	t.storehouse.Save(pid, inst, args)
 }
 
-func (t *Tracer) exitHandler(pid int, regs *syscall.PtraceRegs) (err error) {
-	//t.log.Infof("exitHandler: pid: %v,inst: %v", pid, inst(regs))
-	//defer t.log.Infof("exitHandler: pid: %v,inst: %v: end", pid, inst(regs))
-	inst := inst(regs)
+// stop is a syscall stop of the tracee pid. The handlers change regs and queue the writes to the memory, which are
+// applied by the tracer thread when the tracee is resumed, so that the handlers can run in other goroutines.
+type stop struct {
+	pid     int
+	regs    PtraceRegs
+	orig    PtraceRegs
+	pokes   []poke
+	refused syscall.Errno // the syscall is skipped and fails with it if not 0
+	async   bool          // async is whether the stop is handled off the tracer thread
+	retry   func() error  // retry is the work to run again on the tracer thread before resumed, or nil
+}
+
+type poke struct {
+	addr uintptr
+	data []byte
+}
+
+func (s *stop) poke(addr uintptr, data []byte) {
+	s.pokes = append(s.pokes, poke{addr: addr, data: data})
+}
+
+// peek reads the memory of the tracee at addr. offTracerThreadErr is returned if it is only readable on the tracer
+// thread while the stop is handled off it.
+func (s *stop) peek(addr uintptr, b []byte) error {
+	return peekData(s.pid, addr, b, !s.async)
+}
+
+func (t *Tracer) exitHandler(s *stop) (err error) {
+	pid := s.pid
+	//t.log.Infof("exitHandler: pid: %v,inst: %v", pid, inst(&s.regs))
+	//defer t.log.Infof("exitHandler: pid: %v,inst: %v: end", pid, inst(&s.regs))
+	// the syscall number is not always kept at the exit stop, and socketcall(2) is recorded as the equivalent syscall
+	inst, ok := t.syscalls[pid]
+	delete(t.syscalls, pid)
+	if errno, refused := t.refused[pid]; refused {
+		delete(t.refused, pid)
+		setReturnValue(&s.regs, -int(errno))
+		return nil
+	}
+	if !ok {
+		return nil
+	}
 	switch inst {
-	case syscall.SYS_SOCKET:
+	case sysSocket:
 		//t.log.Tracef("exitHandler: SOCKET: %v, inst: %v", pid, inst)
 		args, err := t.getArgsFromStorehouse(pid, inst)
 		if err != nil {
 			t.log.Infoln(err)
 			return nil
 		}
-		fd, errno := returnValueInt(regs)
+		fd, errno := returnValueInt(&s.regs)
 		if errno != 0 {
 			t.log.Infof("socket error: pid: %v, errno: %v", pid, errno)
 			return nil
@@ -52,7 +91,7 @@ func (t *Tracer) exitHandler(pid int, regs *syscall.PtraceRegs) (err error) {
 		}
 		t.saveSocketInfo(pid, fd, socketInfo)
 		t.log.Tracef("new socket (%v): pid: %v, fd %v", t.network(&socketInfo), pid, fd)
-	case syscall.SYS_FCNTL:
+	case sysFcntl:
 		//t.log.Tracef("exitHandler: FCNTL: %v, inst: %v", pid, inst)
 		// syscall.SYS_FCNTL can be used to duplicate the file descriptor.
 		args, err := t.getArgsFromStorehouse(pid, inst)
@@ -71,182 +110,275 @@ func (t *Tracer) exitHandler(pid int, regs *syscall.PtraceRegs) (err error) {
 			t.log.Tracef("syscall.F_DUPFD: socketInfo cannot found: pid: %v, fd: %v", pid, fd)
 			return nil
 		}
-		newFD, errno := returnValueInt(regs)
+		newFD, errno := returnValueInt(&s.regs)
 		if errno != 0 {
 			t.log.Tracef("socket error: pid: %v, errno: %v", pid, errno)
 			return nil
 		}
 		t.saveSocketInfo(pid, newFD, *socketInfo)
 		t.log.Tracef("SYS_FCNTL: copy %v -> %v", fd, newFD)
-	case syscall.SYS_CLOSE:
+	case sysClose:
 		//t.log.Tracef("exitHandler: CLOSE: %v, inst: %v", pid, inst)
 		// we do not need to know if it succeeded
-		fd := Argument(regs, 0)
+		args, err := t.getArgsFromStorehouse(pid, inst)
+		if err != nil {
+			t.log.Traceln(err)
+			return nil
+		}
+		fd := args[0]
 		t.removeSocketInfo(pid, int(fd))
 		t.log.Tracef("close: pid: %v, fd %v", pid, fd)
 	}
 	return nil
 }
 
-func (t *Tracer) entryHandler(pid int, regs *syscall.PtraceRegs) (err error) {
-	//t.log.Infof("entryHandler: pid: %v,inst: %v", pid, inst(regs))
-	//defer t.log.Infof("entryHandler: pid: %v,inst: %v: end", pid, inst(regs))
-	args := arguments(regs)
-	switch inst(regs) {
+// callArgs is the arguments of a syscall. They are in the registers, or in the memory of the tracee at pArgs for
+// socketcall(2).
+type callArgs struct {
+	values []uint64
+	pArgs  uint64
+}
+
+// set sets the argument at the entry stop.
+func (a callArgs) set(s *stop, order int, val uint64) {
+	if a.pArgs == 0 {
+		setArgument(&s.regs, order, val)
+		return
+	}
+	b := binary.NativeEndian.AppendUint32(nil, uint32(val))
+	s.poke(uintptr(a.pArgs)+uintptr(order*len(b)), b)
+}
+
+// the calls of socketcall(2)
+const (
+	socketcallSocket  = 1
+	socketcallConnect = 3
+	socketcallSendto  = 11
+	socketcallSendmsg = 16
+)
+
+// socketcallArgs returns the syscall equivalent to the socketcall(2) and its arguments, which are 32-bit words in
+// the memory. inst is -1 if the call is not interested.
+func socketcallArgs(pid int, values []uint64) (inst int, args callArgs, err error) {
+	var n int
+	switch values[0] {
+	case socketcallSocket:
+		inst, n = sysSocket, 3
+	case socketcallConnect:
+		inst, n = sysConnect, 3
+	case socketcallSendto:
+		inst, n = sysSendto, 6
+	case socketcallSendmsg:
+		inst, n = sysSendmsg, 3
+	default:
+		return -1, callArgs{}, nil
+	}
+	b := make([]byte, 4*n)
+	if err = peekData(pid, uintptr(values[1]), b, true); err != nil {
+		return -1, callArgs{}, fmt.Errorf("peekData: %w", err)
+	}
+	args = callArgs{values: make([]uint64, n), pArgs: values[1]}
+	for i := range args.values {
+		args.values[i] = uint64(binary.NativeEndian.Uint32(b[4*i:]))
+	}
+	return inst, args, nil
+}
+
+// entryHandler handles the entry stop on the tracer thread. The work to redirect connect(2), sendto(2) and
+// sendmsg(2), which accesses the memory and the proxy, is returned to run in another goroutine.
+func (t *Tracer) entryHandler(s *stop) (work func() error, err error) {
+	pid := s.pid
+	//t.log.Infof("entryHandler: pid: %v,inst: %v", pid, inst(&s.regs))
+	//defer t.log.Infof("entryHandler: pid: %v,inst: %v: end", pid, inst(&s.regs))
+	inst := inst(&s.regs)
+	call := callArgs{values: arguments(&s.regs)}
+	if inst == sysSocketcall {
+		if inst, call, err = socketcallArgs(pid, call.values); err != nil {
+			t.syscalls[pid] = -1
+			return nil, err
+		}
+	}
+	t.syscalls[pid] = inst
+	args := call.values
+	switch inst {
 	//case syscall.SYS_CLONE:
 	//	//t.log.Tracef("entryHandler: clone: %v", pid)
-	//	newRegs := *regs
-	//	setArgument(&newRegs, 0, args[0] & ^uint64(syscall.CLONE_UNTRACED))
-	//	if err = ptraceSetRegs(pid, &newRegs); err != nil {
-	//		return err
-	//	}
-	case syscall.SYS_SOCKET, syscall.SYS_FCNTL:
-		//t.log.Tracef("entryHandler: SOCKET, FCNTL: %v, inst: %v", pid, inst(regs))
-		t.saveArgsToStorehouse(pid, inst(regs), args)
-	case syscall.SYS_CONNECT, syscall.SYS_SENDTO:
+	//	setArgument(&s.regs, 0, args[0] & ^uint64(syscall.CLONE_UNTRACED))
+	case sysSocket, sysFcntl, sysClose:
+		//t.log.Tracef("entryHandler: SOCKET, FCNTL, CLOSE: %v, inst: %v", pid, inst)
+		t.saveArgsToStorehouse(pid, inst, args)
+	case sysConnect, sysSendto:
 		fd := args[0]
 		t.log.Tracef("syscall.SYS_CONNECT, syscall.SYS_SENDTO: pid: %v, fd: %v", pid, fd)
 		socketInfo, ok := t.checkSocket(pid, fd)
 		if !ok {
-			return nil
+			return nil, nil
 		}
-		if t.ignoreUDP && t.network(socketInfo) == "udp" {
-			return nil
-		}
-		var (
-			pSockAddr, sockAddrLen uint64
-			orderSockAddrLen       int
-		)
-		switch inst(regs) {
-		case syscall.SYS_CONNECT:
-			t.log.Tracef("syscall.SYS_CONNECT")
-			pSockAddr = args[1]
-			sockAddrLen = args[2]
-			orderSockAddrLen = 2
-		case syscall.SYS_SENDTO:
-			t.log.Tracef("syscall.SYS_SENDTO")
-			pSockAddr = args[4]
-			sockAddrLen = args[5]
-			orderSockAddrLen = 5
-			if sockAddrLen == 0 {
-				// it is just used like send, which does not carry any address information.
-				return nil
-			}
-		}
-		bSockAddr := make([]byte, sockAddrLen)
-		if _, err = syscall.PtracePeekData(pid, uintptr(pSockAddr), bSockAddr); err != nil {
-			return fmt.Errorf("PtracePeekData: %w", err)
-		}
-		//t.log.Tracef("%v %v", bSockAddr, sockAddrLen)
-		sockAddr := *(*syscall.RawSockaddr)(unsafe.Pointer(&bSockAddr[0]))
-
-		switch sockAddr.Family {
-		case syscall.AF_INET:
-			var bSockAddrToPock []byte
-			if bSockAddrToPock, err = t.handleINet4(socketInfo, bSockAddr); err != nil {
-				return fmt.Errorf("handleINet4: %w", err)
-			}
-			if bSockAddrToPock == nil {
-				return nil
-			}
-			if err = pokeAddrToArgument(pid, regs, bSockAddrToPock, uintptr(pSockAddr), orderSockAddrLen); err != nil {
-				return fmt.Errorf("pokeAddrToArgument: %w", err)
-			}
-		case syscall.AF_INET6:
-			var bSockAddrToPock []byte
-			if bSockAddrToPock, err = t.handleINet6(socketInfo, bSockAddr); err != nil {
-				return fmt.Errorf("handleINet6: %w", err)
-			}
-			if bSockAddrToPock == nil {
-				return nil
-			}
-			if err = pokeAddrToArgument(pid, regs, bSockAddrToPock, uintptr(pSockAddr), orderSockAddrLen); err != nil {
-				return fmt.Errorf("pokeAddrToArgument: %w", err)
-			}
-		}
-	case syscall.SYS_SENDMSG:
+		return func() error {
+			return t.connectHandler(s, inst, call, socketInfo)
+		}, nil
+	case sysSendmsg:
 		fd := args[0]
 		t.log.Tracef("syscall.SYS_SENDMSG: pid: %v, fd: %v", pid, fd)
 		socketInfo, ok := t.checkSocket(pid, fd)
 		if !ok {
-			return nil
+			return nil, nil
 		}
-		if t.ignoreUDP && t.network(socketInfo) == "udp" {
+		return func() error {
+			return t.sendmsgHandler(s, call, socketInfo)
+		}, nil
+	}
+	return nil, nil
+}
+
+func (t *Tracer) connectHandler(s *stop, inst int, call callArgs, socketInfo *SocketMetadata) (err error) {
+	args := call.values
+	var (
+		pSockAddr, sockAddrLen uint64
+		orderSockAddrLen       int
+	)
+	switch inst {
+	case sysConnect:
+		t.log.Tracef("syscall.SYS_CONNECT")
+		pSockAddr = args[1]
+		sockAddrLen = args[2]
+		orderSockAddrLen = 2
+	case sysSendto:
+		t.log.Tracef("syscall.SYS_SENDTO")
+		pSockAddr = args[4]
+		sockAddrLen = args[5]
+		orderSockAddrLen = 5
+		if sockAddrLen == 0 {
+			// it is just used like send, which does not carry any address information.
 			return nil
 		}
-		pMsg := args[1]
-		bMsg := make([]byte, binary.Size(RawMsgHdr{}))
-		_, err = syscall.PtracePeekData(pid, uintptr(pMsg), bMsg)
-		if err != nil {
-			return fmt.Errorf("PtracePeekData: %w", err)
-		}
-		msg := *(*RawMsgHdr)(unsafe.Pointer(&bMsg[0]))
-		if msg.LenMsgName == 0 {
-			// no target
-			return nil
+	}
+	bSockAddr := make([]byte, sockAddrLen)
+	if err = s.peek(uintptr(pSockAddr), bSockAddr); err != nil {
+		return fmt.Errorf("peekData: %w", err)
+	}
+	if refused := t.refuseIfNotAllowed(s, socketInfo, bSockAddr); refused {
+		return nil
+	}
+	if bSockAddrToPoke, handled := t.applyPolicy(s, socketInfo, bSockAddr); handled {
+		if bSockAddrToPoke != nil {
+			pokeAddrToArgument(s, call, bSockAddrToPoke, uintptr(pSockAddr), orderSockAddrLen)
 		}
-		bSockAddr := make([]byte, msg.LenMsgName)
-		if _, err := syscall.PtracePeekData(pid, uintptr(msg.MsgName), bSockAddr); err != nil {
-			return err
-		}
-		//t.log.Tracef("bSockAddr: %v", bSockAddr)
-		sockAddr := *(*syscall.RawSockaddr)(unsafe.Pointer(&bSockAddr[0]))
-		switch sockAddr.Family {
-		case syscall.AF_INET:
-			var bSockAddrToPock []byte
-			if bSockAddrToPock, err = t.handleINet4(socketInfo, bSockAddr); err != nil {
-				return fmt.Errorf("handleINet4: %w", err)
-			}
-			//t.log.Tracef("bSockAddrToPock: %v", bSockAddrToPock)
-			if bSockAddrToPock == nil {
-				return nil
-			}
-			if _, err := syscall.PtracePokeData(pid, uintptr(msg.MsgName), bSockAddrToPock); err != nil {
-				return fmt.Errorf("set addr for SYS_SENDMSG: %w", err)
-			}
-		case syscall.AF_INET6:
-			var bSockAddrToPock []byte
-			if bSockAddrToPock, err = t.handleINet6(socketInfo, bSockAddr); err != nil {
-				return fmt.Errorf("handleINet6: %w", err)
-			}
-			//t.log.Tracef("bSockAddrToPock: %v", bSockAddrToPock)
-			if bSockAddrToPock == nil {
-				return nil
-			}
-			if _, err := syscall.PtracePokeData(pid, uintptr(msg.MsgName), bSockAddrToPock); err != nil {
-				return fmt.Errorf("set addr for SYS_SENDMSG: %w", err)
-			}
-			msg.LenMsgName = uint32(len(bSockAddrToPock))
+		return nil
+	}
+	if t.ignoreUDP.Load() && t.network(socketInfo) == "udp" {
+		return nil
+	}
+	//t.log.Tracef("%v %v", bSockAddr, sockAddrLen)
+	sockAddr := *(*syscall.RawSockaddr)(unsafe.Pointer(&bSockAddr[0]))
 
-			bMsg = *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-				Data: uintptr(unsafe.Pointer(&msg)),
-				Cap:  binary.Size(msg),
-				Len:  binary.Size(msg),
-			}))
-			if _, err := syscall.PtracePokeData(pid, uintptr(pMsg), bMsg); err != nil {
-				return fmt.Errorf("set addr for SYS_SENDMSG: %w", err)
-			}
+	var bSockAddrToPock []byte
+	switch sockAddr.Family {
+	case syscall.AF_INET:
+		if bSockAddrToPock, err = t.handleINet4(s.pid, socketInfo, bSockAddr); err != nil {
+			t.refuseIfExhausted(s, socketInfo, err)
+			return fmt.Errorf("handleINet4: %w", err)
 		}
+	case syscall.AF_INET6:
+		if bSockAddrToPock, err = t.handleINet6(s.pid, int(call.values[0]), socketInfo, bSockAddr); err != nil {
+			t.refuseIfExhausted(s, socketInfo, err)
+			return fmt.Errorf("handleINet6: %w", err)
+		}
+	}
+	if bSockAddrToPock != nil {
+		pokeAddrToArgument(s, call, bSockAddrToPock, uintptr(pSockAddr), orderSockAddrLen)
 	}
 	return nil
 }
 
-func pokeAddrToArgument(pid int, regs *syscall.PtraceRegs, bAddrToPoke []byte, pSockAddr uintptr, orderSockAddrLen int) (err error) {
-	if _, err = syscall.PtracePokeData(pid, pSockAddr, bAddrToPoke); err != nil {
-		return fmt.Errorf("pokeAddrToArgument: %w", err)
+func (t *Tracer) sendmsgHandler(s *stop, call callArgs, socketInfo *SocketMetadata) (err error) {
+	pMsg := call.values[1]
+	compat := isCompat(&s.regs)
+	msgName, lenMsgName, err := peekMsgName(s.peek, pMsg, compat)
+	if err != nil {
+		return fmt.Errorf("peekData: %w", err)
 	}
-	if Argument(regs, orderSockAddrLen) == uint64(len(bAddrToPoke)) {
-		// they are the same, so there is no need to set the len
+	if lenMsgName == 0 {
+		// no target
+		return nil
+	}
+	bSockAddr := make([]byte, lenMsgName)
+	if err = s.peek(uintptr(msgName), bSockAddr); err != nil {
+		return err
+	}
+	if refused := t.refuseIfNotAllowed(s, socketInfo, bSockAddr); refused {
 		return nil
 	}
-	newRegs := *regs
-	setArgument(&newRegs, orderSockAddrLen, uint64(len(bAddrToPoke)))
-	if err = ptraceSetRegs(pid, &newRegs); err != nil {
-		return fmt.Errorf("set addr len for connect: %w", err)
+	if bSockAddrToPoke, handled := t.applyPolicy(s, socketInfo, bSockAddr); handled {
+		if bSockAddrToPoke != nil {
+			s.poke(uintptr(msgName), bSockAddrToPoke)
+		}
+		return nil
+	}
+	if t.ignoreUDP.Load() && t.network(socketInfo) == "udp" {
+		return nil
+	}
+	//t.log.Tracef("bSockAddr: %v", bSockAddr)
+	sockAddr := *(*syscall.RawSockaddr)(unsafe.Pointer(&bSockAddr[0]))
+	switch sockAddr.Family {
+	case syscall.AF_INET:
+		var bSockAddrToPock []byte
+		if bSockAddrToPock, err = t.handleINet4(s.pid, socketInfo, bSockAddr); err != nil {
+			t.refuseIfExhausted(s, socketInfo, err)
+			return fmt.Errorf("handleINet4: %w", err)
+		}
+		//t.log.Tracef("bSockAddrToPock: %v", bSockAddrToPock)
+		if bSockAddrToPock == nil {
+			return nil
+		}
+		s.poke(uintptr(msgName), bSockAddrToPock)
+	case syscall.AF_INET6:
+		var bSockAddrToPock []byte
+		if bSockAddrToPock, err = t.handleINet6(s.pid, int(call.values[0]), socketInfo, bSockAddr); err != nil {
+			t.refuseIfExhausted(s, socketInfo, err)
+			return fmt.Errorf("handleINet6: %w", err)
+		}
+		//t.log.Tracef("bSockAddrToPock: %v", bSockAddrToPock)
+		if bSockAddrToPock == nil {
+			return nil
+		}
+		s.poke(uintptr(msgName), bSockAddrToPock)
+		offset := unsafe.Offsetof(RawMsgHdr{}.LenMsgName)
+		if compat {
+			offset = unsafe.Offsetof(RawMsgHdr32{}.LenMsgName)
+		}
+		s.poke(uintptr(pMsg)+offset, binary.NativeEndian.AppendUint32(nil, uint32(len(bSockAddrToPock))))
 	}
 	return nil
 }
 
+// peekMsgName reads msg_name and msg_namelen of the msghdr at pMsg by peek, which is of the 32-bit ABI if compat.
+func peekMsgName(peek func(addr uintptr, b []byte) error, pMsg uint64, compat bool) (msgName uint64, lenMsgName uint32, err error) {
+	if compat {
+		b := make([]byte, unsafe.Sizeof(RawMsgHdr32{}))
+		if err = peek(uintptr(pMsg), b); err != nil {
+			return 0, 0, err
+		}
+		msg := (*RawMsgHdr32)(unsafe.Pointer(&b[0]))
+		return uint64(msg.MsgName), msg.LenMsgName, nil
+	}
+	b := make([]byte, unsafe.Sizeof(RawMsgHdr{}))
+	if err = peek(uintptr(pMsg), b); err != nil {
+		return 0, 0, err
+	}
+	msg := (*RawMsgHdr)(unsafe.Pointer(&b[0]))
+	return uint64(msg.MsgName), msg.LenMsgName, nil
+}
+
+func pokeAddrToArgument(s *stop, args callArgs, bAddrToPoke []byte, pSockAddr uintptr, orderSockAddrLen int) {
+	s.poke(pSockAddr, bAddrToPoke)
+	if args.values[orderSockAddrLen] == uint64(len(bAddrToPoke)) {
+		// they are the same, so there is no need to set the len
+		return
+	}
+	args.set(s, orderSockAddrLen, uint64(len(bAddrToPoke)))
+}
+
 func (t *Tracer) checkSocket(pid int, fd uint64) (socketInfo *SocketMetadata, expected bool) {
 	socketInfo = t.getSocketInfo(pid, int(fd))
 	if socketInfo == nil {
@@ -308,7 +440,7 @@ func (t *Tracer) network(socketInfo *SocketMetadata) string {
 	return ""
 }
 
-func (t *Tracer) handleINet4(socketInfo *SocketMetadata, bSockAddr []byte) (sockAddrToPock []byte, err error) {
+func (t *Tracer) handleINet4(pid int, socketInfo *SocketMetadata, bSockAddr []byte) (sockAddrToPock []byte, err error) {
 	network := t.network(socketInfo)
 	portHackTo := t.portHackTo(socketInfo)
 	addr := *(*RawSockaddrInet4)(unsafe.Pointer(&bSockAddr[0]))
@@ -318,7 +450,7 @@ func (t *Tracer) handleINet4(socketInfo *SocketMetadata, bSockAddr []byte) (sock
 		t.log.Tracef("handleINet4 (%v): skip sin_port=0", network)
 		return nil, nil
 	}
-	if network == "udp" && !t.supportUDP && targetPort != 53 {
+	if network == "udp" && !t.Dialer().SupportUDP() && targetPort != 53 {
 		// skip UDP traffic
 		// but only keep DNS packets sent to the port 53
 		t.log.Tracef("handleINet4 (%v): skip UDP", network)
@@ -344,7 +476,11 @@ func (t *Tracer) handleINet4(socketInfo *SocketMetadata, bSockAddr []byte) (sock
 				strconv.Itoa(int(binary.BigEndian.Uint16(addr.Port[:]))),
 			)
 		}
-		loopback := t.proxy.AllocProjection(originAddr)
+		loopback, err := t.proxy.AllocProjection(originAddr)
+		if err != nil {
+			return nil, err
+		}
+		t.proxy.SetProjectionOwner(loopback, t.process(pid))
 		addr.Addr = loopback.As4()
 	} else if proxy.ReservedPrefix.Contains(ip) {
 		if realIp, ok := t.proxy.GetRealIP(ip); ok {
@@ -354,18 +490,16 @@ func (t *Tracer) handleINet4(socketInfo *SocketMetadata, bSockAddr []byte) (sock
 
 	binary.BigEndian.PutUint16(addr.Port[:], uint16(portHackTo))
 	//logrus.Traceln("port", addr.Port)
-	_bSockAddrToPock := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: uintptr(unsafe.Pointer(&addr)),
-		Cap:  binary.Size(addr),
-		Len:  binary.Size(addr),
-	}))
+	_bSockAddrToPock := unsafe.Slice((*byte)(unsafe.Pointer(&addr)), binary.Size(addr))
 	bSockAddrToPock := make([]byte, len(_bSockAddrToPock))
 	copy(bSockAddrToPock, _bSockAddrToPock)
 	t.log.Tracef("handleINet4 (%v): origin: %v, after: %v", network, originAddr, net.JoinHostPort(netip.AddrFrom4(addr.Addr).String(), strconv.Itoa(portHackTo)))
 	return bSockAddrToPock, nil
 }
 
-func (t *Tracer) handleINet6(socketInfo *SocketMetadata, bSockAddr []byte) (sockAddrToPock []byte, err error) {
+// handleINet6 redirects the address of the IPv6 socket fd of the tracee pid. The projection is an IPv4-mapped
+// loopback, or IPv6Projection if the socket cannot use IPv4.
+func (t *Tracer) handleINet6(pid int, fd int, socketInfo *SocketMetadata, bSockAddr []byte) (sockAddrToPock []byte, err error) {
 	network := t.network(socketInfo)
 	portHackTo := t.portHackTo(socketInfo)
 
@@ -377,7 +511,7 @@ func (t *Tracer) handleINet6(socketInfo *SocketMetadata, bSockAddr []byte) (sock
 		t.log.Tracef("handleINet6 (%v): skip sin_port=0", network)
 		return nil, nil
 	}
-	if network == "udp" && !t.supportUDP && targetPort != 53 {
+	if network == "udp" && !t.Dialer().SupportUDP() && targetPort != 53 {
 		// skip UDP traffic
 		// but only keep DNS packets sent to the port 53
 		return nil, nil
@@ -404,17 +538,60 @@ func (t *Tracer) handleINet6(socketInfo *SocketMetadata, bSockAddr []byte) (sock
 			strconv.Itoa(int(binary.BigEndian.Uint16(addr.Port[:]))),
 		)
 	}
-	loopback := t.proxy.AllocProjection(originAddr)
+	var loopback netip.Addr
+	if t.v6Only(pid, fd) {
+		inode, ok := proxy.SocketInode(pid, fd)
+		if !ok {
+			return nil, fmt.Errorf("inode of the socket not found: pid: %v, fd: %v", pid, fd)
+		}
+		loopback = proxy.IPv6Projection
+		if err = t.proxy.ProjectSocket(inode, originAddr, t.process(pid)); err != nil {
+			return nil, err
+		}
+	} else {
+		if loopback, err = t.proxy.AllocProjection(originAddr); err != nil {
+			return nil, err
+		}
+		t.proxy.SetProjectionOwner(loopback, t.process(pid))
+	}
 	// 6in4
 	addr.Addr = loopback.As16()
 	binary.BigEndian.PutUint16(addr.Port[:], uint16(portHackTo))
-	_bSockAddrToPock := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: uintptr(unsafe.Pointer(&addr)),
-		Cap:  binary.Size(addr),
-		Len:  binary.Size(addr),
-	}))
+	_bSockAddrToPock := unsafe.Slice((*byte)(unsafe.Pointer(&addr)), binary.Size(addr))
 	t.log.Tracef("handleINet6 (%v): origin: %v, after: %v", network, originAddr, net.JoinHostPort(netip.AddrFrom16(loopback.As16()).String(), strconv.Itoa(portHackTo)))
 	bSockAddrToPock := make([]byte, len(_bSockAddrToPock))
 	copy(bSockAddrToPock, _bSockAddrToPock)
 	return bSockAddrToPock, nil
 }
+
+// ipv4Loopback reports whether the IPv4 loopback is available, which may be removed on IPv6-only hosts.
+var ipv4Loopback = sync.OnceValue(func() bool {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+})
+
+// v6Only reports whether the IPv6 socket fd of the tracee pid cannot connect to IPv4-mapped addresses. IPV6_V6ONLY
+// is read from the socket duplicated by pidfd_getfd(2), and it is assumed unset if the syscall is not supported.
+func (t *Tracer) v6Only(pid int, fd int) bool {
+	if !ipv4Loopback() {
+		return true
+	}
+	pidfd, err := unix.PidfdOpen(t.process(pid).Pid, 0)
+	if err != nil {
+		t.log.Tracef("pidfd_open: %v", err)
+		return false
+	}
+	defer unix.Close(pidfd)
+	sock, err := unix.PidfdGetfd(pidfd, fd, 0)
+	if err != nil {
+		t.log.Tracef("pidfd_getfd: %v", err)
+		return false
+	}
+	defer unix.Close(sock)
+	v6Only, err := unix.GetsockoptInt(sock, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY)
+	return err == nil && v6Only != 0
+}
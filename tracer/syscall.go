@@ -1,10 +1,47 @@
 package tracer
 
 import (
+	"math"
 	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
-func Argument(regs *syscall.PtraceRegs, order int) uint64 {
+const (
+	NT_PRSTATUS = 1
+
+	// sysNone is not a syscall number. It stands for the syscalls that the architecture does not have.
+	sysNone = math.MinInt32
+
+	PTRACE_GET_SYSCALL_INFO   = 0x420e
+	PTRACE_SYSCALL_INFO_ENTRY = 1
+	PTRACE_SYSCALL_INFO_EXIT  = 2
+)
+
+// syscallInfo is struct ptrace_syscall_info. Data is the union of the entry (nr, args[6]) and exit (rval, is_error)
+// information.
+type syscallInfo struct {
+	Op                 uint8
+	_                  [3]uint8
+	Arch               uint32
+	InstructionPointer uint64
+	StackPointer       uint64
+	Data               [8]uint64
+}
+
+// RawMsgHdr32 is struct msghdr of the 32-bit compat ABIs on 64-bit hosts.
+type RawMsgHdr32 struct {
+	MsgName       uint32
+	LenMsgName    uint32
+	MsgIov        uint32
+	LenMsgIov     uint32
+	MsgControl    uint32
+	LenMsgControl uint32
+	Flags         int32
+}
+
+func Argument(regs *PtraceRegs, order int) uint64 {
 	argsMapper := arguments(regs)
 	if order >= 0 && order < len(argsMapper) {
 		return argsMapper[order]
@@ -19,3 +56,16 @@ func ptrace(request int, pid int, addr uintptr, data uintptr) (err error) {
 	}
 	return
 }
+
+func getIovec(base *byte, l int) unix.Iovec {
+	var iov unix.Iovec
+	iov.Base = base
+	iov.SetLen(l)
+	return iov
+}
+
+// getSyscallInfo gets the information of the syscall at the syscall stop. It needs Linux 5.3 or later.
+func getSyscallInfo(pid int) (info syscallInfo, err error) {
+	err = ptrace(PTRACE_GET_SYSCALL_INFO, pid, unsafe.Sizeof(info), uintptr(unsafe.Pointer(&info)))
+	return info, err
+}
@@ -0,0 +1,118 @@
+//go:build linux && 386
+
+package tracer
+
+import (
+	"syscall"
+)
+
+// PtraceRegs is the registers at the syscall stops.
+type PtraceRegs = syscall.PtraceRegs
+
+// The socket syscalls are only called by socketcall(2) before Linux 4.3, and the syscall package does not have them.
+const (
+	sysSocket     = 359
+	sysConnect    = 362
+	sysSendto     = 369
+	sysSendmsg    = 370
+	sysFcntl      = syscall.SYS_FCNTL
+	sysClose      = syscall.SYS_CLOSE
+	sysSocketcall = syscall.SYS_SOCKETCALL
+)
+
+// RawSockaddrInet4 is a bit different from syscall.RawSockaddrInet4 that Port should be encoded by BigEndian.
+type RawSockaddrInet4 struct {
+	Family uint16
+	Port   [2]byte
+	Addr   [4]byte /* in_addr */
+	Zero   [8]uint8
+}
+
+// RawSockaddrInet6 is a bit different from syscall.RawSockaddrInet6 that fields except Family should be encoded by BigEndian.
+type RawSockaddrInet6 struct {
+	Family   uint16
+	Port     [2]byte
+	Flowinfo [4]byte
+	Addr     [16]byte /* in6_addr */
+	Scope_id [4]byte
+}
+
+type RawMsgHdr struct {
+	MsgName       uint32
+	LenMsgName    uint32
+	MsgIov        uint32
+	LenMsgIov     uint32
+	MsgControl    uint32
+	LenMsgControl uint32
+	Flags         int32
+}
+
+func arguments(regs *PtraceRegs) []uint64 {
+	return []uint64{
+		uint64(uint32(regs.Ebx)),
+		uint64(uint32(regs.Ecx)),
+		uint64(uint32(regs.Edx)),
+		uint64(uint32(regs.Esi)),
+		uint64(uint32(regs.Edi)),
+		uint64(uint32(regs.Ebp)),
+	}
+}
+
+func setArgument(regs *PtraceRegs, order int, val uint64) {
+	switch order {
+	case 0:
+		regs.Ebx = int32(val)
+	case 1:
+		regs.Ecx = int32(val)
+	case 2:
+		regs.Edx = int32(val)
+	case 3:
+		regs.Esi = int32(val)
+	case 4:
+		regs.Edi = int32(val)
+	case 5:
+		regs.Ebp = int32(val)
+	}
+}
+
+func returnValueInt(regs *PtraceRegs) (int, syscall.Errno) {
+	if regs.Eax < 0 {
+		return int(regs.Eax), syscall.Errno(-regs.Eax)
+	}
+	return int(regs.Eax), 0
+}
+
+func isEntryStop(regs *PtraceRegs) bool {
+	return regs.Eax == -int32(syscall.ENOSYS)
+}
+
+func isCompat(regs *PtraceRegs) bool {
+	return false
+}
+
+func inst(regs *PtraceRegs) int {
+	if regs.Orig_eax == syscall.SYS_FCNTL64 {
+		// they are the same to us
+		return sysFcntl
+	}
+	return int(regs.Orig_eax)
+}
+
+func ptraceSetRegs(pid int, regs *PtraceRegs) error {
+	return syscall.PtraceSetRegs(pid, regs)
+}
+
+func ptraceGetRegs(pid int, regs *PtraceRegs) error {
+	return syscall.PtraceGetRegs(pid, regs)
+}
+
+// skipSyscall makes the kernel skip the syscall at the entry stop. The registers are changed in place.
+func skipSyscall(pid int, regs *PtraceRegs) error {
+	regs.Orig_eax = -1
+	return nil
+}
+
+// setReturnValue sets the return value of the syscall at the exit stop in place.
+func setReturnValue(regs *PtraceRegs, val int) {
+	regs.Eax = int32(val)
+}
@@ -4,8 +4,52 @@ package tracer
 
 import (
 	"syscall"
+	"unsafe"
 )
 
+// PtraceRegs is the registers at the syscall stops. Compat is whether the syscall is of the i386 ABI, made by
+// 32-bit programs or int 0x80.
+type PtraceRegs struct {
+	syscall.PtraceRegs
+	Compat bool
+}
+
+const (
+	sysSocket  = syscall.SYS_SOCKET
+	sysConnect = syscall.SYS_CONNECT
+	sysSendto  = syscall.SYS_SENDTO
+	sysSendmsg = syscall.SYS_SENDMSG
+	sysFcntl   = syscall.SYS_FCNTL
+	sysClose   = syscall.SYS_CLOSE
+	// sysSocketcall is only in the i386 ABI, so it is out of the range of the native syscalls.
+	sysSocketcall = 1<<16 | 102
+)
+
+const (
+	user32CS       = 0x23
+	auditArchI386  = 0x40000003
+	i386SysSocket  = 359
+	i386SysConnect = 362
+	i386SysSendto  = 369
+	i386SysSendmsg = 370
+	i386SysFcntl   = 55
+	i386SysFcntl64 = 221
+	i386SysClose   = 6
+	i386Socketcall = 102
+)
+
+// i386Syscalls maps the i386 syscalls to the native ones.
+var i386Syscalls = map[uint64]int{
+	i386SysSocket:  sysSocket,
+	i386SysConnect: sysConnect,
+	i386SysSendto:  sysSendto,
+	i386SysSendmsg: sysSendmsg,
+	i386SysFcntl:   sysFcntl,
+	i386SysFcntl64: sysFcntl,
+	i386SysClose:   sysClose,
+	i386Socketcall: sysSocketcall,
+}
+
 // RawSockaddrInet4 is a bit different from syscall.RawSockaddrInet4 that Port should be encoded by BigEndian.
 type RawSockaddrInet4 struct {
 	Family uint16
@@ -33,7 +77,17 @@ type RawMsgHdr struct {
 	Flags         int32
 }
 
-func arguments(regs *syscall.PtraceRegs) []uint64 {
+func arguments(regs *PtraceRegs) []uint64 {
+	if regs.Compat {
+		return []uint64{
+			uint64(uint32(regs.Rbx)),
+			uint64(uint32(regs.Rcx)),
+			uint64(uint32(regs.Rdx)),
+			uint64(uint32(regs.Rsi)),
+			uint64(uint32(regs.Rdi)),
+			uint64(uint32(regs.Rbp)),
+		}
+	}
 	return []uint64{
 		regs.Rdi,
 		regs.Rsi,
@@ -44,7 +98,24 @@ func arguments(regs *syscall.PtraceRegs) []uint64 {
 	}
 }
 
-func setArgument(regs *syscall.PtraceRegs, order int, val uint64) {
+func setArgument(regs *PtraceRegs, order int, val uint64) {
+	if regs.Compat {
+		switch order {
+		case 0:
+			regs.Rbx = val
+		case 1:
+			regs.Rcx = val
+		case 2:
+			regs.Rdx = val
+		case 3:
+			regs.Rsi = val
+		case 4:
+			regs.Rdi = val
+		case 5:
+			regs.Rbp = val
+		}
+		return
+	}
 	switch order {
 	case 0:
 		regs.Rdi = val
@@ -61,25 +132,60 @@ func setArgument(regs *syscall.PtraceRegs, order int, val uint64) {
 	}
 }
 
-func returnValueInt(regs *syscall.PtraceRegs) (int, syscall.Errno) {
+func returnValueInt(regs *PtraceRegs) (int, syscall.Errno) {
 	if int64(regs.Rax) < 0 {
-		return int(regs.Rax), syscall.Errno(^regs.Rax)
+		return int(regs.Rax), syscall.Errno(-int64(regs.Rax))
 	}
 	return int(regs.Rax), 0
 }
 
-func isEntryStop(regs *syscall.PtraceRegs) bool {
+func isEntryStop(regs *PtraceRegs) bool {
 	return int64(regs.Rax) == -int64(syscall.ENOSYS)
 }
 
-func inst(regs *syscall.PtraceRegs) int {
+func isCompat(regs *PtraceRegs) bool {
+	return regs.Compat
+}
+
+// inst returns the syscall number. The i386 syscalls are mapped to the native ones, and the others are -1.
+func inst(regs *PtraceRegs) int {
+	if regs.Compat {
+		if nr, ok := i386Syscalls[regs.Orig_rax]; ok {
+			return nr
+		}
+		return -1
+	}
 	return int(regs.Orig_rax)
 }
 
-func ptraceSetRegs(pid int, regs *syscall.PtraceRegs) error {
-	return syscall.PtraceSetRegs(pid, regs)
+// ptraceSetRegs sets the registers by PTRACE_SETREGS, which takes the 64-bit layout even for 32-bit tracees.
+func ptraceSetRegs(pid int, regs *PtraceRegs) error {
+	return ptrace(syscall.PTRACE_SETREGS, pid, 0, uintptr(unsafe.Pointer(&regs.PtraceRegs)))
+}
+
+// ptraceGetRegs gets the registers by PTRACE_GETREGS. Unlike it, PTRACE_GETREGSET returns the i386 layout for
+// 32-bit tracees.
+func ptraceGetRegs(pid int, regs *PtraceRegs) error {
+	if err := ptrace(syscall.PTRACE_GETREGS, pid, 0, uintptr(unsafe.Pointer(&regs.PtraceRegs))); err != nil {
+		return err
+	}
+	regs.Compat = regs.Cs == user32CS
+	if !regs.Compat && isEntryStop(regs) {
+		// 64-bit programs can make i386 syscalls by int 0x80
+		if info, err := getSyscallInfo(pid); err == nil {
+			regs.Compat = info.Arch == auditArchI386
+		}
+	}
+	return nil
+}
+
+// skipSyscall makes the kernel skip the syscall at the entry stop. The registers are changed in place.
+func skipSyscall(pid int, regs *PtraceRegs) error {
+	regs.Orig_rax = ^uint64(0)
+	return nil
 }
 
-func ptraceGetRegs(pid int, regs *syscall.PtraceRegs) error {
-	return syscall.PtraceGetRegs(pid, regs)
+// setReturnValue sets the return value of the syscall at the exit stop in place.
+func setReturnValue(regs *PtraceRegs, val int) {
+	regs.Rax = uint64(val)
 }
@@ -0,0 +1,118 @@
+//go:build linux && amd64
+
+package tracer
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestRegisters(t *testing.T) {
+	// the i386 arguments are in ebx, ecx, edx, esi, edi and ebp, whose upper halves are ignored
+	regs := &PtraceRegs{Compat: true}
+	regs.Orig_rax = i386SysConnect
+	regs.Rbx, regs.Rcx, regs.Rdx, regs.Rsi, regs.Rdi, regs.Rbp = 1<<32|3, 1, 2, 3, 4, 5
+	setReturnValue(regs, -int(syscall.ENOSYS))
+	if args := arguments(regs); !reflect.DeepEqual(args, []uint64{3, 1, 2, 3, 4, 5}) {
+		t.Fatalf("unexpected arguments: %v", args)
+	}
+	if !isEntryStop(regs) || !isCompat(regs) || inst(regs) != sysConnect {
+		t.Fatalf("unexpected stop: %+v", regs)
+	}
+	setArgument(regs, 2, 16)
+	if args := arguments(regs); !reflect.DeepEqual(args, []uint64{3, 1, 16, 3, 4, 5}) {
+		t.Fatalf("unexpected arguments: %v", args)
+	}
+	for nr, want := range map[uint64]int{
+		i386Socketcall: sysSocketcall,
+		i386SysFcntl64: sysFcntl,
+		i386SysSendmsg: sysSendmsg,
+		// the native number of connect(2), which is another syscall in the i386 ABI
+		syscall.SYS_CONNECT: -1,
+	} {
+		regs.Orig_rax = nr
+		if got := inst(regs); got != want {
+			t.Errorf("i386 syscall %v: inst %v, want %v", nr, got, want)
+		}
+	}
+
+	for _, compat := range []bool{false, true} {
+		for _, c := range []struct {
+			val   int
+			errno syscall.Errno
+		}{
+			{0, 0},
+			{28, 0},
+			{-int(syscall.EINPROGRESS), syscall.EINPROGRESS},
+			{-int(syscall.ECONNREFUSED), syscall.ECONNREFUSED},
+		} {
+			regs := &PtraceRegs{Compat: compat}
+			setReturnValue(regs, c.val)
+			if val, errno := returnValueInt(regs); val != c.val || errno != c.errno {
+				t.Errorf("compat %v: return value %v %v, want %v %v", compat, val, errno, c.val, c.errno)
+			}
+		}
+	}
+}
+
+func TestSocketcallArgs(t *testing.T) {
+	// the arguments of socketcall(2) are 32-bit words in the memory of the program, read from the test itself here
+	words := []uint32{3, 0x1000, 16, 0, 0x2000, 28}
+	pArgs := uint64(uintptr(unsafe.Pointer(&words[0])))
+	for _, c := range []struct {
+		call uint64
+		inst int
+		args []uint64
+	}{
+		{socketcallSocket, sysSocket, []uint64{3, 0x1000, 16}},
+		{socketcallConnect, sysConnect, []uint64{3, 0x1000, 16}},
+		{socketcallSendto, sysSendto, []uint64{3, 0x1000, 16, 0, 0x2000, 28}},
+		{socketcallSendmsg, sysSendmsg, []uint64{3, 0x1000, 16}},
+		// bind(2)
+		{2, -1, nil},
+	} {
+		inst, args, err := socketcallArgs(os.Getpid(), []uint64{c.call, pArgs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst != c.inst || (c.args != nil && (!reflect.DeepEqual(args.values, c.args) || args.pArgs != pArgs)) {
+			t.Errorf("socketcall %v: %v %+v, want %v %v", c.call, inst, args, c.inst, c.args)
+		}
+	}
+	runtime.KeepAlive(words)
+}
+
+func TestPeekMsgName(t *testing.T) {
+	msg32 := &RawMsgHdr32{MsgName: 0xfffe1000, LenMsgName: 28, MsgIov: 0x2000, LenMsgIov: 1}
+	msg := &RawMsgHdr{MsgName: 0x7ffe00001000, LenMsgName: 16, MsgIov: 0x2000, LenMsgIov: 1}
+	peek := func(addr uintptr, b []byte) error {
+		return peekData(os.Getpid(), addr, b, true)
+	}
+	for _, c := range []struct {
+		compat  bool
+		pMsg    uint64
+		msgName uint64
+		len     uint32
+	}{
+		{true, uint64(uintptr(unsafe.Pointer(msg32))), 0xfffe1000, 28},
+		{false, uint64(uintptr(unsafe.Pointer(msg))), 0x7ffe00001000, 16},
+	} {
+		msgName, lenMsgName, err := peekMsgName(peek, c.pMsg, c.compat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgName != c.msgName || lenMsgName != c.len {
+			t.Errorf("compat %v: msg_name %#x, msg_namelen %v, want %#x %v", c.compat, msgName, lenMsgName, c.msgName, c.len)
+		}
+	}
+	runtime.KeepAlive(msg32)
+	runtime.KeepAlive(msg)
+	// msg_namelen is poked at its offset of the ABI
+	if off := unsafe.Offsetof(RawMsgHdr32{}.LenMsgName); off != 4 {
+		t.Errorf("offset of msg_namelen in the i386 msghdr: %v, want 4", off)
+	}
+}
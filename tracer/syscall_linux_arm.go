@@ -6,6 +6,19 @@ import (
 	"syscall"
 )
 
+// PtraceRegs is the registers at the syscall stops.
+type PtraceRegs = syscall.PtraceRegs
+
+const (
+	sysSocket     = syscall.SYS_SOCKET
+	sysConnect    = syscall.SYS_CONNECT
+	sysSendto     = syscall.SYS_SENDTO
+	sysSendmsg    = syscall.SYS_SENDMSG
+	sysFcntl      = syscall.SYS_FCNTL
+	sysClose      = syscall.SYS_CLOSE
+	sysSocketcall = sysNone
+)
+
 // RawSockaddrInet4 is a bit different from syscall.RawSockaddrInet4 that Port should be encoded by BigEndian.
 type RawSockaddrInet4 struct {
 	Family uint16
@@ -62,8 +75,8 @@ func setArgument(regs *syscall.PtraceRegs, order int, val uint64) {
 }
 
 func returnValueInt(regs *syscall.PtraceRegs) (int, syscall.Errno) {
-	if int64(regs.Uregs[0]) < 0 {
-		return int(regs.Uregs[0]), syscall.Errno(^regs.Uregs[0])
+	if val := int32(regs.Uregs[0]); val < 0 {
+		return int(val), syscall.Errno(-val)
 	}
 	return int(regs.Uregs[0]), 0
 }
@@ -72,7 +85,15 @@ func isEntryStop(regs *syscall.PtraceRegs) bool {
 	return regs.Uregs[12] == 0
 }
 
+func isCompat(regs *syscall.PtraceRegs) bool {
+	return false
+}
+
 func inst(regs *syscall.PtraceRegs) int {
+	if regs.Uregs[7] == syscall.SYS_FCNTL64 {
+		// they are the same to us
+		return sysFcntl
+	}
 	return int(regs.Uregs[7])
 }
 
@@ -83,3 +104,15 @@ func ptraceSetRegs(pid int, regs *syscall.PtraceRegs) error {
 func ptraceGetRegs(pid int, regs *syscall.PtraceRegs) error {
 	return syscall.PtraceGetRegs(pid, regs)
 }
+
+const PTRACE_SET_SYSCALL = 23
+
+// skipSyscall makes the kernel skip the syscall at the entry stop.
+func skipSyscall(pid int, regs *syscall.PtraceRegs) error {
+	return ptrace(PTRACE_SET_SYSCALL, pid, 0, ^uintptr(0))
+}
+
+// setReturnValue sets the return value of the syscall at the exit stop in place.
+func setReturnValue(regs *syscall.PtraceRegs, val int) {
+	regs.Uregs[0] = uint32(val)
+}
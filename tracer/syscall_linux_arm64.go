@@ -3,16 +3,39 @@
 package tracer
 
 import (
-	"golang.org/x/sys/unix"
 	"syscall"
 	"unsafe"
 )
 
 const (
-	NT_PRSTATUS = 1
-	ArmRegsFlag = uint64(^-12345)
+	NT_ARM_SYSTEM_CALL = 0x404
+	ArmRegsFlag        = uint64(^-12345)
 )
 
+// PtraceRegs is the registers at the syscall stops.
+type PtraceRegs = syscall.PtraceRegs
+
+const (
+	sysSocket     = syscall.SYS_SOCKET
+	sysConnect    = syscall.SYS_CONNECT
+	sysSendto     = syscall.SYS_SENDTO
+	sysSendmsg    = syscall.SYS_SENDMSG
+	sysFcntl      = syscall.SYS_FCNTL
+	sysClose      = syscall.SYS_CLOSE
+	sysSocketcall = sysNone
+)
+
+// armSyscalls maps the syscalls of the arm32 compat ABI to the native ones.
+var armSyscalls = map[uint32]int{
+	281: sysSocket,
+	283: sysConnect,
+	290: sysSendto,
+	296: sysSendmsg,
+	55:  sysFcntl,
+	221: sysFcntl, // fcntl64
+	6:   sysClose,
+}
+
 // RawSockaddrInet4 is a bit different from syscall.RawSockaddrInet4 that Port should be encoded by BigEndian.
 type RawSockaddrInet4 struct {
 	Family uint16
@@ -102,19 +125,19 @@ func setArgument(regs *syscall.PtraceRegs, order int, val uint64) {
 	}
 }
 
+// returnValueInt returns the return value, which is the negative errno if failed. The arm32 one is 32-bit.
 func returnValueInt(regs *syscall.PtraceRegs) (int, syscall.Errno) {
 	if regs.Pstate == ArmRegsFlag {
-		regs := (*PtraceRegsArm)(unsafe.Pointer(regs))
-		if int64(regs.Uregs[0]) < 0 {
-			return int(regs.Uregs[0]), syscall.Errno(^regs.Uregs[0])
-		}
-		return int(regs.Uregs[0]), 0
-	} else {
-		if int64(regs.Pstate) < 0 {
-			return int(regs.Regs[0]), syscall.Errno(^regs.Regs[0])
+		val := int32((*PtraceRegsArm)(unsafe.Pointer(regs)).Uregs[0])
+		if val < 0 {
+			return int(val), syscall.Errno(-val)
 		}
-		return int(regs.Regs[0]), 0
+		return int(val), 0
 	}
+	if val := int64(regs.Regs[0]); val < 0 {
+		return int(val), syscall.Errno(-val)
+	}
+	return int(regs.Regs[0]), 0
 }
 
 func isEntryStop(regs *syscall.PtraceRegs) bool {
@@ -126,10 +149,18 @@ func isEntryStop(regs *syscall.PtraceRegs) bool {
 	return regs.Regs[7] == 0
 }
 
+func isCompat(regs *syscall.PtraceRegs) bool {
+	return regs.Pstate == ArmRegsFlag
+}
+
+// inst returns the syscall number. The arm32 syscalls are mapped to the native ones, and the others are -1.
 func inst(regs *syscall.PtraceRegs) int {
 	if regs.Pstate == ArmRegsFlag {
 		regs := (*PtraceRegsArm)(unsafe.Pointer(regs))
-		return int(regs.Uregs[7])
+		if nr, ok := armSyscalls[regs.Uregs[7]]; ok {
+			return nr
+		}
+		return -1
 	}
 	return int(regs.Regs[8])
 }
@@ -156,9 +187,18 @@ func ptraceGetRegs(pid int, regs *syscall.PtraceRegs) error {
 	return nil
 }
 
-func getIovec(base *byte, l int) unix.Iovec {
-	return unix.Iovec{
-		Base: base,
-		Len:  uint64(l),
+// skipSyscall makes the kernel skip the syscall at the entry stop.
+func skipSyscall(pid int, regs *syscall.PtraceRegs) error {
+	nr := int32(-1)
+	iov := getIovec((*byte)(unsafe.Pointer(&nr)), int(unsafe.Sizeof(nr)))
+	return ptrace(syscall.PTRACE_SETREGSET, pid, NT_ARM_SYSTEM_CALL, uintptr(unsafe.Pointer(&iov)))
+}
+
+// setReturnValue sets the return value of the syscall at the exit stop in place.
+func setReturnValue(regs *syscall.PtraceRegs, val int) {
+	if regs.Pstate == ArmRegsFlag {
+		(*PtraceRegsArm)(unsafe.Pointer(regs)).Uregs[0] = uint32(val)
+	} else {
+		regs.Regs[0] = uint64(val)
 	}
 }
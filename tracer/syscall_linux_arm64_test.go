@@ -0,0 +1,32 @@
+//go:build linux && arm64
+
+package tracer
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestRegisters(t *testing.T) {
+	for _, compat := range []bool{false, true} {
+		for _, c := range []struct {
+			val   int
+			errno syscall.Errno
+		}{
+			{0, 0},
+			{28, 0},
+			{-int(syscall.EINPROGRESS), syscall.EINPROGRESS},
+			{-int(syscall.ECONNREFUSED), syscall.ECONNREFUSED},
+		} {
+			// the arm32 return value is in the lower half of x0, which is not sign-extended
+			regs := &syscall.PtraceRegs{}
+			if compat {
+				regs.Pstate = ArmRegsFlag
+			}
+			setReturnValue(regs, c.val)
+			if val, errno := returnValueInt(regs); val != c.val || errno != c.errno {
+				t.Errorf("compat %v: return value %v %v, want %v %v", compat, val, errno, c.val, c.errno)
+			}
+		}
+	}
+}
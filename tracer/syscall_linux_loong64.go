@@ -0,0 +1,106 @@
+//go:build linux && loong64
+
+package tracer
+
+import (
+	"syscall"
+)
+
+// PtraceRegs is the registers at the syscall stops.
+type PtraceRegs = syscall.PtraceRegs
+
+const (
+	sysSocket     = syscall.SYS_SOCKET
+	sysConnect    = syscall.SYS_CONNECT
+	sysSendto     = syscall.SYS_SENDTO
+	sysSendmsg    = syscall.SYS_SENDMSG
+	sysFcntl      = syscall.SYS_FCNTL
+	sysClose      = syscall.SYS_CLOSE
+	sysSocketcall = sysNone
+)
+
+// RawSockaddrInet4 is a bit different from syscall.RawSockaddrInet4 that Port should be encoded by BigEndian.
+type RawSockaddrInet4 struct {
+	Family uint16
+	Port   [2]byte
+	Addr   [4]byte /* in_addr */
+	Zero   [8]uint8
+}
+
+// RawSockaddrInet6 is a bit different from syscall.RawSockaddrInet6 that fields except Family should be encoded by BigEndian.
+type RawSockaddrInet6 struct {
+	Family   uint16
+	Port     [2]byte
+	Flowinfo [4]byte
+	Addr     [16]byte /* in6_addr */
+	Scope_id [4]byte
+}
+
+type RawMsgHdr struct {
+	MsgName       uint64
+	LenMsgName    uint32
+	MsgIov        uint64
+	LenMsgIov     uint64
+	MsgControl    uint64
+	LenMsgControl uint64
+	Flags         int32
+}
+
+// arguments are in a0-a5 (r4-r9), but a0 is replaced by -ENOSYS at the entry stop and kept in orig_a0.
+func arguments(regs *PtraceRegs) []uint64 {
+	return []uint64{
+		regs.Orig_a0,
+		regs.Regs[5],
+		regs.Regs[6],
+		regs.Regs[7],
+		regs.Regs[8],
+		regs.Regs[9],
+	}
+}
+
+func setArgument(regs *PtraceRegs, order int, val uint64) {
+	switch order {
+	case 0:
+		regs.Orig_a0 = val
+	case 1, 2, 3, 4, 5:
+		regs.Regs[4+order] = val
+	}
+}
+
+func returnValueInt(regs *PtraceRegs) (int, syscall.Errno) {
+	if int64(regs.Regs[4]) < 0 {
+		return int(regs.Regs[4]), syscall.Errno(-int64(regs.Regs[4]))
+	}
+	return int(regs.Regs[4]), 0
+}
+
+func isEntryStop(regs *PtraceRegs) bool {
+	return int64(regs.Regs[4]) == -int64(syscall.ENOSYS)
+}
+
+func isCompat(regs *PtraceRegs) bool {
+	return false
+}
+
+func inst(regs *PtraceRegs) int {
+	return int(regs.Regs[11])
+}
+
+func ptraceSetRegs(pid int, regs *PtraceRegs) error {
+	return syscall.PtraceSetRegs(pid, regs)
+}
+
+func ptraceGetRegs(pid int, regs *PtraceRegs) error {
+	return syscall.PtraceGetRegs(pid, regs)
+}
+
+// skipSyscall makes the kernel skip the syscall at the entry stop. The registers are changed in place.
+func skipSyscall(pid int, regs *PtraceRegs) error {
+	regs.Regs[11] = ^uint64(0)
+	return nil
+}
+
+// setReturnValue sets the return value of the syscall at the exit stop in place.
+func setReturnValue(regs *PtraceRegs, val int) {
+	regs.Regs[4] = uint64(val)
+}
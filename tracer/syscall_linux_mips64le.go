@@ -0,0 +1,143 @@
+//go:build linux && mips64le
+
+package tracer
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// mipsRegs is the NT_PRSTATUS regset, which is different from syscall.PtraceRegs of PTRACE_GETREGS.
+type mipsRegs struct {
+	Regs     [32]uint64
+	Lo       uint64
+	Hi       uint64
+	Epc      uint64
+	Badvaddr uint64
+	Status   uint64
+	Cause    uint64
+	_        [7]uint64
+}
+
+// PtraceRegs is the registers at the syscall stops. v0 is the syscall number at the entry stop and the return
+// value at the exit stop, so the kind of the stop is got by PTRACE_GET_SYSCALL_INFO.
+type PtraceRegs struct {
+	mipsRegs
+	Entry bool
+}
+
+const (
+	sysSocket     = syscall.SYS_SOCKET
+	sysConnect    = syscall.SYS_CONNECT
+	sysSendto     = syscall.SYS_SENDTO
+	sysSendmsg    = syscall.SYS_SENDMSG
+	sysFcntl      = syscall.SYS_FCNTL
+	sysClose      = syscall.SYS_CLOSE
+	sysSocketcall = sysNone
+)
+
+const (
+	regV0 = 2
+	regA0 = 4
+	regA3 = 7
+)
+
+// RawSockaddrInet4 is a bit different from syscall.RawSockaddrInet4 that Port should be encoded by BigEndian.
+type RawSockaddrInet4 struct {
+	Family uint16
+	Port   [2]byte
+	Addr   [4]byte /* in_addr */
+	Zero   [8]uint8
+}
+
+// RawSockaddrInet6 is a bit different from syscall.RawSockaddrInet6 that fields except Family should be encoded by BigEndian.
+type RawSockaddrInet6 struct {
+	Family   uint16
+	Port     [2]byte
+	Flowinfo [4]byte
+	Addr     [16]byte /* in6_addr */
+	Scope_id [4]byte
+}
+
+type RawMsgHdr struct {
+	MsgName       uint64
+	LenMsgName    uint32
+	MsgIov        uint64
+	LenMsgIov     uint64
+	MsgControl    uint64
+	LenMsgControl uint64
+	Flags         int32
+}
+
+func arguments(regs *PtraceRegs) []uint64 {
+	return []uint64{
+		regs.Regs[regA0],
+		regs.Regs[regA0+1],
+		regs.Regs[regA0+2],
+		regs.Regs[regA0+3],
+		regs.Regs[regA0+4],
+		regs.Regs[regA0+5],
+	}
+}
+
+func setArgument(regs *PtraceRegs, order int, val uint64) {
+	if order >= 0 && order < 6 {
+		regs.Regs[regA0+order] = val
+	}
+}
+
+// returnValueInt returns the return value, which is the positive errno with a3 set if failed.
+func returnValueInt(regs *PtraceRegs) (int, syscall.Errno) {
+	if regs.Regs[regA3] != 0 {
+		return -int(regs.Regs[regV0]), syscall.Errno(regs.Regs[regV0])
+	}
+	return int(regs.Regs[regV0]), 0
+}
+
+func isEntryStop(regs *PtraceRegs) bool {
+	return regs.Entry
+}
+
+func isCompat(regs *PtraceRegs) bool {
+	return false
+}
+
+func inst(regs *PtraceRegs) int {
+	return int(regs.Regs[regV0])
+}
+
+func ptraceSetRegs(pid int, regs *PtraceRegs) error {
+	iov := getIovec((*byte)(unsafe.Pointer(&regs.mipsRegs)), int(unsafe.Sizeof(regs.mipsRegs)))
+	return ptrace(syscall.PTRACE_SETREGSET, pid, NT_PRSTATUS, uintptr(unsafe.Pointer(&iov)))
+}
+
+func ptraceGetRegs(pid int, regs *PtraceRegs) error {
+	iov := getIovec((*byte)(unsafe.Pointer(&regs.mipsRegs)), int(unsafe.Sizeof(regs.mipsRegs)))
+	if err := ptrace(syscall.PTRACE_GETREGSET, pid, NT_PRSTATUS, uintptr(unsafe.Pointer(&iov))); err != nil {
+		return err
+	}
+	info, err := getSyscallInfo(pid)
+	if err != nil {
+		return err
+	}
+	regs.Entry = info.Op == PTRACE_SYSCALL_INFO_ENTRY
+	return nil
+}
+
+// skipSyscall makes the kernel skip the syscall at the entry stop. The registers are changed in place, and the
+// kernel takes the syscall number from v0 after they are set.
+func skipSyscall(pid int, regs *PtraceRegs) error {
+	regs.Regs[regV0] = ^uint64(0)
+	return nil
+}
+
+// setReturnValue sets the return value of the syscall at the exit stop in place.
+func setReturnValue(regs *PtraceRegs, val int) {
+	if val < 0 {
+		regs.Regs[regV0] = uint64(-val)
+		regs.Regs[regA3] = 1
+	} else {
+		regs.Regs[regV0] = uint64(val)
+		regs.Regs[regA3] = 0
+	}
+}
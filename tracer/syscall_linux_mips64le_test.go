@@ -0,0 +1,48 @@
+//go:build linux && mips64le
+
+package tracer
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestRegisters(t *testing.T) {
+	regs := &PtraceRegs{Entry: true}
+	regs.Regs[regV0] = sysConnect
+	for i := 0; i < 6; i++ {
+		regs.Regs[regA0+i] = uint64(i + 1)
+	}
+	if args := arguments(regs); !reflect.DeepEqual(args, []uint64{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("unexpected arguments: %v", args)
+	}
+	if !isEntryStop(regs) || inst(regs) != sysConnect {
+		t.Fatalf("unexpected stop: %+v", regs)
+	}
+
+	// the error is flagged by a3, and v0 is the positive errno
+	for _, c := range []struct {
+		v0, a3 uint64
+		val    int
+		errno  syscall.Errno
+	}{
+		{0, 0, 0, 0},
+		{28, 0, 28, 0},
+		{uint64(syscall.EINPROGRESS), 1, -int(syscall.EINPROGRESS), syscall.EINPROGRESS},
+		{uint64(syscall.ECONNREFUSED), 1, -int(syscall.ECONNREFUSED), syscall.ECONNREFUSED},
+	} {
+		regs := &PtraceRegs{}
+		regs.Regs[regV0], regs.Regs[regA3] = c.v0, c.a3
+		if val, errno := returnValueInt(regs); val != c.val || errno != c.errno {
+			t.Errorf("v0 %v a3 %v: return value %v %v, want %v %v", c.v0, c.a3, val, errno, c.val, c.errno)
+		}
+		// the registers are set back in the same way, clearing a3 of the success
+		regs = &PtraceRegs{}
+		regs.Regs[regA3] = 1
+		setReturnValue(regs, c.val)
+		if regs.Regs[regV0] != c.v0 || regs.Regs[regA3] != c.a3 {
+			t.Errorf("return value %v: v0 %v a3 %v, want %v %v", c.val, regs.Regs[regV0], regs.Regs[regA3], c.v0, c.a3)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+//go:build linux && riscv64
+
+package tracer
+
+import (
+	"syscall"
+)
+
+// PtraceRegs is the registers at the syscall stops. a0 is -ENOSYS at the entry stop, and the first argument is in
+// orig_a0 which is not in the regset, so they are got by PTRACE_GET_SYSCALL_INFO.
+type PtraceRegs struct {
+	syscall.PtraceRegs
+	OrigA0 uint64
+	Entry  bool
+}
+
+const (
+	sysSocket     = syscall.SYS_SOCKET
+	sysConnect    = syscall.SYS_CONNECT
+	sysSendto     = syscall.SYS_SENDTO
+	sysSendmsg    = syscall.SYS_SENDMSG
+	sysFcntl      = syscall.SYS_FCNTL
+	sysClose      = syscall.SYS_CLOSE
+	sysSocketcall = sysNone
+)
+
+// RawSockaddrInet4 is a bit different from syscall.RawSockaddrInet4 that Port should be encoded by BigEndian.
+type RawSockaddrInet4 struct {
+	Family uint16
+	Port   [2]byte
+	Addr   [4]byte /* in_addr */
+	Zero   [8]uint8
+}
+
+// RawSockaddrInet6 is a bit different from syscall.RawSockaddrInet6 that fields except Family should be encoded by BigEndian.
+type RawSockaddrInet6 struct {
+	Family   uint16
+	Port     [2]byte
+	Flowinfo [4]byte
+	Addr     [16]byte /* in6_addr */
+	Scope_id [4]byte
+}
+
+type RawMsgHdr struct {
+	MsgName       uint64
+	LenMsgName    uint32
+	MsgIov        uint64
+	LenMsgIov     uint64
+	MsgControl    uint64
+	LenMsgControl uint64
+	Flags         int32
+}
+
+func arguments(regs *PtraceRegs) []uint64 {
+	return []uint64{
+		regs.OrigA0,
+		regs.A1,
+		regs.A2,
+		regs.A3,
+		regs.A4,
+		regs.A5,
+	}
+}
+
+// setArgument does not set the first argument, which is never changed.
+func setArgument(regs *PtraceRegs, order int, val uint64) {
+	switch order {
+	case 1:
+		regs.A1 = val
+	case 2:
+		regs.A2 = val
+	case 3:
+		regs.A3 = val
+	case 4:
+		regs.A4 = val
+	case 5:
+		regs.A5 = val
+	}
+}
+
+func returnValueInt(regs *PtraceRegs) (int, syscall.Errno) {
+	if int64(regs.A0) < 0 {
+		return int(regs.A0), syscall.Errno(-int64(regs.A0))
+	}
+	return int(regs.A0), 0
+}
+
+func isEntryStop(regs *PtraceRegs) bool {
+	return regs.Entry
+}
+
+func isCompat(regs *PtraceRegs) bool {
+	return false
+}
+
+func inst(regs *PtraceRegs) int {
+	return int(regs.A7)
+}
+
+func ptraceSetRegs(pid int, regs *PtraceRegs) error {
+	return syscall.PtraceSetRegs(pid, &regs.PtraceRegs)
+}
+
+func ptraceGetRegs(pid int, regs *PtraceRegs) error {
+	if err := syscall.PtraceGetRegs(pid, &regs.PtraceRegs); err != nil {
+		return err
+	}
+	info, err := getSyscallInfo(pid)
+	if err != nil {
+		return err
+	}
+	regs.Entry = info.Op == PTRACE_SYSCALL_INFO_ENTRY
+	regs.OrigA0 = regs.A0
+	if regs.Entry {
+		regs.OrigA0 = info.Data[1]
+	}
+	return nil
+}
+
+// skipSyscall makes the kernel skip the syscall at the entry stop. The registers are changed in place.
+func skipSyscall(pid int, regs *PtraceRegs) error {
+	regs.A7 = ^uint64(0)
+	return nil
+}
+
+// setReturnValue sets the return value of the syscall at the exit stop in place.
+func setReturnValue(regs *PtraceRegs, val int) {
+	regs.A0 = uint64(val)
+}
@@ -0,0 +1,44 @@
+//go:build linux && riscv64
+
+package tracer
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestRegisters(t *testing.T) {
+	// at the entry stop, a0 is -ENOSYS and the first argument is in orig_a0
+	regs := &PtraceRegs{OrigA0: 3, Entry: true}
+	setReturnValue(regs, -int(syscall.ENOSYS))
+	regs.A1, regs.A2, regs.A3, regs.A4, regs.A5, regs.A7 = 1, 2, 3, 4, 5, sysConnect
+	if args := arguments(regs); !reflect.DeepEqual(args, []uint64{3, 1, 2, 3, 4, 5}) {
+		t.Fatalf("unexpected arguments: %v", args)
+	}
+	if !isEntryStop(regs) || inst(regs) != sysConnect {
+		t.Fatalf("unexpected stop: %+v", regs)
+	}
+	// the first argument is never changed
+	setArgument(regs, 0, 9)
+	setArgument(regs, 2, 16)
+	if args := arguments(regs); !reflect.DeepEqual(args, []uint64{3, 1, 16, 3, 4, 5}) {
+		t.Fatalf("unexpected arguments: %v", args)
+	}
+
+	for _, c := range []struct {
+		val   int
+		errno syscall.Errno
+	}{
+		{0, 0},
+		{28, 0},
+		{-int(syscall.EINPROGRESS), syscall.EINPROGRESS},
+		{-int(syscall.ECONNREFUSED), syscall.ECONNREFUSED},
+	} {
+		regs := &PtraceRegs{}
+		setReturnValue(regs, c.val)
+		if val, errno := returnValueInt(regs); val != c.val || errno != c.errno {
+			t.Errorf("return value %v %v, want %v %v", val, errno, c.val, c.errno)
+		}
+	}
+}
@@ -2,65 +2,99 @@ package tracer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/mzz2017/gg/backend"
 	"github.com/mzz2017/gg/dialer"
+	"github.com/mzz2017/gg/metrics"
+	"github.com/mzz2017/gg/policy"
 	"github.com/mzz2017/gg/proxy"
+	"github.com/mzz2017/gg/sandbox"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
+// syscallStop is the stop signal of syscall stops with PTRACE_O_TRACESYSGOOD, which tells them from SIGTRAP.
+const syscallStop = syscall.SIGTRAP | 0x80
+
 type SocketMetadata struct {
 	Family   int
 	Type     int
 	Protocol int
 }
 
-// Tracer is not thread-safe.
+// Tracer is not thread-safe, except the methods to inspect and control the session.
+// The stops are waited and the tracees are resumed on the tracer thread, but the connect(2), sendto(2) and
+// sendmsg(2) to redirect are handled in other goroutines, so that a slow dial does not stop the other tracees.
 type Tracer struct {
 	ctx               context.Context
-	ignoreUDP         bool
+	ignoreUDP         atomic.Bool
 	ignorePrivateAddr bool
-	supportUDP        bool
 	log               *logrus.Logger
 	proxy             *proxy.Proxy
 	proc              *os.Process
 	storehouse        Storehouse
 	socketInfo        map[int]map[int]SocketMetadata
+	mu                sync.Mutex // guards processes and tracees
+	processes         map[int]*proxy.Process
+	tracees           map[int]struct{} // the traced threads
+	allowlist         sandbox.Allowlist
+	policy            policy.Policy
+	refused           map[int]syscall.Errno // the errno to return at the exit stop of refused syscalls
+	syscalls          map[int]int           // the syscall at the last entry stop of each thread
+	handled           chan *stop            // the stops handled in other goroutines
 	closed            chan struct{}
-	exitCode          int
+	status            syscall.WaitStatus
 	exitErr           error
 }
 
-func New(ctx context.Context, name string, argv []string, attr *os.ProcAttr, dialer *dialer.Dialer, ignoreUDP bool, ignorePrivateAddr bool, logger *logrus.Logger) (*Tracer, error) {
+// New starts the program and traces it.
+func New(ctx context.Context, name string, argv []string, attr *os.ProcAttr, opt backend.Options) (*Tracer, error) {
 	t := &Tracer{
 		ctx:               ctx,
-		ignoreUDP:         ignoreUDP,
-		ignorePrivateAddr: ignorePrivateAddr,
-		supportUDP:        dialer.SupportUDP(),
-		log:               logger,
-		proxy:             proxy.New(logger, dialer),
+		ignorePrivateAddr: opt.IgnorePrivateAddr,
+		log:               opt.Logger,
+		proxy:             proxy.New(opt.Logger, opt.Dialer),
 		proc:              &os.Process{},
 		storehouse:        MakeStorehouse(),
 		socketInfo:        make(map[int]map[int]SocketMetadata),
+		processes:         make(map[int]*proxy.Process),
+		tracees:           make(map[int]struct{}),
+		allowlist:         opt.Allowlist,
+		policy:            opt.Policy,
+		refused:           make(map[int]syscall.Errno),
+		syscalls:          make(map[int]int),
+		handled:           make(chan *stop),
 		closed:            make(chan struct{}),
-		exitCode:          0,
-		exitErr:           nil,
 	}
+	t.ignoreUDP.Store(opt.IgnoreUDP)
+	t.proxy.SetStats(opt.Stats)
+	t.proxy.SetConnLog(opt.ConnLog)
+	t.proxy.SetCapture(opt.Capture)
+	t.proxy.SetAuthenticator(t.tracedProcesses)
+	listenErr := make(chan error, 1)
 	go func() {
 		if err := t.proxy.ListenAndServe(0); err != nil {
-			t.exitCode = 1
-			t.exitErr = err
-			close(t.closed)
+			listenErr <- err
 		}
 	}()
-	// waiting for listening
-	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-t.proxy.Listened():
+	case err := <-listenErr:
+		return nil, err
+	}
 
 	done := make(chan struct{})
+	var startErr error
 	go func() {
 		runtime.LockOSThread()
 		if attr == nil {
@@ -73,77 +107,170 @@ func New(ctx context.Context, name string, argv []string, attr *os.ProcAttr, dia
 		attr.Sys.Pdeathsig = syscall.SIGCHLD
 		proc, err := os.StartProcess(name, argv, attr)
 		if err != nil {
+			startErr = err
 			close(done)
-			t.exitErr = err
 			return
 		}
 		t.proc = proc
 		close(done)
-		time.Sleep(1 * time.Millisecond)
-		code, err := t.trace()
-		t.exitCode = code
-		t.exitErr = err
-		if err != nil {
+		t.status, t.exitErr = t.trace()
+		if t.exitErr != nil {
 			t.proc.Kill()
 		}
 		close(t.closed)
 	}()
 	<-done
-	if t.exitErr != nil {
-		return nil, t.exitErr
+	if startErr != nil {
+		return nil, startErr
 	}
 	return t, nil
 }
 
-func (t *Tracer) Wait() (exitCode int, err error) {
+// Proxy returns the proxy that the traffic is redirected to.
+func (t *Tracer) Proxy() *proxy.Proxy {
+	return t.proxy
+}
+
+// Dialer returns the dialer to the current node.
+func (t *Tracer) Dialer() *dialer.Dialer {
+	return t.proxy.Dialer().(*dialer.Dialer)
+}
+
+// SetDialer switches the node for new connections.
+func (t *Tracer) SetDialer(d *dialer.Dialer) {
+	t.proxy.SetDialer(d)
+}
+
+// UDPEnabled reports whether UDP traffic is redirected.
+func (t *Tracer) UDPEnabled() bool {
+	return !t.ignoreUDP.Load()
+}
+
+// SetUDPEnabled sets whether new UDP traffic is redirected.
+func (t *Tracer) SetUDPEnabled(enabled bool) {
+	t.ignoreUDP.Store(!enabled)
+}
+
+// Signal forwards sig to the traced processes.
+func (t *Tracer) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal: %v", sig)
+	}
+	pids := t.tracedProcesses()
+	// the program is not traced any more once it is detached
+	if !slices.Contains(pids, t.proc.Pid) {
+		pids = append(pids, t.proc.Pid)
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, s); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait waits for the program to exit. If the context is done, the tracees are detached, and it waits for the
+// program to exit as well.
+func (t *Tracer) Wait() (status syscall.WaitStatus, err error) {
 	<-t.closed
-	return t.exitCode, t.exitErr
+	return t.status, t.exitErr
+}
+
+func (t *Tracer) addTracee(tid int) {
+	t.mu.Lock()
+	t.tracees[tid] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *Tracer) removeTracee(tid int) {
+	t.mu.Lock()
+	delete(t.tracees, tid)
+	t.mu.Unlock()
+}
+
+// tracedProcesses returns the processes that the tracees belong to, which authenticates the connections to the
+// proxy.
+func (t *Tracer) tracedProcesses() []int {
+	t.mu.Lock()
+	threads := make([]int, 0, len(t.tracees))
+	for tid := range t.tracees {
+		threads = append(threads, tid)
+	}
+	t.mu.Unlock()
+	seen := make(map[int]struct{}, len(threads))
+	var pids []int
+	for _, tid := range threads {
+		pid := t.process(tid).Pid
+		if _, ok := seen[pid]; !ok {
+			seen[pid] = struct{}{}
+			pids = append(pids, pid)
+		}
+	}
+	return pids
 }
 
 // Trace traces the process. proc is the process ID (main thread).
-func (t *Tracer) trace() (exitCode int, err error) {
+func (t *Tracer) trace() (status syscall.WaitStatus, err error) {
 	proc := t.proc.Pid
 	// Thanks https://stackoverflow.com/questions/5477976/how-to-ptrace-a-multi-threaded-application and https://github.com/hmgle/graftcp
-	err = syscall.PtraceAttach(proc)
-	if err != nil {
-		if err == syscall.EPERM {
-			_, err = syscall.PtraceGetEventMsg(proc)
-			if err != nil {
-				return 0, err
-			}
-		} else {
-			return 0, err
-		}
-	}
 	options := syscall.PTRACE_O_TRACECLONE | syscall.PTRACE_O_TRACEFORK |
-		syscall.PTRACE_O_TRACEVFORK | syscall.PTRACE_O_TRACEEXEC
-	if err = syscall.PtraceSetOptions(proc, options); err != nil {
-		return 0, err
-	}
-	if err = syscall.PtraceSyscall(proc, 0); err != nil {
+		syscall.PTRACE_O_TRACEVFORK | syscall.PTRACE_O_TRACEEXEC | syscall.PTRACE_O_TRACESYSGOOD
+	if err = seize(proc, options); err != nil {
 		if err == syscall.ESRCH {
 			return 0, fmt.Errorf("tracee died unexpectedly: %w", err)
 		}
-		return 0, fmt.Errorf("PtraceSyscall() threw: %w", err)
+		return 0, err
 	}
+	t.addTracee(proc)
 	//t.log.Tracef("child %v created\n", proc)
+	// PTRACE_PEEKDATA and PTRACE_POKEDATA only work on the tracer thread, and handing the stops over to other
+	// goroutines costs more than it saves on a single CPU
+	async := processVM && runtime.GOMAXPROCS(0) > 1
+	// SIGCHLD wakes the tracer thread to wait for the tracees while some stops are handled in other goroutines
+	sigchld := make(chan os.Signal, 1)
+	defer signal.Stop(sigchld)
+	handling := 0
+	handle := func() {
+		if handling == 0 {
+			signal.Notify(sigchld, syscall.SIGCHLD)
+		}
+		handling++
+	}
+	handled := func(s *stop) {
+		if handling--; handling == 0 {
+			signal.Stop(sigchld)
+		}
+		t.resume(s)
+	}
 	for {
+		// the context is checked once a tracee stops, e.g. for the signal forwarded to it
 		select {
 		case <-t.ctx.Done():
-			syscall.PtraceDetach(proc)
-			return 1, t.ctx.Err()
+			return t.detach(handling)
+		case s := <-t.handled:
+			handled(s)
+			continue
 		default:
 		}
+		waitOptions := syscall.WALL
+		if handling > 0 {
+			waitOptions |= syscall.WNOHANG
+		}
 		var status syscall.WaitStatus
-		child, err := syscall.Wait4(-1, &status, syscall.WALL, nil)
+		child, err := syscall.Wait4(-1, &status, waitOptions, nil)
 		if err != nil {
 			return 0, fmt.Errorf("wait4() threw: %w", err)
 		}
-		select {
-		case <-t.ctx.Done():
-			syscall.PtraceDetach(proc)
-			return 1, t.ctx.Err()
-		default:
+		if child == 0 {
+			// no state change yet
+			select {
+			case <-t.ctx.Done():
+			case s := <-t.handled:
+				handled(s)
+			case <-sigchld:
+			}
+			continue
 		}
 		//t.log.Tracef("main: %v, child: %v\n", proc, child)
 		if t.getSocketInfo(child, 0) == nil {
@@ -164,42 +291,69 @@ func (t *Tracer) trace() (exitCode int, err error) {
 		switch {
 		case status.Exited():
 			t.log.Tracef("child %v exited\n", child)
-			t.removeProcessSocketInfo(child)
+			t.forgetThread(child)
 			if child == proc {
-				return status.ExitStatus(), nil
+				return status, nil
 			}
 		case status.Signaled():
 			t.log.Tracef("child %v killed\n", child)
-			t.removeProcessSocketInfo(child)
+			t.forgetThread(child)
 			if child == proc {
-				return status.ExitStatus(), nil
+				return status, nil
 			}
+		case status.Stopped() && ptraceEvent(status) == unix.PTRACE_EVENT_STOP:
+			if isGroupStop(status) {
+				// keep it stopped until SIGCONT
+				if err := ptrace(unix.PTRACE_LISTEN, child, 0, 0); err != nil {
+					t.log.Tracef("PTRACE_LISTEN: %v", err)
+				}
+				if child == proc {
+					backend.Suspend(proc)
+				}
+				continue
+			}
+			// a new tracee starts, or it is continued
 		case status.Stopped():
 			switch signal := status.StopSignal(); signal {
 			case syscall.SIGTRAP:
-				var regs syscall.PtraceRegs
-				err = ptraceGetRegs(child, &regs)
-				if err == nil {
-					//t.log.Tracef("pid: %v, inst: %v", child, inst(&regs))
-					entryStop := isEntryStop(&regs)
-					if entryStop {
-						if err := t.entryHandler(child, &regs); err != nil {
-							t.log.Infof("entryHandler: %v", err)
-						}
-					} else {
-						if err := t.exitHandler(child, &regs); err != nil {
-							t.log.Infof("exitHandler: %v", err)
+				switch status.TrapCause() {
+				case 0:
+					// not caused by ptrace
+					sig = int(signal)
+				case syscall.PTRACE_EVENT_CLONE, syscall.PTRACE_EVENT_FORK, syscall.PTRACE_EVENT_VFORK:
+					if tid, err := syscall.PtraceGetEventMsg(child); err == nil {
+						t.addTracee(int(tid))
+					}
+				case syscall.PTRACE_EVENT_EXEC:
+					// the process information is changed
+					t.forgetProcess(child)
+					if tid, err := syscall.PtraceGetEventMsg(child); err == nil && int(tid) != child {
+						// the thread that executed the program took over the thread ID of the leader
+						t.forgetThread(int(tid))
+					}
+					if len(t.policy) > 0 {
+						if p, action := t.process(child), t.action(child); action != policy.ActionProxy {
+							t.log.Infof("policy: %v (%v): %v", p.Pid, p.Exe, action)
 						}
 					}
-				} else {
+				}
+			case syscallStop:
+				s := &stop{pid: child}
+				if err = ptraceGetRegs(child, &s.regs); err != nil {
 					t.log.Tracef("PtraceGetRegs: %v", err)
+					break
+				}
+				s.orig = s.regs
+				if t.handleStop(s, async) {
+					handle()
+				} else {
+					t.resume(s)
 				}
+				continue
 			default:
 				// urgent I/O condition, window changed, etc.
 				sig = int(signal)
 				switch signal {
-				case syscall.SIGSTOP:
-					sig = 0
 				case syscall.SIGILL:
 					t.log.Errorf("%v: %v", child, signal)
 				default:
@@ -211,6 +365,229 @@ func (t *Tracer) trace() (exitCode int, err error) {
 	}
 }
 
+// forgetThread drops the information of the thread tid, which has exited.
+func (t *Tracer) forgetThread(tid int) {
+	t.removeProcessSocketInfo(tid)
+	t.forgetProcess(tid)
+	t.removeTracee(tid)
+	delete(t.refused, tid)
+	delete(t.syscalls, tid)
+}
+
+// handleStop handles the syscall stop s. If async, the redirection is handled in another goroutine, which sends s
+// to t.handled to resume the tracee when finished, and it reports true.
+func (t *Tracer) handleStop(s *stop, async bool) bool {
+	metrics.SyscallStops.Inc()
+	start := time.Now()
+	//t.log.Tracef("pid: %v, inst: %v", s.pid, inst(&s.regs))
+	entryStop := isEntryStop(&s.regs)
+	if _, ok := t.refused[s.pid]; ok {
+		// the skipped syscall looks like an entry stop on some architectures
+		entryStop = false
+	}
+	if !entryStop {
+		if err := t.exitHandler(s); err != nil {
+			t.log.Infof("exitHandler: %v", err)
+		}
+		metrics.HandlerSeconds.Observe(time.Since(start))
+		return false
+	}
+	work, err := t.entryHandler(s)
+	if err != nil {
+		t.log.Infof("entryHandler: %v", err)
+	}
+	if work == nil || !async {
+		if work != nil {
+			if err := work(); err != nil {
+				t.log.Infof("entryHandler: %v", err)
+			}
+		}
+		metrics.HandlerSeconds.Observe(time.Since(start))
+		return false
+	}
+	s.async = true
+	go func() {
+		if err := work(); errors.Is(err, offTracerThreadErr) {
+			// the memory is read before any change, so the work can be done again by PTRACE_PEEKDATA
+			s.async, s.retry = false, work
+		} else if err != nil {
+			t.log.Infof("entryHandler: %v", err)
+		}
+		metrics.HandlerSeconds.Observe(time.Since(start))
+		select {
+		case t.handled <- s:
+		case <-t.closed:
+		}
+	}()
+	return true
+}
+
+// resume applies the changes of the handlers to the tracee of the stop s, and resumes it. The work to retry on the
+// tracer thread is done first.
+func (t *Tracer) resume(s *stop) {
+	if s.retry != nil {
+		if err := s.retry(); err != nil {
+			t.log.Infof("entryHandler: %v", err)
+		}
+		s.retry = nil
+	}
+	for _, p := range s.pokes {
+		if err := pokeData(s.pid, p.addr, p.data); err != nil {
+			// leave the syscall as it is
+			t.log.Infof("pokeData: %v", err)
+			s.regs = s.orig
+			break
+		}
+	}
+	refused := s.refused
+	if refused != 0 {
+		if err := skipSyscall(s.pid, &s.regs); err != nil {
+			t.log.Infof("skipSyscall: %v", err)
+			refused = 0
+		}
+	}
+	if s.regs != s.orig {
+		if err := ptraceSetRegs(s.pid, &s.regs); err != nil {
+			t.log.Infof("ptraceSetRegs: %v", err)
+		}
+	}
+	// the tracee may have been killed while the stop was handled in another goroutine
+	if err := syscall.PtraceSyscall(s.pid, 0); err == nil && refused != 0 {
+		t.refused[s.pid] = refused
+	}
+}
+
+// seize makes the program pid, which stops after it is executed with PTRACE_TRACEME, traced by PTRACE_SEIZE
+// instead, with which group-stops are told from signal-delivery-stops for job control.
+func seize(pid int, options int) error {
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &status, syscall.WALL, nil); err != nil {
+		return err
+	}
+	if !status.Stopped() {
+		return syscall.ESRCH
+	}
+	// keep it stopped while it is not traced
+	if err := ptrace(syscall.PTRACE_DETACH, pid, 0, uintptr(syscall.SIGSTOP)); err != nil {
+		return fmt.Errorf("PTRACE_DETACH: %w", err)
+	}
+	if _, err := syscall.Wait4(pid, &status, syscall.WUNTRACED, nil); err != nil {
+		return err
+	}
+	if !status.Stopped() {
+		return syscall.ESRCH
+	}
+	if err := ptrace(unix.PTRACE_SEIZE, pid, 0, uintptr(options)); err != nil {
+		return fmt.Errorf("PTRACE_SEIZE: %w", err)
+	}
+	// the group-stop is reported again
+	if _, err := syscall.Wait4(pid, &status, syscall.WALL, nil); err != nil {
+		return err
+	}
+	if err := syscall.Kill(pid, syscall.SIGCONT); err != nil {
+		return err
+	}
+	return syscall.PtraceSyscall(pid, 0)
+}
+
+// ptraceEvent returns the PTRACE_EVENT_* of the stop.
+func ptraceEvent(status syscall.WaitStatus) int {
+	return int(status>>16) & 0xff
+}
+
+// isGroupStop reports whether the PTRACE_EVENT_STOP is a group-stop, rather than the start of a new tracee or
+// PTRACE_INTERRUPT.
+func isGroupStop(status syscall.WaitStatus) bool {
+	switch status.StopSignal() {
+	case syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		return true
+	}
+	return false
+}
+
+// detach detaches all the tracees, which keep running untraced, and waits for the program to exit. handling is
+// the number of the stops being handled in other goroutines.
+func (t *Tracer) detach(handling int) (status syscall.WaitStatus, err error) {
+	proc := t.proc.Pid
+	for ; handling > 0; handling-- {
+		t.resume(<-t.handled)
+	}
+	// PTRACE_DETACH only works on stopped tracees, so every thread is interrupted first
+	t.mu.Lock()
+	running := make(map[int]struct{}, len(t.tracees))
+	for tid := range t.tracees {
+		running[tid] = struct{}{}
+	}
+	t.mu.Unlock()
+	for tid := range running {
+		if err := ptrace(unix.PTRACE_INTERRUPT, tid, 0, 0); err != nil {
+			delete(running, tid)
+		}
+	}
+	detached := make(map[int]struct{})
+	exited := false
+	for len(running) > 0 {
+		var ws syscall.WaitStatus
+		child, err := syscall.Wait4(-1, &ws, syscall.WALL, nil)
+		if err != nil {
+			break
+		}
+		switch {
+		case ws.Exited(), ws.Signaled():
+			delete(running, child)
+			t.forgetThread(child)
+			if child == proc {
+				exited, status = true, ws
+			}
+		case ws.Stopped() && ws.StopSignal() == syscallStop:
+			// keep redirecting, and interrupt it again because any stop clears the pending interrupt
+			s := &stop{pid: child}
+			if err := ptraceGetRegs(child, &s.regs); err == nil {
+				s.orig = s.regs
+				t.handleStop(s, false)
+				t.resume(s)
+			} else {
+				syscall.PtraceSyscall(child, 0)
+			}
+			if err := ptrace(unix.PTRACE_INTERRUPT, child, 0, 0); err != nil {
+				delete(running, child)
+			}
+		case ws.Stopped():
+			sig := 0
+			switch signal := ws.StopSignal(); {
+			case ptraceEvent(ws) == unix.PTRACE_EVENT_STOP:
+				// interrupted, started or in group-stop, which is kept after detached
+			case signal == syscall.SIGTRAP && ptraceEvent(ws) != 0:
+				switch ptraceEvent(ws) {
+				case syscall.PTRACE_EVENT_CLONE, syscall.PTRACE_EVENT_FORK, syscall.PTRACE_EVENT_VFORK:
+					// the new tracee starts with PTRACE_EVENT_STOP, which may have been reported
+					if tid, err := syscall.PtraceGetEventMsg(child); err == nil {
+						if _, ok := detached[int(tid)]; !ok {
+							running[int(tid)] = struct{}{}
+						}
+					}
+				}
+			default:
+				// the signals forwarded to the tracees are delivered after detached
+				sig = int(signal)
+			}
+			if err := ptrace(syscall.PTRACE_DETACH, child, 0, uintptr(sig)); err != nil {
+				t.log.Tracef("PTRACE_DETACH: %v", err)
+			}
+			delete(running, child)
+			detached[child] = struct{}{}
+			t.forgetThread(child)
+		}
+	}
+	if !exited {
+		// the program is still the child of gg
+		if status, err = backend.WaitProgram(proc); err != nil {
+			return 0, fmt.Errorf("wait4() threw: %w", err)
+		}
+	}
+	return status, nil
+}
+
 func (t *Tracer) getSocketInfo(pid int, socketFD int) (metadata *SocketMetadata) {
 	if _, ok := t.socketInfo[pid]; !ok {
 		return nil
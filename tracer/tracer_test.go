@@ -0,0 +1,420 @@
+package tracer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/gg/backend"
+	"github.com/mzz2017/gg/dialer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// The test binary runs as the tracee if traceeEnv is set. For benchmarks, it waits for a byte from stdin, and then
+// makes the syscall given by traceeEnv as many times as traceeNEnv.
+const (
+	traceeEnv     = "GG_TRACEE"
+	traceeNEnv    = "GG_TRACEE_N"
+	traceeAddrEnv = "GG_TRACEE_ADDR"
+)
+
+func TestMain(m *testing.M) {
+	if call := os.Getenv(traceeEnv); call != "" {
+		os.Exit(tracee(call))
+	}
+	os.Exit(m.Run())
+}
+
+// traceeEnviron returns the environment of the test with the tracee running call. The variables of the tracee
+// running the test are replaced, or the first ones would be used.
+func traceeEnviron(call string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GG_TRACEE") {
+			env = append(env, kv)
+		}
+	}
+	return append(env, traceeEnv+"="+call)
+}
+
+func tracee(call string) int {
+	switch call {
+	case "exit":
+		return 7
+	case "sleep":
+		signal.Ignore(syscall.SIGTERM)
+		time.Sleep(time.Hour)
+		return 0
+	case "detach":
+		return detachTracee()
+	case "kill":
+		signal.Reset(syscall.SIGTERM)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(time.Second)
+		return 1
+	case "stop":
+		return stopTracee()
+	case "v6only":
+		return v6OnlyTracee(os.Getenv(traceeAddrEnv))
+	case "stopped":
+		// stop until continued by the parent
+		syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+		return 0
+	}
+	n, _ := strconv.Atoi(os.Getenv(traceeNEnv))
+	var b [1]byte
+	if _, err := os.Stdin.Read(b[:]); err != nil {
+		return 1
+	}
+	switch call {
+	case "getppid":
+		for i := 0; i < n; i++ {
+			syscall.Getppid()
+		}
+	case "sendto":
+		addr, err := net.ResolveUDPAddr("udp4", os.Getenv(traceeAddrEnv))
+		if err != nil {
+			return 1
+		}
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+		if err != nil {
+			return 1
+		}
+		to := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(to.Addr[:], addr.IP.To4())
+		for i := 0; i < n; i++ {
+			syscall.Sendto(fd, b[:], 0, to)
+		}
+	default:
+		return 1
+	}
+	return 0
+}
+
+// detachTracee starts a child, and exits with 3 once neither of them is traced after SIGTERM.
+func detachTracee() int {
+	child, err := os.StartProcess(os.Args[0], []string{os.Args[0]}, &os.ProcAttr{
+		Env: traceeEnviron("sleep"),
+	})
+	if err != nil {
+		return 1
+	}
+	defer child.Wait()
+	defer child.Kill()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	fmt.Println("ready")
+	<-sigs
+	for deadline := time.Now().Add(5 * time.Second); traced(os.Getpid()) || traced(child.Pid); {
+		if time.Now().After(deadline) {
+			return 1
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 3
+}
+
+// stopTracee starts a child that stops itself, and exits with 5 if the child is kept stopped until continued. The
+// child is not the program, with which the test would be suspended.
+func stopTracee() int {
+	child, err := os.StartProcess(os.Args[0], []string{os.Args[0]}, &os.ProcAttr{
+		Env: traceeEnviron("stopped"),
+	})
+	if err != nil {
+		return 1
+	}
+	time.Sleep(500 * time.Millisecond)
+	var status syscall.WaitStatus
+	if pid, err := syscall.Wait4(child.Pid, &status, syscall.WNOHANG, nil); err != nil || pid != 0 {
+		// exited without being continued
+		child.Kill()
+		return 1
+	}
+	if err = child.Signal(syscall.SIGCONT); err != nil {
+		return 1
+	}
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		return 1
+	}
+	return 5
+}
+
+// v6OnlyTracee connects to addr with an IPv6 socket with IPV6_V6ONLY set, and exits with 0 if the data is echoed.
+func v6OnlyTracee(addr string) int {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return 1
+	}
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return 1
+	}
+	f := os.NewFile(uintptr(fd), "v6only")
+	defer f.Close()
+	if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1); err != nil {
+		return 1
+	}
+	if err = syscall.Connect(fd, &syscall.SockaddrInet6{Port: int(ap.Port()), Addr: ap.Addr().As16()}); err != nil {
+		// IPv4-mapped addresses are unreachable without gg
+		return 2
+	}
+	b := []byte("ping")
+	if _, err = f.Write(b); err != nil {
+		return 1
+	}
+	if _, err = io.ReadFull(f, b); err != nil || string(b) != "ping" {
+		return 1
+	}
+	return 0
+}
+
+// traced reports whether any thread of the process pid is traced.
+func traced(pid int) bool {
+	tasks, _ := filepath.Glob("/proc/" + strconv.Itoa(pid) + "/task/*/status")
+	for _, task := range tasks {
+		b, err := os.ReadFile(task)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if tracer, ok := strings.CutPrefix(line, "TracerPid:"); ok && strings.TrimSpace(tracer) != "0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newTracer(ctx context.Context, attr *os.ProcAttr) (*Tracer, error) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return New(ctx, os.Args[0], []string{os.Args[0]}, attr, backend.Options{
+		Dialer: dialer.NewDialer(dialer.FullconeDirect, true, "direct", "direct", ""),
+		Logger: log,
+	})
+}
+
+func TestExitStatus(t *testing.T) {
+	cases := []struct {
+		call   string
+		code   int
+		signal syscall.Signal
+	}{
+		{"exit", 7, 0},
+		{"kill", 0, syscall.SIGTERM},
+	}
+	for _, c := range cases {
+		t.Run(c.call, func(t *testing.T) {
+			tr, err := newTracer(context.Background(), &os.ProcAttr{Env: traceeEnviron(c.call)})
+			if err != nil {
+				t.Skipf("ptrace is not permitted: %v", err)
+			}
+			status, err := tr.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.signal != 0 {
+				if !status.Signaled() || status.Signal() != c.signal {
+					t.Fatalf("status: %#x, want killed by %v", status, c.signal)
+				}
+			} else if !status.Exited() || status.ExitStatus() != c.code {
+				t.Fatalf("status: %#x, want exit code %v", status, c.code)
+			}
+		})
+	}
+}
+
+// TestGroupStop checks that the group-stop of a tracee is kept until it is continued, rather than suppressed.
+func TestGroupStop(t *testing.T) {
+	tr, err := newTracer(context.Background(), &os.ProcAttr{Env: traceeEnviron("stop")})
+	if err != nil {
+		t.Skipf("ptrace is not permitted: %v", err)
+	}
+	if status, err := tr.Wait(); err != nil || status.ExitStatus() != 5 {
+		t.Fatalf("status: %#x, err: %v", status, err)
+	}
+}
+
+func TestV6Only(t *testing.T) {
+	// the target is not skipped as a loopback address
+	var ip net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if addr, ok := addr.(*net.IPNet); ok && addr.IP.To4() != nil && !addr.IP.IsLoopback() {
+			ip = addr.IP
+			break
+		}
+	}
+	if ip == nil {
+		t.Skip("no IPv4 address to connect")
+	}
+	ln, err := net.Listen("tcp4", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	target := netip.AddrPortFrom(netip.AddrFrom16(netip.MustParseAddr(ip.String()).As16()), uint16(ln.Addr().(*net.TCPAddr).Port))
+	t.Run("process_vm", func(t *testing.T) {
+		tr, err := newTracer(context.Background(), &os.ProcAttr{Env: append(traceeEnviron("v6only"), traceeAddrEnv+"="+target.String())})
+		if err != nil {
+			t.Skipf("ptrace is not permitted: %v", err)
+		}
+		if status, err := tr.Wait(); err != nil || status.ExitStatus() != 0 {
+			t.Fatalf("status: %#x, err: %v", status, err)
+		}
+	})
+	// the stops are handled off the tracer thread, where process_vm_readv(2) is not permitted, so the sockaddr is
+	// read again by PTRACE_PEEKDATA on the tracer thread
+	t.Run("peekdata_retry", func(t *testing.T) {
+		if !processVM {
+			t.Skip("process_vm_readv is not available")
+		}
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+		defer func(f func(int, []unix.Iovec, []unix.RemoteIovec, uint) (int, error)) { processVMReadv = f }(processVMReadv)
+		processVMReadv = func(int, []unix.Iovec, []unix.RemoteIovec, uint) (int, error) {
+			return 0, syscall.EPERM
+		}
+		tr, err := newTracer(context.Background(), &os.ProcAttr{Env: append(traceeEnviron("v6only"), traceeAddrEnv+"="+target.String())})
+		if err != nil {
+			t.Skipf("ptrace is not permitted: %v", err)
+		}
+		if status, err := tr.Wait(); err != nil || status.ExitStatus() != 0 {
+			t.Fatalf("status: %#x, err: %v", status, err)
+		}
+	})
+}
+
+func TestDetach(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr, err := newTracer(ctx, &os.ProcAttr{
+		Env:   traceeEnviron("detach"),
+		Files: []*os.File{os.Stdin, w, os.Stderr},
+	})
+	w.Close()
+	if err != nil {
+		t.Skipf("ptrace is not permitted: %v", err)
+	}
+	if _, err = bufio.NewReader(r).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err = tr.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := tr.Wait(); err != nil || status.ExitStatus() != 3 {
+		t.Fatalf("status: %#x, err: %v", status, err)
+	}
+}
+
+// benchmarkTracee measures the time the tracee takes for each syscall.
+func benchmarkTracee(b *testing.B, call string, addr string, traced bool) {
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stdin.Close()
+	defer w.Close()
+	env := append(traceeEnviron(call), traceeNEnv+"="+strconv.Itoa(b.N), traceeAddrEnv+"="+addr)
+	attr := &os.ProcAttr{Env: env, Files: []*os.File{stdin, os.Stdout, os.Stderr}}
+	wait := func() error {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	if traced {
+		t, err := newTracer(context.Background(), attr)
+		if err != nil {
+			b.Skipf("ptrace is not permitted: %v", err)
+		}
+		b.ResetTimer()
+		if err = wait(); err != nil {
+			b.Fatal(err)
+		}
+		if status, err := t.Wait(); err != nil || status != 0 {
+			b.Fatalf("tracee: status: %#x, err: %v", status, err)
+		}
+		return
+	}
+	p, err := os.StartProcess(os.Args[0], []string{os.Args[0]}, attr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	if err = wait(); err != nil {
+		b.Fatal(err)
+	}
+	if state, err := p.Wait(); err != nil || !state.Success() {
+		b.Fatalf("tracee: state: %v, err: %v", state, err)
+	}
+}
+
+// BenchmarkSyscall measures the overhead of tracing per syscall. "ptrace" handles the stops on the tracer thread
+// with PTRACE_PEEKDATA and PTRACE_POKEDATA, as it did before process_vm_readv(2) was used.
+func BenchmarkSyscall(b *testing.B) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	for _, c := range []struct {
+		name string
+		call string
+		addr string
+	}{
+		{"getppid", "getppid", ""},
+		// loopback destinations are read but not redirected
+		{"sendto", "sendto", conn.LocalAddr().String()},
+		// the destinations are redirected to the proxy
+		{"sendto_redirect", "sendto", "198.51.100.1:9"},
+	} {
+		b.Run(c.name+"/untraced", func(b *testing.B) {
+			benchmarkTracee(b, c.call, c.addr, false)
+		})
+		for _, mode := range []struct {
+			name      string
+			processVM bool
+		}{
+			{"ptrace", false},
+			{"process_vm", true},
+		} {
+			b.Run(c.name+"/"+mode.name, func(b *testing.B) {
+				if mode.processVM && !vmAvailable() {
+					b.Skip("process_vm_readv is not available")
+				}
+				defer func(v bool) { processVM = v }(processVM)
+				processVM = mode.processVM
+				benchmarkTracee(b, c.call, c.addr, true)
+			})
+		}
+	}
+}